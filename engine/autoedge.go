@@ -81,6 +81,16 @@ type ResUID interface {
 	IsReversed() bool // true means this resource happens before the generator
 }
 
+// MatchAllUID is a ResUID which gets an edge to every resource that it matches,
+// instead of only to the first one. This is useful for an edge to all of the
+// resources of a kind, such as from a package repository to every package.
+type MatchAllUID interface {
+	ResUID
+
+	// MatchAll returns true if every match should get an edge.
+	MatchAll() bool
+}
+
 // The BaseUID struct is used to provide a unique resource identifier.
 type BaseUID struct {
 	Name string // name and kind are the values of where this is coming from
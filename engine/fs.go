@@ -59,3 +59,15 @@ type Fs interface {
 	WriteFile(filename string, data []byte, perm os.FileMode) error
 	//WriteReader(path string, r io.Reader) (err error)
 }
+
+// DeployFsRes is an interface that a resource can implement if it needs to read
+// files from the file system of the deploy that it was built by. Whatever built
+// the resource calls SetDeployFs with the URI of that file system, which can be
+// opened with World.Fs, and with the absolute directory in it that relative
+// paths are to be interpreted from.
+type DeployFsRes interface {
+	Res
+
+	// SetDeployFs stores the deploy file system URI and base directory.
+	SetDeployFs(uri, base string)
+}
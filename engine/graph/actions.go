@@ -238,6 +238,20 @@ func (obj *Engine) Process(vertex pgraph.Vertex) error {
 	return errwrap.Wrapf(err, "error during Process()")
 }
 
+// upstreamError tells the resources which depend on this vertex and which want
+// to know about it, that it has failed permanently.
+func (obj *Engine) upstreamError(vertex pgraph.Vertex, err error) {
+	res, ok := vertex.(engine.Res)
+	if !ok {
+		return
+	}
+	for _, v := range obj.graph.OutgoingGraphVertices(vertex) {
+		if r, ok := v.(engine.UpstreamErrorRes); ok {
+			r.UpstreamError(res, err)
+		}
+	}
+}
+
 // Worker is the common run frontend of the vertex. It handles all of the retry
 // and retry delay common code, and ultimately returns the final status of this
 // vertex execution. This function cannot be "re-run" for the same vertex. The
@@ -378,6 +392,7 @@ Loop:
 				failed = true
 				close(obj.state[vertex].watchDone)   // causes doneChan to close
 				reterr = errwrap.Append(reterr, err) // permanent failure
+				obj.upstreamError(vertex, err)
 				continue
 			}
 			if obj.Debug {
@@ -547,6 +562,7 @@ Loop:
 			failed = true
 			close(obj.state[vertex].processDone) // causes doneChan to close
 			reterr = errwrap.Append(reterr, err) // permanent failure
+			obj.upstreamError(vertex, err)
 			continue
 
 		} // retry loop
@@ -137,7 +137,9 @@ func addEdgesByMatchingUIDS(res engine.EdgeableRes, uids []engine.ResUID, graph
 					graph.AddEdge(res, r, edge)
 				}
 				found = true
-				break
+				if m, ok := uid.(engine.MatchAllUID); !ok || !m.MatchAll() {
+					break
+				}
 			}
 		}
 		result = append(result, found)
@@ -266,6 +266,21 @@ type InterruptableRes interface {
 	Interrupt() error
 }
 
+// UpstreamErrorRes is an interface that a resource can implement to be told
+// about the permanent failures of the resources which have an edge to it. Since
+// a failed resource never pokes the resources that depend on it, they would not
+// otherwise run. This is useful for a resource which sends notifications.
+type UpstreamErrorRes interface {
+	Res
+
+	// UpstreamError is called with the resource that failed and its error,
+	// once its retries are exhausted. It can be called concurrently with
+	// the other methods, so it must not block. It can even be called
+	// before Init or after Close, such as during a graph swap, and then
+	// the error should be dropped.
+	UpstreamError(res Res, err error)
+}
+
 // CopyableRes is an interface that a resource can implement if we want to be
 // able to copy the resource to build another one.
 type CopyableRes interface {
@@ -18,14 +18,25 @@
 package resources
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/purpleidea/mgmt/engine"
 	"github.com/purpleidea/mgmt/engine/traits"
+	engineUtil "github.com/purpleidea/mgmt/engine/util"
 	"github.com/purpleidea/mgmt/util/errwrap"
 
 	"github.com/coredhcp/coredhcp/handler"
@@ -36,7 +47,7 @@ import (
 func init() {
 	engine.RegisterResource("dhcp:server", func() engine.Res { return &DHCPServerRes{} })
 	engine.RegisterResource("dhcp:host", func() engine.Res { return &DHCPHostRes{} })
-	//engine.RegisterResource("dhcp:range", func() engine.Res { return &DhcpRangeRes{} })
+	engine.RegisterResource("dhcp:range", func() engine.Res { return &DHCPRangeRes{} })
 
 	if _, err := time.ParseDuration(DHCPDefaultLeaseTime); err != nil {
 		panic("invalid duration for DHCPDefaultLeaseTime constant")
@@ -47,14 +58,24 @@ const (
 	// DHCPDefaultLeaseTime is the default lease time used when one was not
 	// specified explicitly.
 	DHCPDefaultLeaseTime = "10m" // common default from dhcpd
+
+	// dhcpLeasesFile is the name of the file in the VarDir which stores the
+	// lease table so that it persists across restarts.
+	dhcpLeasesFile = "leases.json"
 )
 
 // DHCPServerRes is a simple dhcp server resource. It responds to dhcp client
 // requests, but does not actually apply any state. The name is used as the
 // address to listen on, unless the Address field is specified, and in that case
 // it is used instead. The resource can offer up dhcp client leases from any
-// number of dhcp:host resources which will get autogrouped into this resource
-// at runtime.
+// number of dhcp:host and dhcp:range resources which will get autogrouped into
+// this resource at runtime.
+//
+// Every lease that is handed out is kept in a lease table which is stored in
+// the VarDir of the resource, so that a restarted server remembers who had
+// which address. The table is also published in the world, so that it can be
+// read with the world.dhcp_leases function. When a new lease is handed out, an
+// event is generated, and its mac, ip and hostname are sent with Send/Recv.
 //
 // This server is not meant as a featureful replacement for the venerable dhcpd,
 // but rather as a simple, dynamic, integrated alternative for bootstrapping new
@@ -65,6 +86,7 @@ type DHCPServerRes struct {
 	traits.Base      // add the base methods without re-implementation
 	traits.Edgeable  // TODO: add autoedge support
 	traits.Groupable // can have DHCPHostRes and more, grouped into it
+	traits.Sendable
 
 	init *engine.Init
 
@@ -115,6 +137,15 @@ type DHCPServerRes struct {
 	dnsServers4 []net.IP
 	routers4    []net.IP
 
+	leasesPath  string
+	leaseMutex  *sync.Mutex // guards the lease fields below
+	leases      map[string]*engineUtil.DHCPLease
+	lastLease   *engineUtil.DHCPLease // the most recent new lease
+	leaseNew    bool                  // the lastLease hasn't been sent yet
+	leasesDirty bool                  // the lease table hasn't been saved yet
+	published   string                // the lease table that was last published
+	leaseChan   chan struct{}
+
 	//mutex *sync.RWMutex
 
 	// TODO: add in ipv6 support here or in a separate resource?
@@ -370,6 +401,18 @@ func (obj *DHCPServerRes) Init(init *engine.Init) error {
 		obj.routers4 = append(obj.routers4, router)
 	}
 
+	dir, err := obj.init.VarDir("")
+	if err != nil {
+		return errwrap.Wrapf(err, "could not get VarDir in Init()")
+	}
+	obj.leasesPath = path.Join(dir, dhcpLeasesFile)
+
+	obj.leaseMutex = &sync.Mutex{}
+	if obj.leases, err = obj.loadLeases(); err != nil {
+		return err
+	}
+	obj.leaseChan = make(chan struct{}, 1) // never block the sender
+
 	//obj.mutex = &sync.RWMutex{}
 	//obj.mutex.RLock()
 
@@ -381,7 +424,15 @@ func (obj *DHCPServerRes) Close() error {
 	// NOTE: if this ever panics, it might mean the engine is running Close
 	// before Watch finishes exiting, which is an engine bug in that code...
 	//obj.mutex.RUnlock()
-	return nil
+
+	// The engine doesn't Close anything that's autogrouped, so we do it.
+	var reterr error
+	for _, res := range obj.GetGroup() { // grouped elements
+		if err := res.Close(); err != nil {
+			reterr = errwrap.Append(reterr, err)
+		}
+	}
+	return reterr
 }
 
 // Watch is the primary listener for this resource and it outputs events.
@@ -458,6 +509,9 @@ func (obj *DHCPServerRes) Watch() error {
 			startupChan = nil
 			send = true
 
+		case <-obj.leaseChan: // a new lease was handed out
+			send = true
+
 		case <-closeSignal: // something shut us down early
 			return closeError
 
@@ -496,9 +550,84 @@ func (obj *DHCPServerRes) sidCheckApply(apply bool) (bool, error) {
 	return true, nil
 }
 
-// CheckApply never has anything to do for this resource, so it always succeeds.
-// It does however check that certain runtime requirements (such as the Root dir
-// existing if one was specified) are fulfilled.
+// leasesCheckApply saves the lease table, publishes it in the world, and sends
+// the most recent new lease. Only a new lease is a change. The renewals and the
+// expired leases are saved and published, but they are not reported, so that
+// the resources which depend on us aren't refreshed every few minutes.
+func (obj *DHCPServerRes) leasesCheckApply(apply bool) (bool, error) {
+	obj.leaseMutex.Lock()
+	defer obj.leaseMutex.Unlock()
+
+	now := time.Now()
+	leases := []*engineUtil.DHCPLease{}
+	for mac, lease := range obj.leases {
+		if lease.Expiry < now.Unix() { // forget the expired leases
+			delete(obj.leases, mac)
+			obj.leasesDirty = true
+			continue
+		}
+		leases = append(leases, lease)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(leases[i].IP).To4(), net.ParseIP(leases[j].IP).To4()) < 0
+	})
+	b, err := json.Marshal(leases)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "could not encode the leases")
+	}
+	table := string(b)
+
+	publish := obj.init.World != nil && table != obj.published
+
+	if !obj.leasesDirty && !publish && !obj.leaseNew {
+		return true, nil
+	}
+	if !apply {
+		return !obj.leaseNew, nil
+	}
+
+	if obj.leasesDirty {
+		if err := ioutil.WriteFile(obj.leasesPath, b, 0600); err != nil {
+			return false, errwrap.Wrapf(err, "could not write the leases")
+		}
+		obj.leasesDirty = false
+	}
+
+	if publish {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		namespace := engineUtil.DHCPLeasesNamespace + obj.Name()
+		if err := obj.init.World.StrMapSet(ctx, namespace, table); err != nil {
+			return false, errwrap.Wrapf(err, "could not publish the leases")
+		}
+		obj.published = table
+	}
+
+	if !obj.leaseNew {
+		return true, nil
+	}
+	if err := obj.sendLease(obj.lastLease); err != nil {
+		return false, err
+	}
+	obj.leaseNew = false
+
+	return false, nil
+}
+
+// sendLease sends the lease with Send/Recv.
+func (obj *DHCPServerRes) sendLease(lease *engineUtil.DHCPLease) error {
+	mac, ip, hostname := lease.Mac, lease.IP, lease.Hostname // copy
+	return obj.init.Send(&DHCPServerSends{
+		Mac:      &mac,
+		IP:       &ip,
+		Hostname: &hostname,
+	})
+}
+
+// CheckApply saves and publishes the lease table, but otherwise never has
+// anything to do for this resource. It does however check that certain runtime
+// requirements (such as the Root dir existing if one was specified) are
+// fulfilled.
 func (obj *DHCPServerRes) CheckApply(apply bool) (bool, error) {
 	if obj.init.Debug {
 		obj.init.Logf("CheckApply")
@@ -529,6 +658,12 @@ func (obj *DHCPServerRes) CheckApply(apply bool) (bool, error) {
 		checkOK = false
 	}
 
+	if c, err := obj.leasesCheckApply(apply); err != nil {
+		return false, err
+	} else if !c {
+		checkOK = false
+	}
+
 	return checkOK, nil // almost always succeeds, with nothing to do!
 }
 
@@ -647,6 +782,25 @@ func (obj *DHCPServerRes) Copy() engine.CopyableRes {
 	}
 }
 
+// DHCPServerSends is the struct of data which is sent after a new lease.
+type DHCPServerSends struct {
+	// Mac is the mac address of the host which got the lease.
+	Mac *string `lang:"mac"`
+	// IP is the IPv4 address of the lease, without the CIDR suffix.
+	IP *string `lang:"ip"`
+	// Hostname is the name of the host if it is known, or empty if not.
+	Hostname *string `lang:"hostname"`
+}
+
+// Sends represents the default struct of values we can send using Send/Recv.
+func (obj *DHCPServerRes) Sends() interface{} {
+	return &DHCPServerSends{
+		Mac:      nil,
+		IP:       nil,
+		Hostname: nil,
+	}
+}
+
 // UnmarshalYAML is the custom unmarshal handler for this struct. It is
 // primarily useful for setting the defaults.
 func (obj *DHCPServerRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -683,21 +837,142 @@ func (obj *DHCPServerRes) GroupCmp(r engine.GroupableRes) error {
 		return nil
 	}
 
-	//res2, ok2 := r.(*DhcpRangeRes) // different from what we usually do!
-	//if ok2 {
-	//	// If the dhcp range resource has the Server field specified,
-	//	// then it must match against our name field if we want it to
-	//	// group with us.
-	//	if res2.Server != "" && res2.Server != obj.Name() {
-	//		return fmt.Errorf("resource groups with a different server name")
-	//	}
+	res2, ok2 := r.(*DHCPRangeRes) // different from what we usually do!
+	if ok2 {
+		// If the dhcp range resource has the Server field specified,
+		// then it must match against our name field if we want it to
+		// group with us.
+		if res2.Server != "" && res2.Server != obj.Name() {
+			return fmt.Errorf("resource groups with a different server name")
+		}
 
-	//	return nil
-	//}
+		return nil
+	}
 
 	return fmt.Errorf("resource is not the right kind")
 }
 
+// loadLeases loads the stored lease table. A missing table is an empty one.
+func (obj *DHCPServerRes) loadLeases() (map[string]*engineUtil.DHCPLease, error) {
+	leases := make(map[string]*engineUtil.DHCPLease)
+	b, err := ioutil.ReadFile(obj.leasesPath)
+	if os.IsNotExist(err) {
+		return leases, nil
+	} else if err != nil {
+		return nil, errwrap.Wrapf(err, "could not read the leases")
+	}
+	list := []*engineUtil.DHCPLease{}
+	if err := json.Unmarshal(b, &list); err != nil {
+		// better to hand out new addresses than to not start at all
+		obj.init.Logf("discarding invalid leases: %v", err)
+		return leases, nil
+	}
+	for _, lease := range list {
+		leases[lease.Mac] = lease
+	}
+	return leases, nil
+}
+
+// recordLease adds the lease from an acknowledgement to the lease table. If it
+// is a new lease, then it notifies Watch so that it gets saved and sent.
+func (obj *DHCPServerRes) recordLease(req, resp *dhcpv4.DHCPv4) {
+	ip := resp.YourIPAddr.To4()
+	if ip == nil || ip.IsUnspecified() {
+		return
+	}
+	hostname := resp.HostName() // the dhcp:host might have set it
+	if hostname == "" {
+		hostname = req.HostName()
+	}
+	leaseTime, _ := time.ParseDuration(DHCPDefaultLeaseTime) // checked in init
+	lease := &engineUtil.DHCPLease{
+		Mac:      req.ClientHWAddr.String(),
+		IP:       ip.String(),
+		Hostname: hostname,
+		Expiry:   time.Now().Add(resp.IPAddressLeaseTime(leaseTime)).Unix(),
+	}
+
+	obj.leaseMutex.Lock()
+	defer obj.leaseMutex.Unlock()
+	for mac, x := range obj.leases { // an address only has one owner
+		if x.IP == lease.IP && mac != lease.Mac {
+			delete(obj.leases, mac)
+		}
+	}
+	old, exists := obj.leases[lease.Mac]
+	obj.leases[lease.Mac] = lease
+	obj.leasesDirty = true // a renewal is saved, but it's not a change
+	if exists && old.IP == lease.IP && old.Hostname == lease.Hostname {
+		return
+	}
+
+	obj.init.Logf("new lease of %s for %s", lease.IP, lease.Mac)
+	obj.lastLease = lease
+	obj.leaseNew = true
+	select {
+	case obj.leaseChan <- struct{}{}:
+	default: // an event is already pending
+	}
+}
+
+// reserved returns true if the address must not be handed out from a range.
+// These are the addresses of the dhcp:host resources, and of the server itself.
+func (obj *DHCPServerRes) reserved(ip net.IP) bool {
+	for _, x := range obj.GetGroup() { // grouped elements
+		if res, ok := x.(*DHCPHostRes); ok && res.ipv4Addr.Equal(ip) {
+			return true
+		}
+	}
+	for _, router := range obj.routers4 {
+		if router.Equal(ip) {
+			return true
+		}
+	}
+	obj.sidMutex.Lock()
+	defer obj.sidMutex.Unlock()
+	return obj.serverID != nil && obj.serverID.Equal(ip)
+}
+
+// available returns true if the address can be leased to the mac address. The
+// caller must hold the lease mutex.
+func (obj *DHCPServerRes) available(mac string, ip net.IP) bool {
+	if obj.reserved(ip) {
+		return false
+	}
+	now := time.Now().Unix()
+	for m, lease := range obj.leases {
+		if m != mac && lease.Expiry >= now && net.ParseIP(lease.IP).Equal(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// allocate picks an address from the range for the mac address. A host gets
+// its previous address back if it's still free, and otherwise the one that it
+// asked for, or the first free one. It returns nil if the range is full.
+func (obj *DHCPServerRes) allocate(mac string, rng *DHCPRangeRes, requested net.IP) net.IP {
+	obj.leaseMutex.Lock()
+	defer obj.leaseMutex.Unlock()
+
+	if lease, exists := obj.leases[mac]; exists {
+		if ip := net.ParseIP(lease.IP); rng.contains(ip) && obj.available(mac, ip) {
+			return ip.To4()
+		}
+	}
+	if rng.contains(requested) && obj.available(mac, requested) {
+		return requested.To4()
+	}
+	for i := rng.from; i <= rng.to && i >= rng.from; i++ { // stop on overflow
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, i)
+		if obj.available(mac, ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
 // leasetimeHandler4 handles DHCPv4 packets for the leasetime component.
 // Modified from: https://github.com/coredhcp/coredhcp/blob/b4aa45e6f7268cc4c52f863b130bd8eb388647b2/plugins/leasetime/plugin.go#L32
 func (obj *DHCPServerRes) leasetimeHandler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
@@ -854,9 +1129,9 @@ func (obj *DHCPServerRes) handler4() func(net.PacketConn, net.Addr, *dhcpv4.DHCP
 				h := res.handler4()
 				hostHandlers = append(hostHandlers, h)
 
-			//case *DhcpRangeRes:
-			//	h := res.handler4()
-			//	rangeHandlers = append(rangeHandlers, h)
+			case *DHCPRangeRes:
+				h := res.handler4(obj)
+				rangeHandlers = append(rangeHandlers, h)
 
 			default:
 				continue
@@ -881,6 +1156,10 @@ func (obj *DHCPServerRes) handler4() func(net.PacketConn, net.Addr, *dhcpv4.DHCP
 			}
 		}
 
+		if resp != nil && resp.MessageType() == dhcpv4.MessageTypeAck {
+			obj.recordLease(req, resp)
+		}
+
 		if resp != nil {
 			if obj.init.Debug {
 				obj.init.Logf("sending a DHCPv4 packet: %s", resp.Summary())
@@ -958,10 +1237,29 @@ type DHCPHostRes struct {
 	// slash. This is sometimes desirable for legacy tftp setups.
 	NBPPath string `lang:"nbp_path" yaml:"nbp_path"`
 
+	// Hostname is the name of the host. It is sent to the host in the
+	// DHCPv4 protocol, and the DNS server uses it to answer reverse lookups
+	// for the IP. If it is not fully qualified, then the name is in the
+	// Zone of the dns:server.
+	Hostname string `lang:"hostname" yaml:"hostname"`
+
+	// DNS is the name of the dns:server resource which answers the reverse
+	// lookups for the IP of this host. It requires a Hostname. If it is
+	// omitted, then no reverse lookups are answered for this host.
+	DNS string `lang:"dns" yaml:"dns"`
+
+	// Options is a map of DHCPv4 option codes to their values, which are
+	// sent to the host. They override any of the other options. A value
+	// which starts with 0x is decoded as hex, and otherwise the string is
+	// sent as is. For example, {42 => "0xc0000201",} sends 192.0.2.1 as the
+	// NTP server.
+	Options map[int64]string `lang:"options" yaml:"options"`
+
 	ipv4Addr net.IP
 	ipv4Mask net.IPMask
 	opt66    *dhcpv4.Option
 	opt67    *dhcpv4.Option
+	options  []dhcpv4.Option
 }
 
 // Default returns some sensible defaults for this resource.
@@ -1009,6 +1307,17 @@ func (obj *DHCPHostRes) Validate() error {
 		}
 	}
 
+	if obj.Hostname != "" && !dnsValidName(obj.Hostname) {
+		return fmt.Errorf("invalid hostname: %s", obj.Hostname)
+	}
+	if obj.DNS != "" && obj.Hostname == "" {
+		return fmt.Errorf("the DNS server needs a Hostname to answer with")
+	}
+
+	if _, err := dhcpOptions(obj.Options); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -1041,11 +1350,22 @@ func (obj *DHCPHostRes) Init(init *engine.Init) error {
 	obfn := dhcpv4.OptBootFileName(p)
 	obj.opt67 = &obfn
 
+	if obj.options, err = dhcpOptions(obj.Options); err != nil {
+		return errwrap.Wrapf(err, "unexpected invalid options")
+	}
+
+	if obj.DNS != "" {
+		dnsAddHost(obj)
+	}
+
 	return nil
 }
 
 // Close is run by the engine to clean up after the resource is done.
 func (obj *DHCPHostRes) Close() error {
+	if obj.DNS != "" {
+		dnsRemoveHost(obj)
+	}
 	return nil
 }
 
@@ -1096,6 +1416,15 @@ func (obj *DHCPHostRes) Cmp(r engine.Res) error {
 	if obj.NBPPath != res.NBPPath {
 		return fmt.Errorf("the NBPPath differs")
 	}
+	if obj.Hostname != res.Hostname {
+		return fmt.Errorf("the Hostname differs")
+	}
+	if obj.DNS != res.DNS {
+		return fmt.Errorf("the DNS differs")
+	}
+	if err := dhcpOptionsCmp(obj.Options, res.Options); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -1157,10 +1486,319 @@ func (obj *DHCPHostRes) handler4() func(*dhcpv4.DHCPv4, *dhcpv4.DHCPv4) (*dhcpv4
 			obj.init.Logf("Added NBP %s / %s to request", obj.opt66, obj.opt67)
 		}
 
+		if obj.Hostname != "" { // only the first label is the host name
+			resp.Options.Update(dhcpv4.OptHostName(strings.SplitN(obj.Hostname, ".", 2)[0]))
+		}
+
+		for _, opt := range obj.options { // these override everything
+			resp.Options.Update(opt)
+		}
+
+		return resp, true
+	}
+}
+
+// DHCPRangeRes is a range of addresses which are handed out dynamically by the
+// dhcp server. Hosts which match a dhcp:host get that address instead. A host
+// gets the same address back for as long as its lease hasn't expired, and the
+// addresses of the dhcp:host resources, the routers and the server itself are
+// never handed out.
+type DHCPRangeRes struct {
+	traits.Base // add the base methods without re-implementation
+	//traits.Edgeable // XXX: add autoedge support
+	traits.Groupable // can be grouped into DHCPServerRes
+
+	init *engine.Init
+
+	// Server is the name of the dhcp server resource to group this into. If
+	// it is omitted, and there is only a single dhcp resource, then it will
+	// be grouped into it automatically. If there is more than one main dhcp
+	// resource being used, then the grouping behaviour is *undefined* when
+	// this is not specified, and it is not recommended to leave this blank!
+	Server string `lang:"server" yaml:"server"`
+
+	// Network is the IPv4 network in CIDR notation, for example
+	// 192.0.2.0/24. It specifies the netmask to be used in the DHCPv4
+	// protocol. If it is empty, then the name is used.
+	Network string `lang:"network" yaml:"network"`
+
+	// From is the first address of the range. If it is empty, then the range
+	// starts at the first address after the network address.
+	From string `lang:"from" yaml:"from"`
+
+	// To is the last address of the range. If it is empty, then the range
+	// ends at the last address before the broadcast address.
+	To string `lang:"to" yaml:"to"`
+
+	// Options is a map of DHCPv4 option codes to their values, which are
+	// sent to the hosts in this range. It works the same way as the Options
+	// field of the dhcp:host resource.
+	Options map[int64]string `lang:"options" yaml:"options"`
+
+	network *net.IPNet
+	from    uint32
+	to      uint32
+	options []dhcpv4.Option
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *DHCPRangeRes) Default() engine.Res {
+	return &DHCPRangeRes{}
+}
+
+// getNetwork returns the actual network to use. When Network is not specified,
+// we use the Name.
+func (obj *DHCPRangeRes) getNetwork() string {
+	if obj.Network != "" {
+		return obj.Network
+	}
+	return obj.Name()
+}
+
+// parse returns the network and the first and last address of the range.
+func (obj *DHCPRangeRes) parse() (*net.IPNet, uint32, uint32, error) {
+	ip, network, err := net.ParseCIDR(obj.getNetwork())
+	if err != nil {
+		return nil, 0, 0, errwrap.Wrapf(err, "invalid network")
+	}
+	if ip.To4() == nil {
+		return nil, 0, 0, fmt.Errorf("only IPv4 is currently supported")
+	}
+	base := binary.BigEndian.Uint32(network.IP.To4())
+	ones, bits := network.Mask.Size()
+	if bits-ones < 2 {
+		return nil, 0, 0, fmt.Errorf("the network is too small")
+	}
+	broadcast := base | (1<<uint(bits-ones) - 1)
+
+	from, to := base+1, broadcast-1
+	if obj.From != "" {
+		ip := net.ParseIP(obj.From).To4()
+		if ip == nil || !network.Contains(ip) {
+			return nil, 0, 0, fmt.Errorf("the From address is not in the network: %s", obj.From)
+		}
+		from = binary.BigEndian.Uint32(ip)
+	}
+	if obj.To != "" {
+		ip := net.ParseIP(obj.To).To4()
+		if ip == nil || !network.Contains(ip) {
+			return nil, 0, 0, fmt.Errorf("the To address is not in the network: %s", obj.To)
+		}
+		to = binary.BigEndian.Uint32(ip)
+	}
+	if from > to {
+		return nil, 0, 0, fmt.Errorf("the From address is after the To address")
+	}
+	return network, from, to, nil
+}
+
+// Validate checks if the resource data structure was populated correctly.
+func (obj *DHCPRangeRes) Validate() error {
+	if _, _, _, err := obj.parse(); err != nil {
+		return err
+	}
+	if _, err := dhcpOptions(obj.Options); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *DHCPRangeRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	var err error
+	if obj.network, obj.from, obj.to, err = obj.parse(); err != nil {
+		return errwrap.Wrapf(err, "unexpected invalid range")
+	}
+	if obj.options, err = dhcpOptions(obj.Options); err != nil {
+		return errwrap.Wrapf(err, "unexpected invalid options")
+	}
+
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *DHCPRangeRes) Close() error {
+	return nil
+}
+
+// Watch is the primary listener for this resource and it outputs events. This
+// particular one does absolutely nothing but block until we've received a done
+// signal.
+func (obj *DHCPRangeRes) Watch() error {
+	obj.init.Running() // when started, notify engine that we're running
+
+	select {
+	case <-obj.init.Done: // closed by the engine to signal shutdown
+	}
+
+	return nil
+}
+
+// CheckApply never has anything to do for this resource, so it always succeeds.
+func (obj *DHCPRangeRes) CheckApply(apply bool) (bool, error) {
+	if obj.init.Debug {
+		obj.init.Logf("CheckApply")
+	}
+
+	return true, nil // always succeeds, with nothing to do!
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *DHCPRangeRes) Cmp(r engine.Res) error {
+	// we can only compare DHCPRangeRes to others of the same resource kind
+	res, ok := r.(*DHCPRangeRes)
+	if !ok {
+		return fmt.Errorf("res is not the same kind")
+	}
+
+	if obj.Server != res.Server {
+		return fmt.Errorf("the Server field differs")
+	}
+	if obj.getNetwork() != res.getNetwork() {
+		return fmt.Errorf("the Network differs")
+	}
+	if obj.From != res.From {
+		return fmt.Errorf("the From address differs")
+	}
+	if obj.To != res.To {
+		return fmt.Errorf("the To address differs")
+	}
+	if err := dhcpOptionsCmp(obj.Options, res.Options); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *DHCPRangeRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes DHCPRangeRes // indirection to avoid infinite recursion
+
+	def := obj.Default()           // get the default
+	res, ok := def.(*DHCPRangeRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to DHCPRangeRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = DHCPRangeRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// contains returns true if the address is in the range.
+func (obj *DHCPRangeRes) contains(ip net.IP) bool {
+	ip = ip.To4()
+	if ip == nil {
+		return false
+	}
+	i := binary.BigEndian.Uint32(ip)
+	return i >= obj.from && i <= obj.to
+}
+
+// handler4 returns the handler for the range resource. It gets called from the
+// main handler4 function in the dhcp server resource, which keeps the leases.
+func (obj *DHCPRangeRes) handler4(server *DHCPServerRes) func(*dhcpv4.DHCPv4, *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		mac := req.ClientHWAddr.String()
+
+		var ip net.IP
+		switch req.MessageType() {
+		case dhcpv4.MessageTypeDiscover:
+			if ip = server.allocate(mac, obj, req.RequestedIPAddress()); ip == nil {
+				obj.init.Logf("no free address for MAC %s", mac)
+				return resp, false // another range might have one
+			}
+
+		case dhcpv4.MessageTypeRequest:
+			ip = req.RequestedIPAddress()
+			if ip == nil || ip.IsUnspecified() { // renewing
+				ip = req.ClientIPAddr
+			}
+			if !obj.contains(ip) {
+				return resp, false // another range might have it
+			}
+			server.leaseMutex.Lock()
+			available := server.available(mac, ip)
+			server.leaseMutex.Unlock()
+			if !available {
+				obj.init.Logf("address %s is not available for MAC %s", ip, mac)
+				resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeNak))
+				resp.YourIPAddr = net.IPv4zero
+				return resp, true
+			}
+
+		default:
+			return resp, false
+		}
+		if obj.init.Debug {
+			obj.init.Logf("found IP address %s for MAC %s", ip, mac)
+		}
+
+		resp.YourIPAddr = ip.To4()
+		resp.Options.Update(dhcpv4.OptSubnetMask(obj.network.Mask))
+		for _, opt := range obj.options { // these override everything
+			resp.Options.Update(opt)
+		}
+
 		return resp, true
 	}
 }
 
+// dhcpOptions parses a map of DHCPv4 option codes to values into the options.
+// A value which starts with 0x is decoded as hex, and otherwise the string is
+// used as is. The options are sorted by their code.
+func dhcpOptions(options map[int64]string) ([]dhcpv4.Option, error) {
+	codes := []int64{}
+	for code := range options {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	result := []dhcpv4.Option{}
+	for _, code := range codes {
+		if code <= 0 || code >= 255 { // pad and end
+			return nil, fmt.Errorf("invalid option code: %d", code)
+		}
+		c := dhcpv4.GenericOptionCode(code)
+		if c.Code() == dhcpv4.OptionDHCPMessageType.Code() || c.Code() == dhcpv4.OptionServerIdentifier.Code() {
+			return nil, fmt.Errorf("option %d can't be overridden", code)
+		}
+		value := []byte(options[code])
+		if s := options[code]; strings.HasPrefix(s, "0x") {
+			b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+			if err != nil {
+				return nil, errwrap.Wrapf(err, "invalid hex value for option %d", code)
+			}
+			value = b
+		}
+		if len(value) > 255 {
+			return nil, fmt.Errorf("the value for option %d is too long", code)
+		}
+		result = append(result, dhcpv4.OptGeneric(c, value))
+	}
+	return result, nil
+}
+
+// dhcpOptionsCmp compares two maps of DHCPv4 options.
+func dhcpOptionsCmp(options1, options2 map[int64]string) error {
+	if len(options1) != len(options2) {
+		return fmt.Errorf("the number of Options differs")
+	}
+	for code, value := range options1 {
+		if v, exists := options2[code]; !exists || v != value {
+			return fmt.Errorf("the option %d differs", code)
+		}
+	}
+	return nil
+}
+
 // overEngineeredLogger is a helper struct that fulfills the over-engineered
 // logging interface that was introduced in:
 // https://github.com/insomniacslk/dhcp/pull/371/
@@ -0,0 +1,262 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root
+
+package resources
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/purpleidea/mgmt/engine"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// dhcpTestConn is a fake connection which keeps the last packet it was sent.
+type dhcpTestConn struct {
+	net.PacketConn
+	last []byte
+}
+
+func (obj *dhcpTestConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	obj.last = b
+	return len(b), nil
+}
+
+func TestDHCPOptions1(t *testing.T) {
+	testCases := []struct {
+		name     string
+		options  map[int64]string
+		fail     bool
+		expected []byte // the value of the first option
+	}{
+		{"text", map[int64]string{15: "example.com"}, false, []byte("example.com")},
+		{"hex", map[int64]string{42: "0xc0000201"}, false, []byte{192, 0, 2, 1}},
+		{"bad hex", map[int64]string{42: "0xc00"}, true, nil},
+		{"pad", map[int64]string{0: "x"}, true, nil},
+		{"end", map[int64]string{255: "x"}, true, nil},
+		{"message type", map[int64]string{53: "0x01"}, true, nil},
+		{"server id", map[int64]string{54: "0xc0000201"}, true, nil},
+	}
+	for _, tc := range testCases {
+		options, err := dhcpOptions(tc.options)
+		if tc.fail && err == nil {
+			t.Errorf("%s: parsing should have failed", tc.name)
+		}
+		if !tc.fail && err != nil {
+			t.Errorf("%s: parsing failed with: %v", tc.name, err)
+		}
+		if tc.fail || err != nil {
+			continue
+		}
+		if b := options[0].Value.ToBytes(); !bytes.Equal(b, tc.expected) {
+			t.Errorf("%s: got: %v, expected: %v", tc.name, b, tc.expected)
+		}
+	}
+}
+
+func TestDHCPRangeValidate1(t *testing.T) {
+	testCases := []struct {
+		name string
+		res  *DHCPRangeRes
+		fail bool
+	}{
+		{"network", &DHCPRangeRes{Network: "192.0.2.0/24"}, false},
+		{"range", &DHCPRangeRes{Network: "192.0.2.0/24", From: "192.0.2.100", To: "192.0.2.200"}, false},
+		{"backwards", &DHCPRangeRes{Network: "192.0.2.0/24", From: "192.0.2.200", To: "192.0.2.100"}, true},
+		{"outside", &DHCPRangeRes{Network: "192.0.2.0/24", To: "198.51.100.1"}, true},
+		{"small", &DHCPRangeRes{Network: "192.0.2.0/31"}, true},
+		{"v6", &DHCPRangeRes{Network: "2001:db8::/64"}, true},
+		{"options", &DHCPRangeRes{Network: "192.0.2.0/24", Options: map[int64]string{53: "x"}}, true},
+	}
+	for _, tc := range testCases {
+		tc.res.SetName("range")
+		err := tc.res.Validate()
+		if tc.fail && err == nil {
+			t.Errorf("%s: validate should have failed", tc.name)
+		}
+		if !tc.fail && err != nil {
+			t.Errorf("%s: validate failed with: %v", tc.name, err)
+		}
+	}
+}
+
+func TestDHCPServerLeases1(t *testing.T) {
+	tmpdir := t.TempDir()
+	sends := []*DHCPServerSends{}
+	init := &engine.Init{
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+		VarDir: func(string) (string, error) {
+			return tmpdir, nil
+		},
+		Send: func(st interface{}) error {
+			sends = append(sends, st.(*DHCPServerSends))
+			return nil
+		},
+	}
+
+	newServer := func() *DHCPServerRes {
+		serverID := "192.0.2.1"
+		res := &DHCPServerRes{Interface: "lo", ServerID: &serverID}
+		res.SetKind("dhcp:server")
+		res.SetName(":67")
+		host := &DHCPHostRes{Mac: "00:11:22:33:44:55", IP: "192.0.2.10/24", Hostname: "pxe", Options: map[int64]string{42: "0xc0000201"}}
+		host.SetKind("dhcp:host")
+		host.SetName("pxe")
+		rng := &DHCPRangeRes{From: "192.0.2.10", To: "192.0.2.12", Options: map[int64]string{15: "example.com"}}
+		rng.SetKind("dhcp:range")
+		rng.SetName("192.0.2.0/24")
+		for _, x := range []engine.GroupableRes{host, rng} {
+			if err := x.Validate(); err != nil {
+				t.Fatalf("validate failed with: %v", err)
+			}
+			if err := res.GroupCmp(x); err != nil {
+				t.Fatalf("could not group: %v", err)
+			}
+			if err := res.GroupRes(x); err != nil {
+				t.Fatalf("could not group: %v", err)
+			}
+		}
+		if err := res.Init(init); err != nil {
+			t.Fatalf("init failed with: %v", err)
+		}
+		return res
+	}
+	res := newServer()
+
+	exchange := func(req *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+		conn := &dhcpTestConn{}
+		res.handler4()(conn, &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}, req)
+		if conn.last == nil {
+			t.Fatalf("no response")
+		}
+		resp, err := dhcpv4.FromBytes(conn.last)
+		if err != nil {
+			t.Fatalf("invalid response: %v", err)
+		}
+		return resp
+	}
+	discover := func(mac string) *dhcpv4.DHCPv4 {
+		hw, _ := net.ParseMAC(mac)
+		req, _ := dhcpv4.NewDiscovery(hw, dhcpv4.WithBroadcast(true))
+		return exchange(req)
+	}
+	request := func(mac, ip string) *dhcpv4.DHCPv4 {
+		hw, _ := net.ParseMAC(mac)
+		req, _ := dhcpv4.New(
+			dhcpv4.WithHwAddr(hw),
+			dhcpv4.WithBroadcast(true),
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.ParseIP(ip))),
+			dhcpv4.WithOption(dhcpv4.OptHostName("client")),
+		)
+		return exchange(req)
+	}
+
+	// the address of the dhcp:host is never handed out from the range
+	offer := discover("aa:00:00:00:00:01")
+	if ip := offer.YourIPAddr.String(); ip != "192.0.2.11" {
+		t.Errorf("unexpected offer: %s", ip)
+	}
+	if s := offer.DomainName(); s != "example.com" {
+		t.Errorf("unexpected domain name option: %s", s)
+	}
+	if mask := offer.SubnetMask(); mask.String() != "ffffff00" {
+		t.Errorf("unexpected netmask: %s", mask)
+	}
+
+	ack := request("aa:00:00:00:00:01", "192.0.2.11")
+	if ack.MessageType() != dhcpv4.MessageTypeAck || ack.YourIPAddr.String() != "192.0.2.11" {
+		t.Errorf("unexpected response: %s", ack.Summary())
+	}
+	select {
+	case <-res.leaseChan:
+	default:
+		t.Errorf("a new lease should generate an event")
+	}
+	if checkOK, err := res.CheckApply(true); err != nil || checkOK {
+		t.Errorf("the leases should have been saved: %v", err)
+	}
+	if len(sends) != 1 || *sends[0].Mac != "aa:00:00:00:00:01" || *sends[0].IP != "192.0.2.11" || *sends[0].Hostname != "client" {
+		t.Errorf("unexpected sends: %v", sends)
+	}
+	if _, err := os.Stat(path.Join(tmpdir, dhcpLeasesFile)); err != nil {
+		t.Errorf("the leases were not saved: %v", err)
+	}
+	if checkOK, err := res.CheckApply(true); err != nil || !checkOK {
+		t.Errorf("the second checkapply was not a noop: %v", err)
+	}
+
+	// a renewal is saved, but it isn't a change, and nothing is sent again
+	request("aa:00:00:00:00:01", "192.0.2.11")
+	if checkOK, err := res.CheckApply(true); err != nil || !checkOK {
+		t.Errorf("a renewal should not be a change: %v", err)
+	}
+	if res.leasesDirty {
+		t.Errorf("the renewal was not saved")
+	}
+	if len(sends) != 1 {
+		t.Errorf("unexpected sends after a renewal: %v", sends)
+	}
+
+	// the dhcp:host gets its own address and options
+	offer = discover("00:11:22:33:44:55")
+	if ip := offer.YourIPAddr.String(); ip != "192.0.2.10" {
+		t.Errorf("unexpected offer: %s", ip)
+	}
+	if ntp := offer.NTPServers(); len(ntp) != 1 || ntp[0].String() != "192.0.2.1" {
+		t.Errorf("unexpected ntp servers option: %v", ntp)
+	}
+
+	// the leased address can't be taken by somebody else
+	if nak := request("aa:00:00:00:00:02", "192.0.2.11"); nak.MessageType() != dhcpv4.MessageTypeNak {
+		t.Errorf("unexpected response: %s", nak.Summary())
+	}
+	if ip := discover("aa:00:00:00:00:02").YourIPAddr.String(); ip != "192.0.2.12" {
+		t.Errorf("unexpected offer: %s", ip)
+	}
+	request("aa:00:00:00:00:02", "192.0.2.12")
+	if ip := discover("aa:00:00:00:00:03").YourIPAddr; !ip.IsUnspecified() {
+		t.Errorf("the range should be full, got: %s", ip)
+	}
+	if _, err := res.CheckApply(true); err != nil {
+		t.Errorf("checkapply failed with: %v", err)
+	}
+	if err := res.Close(); err != nil {
+		t.Errorf("close failed with: %v", err)
+	}
+
+	// the leases are remembered by the next server
+	res = newServer()
+	defer res.Close()
+	if ip := discover("aa:00:00:00:00:03").YourIPAddr; !ip.IsUnspecified() {
+		t.Errorf("the range should still be full, got: %s", ip)
+	}
+	if ip := discover("aa:00:00:00:00:01").YourIPAddr.String(); ip != "192.0.2.11" {
+		t.Errorf("unexpected offer after a restart: %s", ip)
+	}
+	if ip := discover("aa:00:00:00:00:02").YourIPAddr.String(); ip != "192.0.2.12" {
+		t.Errorf("unexpected offer after a restart: %s", ip)
+	}
+}
@@ -0,0 +1,399 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/recwatch"
+	"github.com/purpleidea/mgmt/util/errwrap"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	engine.RegisterResource("disk:image", func() engine.Res { return &DiskImageRes{} })
+}
+
+const (
+	// loopControl is the device which hands out the free loop devices.
+	loopControl = "/dev/loop-control"
+)
+
+// DiskImageRes is a disk image resource. The name is the path of the image
+// file, which is created as a sparse file, formatted with a filesystem, and
+// mounted on a loop device. The loop device is released automatically when the
+// image is unmounted. Nothing is written to the fstab, so the mount doesn't
+// persist across a reboot unless this resource runs again.
+type DiskImageRes struct {
+	traits.Base // add the base methods without re-implementation
+
+	init *engine.Init
+
+	// State is either exists or absent. When it is absent, the image is
+	// unmounted and removed.
+	State string `lang:"state" yaml:"state"`
+
+	// Size is the size of the image in MiB. An existing image is never
+	// resized.
+	Size uint64 `lang:"size" yaml:"size"`
+
+	// Type is the type of filesystem to format the image with, using mkfs.
+	// An image which already contains another filesystem is never
+	// formatted. If it is empty, then the image is not formatted.
+	Type string `lang:"type" yaml:"type"`
+
+	// Mount is the (optional) mount point of the image. It is created if it
+	// doesn't exist.
+	Mount string `lang:"mount" yaml:"mount"`
+
+	// Options are the mount options.
+	Options map[string]string `lang:"options" yaml:"options"`
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *DiskImageRes) Default() engine.Res {
+	return &DiskImageRes{
+		State: "exists",
+	}
+}
+
+// Validate if the params passed in are valid data.
+func (obj *DiskImageRes) Validate() error {
+	if obj.State != "exists" && obj.State != "absent" {
+		return fmt.Errorf("state must be 'exists', or 'absent'")
+	}
+	if !strings.HasPrefix(obj.Name(), "/") || strings.HasSuffix(obj.Name(), "/") {
+		return fmt.Errorf("the name must be the absolute path of a file")
+	}
+	if obj.State == "absent" {
+		return nil
+	}
+
+	if obj.Size == 0 {
+		return fmt.Errorf("the size must be positive")
+	}
+	if strings.ContainsAny(obj.Type, "/ ") {
+		return fmt.Errorf("the type is invalid")
+	}
+	if obj.Mount != "" {
+		if obj.Type == "" {
+			return fmt.Errorf("the type is needed to mount the image")
+		}
+		if !strings.HasPrefix(obj.Mount, "/") {
+			return fmt.Errorf("the mount point must be an absolute path")
+		}
+	}
+	if len(obj.Options) > 0 && obj.Mount == "" {
+		return fmt.Errorf("the options can only be used with a mount point")
+	}
+
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *DiskImageRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *DiskImageRes) Close() error {
+	return nil
+}
+
+// Watch is the primary listener for this resource and it outputs events. It
+// watches the image file, and the mount table if there's a mount point.
+func (obj *DiskImageRes) Watch() error {
+	recWatcher, err := recwatch.NewRecWatcher(obj.Name(), false)
+	if err != nil {
+		return err
+	}
+	defer recWatcher.Close()
+
+	var mountEvents <-chan error // nil channels block forever
+	if obj.Mount != "" {
+		done := make(chan struct{})
+		defer close(done)
+		if mountEvents, err = mountTableEvents(done); err != nil {
+			return err
+		}
+	}
+
+	obj.init.Running() // when started, notify engine that we're running
+
+	var send = false // send event?
+	for {
+		select {
+		case event, ok := <-recWatcher.Events():
+			if !ok { // channel shutdown
+				return nil
+			}
+			if err := event.Error; err != nil {
+				return errwrap.Wrapf(err, "unknown %s watcher error", obj)
+			}
+			if obj.init.Debug { // don't access event.Body if event.Error isn't nil
+				obj.init.Logf("event(%s): %v", event.Body.Name, event.Body.Op)
+			}
+			send = true
+
+		case err, ok := <-mountEvents:
+			if !ok {
+				return nil
+			}
+			if err != nil {
+				return errwrap.Wrapf(err, "unknown mount table watcher error")
+			}
+			if obj.init.Debug {
+				obj.init.Logf("event: the mount table changed")
+			}
+			send = true
+
+		case <-obj.init.Done: // closed by the engine to signal shutdown
+			return nil
+		}
+
+		// do all our event sending all together to avoid duplicate msgs
+		if send {
+			send = false
+			obj.init.Event() // notify engine of an event (this can block)
+		}
+	}
+}
+
+// CheckApply is run to check the state and, if apply is true, to apply the
+// necessary changes to reach the desired state. The image is created, then
+// formatted, and then mounted.
+func (obj *DiskImageRes) CheckApply(apply bool) (bool, error) {
+	mounted, err := obj.mounted()
+	if err != nil {
+		return false, err
+	}
+
+	if obj.State == "absent" {
+		_, err := os.Stat(obj.Name())
+		if os.IsNotExist(err) && !mounted {
+			return true, nil
+		} else if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		if !apply {
+			return false, nil
+		}
+		if mounted {
+			obj.init.Logf("unmounting: %s", obj.Mount)
+			if err := unix.Unmount(obj.Mount, 0); err != nil {
+				return false, errwrap.Wrapf(err, "error unmounting %s", obj.Mount)
+			}
+		}
+		obj.init.Logf("removing: %s", obj.Name())
+		if err := os.Remove(obj.Name()); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		return false, nil
+	}
+
+	checkOK := true
+
+	if _, err := os.Stat(obj.Name()); os.IsNotExist(err) {
+		if !apply {
+			return false, nil
+		}
+		obj.init.Logf("creating: %s", obj.Name())
+		if err := createFile(obj.Name(), obj.Size*1024*1024, true); err != nil {
+			return false, errwrap.Wrapf(err, "error creating the image")
+		}
+		checkOK = false
+	} else if err != nil {
+		return false, err
+	}
+
+	if obj.Type != "" {
+		typ, err := blkidType(obj.Name())
+		if err != nil {
+			return false, err
+		}
+		if typ != "" && typ != obj.Type {
+			return false, fmt.Errorf("refusing to format %s which contains %s", obj.Name(), typ)
+		}
+		if typ == "" {
+			if !apply {
+				return false, nil
+			}
+			obj.init.Logf("mkfs: %s", obj.Type)
+			if out, err := exec.Command("mkfs", "-t", obj.Type, obj.Name()).CombinedOutput(); err != nil {
+				return false, errwrap.Wrapf(err, "mkfs failed: %s", strings.TrimSpace(string(out)))
+			}
+			checkOK = false
+		}
+	}
+
+	if obj.Mount == "" || mounted {
+		return checkOK, nil
+	}
+	if !apply {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(obj.Mount, 0755); err != nil {
+		return false, errwrap.Wrapf(err, "error creating the mount point")
+	}
+	loop, err := loopAttach(obj.Name())
+	if err != nil {
+		return false, err
+	}
+	defer loop.Close() // the loop device is released if the mount fails
+	obj.init.Logf("mounting %s on %s", loop.Name(), obj.Mount)
+	flags, data := mountFlags(obj.Options)
+	if err := unix.Mount(loop.Name(), obj.Mount, obj.Type, flags, data); err != nil {
+		return false, errwrap.Wrapf(err, "error mounting %s", loop.Name())
+	}
+	return false, nil
+}
+
+// mounted returns true if the image is mounted on the mount point.
+func (obj *DiskImageRes) mounted() (bool, error) {
+	if obj.Mount == "" {
+		return false, nil
+	}
+	info, err := mountInfoLookup(procMountInfo, obj.Mount)
+	if err != nil || info == nil {
+		return false, err
+	}
+	if !strings.HasPrefix(info.Source, "/dev/loop") {
+		return false, nil
+	}
+	file, err := loopFilePath(info.Source)
+	if err != nil {
+		return false, err
+	}
+	return file == truncateLoopName(filepath.Clean(obj.Name())), nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *DiskImageRes) Cmp(r engine.Res) error {
+	// we can only compare DiskImageRes to others of the same resource kind
+	res, ok := r.(*DiskImageRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.State != res.State {
+		return fmt.Errorf("the State differs")
+	}
+	if obj.Size != res.Size {
+		return fmt.Errorf("the Size differs")
+	}
+	if obj.Type != res.Type {
+		return fmt.Errorf("the Type differs")
+	}
+	if obj.Mount != res.Mount {
+		return fmt.Errorf("the Mount differs")
+	}
+	if !strMapEq(obj.Options, res.Options) {
+		return fmt.Errorf("the Options differ")
+	}
+
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *DiskImageRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes DiskImageRes // indirection to avoid infinite recursion
+
+	def := obj.Default()           // get the default
+	res, ok := def.(*DiskImageRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to DiskImageRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = DiskImageRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// truncateLoopName returns the file name the way that the kernel stores it for
+// a loop device, which is limited to 63 bytes.
+func truncateLoopName(name string) string {
+	var info unix.LoopInfo64
+	if len(name) >= len(info.File_name) {
+		return name[:len(info.File_name)-1]
+	}
+	return name
+}
+
+// loopAttach attaches the file to a free loop device, and returns it open. The
+// loop device is set to detach automatically once it's no longer open or
+// mounted, so the caller must keep it open until it's mounted.
+func loopAttach(file string) (*os.File, error) {
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // the loop device keeps its own reference
+
+	ctl, err := os.OpenFile(loopControl, os.O_RDWR, 0)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "error opening %s", loopControl)
+	}
+	defer ctl.Close()
+
+	// another process can take the free device before us, so try again
+	for i := 0; ; i++ {
+		n, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "error getting a free loop device")
+		}
+		device := fmt.Sprintf("/dev/loop%d", n)
+		loop, err := os.OpenFile(device, os.O_RDWR, 0)
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "error opening %s", device)
+		}
+		err = unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_FD, int(f.Fd()))
+		if err == unix.EBUSY && i < 10 {
+			loop.Close()
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			loop.Close()
+			return nil, errwrap.Wrapf(err, "error attaching %s", device)
+		}
+
+		info := &unix.LoopInfo64{Flags: unix.LO_FLAGS_AUTOCLEAR}
+		copy(info.File_name[:len(info.File_name)-1], file)
+		if err := unix.IoctlLoopSetStatus64(int(loop.Fd()), info); err != nil {
+			unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0) // undo
+			loop.Close()
+			return nil, errwrap.Wrapf(err, "error setting up %s", device)
+		}
+		return loop, nil
+	}
+}
@@ -0,0 +1,820 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/util/errwrap"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	engine.RegisterResource("dns:server", func() engine.Res { return &DNSServerRes{} })
+	engine.RegisterResource("dns:record", func() engine.Res { return &DNSRecordRes{} })
+}
+
+const (
+	// DNSDefaultTTL is the default time to live of the records in seconds.
+	DNSDefaultTTL = 300
+
+	// DNSForwardTimeout is how long we wait for an upstream resolver.
+	DNSForwardTimeout = 5 * time.Second
+
+	// dnsMaxChase is the most CNAME records that we follow for an answer.
+	dnsMaxChase = 8
+)
+
+var (
+	// dnsHosts are the dhcp:host resources which name a dns:server in their
+	// DNS field, keyed by the name of that server. The server answers the
+	// reverse lookups for them. They are not grouped into the dns:server,
+	// because they are already grouped into a dhcp:server. This is opt-in
+	// by design: a host without the DNS field is never looked up, and the
+	// server doesn't need a field for every host, which is what send/recv
+	// would require. The hosts add themselves in Init and remove themselves
+	// in Close, so the server only sees the hosts which are running.
+	dnsHosts      = make(map[string]map[*DHCPHostRes]struct{})
+	dnsHostsMutex = &sync.Mutex{}
+)
+
+// dnsAddHost adds a dhcp host to the dns server that it names, so that reverse
+// lookups are answered for it.
+func dnsAddHost(res *DHCPHostRes) {
+	dnsHostsMutex.Lock()
+	defer dnsHostsMutex.Unlock()
+	if _, exists := dnsHosts[res.DNS]; !exists {
+		dnsHosts[res.DNS] = make(map[*DHCPHostRes]struct{})
+	}
+	dnsHosts[res.DNS][res] = struct{}{}
+}
+
+// dnsRemoveHost removes a dhcp host which was added with dnsAddHost.
+func dnsRemoveHost(res *DHCPHostRes) {
+	dnsHostsMutex.Lock()
+	defer dnsHostsMutex.Unlock()
+	delete(dnsHosts[res.DNS], res)
+	if len(dnsHosts[res.DNS]) == 0 {
+		delete(dnsHosts, res.DNS)
+	}
+}
+
+// DNSServerRes is a simple dns server resource. It answers queries from the
+// dns:record resources which get autogrouped into it at runtime, and it
+// forwards all the other queries to the upstream resolvers. It also answers the
+// reverse lookups for the IP of every dhcp:host resource which names it. It
+// does not actually apply any state. The name is used as the address to listen
+// on, unless the Address field is specified, and in that case it is used
+// instead. It listens on both UDP and TCP.
+//
+// This server is not meant as a featureful replacement for the venerable
+// dnsmasq or bind, but rather as a simple, dynamic, integrated alternative for
+// bootstrapping new machines and clusters in an elegant way.
+type DNSServerRes struct {
+	traits.Base      // add the base methods without re-implementation
+	traits.Edgeable  // TODO: add autoedge support
+	traits.Groupable // can have DNSRecordRes grouped into it
+
+	init *engine.Init
+
+	// Address is the listen address to use for the dns server. It is
+	// common to use `:53` (the standard) to listen on port 53 on all
+	// addresses.
+	Address string `lang:"address" yaml:"address"`
+
+	// Zone is the domain that this server is authoritative for, such as
+	// `example.com`. The relative names of the records are in this zone.
+	// Any query for a name in this zone which doesn't have a record gets a
+	// negative answer instead of being forwarded.
+	Zone string `lang:"zone" yaml:"zone"`
+
+	// Upstream is the list of resolvers to forward the other queries to,
+	// such as `192.0.2.1` or `192.0.2.1:53`. They are tried in order. If
+	// this is empty, then the other queries are refused.
+	Upstream []string `lang:"upstream" yaml:"upstream"`
+
+	// TTL is the time to live in seconds of the records which don't
+	// specify one. If it is unspecified, then a default is used.
+	TTL *uint64 `lang:"ttl" yaml:"ttl"`
+
+	zone     string   // fully qualified
+	upstream []string // with ports
+	records  []dns.RR
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *DNSServerRes) Default() engine.Res {
+	return &DNSServerRes{}
+}
+
+// getAddress returns the actual address to use. When Address is not specified,
+// we use the Name.
+func (obj *DNSServerRes) getAddress() string {
+	if obj.Address != "" {
+		return obj.Address
+	}
+	return obj.Name()
+}
+
+// getTTL returns the default time to live of the records.
+func (obj *DNSServerRes) getTTL() uint32 {
+	if obj.TTL != nil {
+		return uint32(*obj.TTL)
+	}
+	return DNSDefaultTTL
+}
+
+// Validate checks if the resource data structure was populated correctly.
+func (obj *DNSServerRes) Validate() error {
+	if obj.getAddress() == "" {
+		return fmt.Errorf("empty address")
+	}
+
+	host, _, err := net.SplitHostPort(obj.getAddress())
+	if err != nil {
+		return errwrap.Wrapf(err, "the Address is in an invalid format: %s", obj.getAddress())
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		return fmt.Errorf("the Address is not a valid IP: %s", host)
+	}
+
+	if obj.Zone != "" && !dnsValidName(obj.Zone) {
+		return fmt.Errorf("the Zone is not a valid domain: %s", obj.Zone)
+	}
+
+	for _, x := range obj.Upstream {
+		if _, err := dnsUpstream(x); err != nil {
+			return err
+		}
+	}
+
+	if obj.TTL != nil && *obj.TTL > 1<<31-1 { // see rfc2181
+		return fmt.Errorf("the TTL is too large")
+	}
+
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *DNSServerRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	// NOTE: If we don't Init anything that's autogrouped, then it won't
+	// even get an Init call on it.
+	// TODO: should we do this in the engine? Do we want to decide it here?
+	for _, res := range obj.GetGroup() { // grouped elements
+		if err := res.Init(init); err != nil {
+			return errwrap.Wrapf(err, "autogrouped Init failed")
+		}
+	}
+
+	obj.zone = ""
+	if obj.Zone != "" {
+		obj.zone = strings.ToLower(dns.Fqdn(obj.Zone))
+	}
+
+	obj.upstream = []string{}
+	for _, x := range obj.Upstream {
+		addr, err := dnsUpstream(x)
+		if err != nil {
+			return err
+		}
+		obj.upstream = append(obj.upstream, addr)
+	}
+
+	// The records are built here, since the names can be relative to our
+	// zone, and the records might not know which server they're in.
+	obj.records = []dns.RR{}
+	for _, x := range obj.GetGroup() { // grouped elements
+		res, ok := x.(*DNSRecordRes) // convert from Res
+		if !ok {
+			continue
+		}
+		rr, err := res.rr(obj.zone, obj.getTTL())
+		if err != nil {
+			return errwrap.Wrapf(err, "invalid record: %s", res)
+		}
+		obj.records = append(obj.records, rr)
+	}
+
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *DNSServerRes) Close() error {
+	// The engine doesn't Close anything that's autogrouped, so we do it.
+	var reterr error
+	for _, res := range obj.GetGroup() { // grouped elements
+		if err := res.Close(); err != nil {
+			reterr = errwrap.Append(reterr, err)
+		}
+	}
+	return reterr
+}
+
+// Watch is the primary listener for this resource and it outputs events.
+func (obj *DNSServerRes) Watch() error {
+	pc, err := net.ListenPacket("udp", obj.getAddress())
+	if err != nil {
+		return errwrap.Wrapf(err, "could not start udp listener")
+	}
+	defer pc.Close()
+	l, err := net.Listen("tcp", obj.getAddress())
+	if err != nil {
+		return errwrap.Wrapf(err, "could not start tcp listener")
+	}
+	defer l.Close()
+
+	servers := []*dns.Server{
+		{PacketConn: pc, Handler: obj.handler()},
+		{Listener: l, Handler: obj.handler()},
+	}
+
+	var closeError error
+	closeSignal := make(chan struct{})
+	once := &sync.Once{}
+
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+
+	// Shutdown errors if the server hasn't started, so we wait for them.
+	startWg := &sync.WaitGroup{}
+	for _, server := range servers {
+		server := server
+		startWg.Add(1)
+		server.NotifyStartedFunc = startWg.Done
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := server.ActivateAndServe() // blocks until Shutdown()
+			once.Do(func() {
+				if err != nil {
+					// if this returned on its own, then closeSignal can be used...
+					closeError = errwrap.Wrapf(err, "the server errored")
+				}
+				close(closeSignal)
+			})
+		}()
+		defer server.Shutdown()
+	}
+	startWg.Wait()
+
+	obj.init.Running() // when started, notify engine that we're running
+
+	startupChan := make(chan struct{})
+	close(startupChan) // send one initial signal
+
+	var send = false // send event?
+	for {
+		if obj.init.Debug {
+			obj.init.Logf("Looping...")
+		}
+
+		select {
+		case <-startupChan:
+			startupChan = nil
+			send = true
+
+		case <-closeSignal: // something shut us down early
+			return closeError
+
+		case <-obj.init.Done: // closed by the engine to signal shutdown
+			return nil
+		}
+
+		// do all our event sending all together to avoid duplicate msgs
+		if send {
+			send = false
+			obj.init.Event() // notify engine of an event (this can block)
+		}
+	}
+}
+
+// CheckApply never has anything to do for this resource, so it always succeeds.
+func (obj *DNSServerRes) CheckApply(apply bool) (bool, error) {
+	if obj.init.Debug {
+		obj.init.Logf("CheckApply")
+	}
+
+	return true, nil // always succeeds, with nothing to do!
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *DNSServerRes) Cmp(r engine.Res) error {
+	// we can only compare DNSServerRes to others of the same resource kind
+	res, ok := r.(*DNSServerRes)
+	if !ok {
+		return fmt.Errorf("res is not the same kind")
+	}
+
+	if obj.Address != res.Address {
+		return fmt.Errorf("the Address differs")
+	}
+	if obj.Zone != res.Zone {
+		return fmt.Errorf("the Zone differs")
+	}
+
+	if len(obj.Upstream) != len(res.Upstream) {
+		return fmt.Errorf("the number of Upstream servers differs")
+	}
+	for i, x := range obj.Upstream {
+		if x != res.Upstream[i] {
+			return fmt.Errorf("the Upstream server at index %d differs", i)
+		}
+	}
+
+	if (obj.TTL == nil) != (res.TTL == nil) { // xor
+		return fmt.Errorf("the TTL differs")
+	}
+	if obj.TTL != nil && res.TTL != nil {
+		if *obj.TTL != *res.TTL { // compare the values
+			return fmt.Errorf("the value of TTL differs")
+		}
+	}
+
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *DNSServerRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes DNSServerRes // indirection to avoid infinite recursion
+
+	def := obj.Default()           // get the default
+	res, ok := def.(*DNSServerRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to DNSServerRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = DNSServerRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// GroupCmp returns whether two resources can be grouped together or not. Can
+// these two resources be merged, aka, does this resource support doing so? Will
+// resource allow itself to be grouped _into_ this obj?
+func (obj *DNSServerRes) GroupCmp(r engine.GroupableRes) error {
+	res, ok := r.(*DNSRecordRes) // different from what we usually do!
+	if !ok {
+		return fmt.Errorf("resource is not the right kind")
+	}
+
+	// If the dns record resource has the Server field specified, then it
+	// must match against our name field if we want it to group with us.
+	if res.Server != "" && res.Server != obj.Name() {
+		return fmt.Errorf("resource groups with a different server name")
+	}
+
+	return nil
+}
+
+// hostPTRs returns the reverse lookup records of the dhcp hosts for the name.
+func (obj *DNSServerRes) hostPTRs(name string) []dns.RR {
+	dnsHostsMutex.Lock()
+	defer dnsHostsMutex.Unlock()
+
+	result := []dns.RR{}
+	for res := range dnsHosts[obj.Name()] {
+		arpa, err := dns.ReverseAddr(res.ipv4Addr.String())
+		if err != nil || arpa != name {
+			continue
+		}
+		result = append(result, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    obj.getTTL(),
+			},
+			Ptr: dnsQualify(res.Hostname, obj.zone),
+		})
+	}
+	return result
+}
+
+// lookup returns the records for the name and the type. It follows the CNAME
+// records that point to other names which we have. It also returns true if we
+// have any records for the name at all.
+func (obj *DNSServerRes) lookup(name string, qtype uint16) ([]dns.RR, bool) {
+	result := []dns.RR{}
+	exists := false
+	for i := 0; i < dnsMaxChase; i++ {
+		records := append([]dns.RR{}, obj.records...)
+		if qtype == dns.TypePTR || qtype == dns.TypeANY {
+			records = append(records, obj.hostPTRs(name)...)
+		}
+
+		found := false
+		var cname *dns.CNAME
+		for _, rr := range records {
+			if rr.Header().Name != name {
+				continue
+			}
+			if i == 0 { // only the name that was asked for
+				exists = true
+			}
+			if rr.Header().Rrtype == qtype || qtype == dns.TypeANY {
+				result = append(result, dns.Copy(rr))
+				found = true
+				continue
+			}
+			if x, ok := rr.(*dns.CNAME); ok && cname == nil {
+				cname = x
+			}
+		}
+		if found || cname == nil {
+			break // found it, or there's nothing to follow
+		}
+		result = append(result, dns.Copy(cname))
+		name = cname.Target // follow it
+	}
+	return result, exists
+}
+
+// authoritative returns true if the name is in our zone.
+func (obj *DNSServerRes) authoritative(name string) bool {
+	return obj.zone != "" && dns.IsSubDomain(obj.zone, name)
+}
+
+// forward sends the query to the upstream resolvers, and returns the first
+// answer that we get.
+func (obj *DNSServerRes) forward(req *dns.Msg, network string) (*dns.Msg, error) {
+	client := &dns.Client{
+		Net:     network,
+		Timeout: DNSForwardTimeout,
+	}
+	var reterr error
+	for _, addr := range obj.upstream {
+		resp, _, err := client.Exchange(req, addr)
+		if err != nil {
+			reterr = errwrap.Append(reterr, err)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, reterr
+}
+
+// answer builds the response for the request.
+func (obj *DNSServerRes) answer(req *dns.Msg, network string) *dns.Msg {
+	msg := &dns.Msg{}
+	if len(req.Question) != 1 {
+		return msg.SetRcode(req, dns.RcodeFormatError)
+	}
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+
+	answer, exists := obj.lookup(name, q.Qtype)
+	if len(answer) > 0 || exists || obj.authoritative(name) {
+		msg.SetReply(req)
+		msg.Authoritative = true
+		msg.Answer = answer
+		if len(answer) == 0 && !exists {
+			msg.Rcode = dns.RcodeNameError
+		}
+		return msg
+	}
+
+	if len(obj.upstream) == 0 {
+		return msg.SetRcode(req, dns.RcodeRefused)
+	}
+
+	resp, err := obj.forward(req, network)
+	if err != nil {
+		obj.init.Logf("could not forward %s: %v", name, err)
+		return msg.SetRcode(req, dns.RcodeServerFailure)
+	}
+	return resp
+}
+
+// handler handles all the incoming queries from clients.
+func (obj *DNSServerRes) handler() dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		network := "udp"
+		if _, ok := w.LocalAddr().(*net.TCPAddr); ok {
+			network = "tcp"
+		}
+		if obj.init.Debug {
+			obj.init.Logf("Client: %s (%s)", w.RemoteAddr(), network)
+			for _, q := range req.Question {
+				obj.init.Logf("Query: %s %s", q.Name, dns.TypeToString[q.Qtype])
+			}
+		}
+
+		resp := obj.answer(req, network)
+		if err := w.WriteMsg(resp); err != nil {
+			obj.init.Logf("could not write the response: %v", err)
+		}
+	}
+}
+
+// DNSRecordRes is a record that exists within a dns server. The name is used as
+// the domain of the record, unless the Domain field is specified, and in that
+// case it is used instead. The way this works is that it autogroups at runtime
+// with an existing dns:server resource, and in doing so makes the record
+// available from that dns server. There can be several records of the same
+// type for the same domain.
+type DNSRecordRes struct {
+	traits.Base      // add the base methods without re-implementation
+	traits.Edgeable  // XXX: add autoedge support
+	traits.Groupable // can be grouped into DNSServerRes
+
+	init *engine.Init
+
+	// Server is the name of the dns server resource to group this into. If
+	// it is omitted, and there is only a single dns resource, then it will
+	// be grouped into it automatically. If there is more than one main dns
+	// resource being used, then the grouping behaviour is *undefined* when
+	// this is not specified, and it is not recommended to leave this blank!
+	Server string `lang:"server" yaml:"server"`
+
+	// Domain is the name that this record is for. If it is not fully
+	// qualified with a trailing dot, then it is relative to the Zone of the
+	// server. The `@` name is the Zone itself.
+	Domain string `lang:"domain" yaml:"domain"`
+
+	// Type is the record type. It is one of A, AAAA, CNAME, PTR, SRV and
+	// TXT.
+	Type string `lang:"type" yaml:"type"`
+
+	// Value is the data of the record. It is the IP address for A and AAAA,
+	// the text for TXT, and the target name for CNAME, PTR and SRV. A target
+	// name is relative to the Zone, unless it is fully qualified.
+	Value string `lang:"value" yaml:"value"`
+
+	// TTL is the time to live in seconds. If it is zero, then the TTL of the
+	// server is used.
+	TTL uint64 `lang:"ttl" yaml:"ttl"`
+
+	// Priority is the priority of an SRV record.
+	Priority uint64 `lang:"priority" yaml:"priority"`
+
+	// Weight is the weight of an SRV record.
+	Weight uint64 `lang:"weight" yaml:"weight"`
+
+	// Port is the port of an SRV record.
+	Port uint64 `lang:"port" yaml:"port"`
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *DNSRecordRes) Default() engine.Res {
+	return &DNSRecordRes{}
+}
+
+// getDomain returns the actual domain of the record. When Domain is not
+// specified, we use the Name.
+func (obj *DNSRecordRes) getDomain() string {
+	if obj.Domain != "" {
+		return obj.Domain
+	}
+	return obj.Name()
+}
+
+// Validate checks if the resource data structure was populated correctly.
+func (obj *DNSRecordRes) Validate() error {
+	if d := obj.getDomain(); d != "@" && !dnsValidName(d) {
+		return fmt.Errorf("the Domain is not valid: %s", d)
+	}
+
+	switch obj.Type {
+	case "A":
+		if ip := net.ParseIP(obj.Value); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("the Value is not an IPv4 address: %s", obj.Value)
+		}
+	case "AAAA":
+		if ip := net.ParseIP(obj.Value); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("the Value is not an IPv6 address: %s", obj.Value)
+		}
+	case "CNAME", "PTR", "SRV":
+		if obj.Value != "@" && !dnsValidName(obj.Value) {
+			return fmt.Errorf("the Value is not a valid name: %s", obj.Value)
+		}
+	case "TXT":
+	default:
+		return fmt.Errorf("invalid Type: %s", obj.Type)
+	}
+
+	if obj.Type == "SRV" {
+		if obj.Port == 0 || obj.Port > 65535 {
+			return fmt.Errorf("the Port must be between 1 and 65535")
+		}
+		if obj.Priority > 65535 || obj.Weight > 65535 {
+			return fmt.Errorf("the Priority and the Weight must be at most 65535")
+		}
+	} else if obj.Priority != 0 || obj.Weight != 0 || obj.Port != 0 {
+		return fmt.Errorf("only an SRV record can have a Priority, Weight or Port")
+	}
+
+	if obj.TTL > 1<<31-1 { // see rfc2181
+		return fmt.Errorf("the TTL is too large")
+	}
+
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *DNSRecordRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *DNSRecordRes) Close() error {
+	return nil
+}
+
+// Watch is the primary listener for this resource and it outputs events. This
+// particular one does absolutely nothing but block until we've received a done
+// signal.
+func (obj *DNSRecordRes) Watch() error {
+	obj.init.Running() // when started, notify engine that we're running
+
+	select {
+	case <-obj.init.Done: // closed by the engine to signal shutdown
+	}
+
+	//obj.init.Event() // notify engine of an event (this can block)
+
+	return nil
+}
+
+// CheckApply never has anything to do for this resource, so it always succeeds.
+func (obj *DNSRecordRes) CheckApply(apply bool) (bool, error) {
+	if obj.init.Debug {
+		obj.init.Logf("CheckApply")
+	}
+
+	return true, nil // always succeeds, with nothing to do!
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *DNSRecordRes) Cmp(r engine.Res) error {
+	// we can only compare DNSRecordRes to others of the same resource kind
+	res, ok := r.(*DNSRecordRes)
+	if !ok {
+		return fmt.Errorf("res is not the same kind")
+	}
+
+	if obj.Server != res.Server {
+		return fmt.Errorf("the Server field differs")
+	}
+	if obj.Domain != res.Domain {
+		return fmt.Errorf("the Domain differs")
+	}
+	if obj.Type != res.Type {
+		return fmt.Errorf("the Type differs")
+	}
+	if obj.Value != res.Value {
+		return fmt.Errorf("the Value differs")
+	}
+	if obj.TTL != res.TTL {
+		return fmt.Errorf("the TTL differs")
+	}
+	if obj.Priority != res.Priority {
+		return fmt.Errorf("the Priority differs")
+	}
+	if obj.Weight != res.Weight {
+		return fmt.Errorf("the Weight differs")
+	}
+	if obj.Port != res.Port {
+		return fmt.Errorf("the Port differs")
+	}
+
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *DNSRecordRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes DNSRecordRes // indirection to avoid infinite recursion
+
+	def := obj.Default()           // get the default
+	res, ok := def.(*DNSRecordRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to DNSRecordRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = DNSRecordRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// rr builds the record. The relative names are in the zone, and the ttl is used
+// if the record doesn't have one.
+func (obj *DNSRecordRes) rr(zone string, ttl uint32) (dns.RR, error) {
+	if obj.TTL != 0 {
+		ttl = uint32(obj.TTL)
+	}
+	hdr := dns.RR_Header{
+		Name:  dnsQualify(obj.getDomain(), zone),
+		Class: dns.ClassINET,
+		Ttl:   ttl,
+	}
+
+	switch obj.Type {
+	case "A":
+		hdr.Rrtype = dns.TypeA
+		return &dns.A{Hdr: hdr, A: net.ParseIP(obj.Value).To4()}, nil
+	case "AAAA":
+		hdr.Rrtype = dns.TypeAAAA
+		return &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP(obj.Value)}, nil
+	case "CNAME":
+		hdr.Rrtype = dns.TypeCNAME
+		return &dns.CNAME{Hdr: hdr, Target: dnsQualify(obj.Value, zone)}, nil
+	case "PTR":
+		hdr.Rrtype = dns.TypePTR
+		return &dns.PTR{Hdr: hdr, Ptr: dnsQualify(obj.Value, zone)}, nil
+	case "SRV":
+		hdr.Rrtype = dns.TypeSRV
+		return &dns.SRV{
+			Hdr:      hdr,
+			Priority: uint16(obj.Priority),
+			Weight:   uint16(obj.Weight),
+			Port:     uint16(obj.Port),
+			Target:   dnsQualify(obj.Value, zone),
+		}, nil
+	case "TXT":
+		hdr.Rrtype = dns.TypeTXT
+		// each string in a TXT record can have at most 255 bytes
+		txt := []string{}
+		s := obj.Value
+		for len(s) > 255 {
+			txt = append(txt, s[:255])
+			s = s[255:]
+		}
+		txt = append(txt, s)
+		return &dns.TXT{Hdr: hdr, Txt: txt}, nil
+	}
+	return nil, fmt.Errorf("invalid Type: %s", obj.Type) // programming error
+}
+
+// dnsValidName returns true if the name is a valid domain name.
+func dnsValidName(name string) bool {
+	if name == "" || name == "." {
+		return false
+	}
+	_, ok := dns.IsDomainName(name)
+	return ok
+}
+
+// dnsQualify returns the fully qualified name in lower case. A name which is
+// not fully qualified is relative to the zone, if there is one. The `@` name is
+// the zone itself.
+func dnsQualify(name, zone string) string {
+	name = strings.ToLower(name)
+	if name == "@" {
+		return zone
+	}
+	if dns.IsFqdn(name) || zone == "" {
+		return dns.Fqdn(name)
+	}
+	return name + "." + zone
+}
+
+// dnsUpstream adds the default port to the address of an upstream resolver.
+func dnsUpstream(addr string) (string, error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		return net.JoinHostPort(addr, "53"), nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", errwrap.Wrapf(err, "the Upstream is in an invalid format: %s", addr)
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("the Upstream is not a valid IP: %s", host)
+	}
+	return addr, nil
+}
@@ -0,0 +1,342 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root
+
+package resources
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/purpleidea/mgmt/engine"
+
+	"github.com/miekg/dns"
+)
+
+// dnsTestAddress returns a localhost address with a port that is free for both
+// udp and tcp.
+func dnsTestAddress(t *testing.T) string {
+	for i := 0; i < 10; i++ {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("could not listen: %v", err)
+		}
+		addr := pc.LocalAddr().String()
+		l, err := net.Listen("tcp", addr)
+		pc.Close()
+		if err != nil {
+			continue // try another one
+		}
+		l.Close()
+		return addr
+	}
+	t.Fatalf("could not find a free port")
+	return ""
+}
+
+func TestDNSRecordValidate1(t *testing.T) {
+	testCases := []struct {
+		name string
+		res  *DNSRecordRes
+		fail bool
+	}{
+		{"a", &DNSRecordRes{Type: "A", Value: "192.0.2.1"}, false},
+		{"a6", &DNSRecordRes{Type: "A", Value: "2001:db8::1"}, true},
+		{"aaaa", &DNSRecordRes{Type: "AAAA", Value: "2001:db8::1"}, false},
+		{"aaaa4", &DNSRecordRes{Type: "AAAA", Value: "192.0.2.1"}, true},
+		{"cname", &DNSRecordRes{Type: "CNAME", Value: "www.example.com."}, false},
+		{"cname bad", &DNSRecordRes{Type: "CNAME", Value: "a..b"}, true},
+		{"srv", &DNSRecordRes{Type: "SRV", Value: "www", Port: 80}, false},
+		{"srv port", &DNSRecordRes{Type: "SRV", Value: "www"}, true},
+		{"a port", &DNSRecordRes{Type: "A", Value: "192.0.2.1", Port: 80}, true},
+		{"txt", &DNSRecordRes{Type: "TXT", Value: "v=spf1 -all"}, false},
+		{"mx", &DNSRecordRes{Type: "MX", Value: "mail"}, true},
+		{"domain", &DNSRecordRes{Domain: "a..b", Type: "A", Value: "192.0.2.1"}, true},
+	}
+	for _, tc := range testCases {
+		tc.res.SetName("www")
+		err := tc.res.Validate()
+		if tc.fail && err == nil {
+			t.Errorf("%s: validate should have failed", tc.name)
+		}
+		if !tc.fail && err != nil {
+			t.Errorf("%s: validate failed with: %v", tc.name, err)
+		}
+	}
+}
+
+func TestDNSServer1(t *testing.T) {
+	// a fake upstream which answers everything with the same address
+	upstreamAddr := dnsTestAddress(t)
+	upstream := &dns.Server{
+		Addr: upstreamAddr,
+		Net:  "udp",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			msg := &dns.Msg{}
+			msg.SetReply(req)
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 198.51.100.1")
+			msg.Answer = []dns.RR{rr}
+			w.WriteMsg(msg)
+		}),
+	}
+	started := make(chan struct{})
+	upstream.NotifyStartedFunc = func() { close(started) }
+	go upstream.ListenAndServe()
+	<-started
+	defer upstream.Shutdown()
+
+	addr := dnsTestAddress(t)
+	res := &DNSServerRes{
+		Zone:     "Example.com",
+		Upstream: []string{upstreamAddr},
+	}
+	res.SetKind("dns:server")
+	res.SetName(addr)
+	records := map[string]*DNSRecordRes{
+		"www":       {Type: "A", Value: "192.0.2.10"},
+		"www6":      {Domain: "www", Type: "AAAA", Value: "2001:db8::10"},
+		"alias":     {Type: "CNAME", Value: "www"},
+		"_http":     {Domain: "_http._tcp", Type: "SRV", Value: "www", Port: 80, Priority: 10, Weight: 5},
+		"txt":       {Domain: "@", Type: "TXT", Value: strings.Repeat("x", 300), TTL: 60},
+		"ptr":       {Domain: "10.2.0.192.in-addr.arpa.", Type: "PTR", Value: "www"},
+		"elsewhere": {Domain: "mail.example.org.", Type: "A", Value: "192.0.2.25"},
+	}
+	for name, x := range records {
+		x.SetKind("dns:record")
+		x.SetName(name)
+		if err := x.Validate(); err != nil {
+			t.Errorf("validate of %s failed with: %v", name, err)
+			return
+		}
+		if err := res.GroupCmp(x); err != nil {
+			t.Errorf("could not group: %v", err)
+			return
+		}
+		if err := res.GroupRes(x); err != nil {
+			t.Errorf("could not group: %v", err)
+			return
+		}
+	}
+	if err := res.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+
+	// a dhcp host gets a reverse lookup
+	host := &DHCPHostRes{Mac: "00:11:22:33:44:55", IP: "192.0.2.20/24", Hostname: "pxe", DNS: res.Name()}
+	host.SetKind("dhcp:host")
+	host.SetName("pxe")
+	if err := host.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+
+	running := make(chan struct{})
+	done := make(chan struct{})
+	init := &engine.Init{
+		Running: func() { close(running) },
+		Event:   func() {},
+		Done:    done,
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+	}
+	if err := host.Init(init); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	defer host.Close()
+	// a host of another dns server isn't answered by this one
+	other := &DHCPHostRes{Mac: "00:11:22:33:44:56", IP: "192.0.2.21/24", Hostname: "other", DNS: "ns2"}
+	other.SetKind("dhcp:host")
+	other.SetName("other")
+	if err := other.Init(init); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	defer other.Close()
+	if (&DHCPHostRes{Mac: "00:11:22:33:44:57", IP: "192.0.2.22/24", DNS: "ns2"}).Validate() == nil {
+		t.Errorf("a host without a hostname should fail validate")
+	}
+	if err := res.Init(init); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	watchErr := make(chan error)
+	go func() {
+		watchErr <- res.Watch()
+	}()
+	defer func() {
+		close(done)
+		if err := <-watchErr; err != nil {
+			t.Errorf("watch failed with: %v", err)
+		}
+	}()
+	<-running
+
+	query := func(network, name string, qtype uint16) *dns.Msg {
+		client := &dns.Client{Net: network}
+		req := &dns.Msg{}
+		req.SetQuestion(name, qtype)
+		resp, _, err := client.Exchange(req, addr)
+		if err != nil {
+			t.Errorf("query for %s failed: %v", name, err)
+			return &dns.Msg{}
+		}
+		return resp
+	}
+
+	testCases := []struct {
+		name     string
+		qtype    uint16
+		rcode    int
+		expected []string // the answers without the ttl
+	}{
+		{"www.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"www.example.com. IN A 192.0.2.10"}},
+		{"WWW.example.com.", dns.TypeAAAA, dns.RcodeSuccess, []string{"www.example.com. IN AAAA 2001:db8::10"}},
+		{"alias.example.com.", dns.TypeA, dns.RcodeSuccess, []string{
+			"alias.example.com. IN CNAME www.example.com.",
+			"www.example.com. IN A 192.0.2.10",
+		}},
+		{"_http._tcp.example.com.", dns.TypeSRV, dns.RcodeSuccess, []string{"_http._tcp.example.com. IN SRV 10 5 80 www.example.com."}},
+		{"10.2.0.192.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, []string{"10.2.0.192.in-addr.arpa. IN PTR www.example.com."}},
+		{"20.2.0.192.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, []string{"20.2.0.192.in-addr.arpa. IN PTR pxe.example.com."}},
+		{"mail.example.org.", dns.TypeA, dns.RcodeSuccess, []string{"mail.example.org. IN A 192.0.2.25"}},
+		{"www.example.com.", dns.TypeTXT, dns.RcodeSuccess, []string{}}, // no data
+		{"nope.example.com.", dns.TypeA, dns.RcodeNameError, []string{}},
+		{"forwarded.example.net.", dns.TypeA, dns.RcodeSuccess, []string{"forwarded.example.net. IN A 198.51.100.1"}},
+	}
+	for _, tc := range testCases {
+		resp := query("udp", tc.name, tc.qtype)
+		if resp.Rcode != tc.rcode {
+			t.Errorf("%s: got rcode %s", tc.name, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		answers := []string{}
+		for _, rr := range resp.Answer {
+			fields := strings.Fields(rr.String())
+			fields = append(fields[:1], fields[2:]...) // remove the ttl
+			answers = append(answers, strings.Join(fields, " "))
+		}
+		if s := strings.Join(answers, "\n"); s != strings.Join(tc.expected, "\n") {
+			t.Errorf("%s: got:\n%s\nexpected:\n%s", tc.name, s, strings.Join(tc.expected, "\n"))
+		}
+	}
+
+	// the long txt record is split, and it has its own ttl
+	resp := query("tcp", "example.com.", dns.TypeTXT)
+	if len(resp.Answer) != 1 {
+		t.Errorf("expected a txt answer, got: %v", resp)
+		return
+	}
+	txt, ok := resp.Answer[0].(*dns.TXT)
+	if !ok || len(txt.Txt) != 2 || len(txt.Txt[0]) != 255 || txt.Hdr.Ttl != 60 {
+		t.Errorf("unexpected txt answer: %v", resp.Answer[0])
+	}
+	if !resp.Authoritative {
+		t.Errorf("expected an authoritative answer")
+	}
+
+	for _, rr := range query("udp", "21.2.0.192.in-addr.arpa.", dns.TypePTR).Answer {
+		if _, ok := rr.(*dns.PTR); ok {
+			t.Errorf("unexpected answer for another server: %v", rr)
+		}
+	}
+
+	// the dhcp host is gone after it's closed, so the query is forwarded
+	host.Close()
+	for _, rr := range query("udp", "20.2.0.192.in-addr.arpa.", dns.TypePTR).Answer {
+		if _, ok := rr.(*dns.PTR); ok {
+			t.Errorf("unexpected answer after close: %v", rr)
+		}
+	}
+}
+
+func TestDNSServerHostPTRs1(t *testing.T) {
+	res := &DNSServerRes{}
+	res.SetKind("dns:server")
+	res.SetName("ns1")
+	res.zone = "example.com."
+
+	init := &engine.Init{
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+	}
+	hosts := []*DHCPHostRes{
+		{Mac: "00:11:22:33:44:55", IP: "192.0.2.20/24", Hostname: "pxe", DNS: "ns1"},
+		{Mac: "00:11:22:33:44:56", IP: "192.0.2.21/24", Hostname: "other", DNS: "ns2"},
+		{Mac: "00:11:22:33:44:57", IP: "192.0.2.22/24", Hostname: "optout"}, // no DNS
+		{Mac: "00:11:22:33:44:58", IP: "192.0.2.23/24", Hostname: "fqdn.example.org.", DNS: "ns1"},
+	}
+	for i, host := range hosts {
+		host.SetKind("dhcp:host")
+		host.SetName(fmt.Sprintf("host%d", i))
+		if err := host.Validate(); err != nil {
+			t.Errorf("validate of %s failed with: %v", host, err)
+			return
+		}
+		if err := host.Init(init); err != nil {
+			t.Errorf("init of %s failed with: %v", host, err)
+			return
+		}
+	}
+
+	tests := []struct {
+		name string
+		ptr  string // expected target, empty if there's no answer
+	}{
+		{"20.2.0.192.in-addr.arpa.", "pxe.example.com."},
+		{"21.2.0.192.in-addr.arpa.", ""}, // another server
+		{"22.2.0.192.in-addr.arpa.", ""}, // didn't opt-in
+		{"23.2.0.192.in-addr.arpa.", "fqdn.example.org."},
+		{"24.2.0.192.in-addr.arpa.", ""}, // unknown
+	}
+	for _, tc := range tests {
+		result := res.hostPTRs(tc.name)
+		if tc.ptr == "" {
+			if len(result) != 0 {
+				t.Errorf("unexpected answer for %s: %v", tc.name, result)
+			}
+			continue
+		}
+		if len(result) != 1 {
+			t.Errorf("expected one answer for %s, got: %v", tc.name, result)
+			continue
+		}
+		if ptr, ok := result[0].(*dns.PTR); !ok || ptr.Ptr != tc.ptr {
+			t.Errorf("unexpected answer for %s: %v", tc.name, result[0])
+		}
+	}
+
+	for _, host := range hosts {
+		if err := host.Close(); err != nil {
+			t.Errorf("close of %s failed with: %v", host, err)
+		}
+	}
+	if result := res.hostPTRs("20.2.0.192.in-addr.arpa."); len(result) != 0 {
+		t.Errorf("unexpected answer after close: %v", result)
+	}
+	dnsHostsMutex.Lock()
+	defer dnsHostsMutex.Unlock()
+	if len(dnsHosts) != 0 {
+		t.Errorf("the dns hosts weren't all removed: %v", dnsHosts)
+	}
+}
@@ -22,8 +22,11 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"os/user"
+	"path"
 	"sort"
 	"strings"
 	"sync"
@@ -33,9 +36,16 @@ import (
 	"github.com/purpleidea/mgmt/engine"
 	"github.com/purpleidea/mgmt/engine/traits"
 	engineUtil "github.com/purpleidea/mgmt/engine/util"
+	"github.com/purpleidea/mgmt/recwatch"
 	"github.com/purpleidea/mgmt/util/errwrap"
 )
 
+const (
+	// execOutputFile is the name of the file in the VarDir that the full
+	// command output is stored in when SaveOutput is used.
+	execOutputFile = "output"
+)
+
 func init() {
 	engine.RegisterResource("exec", func() engine.Res { return &ExecRes{} })
 }
@@ -88,6 +98,46 @@ type ExecRes struct {
 	// IfShell is the Shell for the IfCmd. See the docs for Shell.
 	IfShell string `yaml:"ifshell"`
 
+	// UnlessCmd is the inverse of the IfCmd. If this command succeeds, then
+	// the Cmd will *not* be run. If this command returns a non-zero result,
+	// then the Cmd will be run. Any error scenario or timeout will cause
+	// the resource to error. If both this and IfCmd are specified, then
+	// both guards must allow the Cmd to run.
+	UnlessCmd string `yaml:"unlesscmd"`
+	// UnlessCwd is the Cwd for the UnlessCmd. See the docs for Cwd.
+	UnlessCwd string `yaml:"unlesscwd"`
+	// UnlessShell is the Shell for the UnlessCmd. See the docs for Shell.
+	UnlessShell string `yaml:"unlessshell"`
+
+	// Creates is the absolute path to a file or directory which the Cmd
+	// creates. If it exists, then the Cmd will not be run. This path is
+	// watched, so that if it gets removed, the Cmd will run again.
+	Creates string `yaml:"creates"`
+
+	// SuccessExitCodes is the list of exit codes which mean that the Cmd
+	// ran successfully. Any other exit code is an error. If this is empty,
+	// then only an exit code of zero is a success.
+	SuccessExitCodes []int `yaml:"successexitcodes"`
+	// UnchangedExitCodes is the list of exit codes which mean that the Cmd
+	// ran successfully, but that it didn't need to change anything. These
+	// are a success too, but are reported to the engine as the state being
+	// already OK, so that nothing downstream gets notified. This lets a
+	// script decide for itself whether it made a change or not.
+	UnchangedExitCodes []int `yaml:"unchangedexitcodes"`
+
+	// LogLimit is the maximum number of bytes of command output which are
+	// streamed to the log line by line as the command runs. Anything after
+	// this is dropped from the log, but it is still kept for the sends. If
+	// this is zero, then the output is only logged once the command exits.
+	LogLimit int64 `yaml:"loglimit"`
+	// SaveOutput specifies that the full combined command output should be
+	// stored in a file named "output" in the VarDir of this resource. This
+	// file is written as the command runs, and replaced on each run.
+	SaveOutput bool `yaml:"saveoutput"`
+	// TailLines is the number of lines from the end of the command output
+	// which are sent as the tail. If this is zero, then no tail is sent.
+	TailLines uint64 `yaml:"taillines"`
+
 	// User is the (optional) user to use to execute the command. It is used
 	// for any command being run.
 	User string `yaml:"user"`
@@ -95,9 +145,11 @@ type ExecRes struct {
 	// used for any command being run.
 	Group string `yaml:"group"`
 
-	output *string // all cmd output, read only, do not set!
-	stdout *string // the cmd stdout, read only, do not set!
-	stderr *string // the cmd stderr, read only, do not set!
+	output   *string // all cmd output, read only, do not set!
+	stdout   *string // the cmd stdout, read only, do not set!
+	stderr   *string // the cmd stderr, read only, do not set!
+	tail     *string // the last lines of cmd output, read only, do not set!
+	exitCode *int64  // the cmd exit code, read only, do not set!
 
 	interruptChan chan struct{}
 	wg            *sync.WaitGroup
@@ -131,6 +183,39 @@ func (obj *ExecRes) Validate() error {
 		return fmt.Errorf("the Args param can't be used when Cmd has args")
 	}
 
+	// Without a shell, the first word is the program, so there must be one.
+	for _, x := range []struct{ name, cmd, shell string }{
+		{"Cmd", obj.getCmd(), obj.Shell},
+		{"WatchCmd", obj.WatchCmd, obj.WatchShell},
+		{"IfCmd", obj.IfCmd, obj.IfShell},
+		{"UnlessCmd", obj.UnlessCmd, obj.UnlessShell},
+	} {
+		if x.cmd != "" && x.shell == "" && strings.TrimSpace(x.cmd) == "" {
+			return fmt.Errorf("the %s can't be blank", x.name)
+		}
+	}
+
+	if obj.LogLimit < 0 {
+		return fmt.Errorf("the LogLimit must not be negative")
+	}
+
+	if obj.Creates != "" && !strings.HasPrefix(obj.Creates, "/") {
+		return fmt.Errorf("the Creates param must be an absolute path")
+	}
+
+	for _, code := range append(obj.SuccessExitCodes, obj.UnchangedExitCodes...) {
+		if code < 0 || code > 255 {
+			return fmt.Errorf("the exit code of %d is out of range", code)
+		}
+	}
+	for _, code := range obj.UnchangedExitCodes {
+		for _, x := range obj.SuccessExitCodes {
+			if code == x {
+				return fmt.Errorf("the exit code of %d can't both be a change and unchanged", code)
+			}
+		}
+	}
+
 	// check that, if an user or a group is set, we're running as root
 	if obj.User != "" || obj.Group != "" {
 		currentUser, err := user.Current()
@@ -208,11 +293,33 @@ func (obj *ExecRes) Watch() error {
 		}
 	}
 
+	var createsEvents chan recwatch.Event
+	if obj.Creates != "" {
+		recWatcher, err := recwatch.NewRecWatcher(obj.Creates, false)
+		if err != nil {
+			return err
+		}
+		defer recWatcher.Close()
+		createsEvents = recWatcher.Events()
+	}
+
 	obj.init.Running() // when started, notify engine that we're running
 
 	var send = false // send event?
 	for {
 		select {
+		case event, ok := <-createsEvents:
+			if !ok { // channel shutdown
+				return fmt.Errorf("unexpected close")
+			}
+			if err := event.Error; err != nil {
+				return errwrap.Wrapf(err, "unknown %s watcher error", obj)
+			}
+			if obj.init.Debug { // don't access event.Body if event.Error isn't nil
+				obj.init.Logf("creates event(%s): %v", event.Body.Name, event.Body.Op)
+			}
+			send = true
+
 		case data, ok := <-ioChan:
 			if !ok { // EOF
 				// FIXME: add an "if watch command ends/crashes"
@@ -272,71 +379,36 @@ func (obj *ExecRes) CheckApply(apply bool) (bool, error) {
 	// check and this will run. It is still guarded by the IfCmd, but it can
 	// have a chance to execute, and all without the check of obj.Refresh()!
 
-	if obj.IfCmd != "" { // if there is no onlyif check, we should just run
-		var cmdName string
-		var cmdArgs []string
-		if obj.IfShell == "" {
-			// call without a shell
-			// FIXME: are there still whitespace splitting issues?
-			split := strings.Fields(obj.IfCmd)
-			cmdName = split[0]
-			//d, _ := os.Getwd() // TODO: how does this ever error ?
-			//cmdName = path.Join(d, cmdName)
-			cmdArgs = split[1:]
-		} else {
-			cmdName = obj.IfShell // usually bash, or sh
-			cmdArgs = []string{"-c", obj.IfCmd}
+	if obj.Creates != "" { // if the path exists, we've already run
+		_, err := os.Stat(obj.Creates)
+		if err == nil {
+			if obj.init.Debug {
+				obj.init.Logf("creates path exists: %s", obj.Creates)
+			}
+			return true, nil // don't run
 		}
-		cmd := exec.Command(cmdName, cmdArgs...)
-		cmd.Dir = obj.IfCwd // run program in pwd if ""
-		// ignore signals sent to parent process (we're in our own group)
-		cmd.SysProcAttr = &syscall.SysProcAttr{
-			Setpgid: true,
-			Pgid:    0,
+		if !os.IsNotExist(err) {
+			return false, errwrap.Wrapf(err, "could not stat the creates path")
 		}
+	}
 
-		// if we have an user and group, use them
-		var err error
-		if cmd.SysProcAttr.Credential, err = obj.getCredential(); err != nil {
-			return false, errwrap.Wrapf(err, "error while setting credential")
+	if obj.IfCmd != "" { // if there is no onlyif check, we should just run
+		success, err := obj.guardCmd("ifcmd", obj.IfCmd, obj.IfCwd, obj.IfShell)
+		if err != nil {
+			return false, err
 		}
-
-		var out splitWriter
-		out.Init()
-		cmd.Stdout = out.Stdout
-		cmd.Stderr = out.Stderr
-
-		if err := cmd.Run(); err != nil {
-			exitErr, ok := err.(*exec.ExitError) // embeds an os.ProcessState
-			if !ok {
-				// command failed in some bad way
-				return false, errwrap.Wrapf(err, "ifcmd failed in some bad way")
-			}
-			pStateSys := exitErr.Sys() // (*os.ProcessState) Sys
-			wStatus, ok := pStateSys.(syscall.WaitStatus)
-			if !ok {
-				return false, errwrap.Wrapf(err, "could not get exit status of ifcmd")
-			}
-			exitStatus := wStatus.ExitStatus()
-			if exitStatus == 0 {
-				// i'm not sure if this could happen
-				return false, errwrap.Wrapf(err, "unexpected ifcmd exit status of zero")
-			}
-
-			obj.init.Logf("ifcmd exited with: %d", exitStatus)
-			if s := out.String(); s == "" {
-				obj.init.Logf("ifcmd output is empty!")
-			} else {
-				obj.init.Logf("ifcmd output is:")
-				obj.init.Logf(s)
-			}
+		if !success {
 			return true, nil // don't run
 		}
-		if s := out.String(); s == "" {
-			obj.init.Logf("ifcmd output is empty!")
-		} else {
-			obj.init.Logf("ifcmd output is:")
-			obj.init.Logf(s)
+	}
+
+	if obj.UnlessCmd != "" {
+		success, err := obj.guardCmd("unlesscmd", obj.UnlessCmd, obj.UnlessCwd, obj.UnlessShell)
+		if err != nil {
+			return false, err
+		}
+		if success {
+			return true, nil // don't run
 		}
 	}
 
@@ -406,6 +478,32 @@ func (obj *ExecRes) CheckApply(apply bool) (bool, error) {
 	}
 
 	var out splitWriter
+	tees := []io.Writer{}
+	var logWriter *lineLogWriter
+	var outFile *os.File
+	if obj.LogLimit > 0 { // stream the output as it arrives
+		logWriter = &lineLogWriter{
+			Logf:  obj.init.Logf,
+			Limit: obj.LogLimit,
+		}
+		tees = append(tees, logWriter)
+	}
+	if obj.SaveOutput {
+		dir, err := obj.init.VarDir("")
+		if err != nil {
+			return false, errwrap.Wrapf(err, "could not get VarDir")
+		}
+		f, err := os.Create(path.Join(dir, execOutputFile))
+		if err != nil {
+			return false, errwrap.Wrapf(err, "could not create output file")
+		}
+		defer f.Close() // also closed below, this is for the early returns
+		outFile = f
+		tees = append(tees, f)
+	}
+	if len(tees) > 0 {
+		out.Tee = io.MultiWriter(tees...)
+	}
 	out.Init()
 	// from the docs: "If Stdout and Stderr are the same writer, at most one
 	// goroutine at a time will call Write." so we trick it here!
@@ -429,12 +527,28 @@ func (obj *ExecRes) CheckApply(apply bool) (bool, error) {
 
 	err = cmd.Wait() // we can unblock this with the timeout
 
+	if logWriter != nil {
+		logWriter.Flush() // log any remaining partial line
+	}
+	if out.Err != nil { // the tee failed, this is probably the output file
+		return false, errwrap.Wrapf(out.Err, "could not store the cmd output")
+	}
+	if outFile != nil {
+		if err := outFile.Close(); err != nil {
+			return false, errwrap.Wrapf(err, "could not close the output file")
+		}
+	}
+
 	// save in memory for send/recv
 	// we use pointers to strings to indicate if used or not
 	if out.Stdout.Activity || out.Stderr.Activity {
 		str := out.String()
 		obj.output = &str
 	}
+	if obj.TailLines > 0 {
+		str := tailLines(out.String(), obj.TailLines)
+		obj.tail = &str
+	}
 	if out.Stdout.Activity {
 		str := out.Stdout.String()
 		obj.stdout = &str
@@ -445,6 +559,7 @@ func (obj *ExecRes) CheckApply(apply bool) (bool, error) {
 	}
 
 	// process the err result from cmd, we process non-zero exits here too!
+	exitStatus := 0
 	exitErr, ok := err.(*exec.ExitError) // embeds an os.ProcessState
 	if err != nil && ok {
 		pStateSys := exitErr.Sys() // (*os.ProcessState) Sys
@@ -452,41 +567,64 @@ func (obj *ExecRes) CheckApply(apply bool) (bool, error) {
 		if !ok {
 			return false, errwrap.Wrapf(err, "error running cmd")
 		}
-		exitStatus := wStatus.ExitStatus()
-		if !wStatus.Signaled() { // not a timeout or cancel (no signal)
-			return false, errwrap.Wrapf(err, "cmd error, exit status: %d", exitStatus)
-		}
-		sig := wStatus.Signal()
+		exitStatus = wStatus.ExitStatus()
+		if wStatus.Signaled() { // a timeout or cancel (signal)
+			sig := wStatus.Signal()
 
-		// we get this on timeout, because ctx calls cmd.Process.Kill()
-		if sig == syscall.SIGKILL {
-			return false, errwrap.Wrapf(err, "cmd timeout, exit status: %d", exitStatus)
-		}
+			// we get this on timeout, because ctx calls cmd.Process.Kill()
+			if sig == syscall.SIGKILL {
+				return false, errwrap.Wrapf(err, "cmd timeout, exit status: %d", exitStatus)
+			}
 
-		return false, errwrap.Wrapf(err, "unknown cmd error, signal: %s, exit status: %d", sig, exitStatus)
+			return false, errwrap.Wrapf(err, "unknown cmd error, signal: %s, exit status: %d", sig, exitStatus)
+		}
+		// a non-zero exit is checked against the exit codes below
 
 	} else if err != nil {
 		return false, errwrap.Wrapf(err, "general cmd error")
 	}
+	code := int64(exitStatus)
+	obj.exitCode = &code
+
+	unchanged := false
+	for _, code := range obj.UnchangedExitCodes {
+		if exitStatus == code {
+			unchanged = true
+			break
+		}
+	}
+	if !unchanged && !obj.isSuccessExitCode(exitStatus) {
+		if s := out.String(); s != "" && logWriter == nil {
+			obj.init.Logf("command output is:")
+			obj.init.Logf(s)
+		}
+		return false, fmt.Errorf("cmd error, exit status: %d", exitStatus)
+	}
 
-	// TODO: if we printed the stdout while the command is running, this
-	// would be nice, but it would require terminal log output that doesn't
-	// interleave all the parallel parts which would mix it all up...
+	// If we streamed the output while the command was running, then we
+	// don't log it all again here.
 	if s := out.String(); s == "" {
 		obj.init.Logf("command output is empty!")
-	} else {
+	} else if logWriter == nil {
 		obj.init.Logf("command output is:")
 		obj.init.Logf(s)
 	}
 
 	if err := obj.init.Send(&ExecSends{
-		Output: obj.output,
-		Stdout: obj.stdout,
-		Stderr: obj.stderr,
+		Output:   obj.output,
+		Stdout:   obj.stdout,
+		Stderr:   obj.stderr,
+		Tail:     obj.tail,
+		ExitCode: obj.exitCode,
 	}); err != nil {
 		return false, err
 	}
 
+	if unchanged {
+		obj.init.Logf("cmd exited with unchanged status: %d", exitStatus)
+		return true, nil // success, but nothing was changed
+	}
+
 	// The state tracking is for exec resources that can't "detect" their
 	// state, and assume it's invalid when the Watch() function triggers.
 	// If we apply state successfully, we should reset it here so that we
@@ -544,6 +682,47 @@ func (obj *ExecRes) Cmp(r engine.Res) error {
 		return fmt.Errorf("the IfShell differs")
 	}
 
+	if obj.UnlessCmd != res.UnlessCmd {
+		return fmt.Errorf("the UnlessCmd differs")
+	}
+	if obj.UnlessCwd != res.UnlessCwd {
+		return fmt.Errorf("the UnlessCwd differs")
+	}
+	if obj.UnlessShell != res.UnlessShell {
+		return fmt.Errorf("the UnlessShell differs")
+	}
+
+	if obj.Creates != res.Creates {
+		return fmt.Errorf("the Creates differs")
+	}
+
+	if obj.LogLimit != res.LogLimit {
+		return fmt.Errorf("the LogLimit differs")
+	}
+	if obj.SaveOutput != res.SaveOutput {
+		return fmt.Errorf("the SaveOutput differs")
+	}
+	if obj.TailLines != res.TailLines {
+		return fmt.Errorf("the TailLines differs")
+	}
+
+	if len(obj.SuccessExitCodes) != len(res.SuccessExitCodes) {
+		return fmt.Errorf("the SuccessExitCodes differ")
+	}
+	for i, x := range obj.SuccessExitCodes {
+		if x != res.SuccessExitCodes[i] {
+			return fmt.Errorf("the SuccessExitCodes differ at index: %d", i)
+		}
+	}
+	if len(obj.UnchangedExitCodes) != len(res.UnchangedExitCodes) {
+		return fmt.Errorf("the UnchangedExitCodes differ")
+	}
+	for i, x := range obj.UnchangedExitCodes {
+		if x != res.UnchangedExitCodes[i] {
+			return fmt.Errorf("the UnchangedExitCodes differ at index: %d", i)
+		}
+	}
+
 	if obj.User != res.User {
 		return fmt.Errorf("the User differs")
 	}
@@ -666,14 +845,20 @@ type ExecSends struct {
 	Stdout *string `lang:"stdout"`
 	// Stderr is the stderr of the command.
 	Stderr *string `lang:"stderr"`
+	// Tail is the last TailLines lines of the combined command output.
+	Tail *string `lang:"tail"`
+	// ExitCode is the exit code of the command.
+	ExitCode *int64 `lang:"exitcode"`
 }
 
 // Sends represents the default struct of values we can send using Send/Recv.
 func (obj *ExecRes) Sends() interface{} {
 	return &ExecSends{
-		Output: nil,
-		Stdout: nil,
-		Stderr: nil,
+		Output:   nil,
+		Stdout:   nil,
+		Stderr:   nil,
+		Tail:     nil,
+		ExitCode: nil,
 	}
 }
 
@@ -700,32 +885,7 @@ func (obj *ExecRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
 // getCredential returns the correct *syscall.Credential if an User and Group
 // are set.
 func (obj *ExecRes) getCredential() (*syscall.Credential, error) {
-	var uid, gid int
-	var err error
-	var currentUser *user.User
-	if currentUser, err = user.Current(); err != nil {
-		return nil, errwrap.Wrapf(err, "error looking up current user")
-	}
-	if currentUser.Uid != "0" {
-		// since we're not root, we've got nothing to do
-		return nil, nil
-	}
-
-	if obj.Group != "" {
-		gid, err = engineUtil.GetGID(obj.Group)
-		if err != nil {
-			return nil, errwrap.Wrapf(err, "error looking up gid for %s", obj.Group)
-		}
-	}
-
-	if obj.User != "" {
-		uid, err = engineUtil.GetUID(obj.User)
-		if err != nil {
-			return nil, errwrap.Wrapf(err, "error looking up uid for %s", obj.User)
-		}
-	}
-
-	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+	return userCredential(obj.User, obj.Group)
 }
 
 // cmdFiles returns all the potential files/commands this command might need.
@@ -746,9 +906,99 @@ func (obj *ExecRes) cmdFiles() []string {
 	} else if ifSplit := strings.Fields(obj.IfCmd); len(ifSplit) > 0 {
 		paths = append(paths, ifSplit[0])
 	}
+	if obj.UnlessShell != "" {
+		paths = append(paths, obj.UnlessShell)
+	} else if unlessSplit := strings.Fields(obj.UnlessCmd); len(unlessSplit) > 0 {
+		paths = append(paths, unlessSplit[0])
+	}
 	return paths
 }
 
+// isSuccessExitCode returns true if the exit code of the Cmd is a success.
+func (obj *ExecRes) isSuccessExitCode(code int) bool {
+	if len(obj.SuccessExitCodes) == 0 {
+		return code == 0
+	}
+	for _, x := range obj.SuccessExitCodes {
+		if code == x {
+			return true
+		}
+	}
+	return false
+}
+
+// guardCmd runs one of the guard commands, such as the IfCmd, and returns true
+// if it exited successfully, and false if it had a non-zero exit. Any other
+// failure is returned as an error. The name is used for logging.
+func (obj *ExecRes) guardCmd(name, command, cwd, shell string) (bool, error) {
+	var cmdName string
+	var cmdArgs []string
+	if shell == "" {
+		// call without a shell
+		// FIXME: are there still whitespace splitting issues?
+		split := strings.Fields(command)
+		cmdName = split[0]
+		//d, _ := os.Getwd() // TODO: how does this ever error ?
+		//cmdName = path.Join(d, cmdName)
+		cmdArgs = split[1:]
+	} else {
+		cmdName = shell // usually bash, or sh
+		cmdArgs = []string{"-c", command}
+	}
+	cmd := exec.Command(cmdName, cmdArgs...)
+	cmd.Dir = cwd // run program in pwd if ""
+	// ignore signals sent to parent process (we're in our own group)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+		Pgid:    0,
+	}
+
+	// if we have an user and group, use them
+	var err error
+	if cmd.SysProcAttr.Credential, err = obj.getCredential(); err != nil {
+		return false, errwrap.Wrapf(err, "error while setting credential")
+	}
+
+	var out splitWriter
+	out.Init()
+	cmd.Stdout = out.Stdout
+	cmd.Stderr = out.Stderr
+
+	if err := cmd.Run(); err != nil {
+		exitErr, ok := err.(*exec.ExitError) // embeds an os.ProcessState
+		if !ok {
+			// command failed in some bad way
+			return false, errwrap.Wrapf(err, "%s failed in some bad way", name)
+		}
+		pStateSys := exitErr.Sys() // (*os.ProcessState) Sys
+		wStatus, ok := pStateSys.(syscall.WaitStatus)
+		if !ok {
+			return false, errwrap.Wrapf(err, "could not get exit status of %s", name)
+		}
+		exitStatus := wStatus.ExitStatus()
+		if exitStatus == 0 {
+			// i'm not sure if this could happen
+			return false, errwrap.Wrapf(err, "unexpected %s exit status of zero", name)
+		}
+
+		obj.init.Logf("%s exited with: %d", name, exitStatus)
+		if s := out.String(); s == "" {
+			obj.init.Logf("%s output is empty!", name)
+		} else {
+			obj.init.Logf("%s output is:", name)
+			obj.init.Logf(s)
+		}
+		return false, nil
+	}
+	if s := out.String(); s == "" {
+		obj.init.Logf("%s output is empty!", name)
+	} else {
+		obj.init.Logf("%s output is:", name)
+		obj.init.Logf(s)
+	}
+	return true, nil
+}
+
 // cmdOutput is the output struct of the cmdOutputRunner channel output. You
 // should always check the error first. If it's nil, then you can assume the
 // text data is good to use.
@@ -809,6 +1059,13 @@ type splitWriter struct {
 	Stdout *wrapWriter
 	Stderr *wrapWriter
 
+	// Tee is an optional writer which also receives the combined output. It
+	// must be set before Init is called.
+	Tee io.Writer
+	// Err is the first error returned by the Tee, if any. Writes to the Tee
+	// stop after an error, but the command output is still buffered.
+	Err error
+
 	stdout      bytes.Buffer // just the stdout
 	stderr      bytes.Buffer // just the stderr
 	output      bytes.Buffer // combined output
@@ -826,11 +1083,13 @@ func (obj *splitWriter) Init() {
 		Mutex:  obj.mutex,
 		Buffer: &obj.stdout,
 		Output: &obj.output,
+		Parent: obj,
 	}
 	obj.Stderr = &wrapWriter{
 		Mutex:  obj.mutex,
 		Buffer: &obj.stderr,
 		Output: &obj.output,
+		Parent: obj,
 	}
 	obj.initialized = true
 }
@@ -848,6 +1107,7 @@ type wrapWriter struct {
 	Mutex    *sync.Mutex
 	Buffer   *bytes.Buffer // stdout or stderr
 	Output   *bytes.Buffer // combined output
+	Parent   *splitWriter  // for the shared tee
 	Activity bool          // did we get any writes?
 }
 
@@ -861,9 +1121,74 @@ func (obj *wrapWriter) Write(p []byte) (int, error) {
 	if err != nil {
 		return i, err
 	}
+	if obj.Parent != nil && obj.Parent.Tee != nil && obj.Parent.Err == nil {
+		// don't fail the command if the tee has trouble
+		_, obj.Parent.Err = obj.Parent.Tee.Write(p)
+	}
 	return obj.Output.Write(p) // shared write
 }
 
+// lineLogWriter is a writer which logs each complete line that it receives. It
+// stops logging once the limit of bytes is reached, so that a very chatty
+// command doesn't flood the logs. It always accepts the entire write.
+type lineLogWriter struct {
+	Logf  func(format string, v ...interface{})
+	Limit int64 // maximum number of bytes to log
+
+	buf       []byte
+	count     int64
+	truncated bool
+}
+
+// Write logs each complete line in the input, and buffers any partial line.
+func (obj *lineLogWriter) Write(p []byte) (int, error) {
+	obj.buf = append(obj.buf, p...)
+	for {
+		i := bytes.IndexByte(obj.buf, '\n')
+		if i < 0 {
+			break
+		}
+		obj.log(string(obj.buf[:i]))
+		obj.buf = obj.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush logs any remaining partial line.
+func (obj *lineLogWriter) Flush() {
+	if len(obj.buf) > 0 {
+		obj.log(string(obj.buf))
+		obj.buf = nil
+	}
+}
+
+// log logs a single line if we're still under the limit.
+func (obj *lineLogWriter) log(line string) {
+	if obj.truncated {
+		return
+	}
+	obj.count += int64(len(line)) + 1 // include the newline
+	if obj.count > obj.Limit {
+		obj.truncated = true
+		obj.Logf("output exceeded the log limit of %d bytes, not logging the rest", obj.Limit)
+		return
+	}
+	obj.Logf("output: %s", line)
+}
+
+// tailLines returns the last n lines of the input. A trailing newline is not
+// counted as an extra empty line.
+func tailLines(s string, n uint64) string {
+	lines := strings.SplitAfter(s, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if uint64(len(lines)) > n {
+		lines = lines[uint64(len(lines))-n:]
+	}
+	return strings.Join(lines, "")
+}
+
 // String returns the contents of the unshared buffer.
 func (obj *wrapWriter) String() string {
 	return obj.Buffer.String()
@@ -885,3 +1210,35 @@ func isNameValid(varName string) error {
 	}
 	return nil
 }
+
+// userCredential returns the correct *syscall.Credential for running a command
+// as this user and group. It returns nil when we're not root, since we couldn't
+// switch to them anyways.
+func userCredential(userName, groupName string) (*syscall.Credential, error) {
+	var uid, gid int
+	var err error
+	var currentUser *user.User
+	if currentUser, err = user.Current(); err != nil {
+		return nil, errwrap.Wrapf(err, "error looking up current user")
+	}
+	if currentUser.Uid != "0" {
+		// since we're not root, we've got nothing to do
+		return nil, nil
+	}
+
+	if groupName != "" {
+		gid, err = engineUtil.GetGID(groupName)
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "error looking up gid for %s", groupName)
+		}
+	}
+
+	if userName != "" {
+		uid, err = engineUtil.GetUID(userName)
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "error looking up uid for %s", userName)
+		}
+	}
+
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
@@ -22,7 +22,11 @@ package resources
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -205,6 +209,191 @@ func TestExecSendRecv3(t *testing.T) {
 	}
 }
 
+func TestExecGuards1(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "mgmt-test-exec-")
+	if err != nil {
+		t.Errorf("could not make tmpdir: %v", err)
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+	creates := path.Join(tmpdir, "creates")
+
+	testCases := []struct {
+		name    string
+		res     *ExecRes
+		checkOK bool // expected result
+		fail    bool // expect an error
+	}{
+		{"plain", &ExecRes{Cmd: "true", Shell: "/bin/bash"}, false, false},
+		{"failure", &ExecRes{Cmd: "exit 3", Shell: "/bin/bash"}, false, true},
+		{"creates missing", &ExecRes{Cmd: "touch " + creates, Shell: "/bin/bash", Creates: creates}, false, false},
+		{"creates exists", &ExecRes{Cmd: "false", Shell: "/bin/bash", Creates: creates}, true, false},
+		{"unless success", &ExecRes{Cmd: "false", Shell: "/bin/bash", UnlessCmd: "true", UnlessShell: "/bin/bash"}, true, false},
+		{"unless failure", &ExecRes{Cmd: "true", Shell: "/bin/bash", UnlessCmd: "false", UnlessShell: "/bin/bash"}, false, false},
+		{"ifcmd and unless", &ExecRes{Cmd: "false", Shell: "/bin/bash", IfCmd: "true", IfShell: "/bin/bash", UnlessCmd: "true", UnlessShell: "/bin/bash"}, true, false},
+		{"success codes", &ExecRes{Cmd: "exit 3", Shell: "/bin/bash", SuccessExitCodes: []int{0, 3}}, false, false},
+		{"success codes failure", &ExecRes{Cmd: "exit 0", Shell: "/bin/bash", SuccessExitCodes: []int{3}}, false, true},
+		{"unchanged codes", &ExecRes{Cmd: "exit 4", Shell: "/bin/bash", UnchangedExitCodes: []int{4}}, true, false},
+	}
+
+	for _, tc := range testCases {
+		if err := tc.res.Validate(); err != nil {
+			t.Errorf("test %s: validate failed with: %v", tc.name, err)
+			continue
+		}
+		init, _ := fakeExecInit(t)
+		if err := tc.res.Init(init); err != nil {
+			t.Errorf("test %s: init failed with: %v", tc.name, err)
+			continue
+		}
+		checkOK, err := tc.res.CheckApply(true)
+		if err := tc.res.Close(); err != nil {
+			t.Errorf("test %s: close failed with: %v", tc.name, err)
+		}
+		if tc.fail {
+			if err == nil {
+				t.Errorf("test %s: expected an error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %s: checkapply failed with: %v", tc.name, err)
+			continue
+		}
+		if checkOK != tc.checkOK {
+			t.Errorf("test %s: expected checkOK of %t, got: %t", tc.name, tc.checkOK, checkOK)
+		}
+	}
+}
+
+func TestExecValidate1(t *testing.T) {
+	testCases := map[string]*ExecRes{
+		"relative creates": {Cmd: "true", Creates: "foo"},
+		"negative code":    {Cmd: "true", SuccessExitCodes: []int{-1}},
+		"overlapping code": {Cmd: "true", SuccessExitCodes: []int{0, 1}, UnchangedExitCodes: []int{1}},
+		"blank cmd":        {Cmd: "  "},
+		"blank watchcmd":   {Cmd: "true", WatchCmd: " \t"},
+		"blank ifcmd":      {Cmd: "true", IfCmd: " "},
+		"blank unlesscmd":  {Cmd: "true", UnlessCmd: "\n"},
+	}
+	for name, res := range testCases {
+		if err := res.Validate(); err == nil {
+			t.Errorf("test %s: expected validate to fail", name)
+		}
+	}
+
+	// a shell can run a blank command, so that's allowed
+	res := &ExecRes{Cmd: "true", IfCmd: " ", IfShell: "/bin/bash"}
+	if err := res.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+	}
+}
+
+func TestExecOutput1(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "mgmt-test-exec-")
+	if err != nil {
+		t.Errorf("could not make tmpdir: %v", err)
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	r1 := &ExecRes{
+		Cmd:                "seq 1 20; echo -n last; exit 2",
+		Shell:              "/bin/bash",
+		UnchangedExitCodes: []int{2},
+		LogLimit:           16,
+		SaveOutput:         true,
+		TailLines:          3,
+	}
+	if err := r1.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	init, execSends := fakeExecInit(t)
+	logged := []string{}
+	init.Logf = func(format string, v ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, v...))
+	}
+	init.VarDir = func(p string) (string, error) {
+		return path.Join(tmpdir, p), nil
+	}
+	if err := r1.Init(init); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	defer r1.Close()
+	if _, err := r1.CheckApply(true); err != nil {
+		t.Errorf("checkapply failed with: %v", err)
+		return
+	}
+
+	// 1..8 are 16 bytes, including the newlines
+	streamed := []string{}
+	for _, x := range logged {
+		if strings.HasPrefix(x, "output: ") {
+			streamed = append(streamed, strings.TrimPrefix(x, "output: "))
+		}
+	}
+	if s := strings.Join(streamed, ","); s != "1,2,3,4,5,6,7,8" {
+		t.Errorf("got wrong streamed output: %s", s)
+	}
+
+	if execSends.Tail == nil {
+		t.Errorf("tail is nil")
+	} else if tail := *execSends.Tail; tail != "19\n20\nlast" {
+		t.Errorf("got wrong tail: %q", tail)
+	}
+	if execSends.ExitCode == nil {
+		t.Errorf("exit code is nil")
+	} else if code := *execSends.ExitCode; code != 2 {
+		t.Errorf("got wrong exit code: %d", code)
+	}
+
+	b, err := ioutil.ReadFile(path.Join(tmpdir, "output"))
+	if err != nil {
+		t.Errorf("could not read output file: %v", err)
+		return
+	}
+	if execSends.Output == nil || string(b) != *execSends.Output {
+		t.Errorf("got wrong saved output: %q", string(b))
+	}
+}
+
+func TestExecOutput2(t *testing.T) {
+	// the defaults log the output once it exits, and don't send a tail
+	r1 := (&ExecRes{}).Default().(*ExecRes)
+	r1.Cmd = "seq 1 3"
+	r1.Shell = "/bin/bash"
+	if err := r1.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	init, execSends := fakeExecInit(t)
+	logged := []string{}
+	init.Logf = func(format string, v ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, v...))
+	}
+	if err := r1.Init(init); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	defer r1.Close()
+	if _, err := r1.CheckApply(true); err != nil {
+		t.Errorf("checkapply failed with: %v", err)
+		return
+	}
+
+	if s := strings.Join(logged, ","); !strings.HasSuffix(s, "command output is:,1\n2\n3\n") {
+		t.Errorf("got wrong logged output: %q", s)
+	}
+	if execSends.Tail != nil {
+		t.Errorf("unexpected tail: %q", *execSends.Tail)
+	}
+	if execSends.Output == nil || *execSends.Output != "1\n2\n3\n" {
+		t.Errorf("got wrong output: %v", execSends.Output)
+	}
+}
+
 func TestExecTimeoutBehaviour(t *testing.T) {
 	// cmd.Process.Kill() is called on timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
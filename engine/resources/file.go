@@ -27,10 +27,12 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"text/template"
 
 	"github.com/purpleidea/mgmt/engine"
 	"github.com/purpleidea/mgmt/engine/traits"
@@ -41,6 +43,8 @@ import (
 	"github.com/purpleidea/mgmt/recwatch"
 	"github.com/purpleidea/mgmt/util"
 	"github.com/purpleidea/mgmt/util/errwrap"
+
+	"golang.org/x/sys/unix"
 )
 
 func init() {
@@ -48,6 +52,8 @@ func init() {
 
 	// const.res.file.state.exists = "exists"
 	// const.res.file.state.absent = "absent"
+	// const.res.file.state.symlink = "symlink"
+	// const.res.file.state.hardlink = "hardlink"
 	vars.RegisterResourceParams(KindFile, map[string]map[string]func() interfaces.Var{
 		ParamFileState: {
 			FileStateExists: func() interfaces.Var {
@@ -60,6 +66,16 @@ func init() {
 					V: FileStateAbsent,
 				}
 			},
+			FileStateSymlink: func() interfaces.Var {
+				return &types.StrValue{
+					V: FileStateSymlink,
+				}
+			},
+			FileStateHardlink: func() interfaces.Var {
+				return &types.StrValue{
+					V: FileStateHardlink,
+				}
+			},
 			// TODO: consider removing this field entirely
 			"undefined": func() interfaces.Var {
 				return &types.StrValue{
@@ -81,10 +97,20 @@ const (
 	// FileStateAbsent is the string that represents that the file should
 	// not exist.
 	FileStateAbsent = "absent"
+	// FileStateSymlink is the string that represents that the file should
+	// be a symbolic link pointing to the Target.
+	FileStateSymlink = "symlink"
+	// FileStateHardlink is the string that represents that the file should
+	// be a hard link to the same inode as the Target.
+	FileStateHardlink = "hardlink"
 	// FileStateUndefined means the file state has not been specified.
 	// TODO: consider moving to *string and express this state as a nil.
 	FileStateUndefined = ""
 
+	// fileXattrSELinux is the name of the xattr which stores the SELinux
+	// security context.
+	fileXattrSELinux = "security.selinux"
+
 	// FileModeAllowAssign specifies whether we only use ugo=rwx style
 	// assignment (false) or if we also allow ugo+-rwx style too (true). I
 	// think that it's possibly illogical to allow imperative mode
@@ -115,9 +141,20 @@ type FileRes struct {
 	// `exists` or `absent`. If you do not specify this, we will not be able
 	// to create or remove a file if it might be logical for another
 	// param to require that. Instead it will error. This means that this
-	// field is not implied by specifying some content or a mode.
+	// field is not implied by specifying some content or a mode. It can
+	// also be `symlink` or `hardlink`, in which case the Target param must
+	// be specified too.
 	State string `lang:"state" yaml:"state"`
 
+	// Target is the path that this file links to when State is either
+	// `symlink` or `hardlink`. A symlink target may be relative, in which
+	// case it is interpreted relative to the directory containing the link,
+	// the same way the kernel does. A hardlink target must be absolute. If
+	// something other than a link already exists at the path, you need to
+	// specify Force to have it replaced. An automatic edge is added from
+	// the file resource which manages the target, if one exists.
+	Target string `lang:"target" yaml:"target"`
+
 	// Content specifies the file contents to use. If this is nil, they are
 	// left undefined. It cannot be combined with the Source or Fragments
 	// parameters.
@@ -151,18 +188,61 @@ type FileRes struct {
 	// isn't recursive in that if a fragment is a directory, this only
 	// searches one level deep at the moment.
 	Fragments []string `lang:"fragments" yaml:"fragments"`
+	// Template specifies the path of a golang text/template file in the
+	// deploy which is rendered to build the file contents. If the path is
+	// relative, it is relative to the directory of the code which defined
+	// this resource, which is the same thing that the deploy readfile
+	// function does. It cannot be combined with the Content, Source or
+	// Fragments parameters. The template is only read and rendered again
+	// when one of the template params changes, or if we're a new deploy.
+	Template string `lang:"template" yaml:"template"`
+	// TemplateVars is the value that the Template is rendered with. It can
+	// be any value, but it is usually a struct or a map, and then a field
+	// can be accessed with `{{ .name }}` inside of the template. Nested
+	// structs, lists, and the other types can be used with the usual
+	// template actions such as `{{ range }}` and `{{ if }}`. Missing keys
+	// are an error.
+	TemplateVars types.Value `lang:"template_vars" yaml:"template_vars"`
 
 	// Owner specifies the file owner. You can specify either the string
-	// name, or a string representation of the owner integer uid.
+	// name, or a string representation of the owner integer uid. If this is
+	// a directory and Recurse is true, then ownership is applied to all of
+	// the contents of the directory as well.
 	Owner string `lang:"owner" yaml:"owner"`
 	// Group specifies the file group. You can specify either the string
-	// name, or a string representation of the group integer gid.
+	// name, or a string representation of the group integer gid. It is
+	// applied recursively in the same way as the Owner is.
 	Group string `lang:"group" yaml:"group"`
 	// Mode is the mode of the file as a string representation of the octal
 	// form or symbolic form.
-	Mode    string `lang:"mode" yaml:"mode"`
-	Recurse bool   `lang:"recurse" yaml:"recurse"`
-	Force   bool   `lang:"force" yaml:"force"`
+	Mode string `lang:"mode" yaml:"mode"`
+
+	// Xattrs is a map of extended attribute names to the values that they
+	// should have. The names must include their namespace, such as `user.`
+	// or `trusted.`. Only the attributes listed here are managed, and any
+	// others present on the file are left alone. Use the ACL and SELinux
+	// params instead of setting those attributes directly. These are set
+	// recursively if this is a directory and Recurse is true.
+	Xattrs map[string]string `lang:"xattrs" yaml:"xattrs"`
+	// ACL is the list of POSIX access control list entries for the file in
+	// the textual form that setfacl uses, such as `user:alice:rwx` or
+	// `group:admins:r-x`. Entries prefixed with `default:` are part of the
+	// default ACL, which is only allowed on directories. If the owner,
+	// owning group or other entries are omitted, they are kept from what's
+	// currently there, and a mask is computed if one is needed. Since the
+	// group bits of the mode are the ACL mask, you probably don't want to
+	// also specify a conflicting Mode. These are set recursively if this is
+	// a directory and Recurse is true, with default entries only going onto
+	// the directories.
+	ACL []string `lang:"acl" yaml:"acl"`
+	// SELinux is the security context label for the file, for example:
+	// `system_u:object_r:httpd_sys_content_t:s0`. It is set directly, and
+	// isn't looked up from the system policy. It is set recursively if this
+	// is a directory and Recurse is true.
+	SELinux string `lang:"selinux" yaml:"selinux"`
+
+	Recurse bool `lang:"recurse" yaml:"recurse"`
+	Force   bool `lang:"force" yaml:"force"`
 	// Purge specifies that when true, any unmanaged file in this file
 	// directory will be removed. As a result, this file resource must be a
 	// directory. This isn't particularly meaningful if you don't also set
@@ -170,6 +250,17 @@ type FileRes struct {
 	Purge bool `lang:"purge" yaml:"purge"`
 
 	sha256sum string
+
+	deployFsURI  string  // fs uri of the deploy which built us
+	deployBase   string  // base dir in the deploy for relative paths
+	templateData *string // last rendered template output
+}
+
+// SetDeployFs stores the deploy file system information that the Template is
+// read from. It is part of the DeployFsRes interface.
+func (obj *FileRes) SetDeployFs(uri, base string) {
+	obj.deployFsURI = uri
+	obj.deployBase = base
 }
 
 // getPath returns the actual path to use for this resource. It computes this
@@ -201,6 +292,20 @@ func (obj *FileRes) isDir() bool {
 	return strings.HasSuffix(obj.getPath(), "/") // dirs have trailing slashes
 }
 
+// isLink is a helper function to specify whether the path should be a link.
+func (obj *FileRes) isLink() bool {
+	return obj.State == FileStateSymlink || obj.State == FileStateHardlink
+}
+
+// targetPath returns the absolute path of the link target. Relative symlink
+// targets are resolved relative to the directory that contains the link.
+func (obj *FileRes) targetPath() string {
+	if obj.Target == "" || strings.HasPrefix(obj.Target, "/") {
+		return obj.Target
+	}
+	return path.Join(util.Dirname(obj.getPath()), obj.Target)
+}
+
 // mode returns the file permission specified on the graph. It doesn't handle
 // the case where the mode is not specified. The caller should check obj.Mode is
 // not empty.
@@ -249,19 +354,53 @@ func (obj *FileRes) Validate() error {
 		return fmt.Errorf("resultant path must be absolute")
 	}
 
-	if obj.State != FileStateExists && obj.State != FileStateAbsent && obj.State != FileStateUndefined {
+	if obj.State != FileStateExists && obj.State != FileStateAbsent && obj.State != FileStateUndefined && !obj.isLink() {
 		return fmt.Errorf("the State is invalid")
 	}
 
+	if obj.isLink() && obj.Target == "" {
+		return fmt.Errorf("the Target must be specified when State is %s", obj.State)
+	}
+	if !obj.isLink() && obj.Target != "" {
+		return fmt.Errorf("the Target can only be specified when State is %s or %s", FileStateSymlink, FileStateHardlink)
+	}
+	if obj.isLink() && obj.isDir() {
+		return fmt.Errorf("a link path must not end with a slash")
+	}
+	if obj.State == FileStateHardlink && !strings.HasPrefix(obj.Target, "/") {
+		return fmt.Errorf("the hardlink Target must be an absolute path")
+	}
+	if obj.State == FileStateHardlink && strings.HasSuffix(obj.Target, "/") {
+		return fmt.Errorf("can't hardlink to a directory")
+	}
+	if obj.isLink() && path.Clean(obj.targetPath()) == path.Clean(obj.getPath()) {
+		return fmt.Errorf("a link can't point to itself")
+	}
+
 	isContent := obj.Content != nil
 	isSrc := obj.Source != ""
 	isFrag := len(obj.Fragments) > 0
 	if (isContent && isSrc) || (isSrc && isFrag) || (isFrag && isContent) {
 		return fmt.Errorf("can only specify one of Content, Source, and Fragments")
 	}
+	isTmpl := obj.Template != ""
+	if isTmpl && (isContent || isSrc || isFrag) {
+		return fmt.Errorf("can't combine Template with Content, Source, or Fragments")
+	}
+	if !isTmpl && obj.TemplateVars != nil {
+		return fmt.Errorf("can't specify TemplateVars without a Template")
+	}
 
-	if obj.State == FileStateAbsent && (isContent || isSrc || isFrag) {
-		return fmt.Errorf("can't specify file Content, Source, or Fragments when State is %s", FileStateAbsent)
+	if obj.State == FileStateAbsent && (isContent || isSrc || isFrag || isTmpl) {
+		return fmt.Errorf("can't specify file Content, Source, Fragments, or Template when State is %s", FileStateAbsent)
+	}
+
+	if obj.isLink() && (isContent || isSrc || isFrag || isTmpl || obj.Recurse || obj.Purge) {
+		return fmt.Errorf("can't specify Content, Source, Fragments, Template, Recurse or Purge when State is %s", obj.State)
+	}
+	// The mode of a symlink is meaningless, and chmod would follow it.
+	if obj.State == FileStateSymlink && obj.Mode != "" {
+		return fmt.Errorf("can't specify Mode when State is %s", FileStateSymlink)
 	}
 
 	// The path and Source must either both be dirs or both not be.
@@ -270,8 +409,8 @@ func (obj *FileRes) Validate() error {
 		return fmt.Errorf("the path and Source must either both be dirs or both not be")
 	}
 
-	if obj.isDir() && (isContent || isFrag) { // makes no sense
-		return fmt.Errorf("can't specify Content or Fragments when creating a Dir")
+	if obj.isDir() && (isContent || isFrag || isTmpl) { // makes no sense
+		return fmt.Errorf("can't specify Content, Fragments, or Template when creating a Dir")
 	}
 
 	// TODO: is this really a requirement that we want to enforce?
@@ -294,8 +433,8 @@ func (obj *FileRes) Validate() error {
 		}
 	}
 
-	if obj.Purge && (isContent || isFrag) {
-		return fmt.Errorf("can't combine Purge with Content or Fragments")
+	if obj.Purge && (isContent || isFrag || isTmpl) {
+		return fmt.Errorf("can't combine Purge with Content, Fragments, or Template")
 	}
 	// XXX: should this work with obj.Purge && obj.Source != "" or not?
 	//if obj.Purge && obj.Source != "" {
@@ -337,6 +476,28 @@ func (obj *FileRes) Validate() error {
 		}
 	}
 
+	for name := range obj.Xattrs {
+		if !strings.Contains(name, ".") || strings.HasPrefix(name, ".") {
+			return fmt.Errorf("the xattr `%s` must include a namespace", name)
+		}
+		if name == engineUtil.ACLXattrAccess || name == engineUtil.ACLXattrDefault || name == fileXattrSELinux {
+			return fmt.Errorf("the xattr `%s` must be set with its own param", name)
+		}
+	}
+	_, def, err := engineUtil.ParseACL(obj.ACL)
+	if err != nil {
+		return errwrap.Wrapf(err, "the ACL is invalid")
+	}
+	if len(def) > 0 && !obj.isDir() {
+		return fmt.Errorf("a default ACL can only be specified on a directory")
+	}
+	if obj.State == FileStateSymlink && (len(obj.Xattrs) > 0 || len(obj.ACL) > 0) {
+		return fmt.Errorf("can't specify Xattrs or ACL when State is %s", FileStateSymlink)
+	}
+	if obj.State == FileStateAbsent && (len(obj.Xattrs) > 0 || len(obj.ACL) > 0 || obj.SELinux != "") {
+		return fmt.Errorf("can't specify Xattrs, ACL or SELinux when State is %s", FileStateAbsent)
+	}
+
 	return nil
 }
 
@@ -345,6 +506,7 @@ func (obj *FileRes) Init(init *engine.Init) error {
 	obj.init = init // save for later
 
 	obj.sha256sum = ""
+	obj.templateData = nil
 
 	return nil
 }
@@ -419,7 +581,13 @@ func (obj *FileRes) Watch() error {
 			}
 		}()
 	}
-	for _, frag := range obj.Fragments {
+	inputs := []string{}
+	inputs = append(inputs, obj.Fragments...)
+	if obj.State == FileStateHardlink {
+		// if the target gets replaced, our link points at a stale inode
+		inputs = append(inputs, obj.Target)
+	}
+	for _, frag := range inputs {
 		// This block is virtually identical to the above one.
 		recurse := false // TODO: is it okay for depth==1 dirs?
 		//recurse := strings.HasSuffix(frag, "/") // isDir
@@ -896,7 +1064,12 @@ func (obj *FileRes) stateCheckApply(apply bool) (bool, error) {
 		return true, nil
 	}
 
-	_, err := os.Stat(obj.getPath())
+	if obj.isLink() {
+		return obj.linkCheckApply(apply)
+	}
+
+	// Lstat so that a dangling symlink is still seen as something to remove.
+	_, err := os.Lstat(obj.getPath())
 
 	if err != nil && !os.IsNotExist(err) {
 		return false, errwrap.Wrapf(err, "could not stat file")
@@ -940,7 +1113,7 @@ func (obj *FileRes) stateCheckApply(apply bool) (bool, error) {
 	// Optimization: we shouldn't even look at obj.Content here, but we can
 	// skip this empty file creation here since we know we're going to be
 	// making it there anyways. This way we save the extra fopen noise.
-	if obj.Content != nil || len(obj.Fragments) > 0 {
+	if obj.Content != nil || len(obj.Fragments) > 0 || obj.Template != "" {
 		return false, nil // pretend we actually made it
 	}
 
@@ -959,6 +1132,91 @@ func (obj *FileRes) stateCheckApply(apply bool) (bool, error) {
 	return false, nil // defer the Content != nil work to later...
 }
 
+// linkCheckApply is the CheckApply operation for a symlink or a hardlink. It
+// replaces a link pointing to the wrong place, but requires Force to replace
+// anything else that might be at the path.
+func (obj *FileRes) linkCheckApply(apply bool) (bool, error) {
+	p := obj.getPath()
+	fileInfo, err := os.Lstat(p)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errwrap.Wrapf(err, "could not lstat file")
+	}
+	exists := err == nil
+
+	isSymlink := exists && fileInfo.Mode()&os.ModeSymlink != 0
+
+	if obj.State == FileStateSymlink && isSymlink {
+		target, err := os.Readlink(p)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "could not read symlink")
+		}
+		if target == obj.Target {
+			return true, nil
+		}
+	}
+
+	if obj.State == FileStateHardlink {
+		targetInfo, err := os.Lstat(obj.Target)
+		if err != nil { // we can't hardlink to something that's missing
+			return false, errwrap.Wrapf(err, "could not lstat hardlink target")
+		}
+		if targetInfo.IsDir() {
+			return false, fmt.Errorf("can't hardlink to a directory: %s", obj.Target)
+		}
+		if exists && os.SameFile(fileInfo, targetInfo) {
+			return true, nil
+		}
+	}
+
+	// Something is at the path, and it's not the link we want. We can
+	// always replace a symlink, but anything else needs to be forced.
+	if exists && !isSymlink && !obj.Force {
+		if fileInfo.IsDir() {
+			return false, fmt.Errorf("can't force dir into link: %s", p)
+		}
+		return false, fmt.Errorf("can't force file into link: %s", p)
+	}
+
+	// state is not okay, no work done, exit, but without error
+	if !apply {
+		return false, nil
+	}
+
+	if exists && fileInfo.IsDir() {
+		cleanDst := path.Clean(p)
+		if cleanDst == "" || cleanDst == "/" {
+			return false, fmt.Errorf("don't want to remove root") // safety
+		}
+		obj.init.Logf("linkCheckApply: removing (force): %s", cleanDst)
+		if err := os.RemoveAll(cleanDst); err != nil { // dangerous ;)
+			return false, err
+		}
+	}
+
+	// Build the link next to the destination and rename it into place, so
+	// that an existing file or link is atomically replaced.
+	tmp := path.Join(util.Dirname(p), "."+util.Basename(p)+".tmp")
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) { // stale
+		return false, err
+	}
+	if obj.State == FileStateSymlink {
+		obj.init.Logf("linkCheckApply: symlink: %s -> %s", p, obj.Target)
+		err = os.Symlink(obj.Target, tmp)
+	} else {
+		obj.init.Logf("linkCheckApply: hardlink: %s -> %s", p, obj.Target)
+		err = os.Link(obj.Target, tmp)
+	}
+	if err != nil {
+		return false, errwrap.Wrapf(err, "could not create link")
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp) // cleanup
+		return false, errwrap.Wrapf(err, "could not rename link into place")
+	}
+
+	return false, nil
+}
+
 // contentCheckApply performs a CheckApply for the file content.
 func (obj *FileRes) contentCheckApply(apply bool) (bool, error) {
 	obj.init.Logf("contentCheckApply(%t)", apply)
@@ -982,6 +1240,112 @@ func (obj *FileRes) contentCheckApply(apply bool) (bool, error) {
 	return checkOK, nil // success
 }
 
+// templatePath returns the path of the Template in the deploy file system.
+func (obj *FileRes) templatePath() string {
+	if strings.HasPrefix(obj.Template, "/") {
+		return obj.Template
+	}
+	return path.Join(obj.deployBase, obj.Template) // relative to the code
+}
+
+// templateValue converts a value into the golang data that a template is
+// rendered with. Structs and maps are converted to a map[string]interface{} so
+// that their fields can be accessed by their lowercase mcl names, and so that
+// nested values are converted too. Map keys which aren't strings are keyed by
+// their string representation.
+func templateValue(v types.Value) interface{} {
+	switch x := v.(type) {
+	case *types.StructValue:
+		m := make(map[string]interface{})
+		for k, val := range x.V {
+			m[k] = templateValue(val)
+		}
+		return m
+
+	case *types.MapValue:
+		m := make(map[string]interface{})
+		for k, val := range x.V {
+			key := k.String()
+			if s, ok := k.(*types.StrValue); ok {
+				key = s.V
+			}
+			m[key] = templateValue(val)
+		}
+		return m
+
+	case *types.ListValue:
+		l := []interface{}{}
+		for _, val := range x.V {
+			l = append(l, templateValue(val))
+		}
+		return l
+
+	default:
+		return v.Value()
+	}
+}
+
+// renderTemplate reads the template from the file system and renders it with
+// the template vars.
+func renderTemplate(fs engine.Fs, p string, vars types.Value) (string, error) {
+	b, err := fs.ReadFile(p)
+	if err != nil {
+		return "", errwrap.Wrapf(err, "can't read template `%s`", p)
+	}
+	tmpl, err := template.New(p).Option("missingkey=error").Parse(string(b))
+	if err != nil {
+		return "", errwrap.Wrapf(err, "can't parse template `%s`", p)
+	}
+	var data interface{} = make(map[string]interface{}) // so that missing keys error
+	if vars != nil {
+		data = templateValue(vars)
+	}
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, data); err != nil {
+		return "", errwrap.Wrapf(err, "can't render template `%s`", p)
+	}
+	return buf.String(), nil
+}
+
+// templateCheckApply performs a CheckApply for the file template.
+func (obj *FileRes) templateCheckApply(apply bool) (bool, error) {
+	obj.init.Logf("templateCheckApply(%t)", apply)
+
+	// template is not defined, leave it alone...
+	if obj.Template == "" {
+		return true, nil
+	}
+
+	if obj.templateData == nil { // only render when something changed
+		if obj.deployFsURI == "" {
+			return false, fmt.Errorf("no deploy file system to read the template from")
+		}
+		fs, err := obj.init.World.Fs(obj.deployFsURI) // open the remote file system
+		if err != nil {
+			return false, errwrap.Wrapf(err, "can't load template from file system `%s`", obj.deployFsURI)
+		}
+		data, err := renderTemplate(fs, obj.templatePath(), obj.TemplateVars)
+		if err != nil {
+			return false, err
+		}
+		obj.templateData = &data
+		obj.sha256sum = "" // invalidate!!
+	}
+
+	// Actually write the file. This is similar to contentCheckApply.
+	bufferSrc := bytes.NewReader([]byte(*obj.templateData))
+	sha256sum, checkOK, err := obj.fileCheckApply(apply, bufferSrc, obj.getPath(), obj.sha256sum)
+	if sha256sum != "" { // empty values mean errored or didn't hash
+		// this can be valid even when the whole function errors
+		obj.sha256sum = sha256sum // cache value
+	}
+	if err != nil {
+		return false, err
+	}
+	// if no err, but !ok, then...
+	return checkOK, nil // success
+}
+
 // sourceCheckApply performs a CheckApply for the file source.
 func (obj *FileRes) sourceCheckApply(apply bool) (bool, error) {
 	obj.init.Logf("sourceCheckApply(%t)", apply)
@@ -1106,7 +1470,18 @@ func (obj *FileRes) chownCheckApply(apply bool) (bool, error) {
 		return true, nil
 	}
 
-	fileInfo, err := os.Stat(obj.getPath())
+	if obj.isDir() && obj.Recurse {
+		return obj.chownRecurseCheckApply(apply)
+	}
+
+	stat := os.Stat
+	chown := os.Chown
+	if obj.State == FileStateSymlink { // don't follow the link
+		stat = os.Lstat
+		chown = os.Lchown
+	}
+
+	fileInfo, err := stat(obj.getPath())
 	// TODO: is this a sane behaviour that we want to preserve?
 	// If the file does not exist and we are in noop mode, do not throw an
 	// error.
@@ -1154,7 +1529,55 @@ func (obj *FileRes) chownCheckApply(apply bool) (bool, error) {
 		return false, nil
 	}
 
-	return false, os.Chown(obj.getPath(), expectedUID, expectedGID)
+	return false, chown(obj.getPath(), expectedUID, expectedGID)
+}
+
+// chownRecurseCheckApply performs a CheckApply for the ownership of a directory
+// and everything inside of it. Symlinks found inside are changed themselves and
+// are never followed.
+func (obj *FileRes) chownRecurseCheckApply(apply bool) (bool, error) {
+	expectedUID, expectedGID := -1, -1 // -1 means leave it alone
+	var err error
+	if obj.Owner != "" {
+		if expectedUID, err = engineUtil.GetUID(obj.Owner); err != nil {
+			return false, err
+		}
+	}
+	if obj.Group != "" {
+		if expectedGID, err = engineUtil.GetGID(obj.Group); err != nil {
+			return false, err
+		}
+	}
+
+	checkOK := true
+	errDone := fmt.Errorf("done") // sentinel to stop walking early
+	fn := func(p string, fileInfo os.FileInfo, err error) error {
+		if err != nil { // if the dir does not exist, it's correct to error!
+			return err
+		}
+		stUnix, ok := fileInfo.Sys().(*syscall.Stat_t)
+		if !ok { // this check is done in Validate, but it's done here again...
+			return fmt.Errorf("can't set Owner or Group on this platform")
+		}
+		uidOK := expectedUID == -1 || int(stUnix.Uid) == expectedUID
+		gidOK := expectedGID == -1 || int(stUnix.Gid) == expectedGID
+		if uidOK && gidOK {
+			return nil
+		}
+		checkOK = false
+		if !apply {
+			return errDone // stop walking, we know the answer
+		}
+		if obj.init.Debug {
+			obj.init.Logf("chownRecurseCheckApply: chown: %s", p)
+		}
+		return os.Lchown(p, expectedUID, expectedGID)
+	}
+	if err := filepath.Walk(obj.getPath(), fn); err != nil && err != errDone {
+		return false, err
+	}
+
+	return checkOK, nil
 }
 
 // chmodCheckApply performs a CheckApply for the file permissions.
@@ -1189,6 +1612,212 @@ func (obj *FileRes) chmodCheckApply(apply bool) (bool, error) {
 	return false, os.Chmod(obj.getPath(), mode)
 }
 
+// walkCheckApply runs the per file CheckApply function on the path, or on the
+// path and everything inside of it if this is a directory and Recurse is true.
+// Symlinks are passed in, but are never followed.
+func (obj *FileRes) walkCheckApply(apply bool, fn func(apply bool, p string, fileInfo os.FileInfo) (bool, error)) (bool, error) {
+	if !obj.isDir() || !obj.Recurse {
+		fileInfo, err := os.Lstat(obj.getPath())
+		if err != nil { // if the file does not exist, it's correct to error!
+			return false, err
+		}
+		return fn(apply, obj.getPath(), fileInfo)
+	}
+
+	checkOK := true
+	errDone := fmt.Errorf("done") // sentinel to stop walking early
+	walkFn := func(p string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		c, err := fn(apply, p, fileInfo)
+		if err != nil {
+			return err
+		}
+		if !c {
+			checkOK = false
+			if !apply {
+				return errDone // stop walking, we know the answer
+			}
+		}
+		return nil
+	}
+	if err := filepath.Walk(obj.getPath(), walkFn); err != nil && err != errDone {
+		return false, err
+	}
+	return checkOK, nil
+}
+
+// getXattr returns the value of the named xattr on the path without following
+// symlinks. A missing attribute returns a nil value and no error.
+func getXattr(p, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(p, name, nil)
+		if err == unix.ENODATA {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		n, err := unix.Lgetxattr(p, name, value)
+		if err == unix.ERANGE { // it grew since we got the size
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return value[:n], nil
+	}
+}
+
+// xattrsCheckApply performs a CheckApply for the file extended attributes.
+func (obj *FileRes) xattrsCheckApply(apply bool) (bool, error) {
+	obj.init.Logf("xattrsCheckApply(%t)", apply)
+
+	if len(obj.Xattrs) == 0 {
+		return true, nil
+	}
+
+	names := []string{}
+	for name := range obj.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names) // deterministic
+
+	return obj.walkCheckApply(apply, func(apply bool, p string, fileInfo os.FileInfo) (bool, error) {
+		if fileInfo.Mode()&os.ModeSymlink != 0 {
+			return true, nil // most namespaces aren't allowed on symlinks
+		}
+		checkOK := true
+		for _, name := range names {
+			value, err := getXattr(p, name)
+			if err != nil {
+				return false, errwrap.Wrapf(err, "could not get xattr `%s` on %s", name, p)
+			}
+			if value != nil && string(value) == obj.Xattrs[name] {
+				continue
+			}
+			checkOK = false
+			if !apply {
+				return false, nil
+			}
+			obj.init.Logf("xattrsCheckApply: set `%s` on %s", name, p)
+			if err := unix.Lsetxattr(p, name, []byte(obj.Xattrs[name]), 0); err != nil {
+				return false, errwrap.Wrapf(err, "could not set xattr `%s` on %s", name, p)
+			}
+		}
+		return checkOK, nil
+	})
+}
+
+// aclCheckApply performs a CheckApply for the POSIX access control lists.
+func (obj *FileRes) aclCheckApply(apply bool) (bool, error) {
+	obj.init.Logf("aclCheckApply(%t)", apply)
+
+	if len(obj.ACL) == 0 {
+		return true, nil
+	}
+
+	access, def, err := engineUtil.ParseACL(obj.ACL)
+	if err != nil {
+		return false, err
+	}
+
+	return obj.walkCheckApply(apply, func(apply bool, p string, fileInfo os.FileInfo) (bool, error) {
+		if fileInfo.Mode()&os.ModeSymlink != 0 {
+			return true, nil // symlinks don't have an acl
+		}
+
+		// The missing base entries come from what is there now. If no acl
+		// is stored, it is exactly what the file mode says it is.
+		value, err := getXattr(p, engineUtil.ACLXattrAccess)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "could not get the acl on %s", p)
+		}
+		current := engineUtil.ACLFromMode(fileInfo.Mode())
+		if value != nil {
+			if current, err = engineUtil.DecodeACL(value); err != nil {
+				return false, errwrap.Wrapf(err, "could not decode the acl on %s", p)
+			}
+		}
+
+		checkOK := true
+		if len(access) > 0 {
+			desired := engineUtil.ACLComplete(access, current)
+			if engineUtil.ACLCmp(desired, current) != nil {
+				checkOK = false
+				if !apply {
+					return false, nil
+				}
+				obj.init.Logf("aclCheckApply: set access acl on %s", p)
+				if err := unix.Setxattr(p, engineUtil.ACLXattrAccess, engineUtil.EncodeACL(desired), 0); err != nil {
+					return false, errwrap.Wrapf(err, "could not set the acl on %s", p)
+				}
+			}
+		}
+
+		if len(def) == 0 || !fileInfo.IsDir() {
+			return checkOK, nil
+		}
+
+		value, err = getXattr(p, engineUtil.ACLXattrDefault)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "could not get the default acl on %s", p)
+		}
+		currentDef := []engineUtil.ACLEntry{}
+		if value != nil {
+			if currentDef, err = engineUtil.DecodeACL(value); err != nil {
+				return false, errwrap.Wrapf(err, "could not decode the default acl on %s", p)
+			}
+		}
+		base := currentDef
+		if len(base) == 0 { // like setfacl, start from the access acl
+			base = current
+		}
+		desired := engineUtil.ACLComplete(def, base)
+		if engineUtil.ACLCmp(desired, currentDef) == nil {
+			return checkOK, nil
+		}
+		if !apply {
+			return false, nil
+		}
+		obj.init.Logf("aclCheckApply: set default acl on %s", p)
+		if err := unix.Setxattr(p, engineUtil.ACLXattrDefault, engineUtil.EncodeACL(desired), 0); err != nil {
+			return false, errwrap.Wrapf(err, "could not set the default acl on %s", p)
+		}
+		return false, nil
+	})
+}
+
+// selinuxCheckApply performs a CheckApply for the SELinux security context.
+func (obj *FileRes) selinuxCheckApply(apply bool) (bool, error) {
+	obj.init.Logf("selinuxCheckApply(%t)", apply)
+
+	if obj.SELinux == "" {
+		return true, nil
+	}
+
+	return obj.walkCheckApply(apply, func(apply bool, p string, fileInfo os.FileInfo) (bool, error) {
+		value, err := getXattr(p, fileXattrSELinux)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "could not get the selinux context on %s", p)
+		}
+		// the stored value is usually null terminated
+		if strings.TrimSuffix(string(value), "\x00") == obj.SELinux {
+			return true, nil
+		}
+		if !apply {
+			return false, nil
+		}
+		obj.init.Logf("selinuxCheckApply: set context on %s", p)
+		if err := unix.Lsetxattr(p, fileXattrSELinux, []byte(obj.SELinux+"\x00"), 0); err != nil {
+			return false, errwrap.Wrapf(err, "could not set the selinux context on %s", p)
+		}
+		return false, nil
+	})
+}
+
 // CheckApply checks the resource state and applies the resource if the bool
 // input is true. It returns error info and if the state check passed or not.
 func (obj *FileRes) CheckApply(apply bool) (bool, error) {
@@ -1203,11 +1832,18 @@ func (obj *FileRes) CheckApply(apply bool) (bool, error) {
 		obj.init.Logf("contentCheckApply: invalidating sha256sum of `Content`")
 		obj.sha256sum = "" // invalidate!!
 	}
+	for _, key := range []string{"Template", "TemplateVars"} {
+		if val, exists := obj.init.Recv()[key]; exists && val.Changed {
+			// if we received new template inputs, render again!
+			obj.init.Logf("templateCheckApply: invalidating rendered `Template`")
+			obj.templateData = nil // invalidate!!
+		}
+	}
 
 	checkOK := true
 
-	// Run stateCheckApply before contentCheckApply, sourceCheckApply, and
-	// fragmentsCheckApply.
+	// Run stateCheckApply before contentCheckApply, sourceCheckApply,
+	// fragmentsCheckApply, and templateCheckApply.
 	if c, err := obj.stateCheckApply(apply); err != nil {
 		return false, err
 	} else if !c {
@@ -1228,6 +1864,11 @@ func (obj *FileRes) CheckApply(apply bool) (bool, error) {
 	} else if !c {
 		checkOK = false
 	}
+	if c, err := obj.templateCheckApply(apply); err != nil {
+		return false, err
+	} else if !c {
+		checkOK = false
+	}
 
 	if c, err := obj.chownCheckApply(apply); err != nil {
 		return false, err
@@ -1240,6 +1881,24 @@ func (obj *FileRes) CheckApply(apply bool) (bool, error) {
 		checkOK = false
 	}
 
+	// Run aclCheckApply after chmodCheckApply, since setting an acl changes
+	// the group bits of the mode to match the acl mask.
+	if c, err := obj.xattrsCheckApply(apply); err != nil {
+		return false, err
+	} else if !c {
+		checkOK = false
+	}
+	if c, err := obj.aclCheckApply(apply); err != nil {
+		return false, err
+	} else if !c {
+		checkOK = false
+	}
+	if c, err := obj.selinuxCheckApply(apply); err != nil {
+		return false, err
+	} else if !c {
+		checkOK = false
+	}
+
 	return checkOK, nil // w00t
 }
 
@@ -1260,6 +1919,9 @@ func (obj *FileRes) Cmp(r engine.Res) error {
 	if obj.State != res.State {
 		return fmt.Errorf("the State differs")
 	}
+	if obj.Target != res.Target {
+		return fmt.Errorf("the Target differs")
+	}
 
 	if (obj.Content == nil) != (res.Content == nil) { // xor
 		return fmt.Errorf("the Content differs")
@@ -1280,6 +1942,21 @@ func (obj *FileRes) Cmp(r engine.Res) error {
 			return fmt.Errorf("the fragment at index %d differs", i)
 		}
 	}
+	if obj.Template != res.Template {
+		return fmt.Errorf("the Template differs")
+	}
+	if (obj.TemplateVars == nil) != (res.TemplateVars == nil) { // xor
+		return fmt.Errorf("the TemplateVars differ")
+	}
+	if obj.TemplateVars != nil {
+		if err := obj.TemplateVars.Cmp(res.TemplateVars); err != nil {
+			return errwrap.Wrapf(err, "the TemplateVars differ")
+		}
+	}
+	// A new deploy might have a different template with the same name.
+	if obj.Template != "" && (obj.deployFsURI != res.deployFsURI || obj.deployBase != res.deployBase) {
+		return fmt.Errorf("the deploy of the Template differs")
+	}
 
 	if obj.Owner != res.Owner {
 		return fmt.Errorf("the Owner differs")
@@ -1293,6 +1970,26 @@ func (obj *FileRes) Cmp(r engine.Res) error {
 		return fmt.Errorf("the Mode differs")
 	}
 
+	if len(obj.Xattrs) != len(res.Xattrs) {
+		return fmt.Errorf("the number of Xattrs differs")
+	}
+	for name, value := range obj.Xattrs {
+		if v, exists := res.Xattrs[name]; !exists || v != value {
+			return fmt.Errorf("the xattr `%s` differs", name)
+		}
+	}
+	if len(obj.ACL) != len(res.ACL) {
+		return fmt.Errorf("the number of ACL entries differs")
+	}
+	for i, x := range obj.ACL {
+		if entry := res.ACL[i]; x != entry {
+			return fmt.Errorf("the ACL entry at index %d differs", i)
+		}
+	}
+	if obj.SELinux != res.SELinux {
+		return fmt.Errorf("the SELinux context differs")
+	}
+
 	if obj.Recurse != res.Recurse {
 		return fmt.Errorf("the Recurse option differs")
 	}
@@ -1398,9 +2095,15 @@ func (obj *FileRes) AutoEdges() (engine.AutoEdge, error) {
 		}) // build list
 	}
 
-	// Ensure any file or dir fragments come first.
+	// Ensure any file or dir fragments come first. The link target, if one
+	// exists, is treated in the same way, since it must exist before us.
+	inputs := []string{}
+	inputs = append(inputs, obj.Fragments...)
+	if obj.isLink() {
+		inputs = append(inputs, obj.targetPath())
+	}
 	frags := []engine.ResUID{}
-	for _, frag := range obj.Fragments {
+	for _, frag := range inputs {
 		var reversed = true // cheat by passing a pointer
 		frags = append(frags, &FileUID{
 			BaseUID: engine.BaseUID{
@@ -1480,20 +2183,44 @@ func (obj *FileRes) Copy() engine.CopyableRes {
 	for _, frag := range obj.Fragments {
 		fragments = append(fragments, frag)
 	}
+	var templateVars types.Value
+	if obj.TemplateVars != nil {
+		templateVars = obj.TemplateVars.Copy()
+	}
+	var xattrs map[string]string
+	if obj.Xattrs != nil {
+		xattrs = make(map[string]string)
+		for name, value := range obj.Xattrs {
+			xattrs[name] = value
+		}
+	}
+	acl := []string{}
+	for _, entry := range obj.ACL {
+		acl = append(acl, entry)
+	}
 	return &FileRes{
-		Path:      obj.Path,
-		Dirname:   obj.Dirname,
-		Basename:  obj.Basename,
-		State:     obj.State, // TODO: if this becomes a pointer, copy the string!
-		Content:   content,
-		Source:    obj.Source,
-		Fragments: fragments,
-		Owner:     obj.Owner,
-		Group:     obj.Group,
-		Mode:      obj.Mode,
-		Recurse:   obj.Recurse,
-		Force:     obj.Force,
-		Purge:     obj.Purge,
+		Path:         obj.Path,
+		Dirname:      obj.Dirname,
+		Basename:     obj.Basename,
+		State:        obj.State, // TODO: if this becomes a pointer, copy the string!
+		Target:       obj.Target,
+		Content:      content,
+		Source:       obj.Source,
+		Fragments:    fragments,
+		Template:     obj.Template,
+		TemplateVars: templateVars,
+		Owner:        obj.Owner,
+		Group:        obj.Group,
+		Mode:         obj.Mode,
+		Xattrs:       xattrs,
+		ACL:          acl,
+		SELinux:      obj.SELinux,
+		Recurse:      obj.Recurse,
+		Force:        obj.Force,
+		Purge:        obj.Purge,
+
+		deployFsURI: obj.deployFsURI,
+		deployBase:  obj.deployBase,
 	}
 }
 
@@ -1531,18 +2258,45 @@ func (obj *FileRes) Reversed() (engine.ReversibleRes, error) {
 	//res.Dirname = obj.Dirname
 	//res.Basename = obj.Basename
 
-	if obj.State == FileStateExists {
+	if obj.State == FileStateExists || obj.isLink() {
 		res.State = FileStateAbsent
+		res.Target = ""
 	}
 	if obj.State == FileStateAbsent {
 		res.State = FileStateExists
 	}
 
+	// If we're removing a symlink, then the reverse is to put it back with
+	// the same target. We don't look through it at the pointed to content.
+	if obj.State == FileStateAbsent {
+		fileInfo, err := os.Lstat(obj.getPath())
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errwrap.Wrapf(err, "could not lstat file for reversal information")
+		}
+		if err == nil && fileInfo.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(obj.getPath())
+			if err != nil {
+				return nil, errwrap.Wrapf(err, "could not read symlink for reversal storage")
+			}
+			res.State = FileStateSymlink
+			res.Target = target
+			res.Content = nil
+			res.Owner = ""
+			res.Group = ""
+			res.Mode = ""
+			res.Xattrs = nil
+			res.ACL = []string{}
+			res.SELinux = ""
+			return res, nil
+		}
+	}
+
 	// If we've specified content, we might need to restore the original, OR
 	// if we're removing the file with a `state => "absent"`, save it too...
-	// We do this whether we specified content with Content or w/ Fragments.
+	// We do this whether we specified content with Content, w/ Fragments,
+	// or with a Template.
 	// The `res.State != FileStateAbsent` check is an optional optimization.
-	if ((obj.Content != nil || len(obj.Fragments) > 0) || obj.State == FileStateAbsent) && res.State != FileStateAbsent {
+	if ((obj.Content != nil || len(obj.Fragments) > 0 || obj.Template != "") || obj.State == FileStateAbsent) && res.State != FileStateAbsent {
 		content, err := ioutil.ReadFile(obj.getPath())
 		if err != nil && !os.IsNotExist(err) {
 			return nil, errwrap.Wrapf(err, "could not read file for reversal storage")
@@ -1568,6 +2322,9 @@ func (obj *FileRes) Reversed() (engine.ReversibleRes, error) {
 	if len(obj.Fragments) > 0 {
 		res.Fragments = []string{}
 	}
+	// Same as with Fragments, the rendered template was sucked in above.
+	res.Template = ""
+	res.TemplateVars = nil
 
 	// There is a race if the operating system is adding/changing/removing
 	// the file between the ioutil.Readfile at the top and here. If there is
@@ -1599,6 +2356,17 @@ func (obj *FileRes) Reversed() (engine.ReversibleRes, error) {
 		}
 	}
 
+	// We can only put back the attributes which were there before, since we
+	// don't have a way to express that an attribute should be removed.
+	res.Xattrs = nil
+	res.ACL = []string{}
+	res.SELinux = ""
+	if err == nil && res.State != FileStateAbsent {
+		if err := obj.reversedAttrs(res); err != nil {
+			return nil, err
+		}
+	}
+
 	// these are already copied in, and we don't need to change them...
 	//res.Recurse = obj.Recurse
 	//res.Force = obj.Force
@@ -1606,6 +2374,72 @@ func (obj *FileRes) Reversed() (engine.ReversibleRes, error) {
 	return res, nil
 }
 
+// reversedAttrs stores the current extended attributes, acl and selinux context
+// of the file into the reversed resource, for any of those which we manage.
+func (obj *FileRes) reversedAttrs(res *FileRes) error {
+	p := obj.getPath()
+	for name := range obj.Xattrs {
+		value, err := getXattr(p, name)
+		if err != nil {
+			return errwrap.Wrapf(err, "could not get xattr for reversal information")
+		}
+		if value == nil {
+			continue
+		}
+		if res.Xattrs == nil {
+			res.Xattrs = make(map[string]string)
+		}
+		res.Xattrs[name] = string(value)
+	}
+
+	if len(obj.ACL) > 0 {
+		fileInfo, err := os.Stat(p)
+		if err != nil {
+			return errwrap.Wrapf(err, "could not stat file for reversal information")
+		}
+		access, def, err := engineUtil.ParseACL(obj.ACL)
+		if err != nil {
+			return err
+		}
+		if len(access) > 0 {
+			value, err := getXattr(p, engineUtil.ACLXattrAccess)
+			if err != nil {
+				return errwrap.Wrapf(err, "could not get acl for reversal information")
+			}
+			current := engineUtil.ACLFromMode(fileInfo.Mode())
+			if value != nil {
+				if current, err = engineUtil.DecodeACL(value); err != nil {
+					return err
+				}
+			}
+			res.ACL = append(res.ACL, engineUtil.ACLStrings(current, false)...)
+		}
+		if len(def) > 0 {
+			value, err := getXattr(p, engineUtil.ACLXattrDefault)
+			if err != nil {
+				return errwrap.Wrapf(err, "could not get default acl for reversal information")
+			}
+			if value != nil {
+				current, err := engineUtil.DecodeACL(value)
+				if err != nil {
+					return err
+				}
+				res.ACL = append(res.ACL, engineUtil.ACLStrings(current, true)...)
+			}
+		}
+	}
+
+	if obj.SELinux != "" {
+		value, err := getXattr(p, fileXattrSELinux)
+		if err != nil {
+			return errwrap.Wrapf(err, "could not get selinux context for reversal information")
+		}
+		res.SELinux = strings.TrimSuffix(string(value), "\x00")
+	}
+
+	return nil
+}
+
 // GraphQueryAllowed returns nil if you're allowed to query the graph. This
 // function accepts information about the requesting resource so we can
 // determine the access with some form of fine-grained control.
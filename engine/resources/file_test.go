@@ -28,7 +28,11 @@ import (
 	"github.com/purpleidea/mgmt/engine"
 	"github.com/purpleidea/mgmt/engine/graph/autoedge"
 	engineUtil "github.com/purpleidea/mgmt/engine/util"
+	"github.com/purpleidea/mgmt/lang/types"
 	"github.com/purpleidea/mgmt/pgraph"
+	"github.com/purpleidea/mgmt/util"
+
+	"github.com/spf13/afero"
 )
 
 func TestFileAutoEdge1(t *testing.T) {
@@ -263,3 +267,180 @@ func TestFileAbsolute1(t *testing.T) {
 		t.Errorf("file res should have failed validate")
 	}
 }
+
+func TestFileLinkValidate1(t *testing.T) {
+	// link states need a target
+	f1 := &FileRes{
+		Path:  "/tmp/a/link",
+		State: FileStateSymlink,
+	}
+	// a target without a link state makes no sense
+	f2 := &FileRes{
+		Path:   "/tmp/a/link",
+		State:  FileStateExists,
+		Target: "/tmp/a/target",
+	}
+	// hardlinks must be absolute
+	f3 := &FileRes{
+		Path:   "/tmp/a/link",
+		State:  FileStateHardlink,
+		Target: "target",
+	}
+	content := "hello\n"
+	f4 := &FileRes{
+		Path:    "/tmp/a/link",
+		State:   FileStateSymlink,
+		Target:  "target",
+		Content: &content,
+	}
+	f5 := &FileRes{
+		Path:   "/tmp/a/link",
+		State:  FileStateSymlink,
+		Target: "link", // itself
+	}
+	for i, f := range []*FileRes{f1, f2, f3, f4, f5} {
+		if f.Validate() == nil {
+			t.Errorf("file res #%d should have failed validate", i+1)
+		}
+	}
+
+	f6 := &FileRes{
+		Path:   "/tmp/a/link",
+		State:  FileStateSymlink,
+		Target: "../b/target",
+	}
+	if err := f6.Validate(); err != nil {
+		t.Errorf("file res should have passed validate: %+v", err)
+	}
+	if p := f6.targetPath(); p != "/tmp/b/target" {
+		t.Errorf("unexpected target path: %s", p)
+	}
+}
+
+func TestFileAutoEdgeLink1(t *testing.T) {
+
+	g, err := pgraph.NewGraph("TestGraph")
+	if err != nil {
+		t.Errorf("error creating graph: %v", err)
+		return
+	}
+
+	r1 := &FileRes{
+		Path:   "/tmp/nginx/sites-enabled/foo",
+		State:  FileStateSymlink,
+		Target: "../sites-available/foo",
+	}
+	r2 := &FileRes{
+		Path: "/tmp/nginx/sites-available/foo", // the link target
+	}
+	g.AddVertex(r1, r2)
+
+	debug := testing.Verbose() // set via the -test.v flag to `go test`
+	logf := func(format string, v ...interface{}) {
+		t.Logf("test: "+format, v...)
+	}
+	// run artificially without the entire engine
+	if err := autoedge.AutoEdge(g, debug, logf); err != nil {
+		t.Errorf("error running autoedges: %v", err)
+	}
+
+	// one edge from the target to the link should have been added
+	if i := g.NumEdges(); i != 1 {
+		t.Errorf("should have 1 edge instead of: %d", i)
+	}
+	if g.FindEdge(r2, r1) == nil {
+		t.Errorf("missing edge from the link target to the link")
+	}
+}
+
+func TestFileTemplate1(t *testing.T) {
+	mmFs := afero.NewMemMapFs()
+	afs := &afero.Afero{Fs: mmFs} // wrap so that we're implementing ioutil
+	fs := &util.Fs{Afero: afs}
+
+	if err := fs.MkdirAll("/deploy/templates/", 0755); err != nil {
+		t.Errorf("can't mkdir: %+v", err)
+		return
+	}
+	tmpl := "server_name {{ .name }};\n{{ range .ports }}listen {{ . }};\n{{ end }}{{ if .ssl.enabled }}ssl_certificate {{ .ssl.cert }};\n{{ end }}"
+	if err := fs.WriteFile("/deploy/templates/nginx.tmpl", []byte(tmpl), 0644); err != nil {
+		t.Errorf("can't write template: %+v", err)
+		return
+	}
+
+	vars := &types.StructValue{
+		T: types.NewType("struct{name str; ports []int; ssl struct{enabled bool; cert str}}"),
+		V: map[string]types.Value{
+			"name": &types.StrValue{V: "example.com"},
+			"ports": &types.ListValue{
+				T: types.NewType("[]int"),
+				V: []types.Value{&types.IntValue{V: 80}, &types.IntValue{V: 443}},
+			},
+			"ssl": &types.StructValue{
+				T: types.NewType("struct{enabled bool; cert str}"),
+				V: map[string]types.Value{
+					"enabled": &types.BoolValue{V: true},
+					"cert":    &types.StrValue{V: "/etc/ssl/example.pem"},
+				},
+			},
+		},
+	}
+	f1 := &FileRes{
+		Path:         "/tmp/nginx.conf",
+		State:        FileStateExists,
+		Template:     "templates/nginx.tmpl", // relative to the code
+		TemplateVars: vars,
+	}
+	if err := f1.Validate(); err != nil {
+		t.Errorf("file res should have passed validate: %+v", err)
+		return
+	}
+	f1.SetDeployFs(fs.URI(), "/deploy/")
+	if p := f1.templatePath(); p != "/deploy/templates/nginx.tmpl" {
+		t.Errorf("unexpected template path: %s", p)
+	}
+
+	out, err := renderTemplate(fs, f1.templatePath(), f1.TemplateVars)
+	if err != nil {
+		t.Errorf("can't render template: %+v", err)
+		return
+	}
+	if exp := "server_name example.com;\nlisten 80;\nlisten 443;\nssl_certificate /etc/ssl/example.pem;\n"; out != exp {
+		t.Errorf("unexpected output: %s", out)
+	}
+
+	// a missing var is an error
+	name := &types.MapValue{
+		T: types.NewType("map{str: str}"),
+		V: map[types.Value]types.Value{&types.StrValue{V: "name"}: &types.StrValue{V: "x"}},
+	}
+	if _, err := renderTemplate(fs, f1.templatePath(), name); err == nil {
+		t.Errorf("expected an error for a missing template var")
+	}
+
+	// a new deploy is a different resource
+	f2 := f1.Copy().(*FileRes)
+	if err := f1.Cmp(f2); err != nil {
+		t.Errorf("copied file res should be the same: %+v", err)
+	}
+	// the copy is deep, and a nested change is noticed
+	f2.TemplateVars.Struct()["ssl"].Struct()["enabled"] = &types.BoolValue{V: false}
+	if err := f1.Cmp(f2); err == nil {
+		t.Errorf("file res with different template vars should differ")
+	}
+	f2.TemplateVars = f1.TemplateVars.Copy()
+	f2.SetDeployFs(fs.URI(), "/deploy2/")
+	if err := f1.Cmp(f2); err == nil {
+		t.Errorf("file res from a different deploy should differ")
+	}
+
+	content := "hello"
+	f3 := &FileRes{
+		Path:     "/tmp/nginx.conf",
+		Template: "templates/nginx.tmpl",
+		Content:  &content,
+	}
+	if f3.Validate() == nil {
+		t.Errorf("file res should have failed validate")
+	}
+}
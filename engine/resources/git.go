@@ -0,0 +1,702 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/recwatch"
+	"github.com/purpleidea/mgmt/util/errwrap"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+func init() {
+	engine.RegisterResource("git", func() engine.Res { return &GitRes{} })
+}
+
+const (
+	// GitStatePresent is the state which clones the repository if it is
+	// missing and checks out the ref, but which never fetches new commits
+	// once the ref can be found locally.
+	GitStatePresent = "present"
+
+	// GitStateLatest is the state which also fetches from the remote and
+	// moves the checkout to the newest commit of the ref.
+	GitStateLatest = "latest"
+
+	// GitStateAbsent is the state which removes the working tree.
+	GitStateAbsent = "absent"
+
+	// GitRemote is the name of the remote which is used for the URL.
+	GitRemote = "origin"
+
+	// gitDefaultPoll is the default number of seconds between polls of the
+	// remote when the state is latest.
+	gitDefaultPoll = 300
+)
+
+var (
+	// gitCommitRegexp matches a full commit hash.
+	gitCommitRegexp = regexp.MustCompile(`^[0-9a-f]{40}$`)
+)
+
+// GitRes is a git checkout resource. The name is the path of the working tree,
+// which is cloned from the URL and kept at the commit that the Ref resolves to.
+// The resolved commit hash is sent after each successful CheckApply, so that a
+// downstream resource (such as a svc) can be refreshed only when the checkout
+// really changed.
+type GitRes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Sendable
+
+	init *engine.Init
+
+	// Path is the path of the working tree. If it is empty, the name is used.
+	Path string `lang:"path" yaml:"path"`
+
+	// State is either present, latest or absent. With present, the remote is
+	// only contacted when the repository is cloned or when the ref can't be
+	// found locally. With latest, the ref is fetched on every CheckApply and
+	// the remote is polled every Poll seconds.
+	State string `lang:"state" yaml:"state"`
+
+	// URL is the url of the remote repository. The file, ssh, git, http and
+	// https transports are supported.
+	URL string `lang:"url" yaml:"url"`
+
+	// Ref is the branch, tag or full commit hash to check out. If it is
+	// empty, then the default branch of the remote is used.
+	Ref string `lang:"ref" yaml:"ref"`
+
+	// Depth creates a shallow clone with this many commits of history. Zero
+	// means the full history. It can't be used with a commit hash ref, since
+	// that commit might not be part of the shallow history.
+	Depth uint32 `lang:"depth" yaml:"depth"`
+
+	// Force discards any local changes in the working tree, including the
+	// untracked files. It also allows replacing a directory which is not a
+	// clone of the URL. Without it, local changes are left alone, and an
+	// error is returned if they would have to be overwritten.
+	Force bool `lang:"force" yaml:"force"`
+
+	// Key is the path of the private ssh key which is used for ssh urls. If
+	// it is empty, then the ssh agent is used.
+	Key string `lang:"key" yaml:"key"`
+
+	// Poll is the number of seconds between checks of the remote, when the
+	// state is latest. Zero disables the polling.
+	Poll uint32 `lang:"poll" yaml:"poll"`
+}
+
+// getPath returns the actual path to use for this resource. It computes this
+// after analysis of the Path and Name fields.
+func (obj *GitRes) getPath() string {
+	if obj.Path != "" {
+		return path.Clean(obj.Path)
+	}
+	return path.Clean(obj.Name())
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *GitRes) Default() engine.Res {
+	return &GitRes{
+		State: GitStatePresent,
+		Poll:  gitDefaultPoll,
+	}
+}
+
+// Validate if the params passed in are valid data.
+func (obj *GitRes) Validate() error {
+	if !strings.HasPrefix(obj.getPath(), "/") {
+		return fmt.Errorf("the path must be absolute")
+	}
+	if obj.getPath() == "/" {
+		return fmt.Errorf("the path can't be the root dir")
+	}
+
+	if obj.State != GitStatePresent && obj.State != GitStateLatest && obj.State != GitStateAbsent {
+		return fmt.Errorf("the State is invalid")
+	}
+	if obj.State == GitStateAbsent {
+		return nil
+	}
+
+	if obj.URL == "" {
+		return fmt.Errorf("the URL is empty")
+	}
+	ep, err := transport.NewEndpoint(obj.URL)
+	if err != nil {
+		return errwrap.Wrapf(err, "the URL is invalid")
+	}
+	switch ep.Protocol {
+	case "file", "ssh", "git", "http", "https":
+	default:
+		return fmt.Errorf("the URL protocol of `%s` is not supported", ep.Protocol)
+	}
+	if obj.Key != "" {
+		if ep.Protocol != "ssh" {
+			return fmt.Errorf("the Key can only be used with an ssh URL")
+		}
+		if !strings.HasPrefix(obj.Key, "/") {
+			return fmt.Errorf("the Key must be an absolute path")
+		}
+	}
+
+	if strings.HasPrefix(obj.Ref, "-") || strings.Contains(obj.Ref, "..") || strings.ContainsAny(obj.Ref, " ~^:?*[\\") {
+		return fmt.Errorf("the Ref is invalid")
+	}
+	if obj.Depth > 0 && gitCommitRegexp.MatchString(obj.Ref) {
+		return fmt.Errorf("the Depth can't be used with a commit hash Ref")
+	}
+
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *GitRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *GitRes) Close() error {
+	return nil
+}
+
+// Watch is the primary listener for this resource and it outputs events. It
+// watches the working tree, and polls the remote if the state is latest.
+func (obj *GitRes) Watch() error {
+	recWatcher, err := recwatch.NewRecWatcher(obj.getPath(), true)
+	if err != nil {
+		return err
+	}
+	defer recWatcher.Close()
+
+	var tick <-chan time.Time // nil channels block forever
+	if obj.State == GitStateLatest && obj.Poll > 0 {
+		ticker := time.NewTicker(time.Duration(obj.Poll) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	obj.init.Running() // when started, notify engine that we're running
+
+	var send = false // send event?
+	for {
+		select {
+		case event, ok := <-recWatcher.Events():
+			if !ok { // channel shutdown
+				return nil
+			}
+			if err := event.Error; err != nil {
+				return errwrap.Wrapf(err, "unknown %s watcher error", obj)
+			}
+			if !gitWatched(obj.getPath(), event.Body.Name) {
+				continue
+			}
+			if obj.init.Debug { // don't access event.Body if event.Error isn't nil
+				obj.init.Logf("event(%s): %v", event.Body.Name, event.Body.Op)
+			}
+			send = true
+
+		case <-tick:
+			// only send an event if the remote actually changed
+			if changed, err := obj.remoteChanged(); err != nil || changed {
+				send = true
+			}
+
+		case <-obj.init.Done: // closed by the engine to signal shutdown
+			return nil
+		}
+
+		// do all our event sending all together to avoid duplicate msgs
+		if send {
+			send = false
+			obj.init.Event() // notify engine of an event (this can block)
+		}
+	}
+}
+
+// CheckApply is run to check the state and, if apply is true, to apply the
+// necessary changes to reach the desired state. The repository is cloned if it
+// is missing, then fetched if needed, and finally the resolved commit is
+// checked out.
+func (obj *GitRes) CheckApply(apply bool) (bool, error) {
+	p := obj.getPath()
+
+	repo, err := git.PlainOpen(p)
+	if err != nil && err != git.ErrRepositoryNotExists {
+		return false, errwrap.Wrapf(err, "could not open the repository")
+	}
+
+	if obj.State == GitStateAbsent {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+		if repo == nil && !obj.Force {
+			return false, fmt.Errorf("refusing to remove `%s` which is not a git repository", p)
+		}
+		if !apply {
+			return false, nil
+		}
+		obj.init.Logf("removing: %s", p)
+		return false, os.RemoveAll(p)
+	}
+
+	checkOK := true
+
+	// a clone of a different url is only replaced when forced
+	if repo != nil {
+		remote, err := repo.Remote(GitRemote)
+		if err != nil && err != git.ErrRemoteNotFound {
+			return false, errwrap.Wrapf(err, "could not get the remote")
+		}
+		if remote == nil || len(remote.Config().URLs) == 0 || remote.Config().URLs[0] != obj.URL {
+			if !obj.Force {
+				return false, fmt.Errorf("`%s` is not a clone of `%s`", p, obj.URL)
+			}
+			if !apply {
+				return false, nil
+			}
+			obj.init.Logf("removing: %s", p)
+			if err := os.RemoveAll(p); err != nil {
+				return false, err
+			}
+			repo = nil
+		}
+	}
+
+	fetched := false
+	if repo == nil {
+		if files, err := readDirNames(p); err != nil && !os.IsNotExist(err) {
+			return false, err
+		} else if len(files) > 0 {
+			if !obj.Force {
+				return false, fmt.Errorf("`%s` is not empty and is not a git repository", p)
+			}
+			if !apply {
+				return false, nil
+			}
+			obj.init.Logf("removing: %s", p)
+			if err := os.RemoveAll(p); err != nil {
+				return false, err
+			}
+		}
+		if !apply {
+			return false, nil
+		}
+		auth, err := obj.auth()
+		if err != nil {
+			return false, err
+		}
+		obj.init.Logf("cloning: %s", obj.URL)
+		repo, err = git.PlainClone(p, false, &git.CloneOptions{
+			URL:        obj.URL,
+			Auth:       auth,
+			RemoteName: GitRemote,
+			Depth:      int(obj.Depth),
+			Tags:       git.AllTags,
+		})
+		if err != nil {
+			os.RemoveAll(p) // don't leave a broken clone behind
+			return false, errwrap.Wrapf(err, "could not clone `%s`", obj.URL)
+		}
+		checkOK = false
+		fetched = true
+	}
+
+	if obj.State == GitStateLatest && !fetched {
+		if err := obj.fetch(repo); err != nil {
+			return false, err
+		}
+		fetched = true
+	}
+
+	hash, branch, err := obj.resolve(repo, fetched)
+	if err == plumbing.ErrReferenceNotFound && !fetched { // try the remote
+		if err := obj.fetch(repo); err != nil {
+			return false, err
+		}
+		fetched = true
+		hash, branch, err = obj.resolve(repo, fetched)
+	}
+	if err == plumbing.ErrReferenceNotFound {
+		return false, fmt.Errorf("the ref `%s` was not found", obj.Ref)
+	}
+	if err != nil {
+		return false, errwrap.Wrapf(err, "could not resolve the ref")
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return false, err
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return false, errwrap.Wrapf(err, "could not get the status")
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return false, errwrap.Wrapf(err, "could not get the head")
+	}
+
+	if head.Hash() != hash || (branch != "" && head.Name() != branch) {
+		if gitModified(status) && !obj.Force {
+			return false, fmt.Errorf("the working tree has local changes")
+		}
+		if !apply {
+			return false, nil
+		}
+		obj.init.Logf("checkout: %s", hash)
+		opts := &git.CheckoutOptions{
+			Hash:  hash,
+			Force: obj.Force,
+		}
+		if branch != "" {
+			// point the local branch at the commit, and switch to it
+			if err := repo.Storer.SetReference(plumbing.NewHashReference(branch, hash)); err != nil {
+				return false, err
+			}
+			opts = &git.CheckoutOptions{
+				Branch: branch,
+				Force:  obj.Force,
+			}
+		}
+		if err := wt.Checkout(opts); err != nil {
+			return false, errwrap.Wrapf(err, "could not checkout `%s`", hash)
+		}
+		checkOK = false
+
+		if status, err = wt.Status(); err != nil {
+			return false, errwrap.Wrapf(err, "could not get the status")
+		}
+	}
+
+	if !status.IsClean() && obj.Force {
+		if !apply {
+			return false, nil
+		}
+		obj.init.Logf("discarding local changes")
+		if err := wt.Reset(&git.ResetOptions{Commit: hash, Mode: git.HardReset}); err != nil {
+			return false, errwrap.Wrapf(err, "could not reset")
+		}
+		if err := wt.Clean(&git.CleanOptions{Dir: true}); err != nil {
+			return false, errwrap.Wrapf(err, "could not clean")
+		}
+		checkOK = false
+	}
+
+	commit := hash.String()
+	if err := obj.init.Send(&GitSends{
+		Commit: &commit,
+	}); err != nil {
+		return false, err
+	}
+
+	return checkOK, nil
+}
+
+// auth returns the auth method to use for the URL. It is nil if there's no Key,
+// which lets go-git pick its default, which is the ssh agent for ssh urls.
+func (obj *GitRes) auth() (transport.AuthMethod, error) {
+	if obj.Key == "" {
+		return nil, nil
+	}
+	ep, err := transport.NewEndpoint(obj.URL)
+	if err != nil {
+		return nil, err
+	}
+	user := ep.User
+	if user == "" {
+		user = "git"
+	}
+	auth, err := ssh.NewPublicKeysFromFile(user, obj.Key, "")
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "could not read the Key")
+	}
+	return auth, nil
+}
+
+// fetch gets all the branches and tags of the remote.
+func (obj *GitRes) fetch(repo *git.Repository) error {
+	auth, err := obj.auth()
+	if err != nil {
+		return err
+	}
+	if obj.init.Debug {
+		obj.init.Logf("fetching: %s", obj.URL)
+	}
+	err = repo.Fetch(&git.FetchOptions{
+		RemoteName: GitRemote,
+		Auth:       auth,
+		Depth:      int(obj.Depth),
+		Tags:       git.AllTags,
+		Force:      true,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return errwrap.Wrapf(err, "could not fetch `%s`", obj.URL)
+	}
+	return nil
+}
+
+// resolve returns the commit which the Ref points to, and the local branch to
+// check out, which is empty if the commit should be checked out detached. The
+// empty Ref is the default branch of the remote if it can be listed, which is
+// only done after a fetch, and the current branch otherwise.
+func (obj *GitRes) resolve(repo *git.Repository, remote bool) (plumbing.Hash, plumbing.ReferenceName, error) {
+	ref := obj.Ref
+	if ref == "" && !remote {
+		head, err := repo.Head()
+		if err != nil {
+			return plumbing.ZeroHash, "", err
+		}
+		if !head.Name().IsBranch() {
+			return head.Hash(), "", nil
+		}
+		ref = head.Name().Short()
+	} else if ref == "" {
+		refs, err := obj.list(repo)
+		if err != nil {
+			return plumbing.ZeroHash, "", err
+		}
+		head, exists := refs[plumbing.HEAD]
+		if !exists {
+			return plumbing.ZeroHash, "", plumbing.ErrReferenceNotFound
+		}
+		if head.Type() != plumbing.SymbolicReference {
+			return head.Hash(), "", nil
+		}
+		ref = head.Target().Short()
+	}
+
+	if gitCommitRegexp.MatchString(ref) {
+		hash := plumbing.NewHash(ref)
+		if _, err := repo.CommitObject(hash); err != nil {
+			return plumbing.ZeroHash, "", plumbing.ErrReferenceNotFound
+		}
+		return hash, "", nil
+	}
+
+	if r, err := repo.Reference(plumbing.NewRemoteReferenceName(GitRemote, ref), true); err == nil {
+		return r.Hash(), plumbing.NewBranchReferenceName(ref), nil
+	} else if err != plumbing.ErrReferenceNotFound {
+		return plumbing.ZeroHash, "", err
+	}
+
+	r, err := repo.Reference(plumbing.NewTagReferenceName(ref), true)
+	if err != nil {
+		return plumbing.ZeroHash, "", err
+	}
+	tag, err := repo.TagObject(r.Hash())
+	if err == plumbing.ErrObjectNotFound { // lightweight tag
+		return r.Hash(), "", nil
+	} else if err != nil {
+		return plumbing.ZeroHash, "", err
+	}
+	commit, err := tag.Commit() // annotated tag
+	if err != nil {
+		return plumbing.ZeroHash, "", err
+	}
+	return commit.Hash, "", nil
+}
+
+// list returns the references of the remote, keyed by their name.
+func (obj *GitRes) list(repo *git.Repository) (map[plumbing.ReferenceName]*plumbing.Reference, error) {
+	remote, err := repo.Remote(GitRemote)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := obj.auth()
+	if err != nil {
+		return nil, err
+	}
+	refs, err := remote.List(&git.ListOptions{Auth: auth})
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "could not list `%s`", obj.URL)
+	}
+	result := make(map[plumbing.ReferenceName]*plumbing.Reference)
+	for _, r := range refs {
+		result[r.Name()] = r
+	}
+	return result, nil
+}
+
+// remoteChanged returns true if the Ref of the remote points to something else
+// than what was last fetched. It is used when polling, since listing the
+// remote is much cheaper than fetching from it.
+func (obj *GitRes) remoteChanged() (bool, error) {
+	repo, err := git.PlainOpen(obj.getPath())
+	if err != nil {
+		return false, err
+	}
+	refs, err := obj.list(repo)
+	if err != nil {
+		return false, err
+	}
+
+	ref := obj.Ref
+	if ref == "" {
+		head, exists := refs[plumbing.HEAD]
+		if !exists || head.Type() != plumbing.SymbolicReference {
+			return true, nil
+		}
+		ref = head.Target().Short()
+	}
+	if gitCommitRegexp.MatchString(ref) {
+		return false, nil // a commit never changes
+	}
+
+	names := map[plumbing.ReferenceName]plumbing.ReferenceName{ // remote: local
+		plumbing.NewBranchReferenceName(ref): plumbing.NewRemoteReferenceName(GitRemote, ref),
+		plumbing.NewTagReferenceName(ref):    plumbing.NewTagReferenceName(ref),
+	}
+	for name, local := range names {
+		r, exists := refs[name]
+		if !exists {
+			continue
+		}
+		l, err := repo.Reference(local, true)
+		if err != nil {
+			return true, nil
+		}
+		return l.Hash() != r.Hash(), nil
+	}
+	return true, nil // the ref is gone, so let CheckApply error
+}
+
+// gitWatched returns true if an event on the name, which is inside of the
+// repository at dir, can change the state. Inside of .git, this is only HEAD
+// and the local branches. The rest of it, such as the index, the objects, the
+// remote refs and FETCH_HEAD, is rewritten by CheckApply on every fetch and
+// status, so watching it would cause an endless loop of events.
+func gitWatched(dir, name string) bool {
+	gitDir := path.Join(dir, ".git")
+	if !strings.HasPrefix(name, gitDir+"/") {
+		return true // the worktree, or the .git dir itself
+	}
+	if name == path.Join(gitDir, "HEAD") {
+		return true
+	}
+	return strings.HasPrefix(name, path.Join(gitDir, "refs", "heads")+"/")
+}
+
+// gitModified returns true if any tracked file was changed. Untracked files are
+// not counted, since they never get overwritten by a checkout.
+func gitModified(status git.Status) bool {
+	for _, s := range status {
+		if s.Worktree != git.Unmodified && s.Worktree != git.Untracked {
+			return true
+		}
+		if s.Staging != git.Unmodified && s.Staging != git.Untracked {
+			return true
+		}
+	}
+	return false
+}
+
+// readDirNames returns the names of the files in a dir.
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// GitSends is the struct of data which is sent after a successful Apply.
+type GitSends struct {
+	// Commit is the hash of the commit which is checked out.
+	Commit *string `lang:"commit"`
+}
+
+// Sends represents the default struct of values we can send using Send/Recv.
+func (obj *GitRes) Sends() interface{} {
+	return &GitSends{
+		Commit: nil,
+	}
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *GitRes) Cmp(r engine.Res) error {
+	// we can only compare GitRes to others of the same resource kind
+	res, ok := r.(*GitRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.getPath() != res.getPath() {
+		return fmt.Errorf("the Path differs")
+	}
+	if obj.State != res.State {
+		return fmt.Errorf("the State differs")
+	}
+	if obj.URL != res.URL {
+		return fmt.Errorf("the URL differs")
+	}
+	if obj.Ref != res.Ref {
+		return fmt.Errorf("the Ref differs")
+	}
+	if obj.Depth != res.Depth {
+		return fmt.Errorf("the Depth differs")
+	}
+	if obj.Force != res.Force {
+		return fmt.Errorf("the Force differs")
+	}
+	if obj.Key != res.Key {
+		return fmt.Errorf("the Key differs")
+	}
+	if obj.Poll != res.Poll {
+		return fmt.Errorf("the Poll differs")
+	}
+
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *GitRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes GitRes // indirection to avoid infinite recursion
+
+	def := obj.Default()     // get the default
+	res, ok := def.(*GitRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to GitRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = GitRes(raw) // restore from indirection with type conversion!
+	return nil
+}
@@ -0,0 +1,255 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root
+
+package resources
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// gitTestCommit writes a file into the upstream repository and commits it.
+func gitTestCommit(repo *git.Repository, dir, name, data string) (plumbing.Hash, error) {
+	if err := ioutil.WriteFile(path.Join(dir, name), []byte(data), 0644); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := wt.Add(name); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return wt.Commit(fmt.Sprintf("update %s", name), &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "mgmt",
+			Email: "mgmt@example.com",
+			When:  time.Now(),
+		},
+	})
+}
+
+func TestGitValidate1(t *testing.T) {
+	tests := []struct {
+		res  *GitRes
+		fail bool
+	}{
+		{&GitRes{State: "present", URL: "file:///tmp/repo"}, false},
+		{&GitRes{State: "latest", URL: "ssh://git@example.com/repo.git", Key: "/root/.ssh/id_ed25519"}, false},
+		{&GitRes{State: "latest", URL: "git@example.com:repo.git", Ref: "v1.0"}, false},
+		{&GitRes{State: "absent"}, false},
+		{&GitRes{State: "present"}, true},                                            // no url
+		{&GitRes{State: "cloned", URL: "file:///tmp/repo"}, true},                    // bad state
+		{&GitRes{State: "present", URL: "file:///tmp/repo", Key: "/key"}, true},      // key without ssh
+		{&GitRes{State: "present", URL: "file:///tmp/repo", Ref: "a..b"}, true},      // bad ref
+		{&GitRes{State: "present", URL: "file:///tmp/repo", Path: "relative"}, true}, // relative path
+		{&GitRes{State: "present", URL: "file:///tmp/repo", Depth: 1, Ref: "0123456789abcdef0123456789abcdef01234567"}, true},
+	}
+	for i, tt := range tests {
+		tt.res.SetKind("git")
+		tt.res.SetName("/tmp/checkout")
+		if err := tt.res.Validate(); (err != nil) != tt.fail {
+			t.Errorf("test #%d: expected fail: %t, got: %v", i, tt.fail, err)
+		}
+	}
+}
+
+func TestGitWatched1(t *testing.T) {
+	tests := []struct {
+		name    string
+		watched bool
+	}{
+		{"/tmp/repo/README", true},
+		{"/tmp/repo/docs/index.md", true},
+		{"/tmp/repo/.git", true},
+		{"/tmp/repo/.git/HEAD", true},
+		{"/tmp/repo/.git/refs/heads/master", true},
+		{"/tmp/repo/.gitignore", true},
+		{"/tmp/repo/.git/index", false},
+		{"/tmp/repo/.git/index.lock", false},
+		{"/tmp/repo/.git/FETCH_HEAD", false},
+		{"/tmp/repo/.git/ORIG_HEAD", false},
+		{"/tmp/repo/.git/objects/ab/cdef", false},
+		{"/tmp/repo/.git/refs/remotes/origin/master", false},
+		{"/tmp/repo/.git/refs/tags/v1", false},
+		{"/tmp/repo/.git/packed-refs", false},
+	}
+	for _, tc := range tests {
+		if watched := gitWatched("/tmp/repo", tc.name); watched != tc.watched {
+			t.Errorf("expected watched to be %t for %s", tc.watched, tc.name)
+		}
+	}
+}
+
+func TestGit1(t *testing.T) {
+	if _, err := exec.LookPath("git-upload-pack"); err != nil {
+		if _, err := exec.LookPath("git"); err != nil {
+			t.Skip("the git binary is needed for the file transport")
+		}
+	}
+
+	tmpdir := t.TempDir()
+	upstream := path.Join(tmpdir, "upstream")
+	checkout := path.Join(tmpdir, "checkout")
+	repo, err := git.PlainInit(upstream, false)
+	if err != nil {
+		t.Errorf("could not init the upstream: %v", err)
+		return
+	}
+	first, err := gitTestCommit(repo, upstream, "README", "hello\n")
+	if err != nil {
+		t.Errorf("could not commit: %v", err)
+		return
+	}
+
+	var sent string
+	init := &engine.Init{
+		Send: func(st interface{}) error {
+			x, ok := st.(*GitSends)
+			if !ok {
+				return fmt.Errorf("unexpected sends: %T", st)
+			}
+			sent = *x.Commit
+			return nil
+		},
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+	}
+	// run returns the result of a checkapply, with the defaults already set
+	run := func(res *GitRes) (bool, error) {
+		res.SetKind("git")
+		res.SetName(checkout)
+		if err := res.Validate(); err != nil {
+			return false, err
+		}
+		if err := res.Init(init); err != nil {
+			return false, err
+		}
+		defer res.Close()
+		return res.CheckApply(true)
+	}
+
+	// clone
+	res := &GitRes{State: "present", URL: "file://" + upstream}
+	if checkOK, err := run(res); err != nil || checkOK {
+		t.Errorf("the clone failed: %t, %v", checkOK, err)
+		return
+	}
+	if sent != first.String() {
+		t.Errorf("expected commit %s, got: %s", first, sent)
+	}
+	if b, err := ioutil.ReadFile(path.Join(checkout, "README")); err != nil || string(b) != "hello\n" {
+		t.Errorf("the checkout is wrong: %s, %v", b, err)
+	}
+	if checkOK, err := run(res); err != nil || !checkOK {
+		t.Errorf("the second checkapply was not a noop: %v", err)
+	}
+
+	// present doesn't pull new commits, but latest does
+	second, err := gitTestCommit(repo, upstream, "README", "world\n")
+	if err != nil {
+		t.Errorf("could not commit: %v", err)
+		return
+	}
+	if checkOK, err := run(res); err != nil || !checkOK {
+		t.Errorf("present should not have changed anything: %v", err)
+	}
+	res = &GitRes{State: "latest", URL: "file://" + upstream}
+	if checkOK, err := run(res); err != nil || checkOK {
+		t.Errorf("latest should have changed something: %t, %v", checkOK, err)
+		return
+	}
+	if sent != second.String() {
+		t.Errorf("expected commit %s, got: %s", second, sent)
+	}
+	if checkOK, err := run(res); err != nil || !checkOK {
+		t.Errorf("latest should now be a noop: %v", err)
+	}
+
+	// an older commit, which can't be checked out over local changes
+	readme := path.Join(checkout, "README")
+	if err := ioutil.WriteFile(readme, []byte("local\n"), 0644); err != nil {
+		t.Errorf("could not write: %v", err)
+		return
+	}
+	res = &GitRes{State: "present", URL: "file://" + upstream, Ref: first.String()}
+	if _, err := run(res); err == nil {
+		t.Errorf("expected an error because of the local changes")
+	}
+	res.Force = true
+	if checkOK, err := run(res); err != nil || checkOK {
+		t.Errorf("the forced checkout failed: %t, %v", checkOK, err)
+		return
+	}
+	if b, err := ioutil.ReadFile(readme); err != nil || string(b) != "hello\n" {
+		t.Errorf("the checkout is wrong: %s, %v", b, err)
+	}
+
+	// local changes are discarded at the same commit when forced
+	if err := ioutil.WriteFile(path.Join(checkout, "junk"), []byte("junk\n"), 0644); err != nil {
+		t.Errorf("could not write: %v", err)
+		return
+	}
+	if checkOK, err := run(res); err != nil || checkOK {
+		t.Errorf("the forced clean failed: %t, %v", checkOK, err)
+	}
+	if _, err := os.Stat(path.Join(checkout, "junk")); !os.IsNotExist(err) {
+		t.Errorf("the untracked file still exists: %v", err)
+	}
+
+	// an annotated tag
+	if _, err := repo.CreateTag("v1", second, &git.CreateTagOptions{
+		Tagger: &object.Signature{
+			Name:  "mgmt",
+			Email: "mgmt@example.com",
+			When:  time.Now(),
+		},
+		Message: "v1",
+	}); err != nil {
+		t.Errorf("could not tag: %v", err)
+		return
+	}
+	res = &GitRes{State: "present", URL: "file://" + upstream, Ref: "v1"}
+	if checkOK, err := run(res); err != nil || checkOK {
+		t.Errorf("the tag checkout failed: %t, %v", checkOK, err)
+	}
+	if sent != second.String() {
+		t.Errorf("expected commit %s, got: %s", second, sent)
+	}
+
+	res = &GitRes{State: "absent"}
+	if checkOK, err := run(res); err != nil || checkOK {
+		t.Errorf("the removal failed: %t, %v", checkOK, err)
+	}
+	if _, err := os.Stat(checkout); !os.IsNotExist(err) {
+		t.Errorf("the checkout still exists: %v", err)
+	}
+}
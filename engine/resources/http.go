@@ -20,10 +20,16 @@ package resources
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"fmt"
+	"html"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -32,6 +38,7 @@ import (
 
 	"github.com/purpleidea/mgmt/engine"
 	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/recwatch"
 	"github.com/purpleidea/mgmt/util/errwrap"
 
 	securefilepath "github.com/cyphar/filepath-securejoin"
@@ -40,12 +47,17 @@ import (
 func init() {
 	engine.RegisterResource("http:server", func() engine.Res { return &HTTPServerRes{} })
 	engine.RegisterResource("http:file", func() engine.Res { return &HTTPFileRes{} })
+	engine.RegisterResource("http:proxy", func() engine.Res { return &HTTPProxyRes{} })
 }
 
 const (
 	// HTTPUseSecureJoin specifies that we should add in a "secure join" lib
 	// so that we avoid the ../../etc/passwd and symlink problems.
 	HTTPUseSecureJoin = true
+
+	// HTTPIndexFile is the file that is served for a directory in the Root,
+	// if it exists.
+	HTTPIndexFile = "index.html"
 )
 
 // HTTPServerRes is an http server resource. It serves files, but does not
@@ -54,7 +66,13 @@ const (
 // This resource can offer up files for serving that are specified either inline
 // in this resource by specifying an http root, or as http:file resources which
 // will get autogrouped into this resource at runtime. The two methods can be
-// combined as well.
+// combined as well. Paths can also be forwarded to a local backend with the
+// http:proxy resource, which is autogrouped in the same way.
+//
+// When a certificate and a key are specified, the server uses TLS. They can be
+// received as PEM, for example from the x509:cert and x509:key resources, or
+// read from files, which are watched for changes. A new certificate is used for
+// new connections without restarting the server.
 //
 // This server also supports autogrouping some more magical resources into it.
 // For example, the http:flag and http:ui resources add in magic endpoints.
@@ -63,14 +81,14 @@ const (
 // modern httpd servers out there, but rather as a simple, dynamic, integrated
 // alternative for bootstrapping new machines and clusters in an elegant way.
 //
-// TODO: add support for TLS
 // XXX: Add an http:flag resource that lets an http client set a flag somewhere!
 // XXX: Add a http:ui resource that functions can read data from!
 // XXX: The http:ui resource can also take in values from those functions!
 type HTTPServerRes struct {
 	traits.Base      // add the base methods without re-implementation
 	traits.Edgeable  // XXX: add autoedge support
-	traits.Groupable // can have HTTPFileRes grouped into it
+	traits.Groupable // can have HTTPFileRes and HTTPProxyRes grouped into it
+	traits.Recvable
 
 	init *engine.Init
 
@@ -115,20 +133,128 @@ type HTTPServerRes struct {
 	// TODO: should we have a flag to determine the precedence rules here?
 	Root string `lang:"root" yaml:"root"`
 
+	// Index enables the directory listings in the Root. Without it, a
+	// directory is only served if it contains an index.html file.
+	Index bool `lang:"index" yaml:"index"`
+
 	// TODO: should we allow adding a list of one-of files directly here?
 
+	// Cert is the PEM encoded certificate to use for TLS. It is usually
+	// received from an x509:cert resource. It may include the chain of
+	// intermediate certificates after the main certificate. It must not be
+	// combined with CertPath.
+	Cert string `lang:"cert" yaml:"cert"`
+
+	// Key is the PEM encoded private key to use for TLS. It is usually
+	// received from an x509:key resource. It must not be combined with
+	// KeyPath.
+	Key string `lang:"key" yaml:"key"`
+
+	// CertPath is the absolute path of a PEM certificate file to use for
+	// TLS. It must not be combined with Cert.
+	CertPath string `lang:"cert_path" yaml:"cert_path"`
+
+	// KeyPath is the absolute path of a PEM private key file to use for
+	// TLS. It must not be combined with Key.
+	KeyPath string `lang:"key_path" yaml:"key_path"`
+
+	// RedirectAddress is an additional listen address for plain http,
+	// which redirects every request to the https server. It is common to
+	// use `:80` here when the Address is `:443`. It can only be used with
+	// TLS.
+	RedirectAddress string `lang:"redirect_address" yaml:"redirect_address"`
+
+	// Auth is the list of paths which are protected with http basic auth.
+	Auth []*HTTPAuth `lang:"auth" yaml:"auth"`
+
 	interruptChan chan struct{}
 
+	mutex       *sync.Mutex // guards certificate
+	certificate *tls.Certificate
+
 	conn     net.Listener
 	serveMux *http.ServeMux // can't share the global one between resources!
 	server   *http.Server
 }
 
+// HTTPAuth is a path which is protected with http basic auth.
+type HTTPAuth struct {
+	// Path is the path to protect. Everything below it is also protected.
+	Path string `lang:"path" yaml:"path"`
+
+	// Realm is the name of the protection space that is shown to the user.
+	Realm string `lang:"realm" yaml:"realm"`
+
+	// Username is the user name to accept.
+	Username string `lang:"username" yaml:"username"`
+
+	// Password is the password to accept.
+	Password string `lang:"password" yaml:"password"`
+}
+
+// Cmp compares two of these and returns an error if they are not equivalent.
+func (obj *HTTPAuth) Cmp(auth *HTTPAuth) error {
+	if obj.Path != auth.Path {
+		return fmt.Errorf("the Path differs")
+	}
+	if obj.Realm != auth.Realm {
+		return fmt.Errorf("the Realm differs")
+	}
+	if obj.Username != auth.Username {
+		return fmt.Errorf("the Username differs")
+	}
+	if obj.Password != auth.Password {
+		return fmt.Errorf("the Password differs")
+	}
+	return nil
+}
+
 // Default returns some sensible defaults for this resource.
 func (obj *HTTPServerRes) Default() engine.Res {
 	return &HTTPServerRes{}
 }
 
+// isTLS returns true if this server uses TLS.
+func (obj *HTTPServerRes) isTLS() bool {
+	return obj.Cert != "" || obj.CertPath != ""
+}
+
+// loadCertificate builds the TLS certificate from the PEM params or files.
+func (obj *HTTPServerRes) loadCertificate() (*tls.Certificate, error) {
+	certPEM, keyPEM := []byte(obj.Cert), []byte(obj.Key)
+	if obj.CertPath != "" {
+		b, err := ioutil.ReadFile(obj.CertPath)
+		if err != nil {
+			return nil, err
+		}
+		certPEM = b
+	}
+	if obj.KeyPath != "" {
+		b, err := ioutil.ReadFile(obj.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM = b
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// getCertificate returns the most recently loaded TLS certificate. It is used
+// for each new connection, so that a renewed certificate is picked up without
+// restarting the server.
+func (obj *HTTPServerRes) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	if obj.certificate == nil {
+		return nil, fmt.Errorf("the certificate is not loaded yet")
+	}
+	return obj.certificate, nil
+}
+
 // getAddress returns the actual address to use. When Address is not specified,
 // we use the Name.
 func (obj *HTTPServerRes) getAddress() string {
@@ -190,6 +316,47 @@ func (obj *HTTPServerRes) Validate() error {
 		return fmt.Errorf("the Root must be a dir")
 	}
 
+	if obj.Cert != "" && obj.CertPath != "" {
+		return fmt.Errorf("must not specify Cert and CertPath")
+	}
+	if obj.Key != "" && obj.KeyPath != "" {
+		return fmt.Errorf("must not specify Key and KeyPath")
+	}
+	if obj.isTLS() != (obj.Key != "" || obj.KeyPath != "") {
+		return fmt.Errorf("a certificate and a key must be specified together")
+	}
+	for name, p := range map[string]string{"CertPath": obj.CertPath, "KeyPath": obj.KeyPath} {
+		if p != "" && !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("the %s must be absolute", name)
+		}
+	}
+
+	if obj.RedirectAddress != "" {
+		if !obj.isTLS() {
+			return fmt.Errorf("the RedirectAddress can only be used with TLS")
+		}
+		if _, _, err := net.SplitHostPort(obj.RedirectAddress); err != nil {
+			return errwrap.Wrapf(err, "the RedirectAddress is in an invalid format: %s", obj.RedirectAddress)
+		}
+	}
+
+	paths := make(map[string]struct{})
+	for _, x := range obj.Auth {
+		if x == nil {
+			return fmt.Errorf("the Auth list contains a nil entry")
+		}
+		if !strings.HasPrefix(x.Path, "/") {
+			return fmt.Errorf("the Auth path must be absolute: %s", x.Path)
+		}
+		if _, exists := paths[x.Path]; exists {
+			return fmt.Errorf("duplicate Auth path: %s", x.Path)
+		}
+		paths[x.Path] = struct{}{}
+		if x.Username == "" {
+			return fmt.Errorf("the Auth username must not be empty: %s", x.Path)
+		}
+	}
+
 	// XXX: validate that the autogrouped resources don't have paths that
 	// conflict with each other. We can only have a single unique entry for
 	// what handles a /whatever URL.
@@ -220,6 +387,7 @@ func (obj *HTTPServerRes) Init(init *engine.Init) error {
 	}
 
 	obj.interruptChan = make(chan struct{})
+	obj.mutex = &sync.Mutex{}
 
 	return nil
 }
@@ -263,6 +431,49 @@ func (obj *HTTPServerRes) Watch() error {
 		WriteTimeout: time.Duration(writeTimeout) * time.Second,
 		//MaxHeaderBytes: 1 << 20, XXX: should we add a param for this?
 	}
+	if obj.isTLS() {
+		obj.server.TLSConfig = &tls.Config{
+			GetCertificate: obj.getCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+
+	// The certificate files are watched, so that CheckApply can load them
+	// again when they change.
+	var certEvents, keyEvents chan recwatch.Event
+	if obj.CertPath != "" {
+		recWatcher, err := recwatch.NewRecWatcher(obj.CertPath, false)
+		if err != nil {
+			return err
+		}
+		defer recWatcher.Close()
+		certEvents = recWatcher.Events()
+	}
+	if obj.KeyPath != "" {
+		recWatcher, err := recwatch.NewRecWatcher(obj.KeyPath, false)
+		if err != nil {
+			return err
+		}
+		defer recWatcher.Close()
+		keyEvents = recWatcher.Events()
+	}
+
+	var redirectServer *http.Server
+	if obj.RedirectAddress != "" {
+		redirectConn, err := net.Listen("tcp", obj.RedirectAddress)
+		if err != nil {
+			return errwrap.Wrapf(err, "could not start redirect listener")
+		}
+		defer redirectConn.Close()
+		redirectServer = &http.Server{
+			Addr:         obj.RedirectAddress,
+			Handler:      obj.redirectHandler(),
+			ReadTimeout:  time.Duration(readTimeout) * time.Second,
+			WriteTimeout: time.Duration(writeTimeout) * time.Second,
+		}
+		defer redirectServer.Close() // nothing to wait for on shutdown
+		go redirectServer.Serve(redirectConn)
+	}
 
 	obj.init.Running() // when started, notify engine that we're running
 
@@ -291,7 +502,13 @@ func (obj *HTTPServerRes) Watch() error {
 		defer wg.Done()
 		defer close(closeSignal)
 
-		err := obj.server.Serve(obj.conn) // blocks until Shutdown() is called!
+		var err error
+		if obj.isTLS() {
+			// the certificate comes from the TLSConfig
+			err = obj.server.ServeTLS(obj.conn, "", "") // blocks until Shutdown() is called!
+		} else {
+			err = obj.server.Serve(obj.conn) // blocks until Shutdown() is called!
+		}
 		if err == nil || err == http.ErrServerClosed {
 			return
 		}
@@ -332,6 +549,24 @@ func (obj *HTTPServerRes) Watch() error {
 			startupChan = nil
 			send = true
 
+		case event, ok := <-certEvents:
+			if !ok { // channel shutdown
+				return nil
+			}
+			if err := event.Error; err != nil {
+				return errwrap.Wrapf(err, "unknown %s watcher error", obj)
+			}
+			send = true
+
+		case event, ok := <-keyEvents:
+			if !ok { // channel shutdown
+				return nil
+			}
+			if err := event.Error; err != nil {
+				return errwrap.Wrapf(err, "unknown %s watcher error", obj)
+			}
+			send = true
+
 		case <-closeSignal: // something shut us down early
 			return closeError
 
@@ -349,12 +584,28 @@ func (obj *HTTPServerRes) Watch() error {
 
 // CheckApply never has anything to do for this resource, so it always succeeds.
 // It does however check that certain runtime requirements (such as the Root dir
-// existing if one was specified) are fulfilled.
+// existing if one was specified) are fulfilled. It also loads the TLS
+// certificate, which might have been received or changed on disk.
 func (obj *HTTPServerRes) CheckApply(apply bool) (bool, error) {
 	if obj.init.Debug {
 		obj.init.Logf("CheckApply")
 	}
 
+	if val, exists := obj.init.Recv()["Cert"]; exists && val.Changed {
+		// if we received on Cert, and it changed, log it
+		obj.init.Logf("CheckApply: received a new certificate")
+	}
+
+	if obj.isTLS() {
+		cert, err := obj.loadCertificate()
+		if err != nil {
+			return false, errwrap.Wrapf(err, "could not load the certificate")
+		}
+		obj.mutex.Lock()
+		obj.certificate = cert
+		obj.mutex.Unlock()
+	}
+
 	// XXX: We don't want the initial CheckApply to return true until the
 	// Watch has started up, so we must block here until that's the case...
 
@@ -429,6 +680,34 @@ func (obj *HTTPServerRes) Cmp(r engine.Res) error {
 	if obj.Root != res.Root {
 		return fmt.Errorf("the Root differs")
 	}
+	if obj.Index != res.Index {
+		return fmt.Errorf("the Index differs")
+	}
+
+	if obj.Cert != res.Cert {
+		return fmt.Errorf("the Cert differs")
+	}
+	if obj.Key != res.Key {
+		return fmt.Errorf("the Key differs")
+	}
+	if obj.CertPath != res.CertPath {
+		return fmt.Errorf("the CertPath differs")
+	}
+	if obj.KeyPath != res.KeyPath {
+		return fmt.Errorf("the KeyPath differs")
+	}
+	if obj.RedirectAddress != res.RedirectAddress {
+		return fmt.Errorf("the RedirectAddress differs")
+	}
+
+	if len(obj.Auth) != len(res.Auth) {
+		return fmt.Errorf("the number of Auth entries differs")
+	}
+	for i, x := range obj.Auth {
+		if err := x.Cmp(res.Auth[i]); err != nil {
+			return errwrap.Wrapf(err, "the Auth entry at index %d differs", i)
+		}
+	}
 
 	return nil
 }
@@ -462,6 +741,11 @@ func (obj *HTTPServerRes) Copy() engine.CopyableRes {
 		x := *obj.ShutdownTimeout
 		shutdownTimeout = &x
 	}
+	auth := []*HTTPAuth{}
+	for _, x := range obj.Auth {
+		a := *x
+		auth = append(auth, &a)
+	}
 	return &HTTPServerRes{
 		Address:         obj.Address,
 		Timeout:         timeout,
@@ -469,6 +753,13 @@ func (obj *HTTPServerRes) Copy() engine.CopyableRes {
 		WriteTimeout:    writeTimeout,
 		ShutdownTimeout: shutdownTimeout,
 		Root:            obj.Root,
+		Index:           obj.Index,
+		Cert:            obj.Cert,
+		Key:             obj.Key,
+		CertPath:        obj.CertPath,
+		KeyPath:         obj.KeyPath,
+		RedirectAddress: obj.RedirectAddress,
+		Auth:            auth,
 	}
 }
 
@@ -508,9 +799,151 @@ func (obj *HTTPServerRes) GroupCmp(r engine.GroupableRes) error {
 		return nil
 	}
 
+	res2, ok2 := r.(*HTTPProxyRes)
+	if ok2 {
+		// same rule as for the http file resource
+		if res2.Server != "" && res2.Server != obj.Name() {
+			return fmt.Errorf("resource groups with a different server name")
+		}
+
+		return nil
+	}
+
 	return fmt.Errorf("resource is not the right kind")
 }
 
+// httpPathMatch returns true if the request path is the prefix, or if it is
+// below it.
+func httpPathMatch(requestPath, prefix string) bool {
+	if requestPath == prefix {
+		return true
+	}
+	return strings.HasPrefix(requestPath, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// getAuth returns the auth entry with the longest path that protects the
+// request path, or nil if there isn't one.
+func (obj *HTTPServerRes) getAuth(requestPath string) *HTTPAuth {
+	var auth *HTTPAuth
+	for _, x := range obj.Auth {
+		if !httpPathMatch(requestPath, x.Path) {
+			continue
+		}
+		if auth == nil || len(x.Path) > len(auth.Path) {
+			auth = x
+		}
+	}
+	return auth
+}
+
+// checkAuth returns true if the request has the right credentials.
+func (obj *HTTPServerRes) checkAuth(auth *HTTPAuth, req *http.Request) bool {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+	// compare both in constant time to not leak which one was wrong
+	u := subtle.ConstantTimeCompare([]byte(username), []byte(auth.Username))
+	p := subtle.ConstantTimeCompare([]byte(password), []byte(auth.Password))
+	return u&p == 1
+}
+
+// getProxy returns the grouped proxy with the longest path that matches the
+// request path, or nil if there isn't one.
+func (obj *HTTPServerRes) getProxy(requestPath string) *HTTPProxyRes {
+	var proxy *HTTPProxyRes
+	for _, x := range obj.GetGroup() { // grouped elements
+		res, ok := x.(*HTTPProxyRes) // convert from Res
+		if !ok {
+			continue
+		}
+		if !httpPathMatch(requestPath, res.getPath()) {
+			continue
+		}
+		if proxy == nil || len(res.getPath()) > len(proxy.getPath()) {
+			proxy = res
+		}
+	}
+	return proxy
+}
+
+// redirectHandler redirects all the plain http requests to the https server.
+func (obj *HTTPServerRes) redirectHandler() http.HandlerFunc {
+	_, port, _ := net.SplitHostPort(obj.getAddress()) // validated earlier
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil { // there is no port
+			host = strings.Trim(req.Host, "[]")
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") { // ipv6
+			host = "[" + host + "]"
+		}
+		u := *req.URL
+		u.Scheme = "https"
+		u.Host = host
+		http.Redirect(w, req, u.String(), http.StatusMovedPermanently)
+	}
+}
+
+// serveDir serves a directory from the Root. It uses the index.html file if it
+// exists, and otherwise a listing if Index is enabled.
+func (obj *HTTPServerRes) serveDir(w http.ResponseWriter, req *http.Request, p string) {
+	requestPath := req.URL.Path
+	if !strings.HasSuffix(requestPath, "/") {
+		// relative links in the directory need the trailing slash
+		u := *req.URL
+		u.Path = requestPath + "/"
+		http.Redirect(w, req, u.String(), http.StatusMovedPermanently)
+		return
+	}
+
+	index := filepath.Join(p, HTTPIndexFile)
+	if f, err := os.Open(index); err == nil {
+		defer f.Close()
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			http.ServeContent(w, req, index, fi.ModTime(), f)
+			return
+		}
+	}
+
+	if !obj.Index {
+		obj.init.Logf("directory listing disabled: %s", p)
+		http.NotFound(w, req)
+		return
+	}
+
+	files, err := ioutil.ReadDir(p) // sorted by name
+	if err != nil {
+		obj.init.Logf("could not list: %s", p)
+		msg, httpStatus := toHTTPError(err)
+		http.Error(w, msg, httpStatus)
+		return
+	}
+
+	title := html.EscapeString(requestPath)
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "<!DOCTYPE html>\n<html>\n<head><title>%s</title></head>\n<body>\n", title)
+	fmt.Fprintf(b, "<h1>%s</h1>\n<ul>\n", title)
+	if requestPath != "/" {
+		fmt.Fprintf(b, "<li><a href=\"../\">../</a></li>\n")
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() {
+			name += "/"
+		}
+		href := (&url.URL{Path: name}).String()
+		fmt.Fprintf(b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	fmt.Fprintf(b, "</ul>\n</body>\n</html>\n")
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
 // readHandler handles all the incoming download requests from clients.
 func (obj *HTTPServerRes) handler() func(http.ResponseWriter, *http.Request) {
 	// TODO: we could statically pre-compute some stuff here...
@@ -526,14 +959,34 @@ func (obj *HTTPServerRes) handler() func(http.ResponseWriter, *http.Request) {
 			obj.init.Logf("Path: %s", req.URL.Path)
 		}
 
+		requestPath := req.URL.Path // TODO: is this what we want here?
+
+		if auth := obj.getAuth(requestPath); auth != nil && !obj.checkAuth(auth, req) {
+			obj.init.Logf("unauthorized: %s", requestPath)
+			realm := auth.Realm
+			if realm == "" {
+				realm = auth.Path
+			}
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm))
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		// A proxy accepts all the methods, so it goes first.
+		if proxy := obj.getProxy(requestPath); proxy != nil {
+			if obj.init.Debug {
+				obj.init.Logf("Got grouped proxy: %s", proxy.String())
+			}
+			proxy.ServeHTTP(w, req)
+			return
+		}
+
 		// We only allow GET at the moment.
 		if req.Method != http.MethodGet {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
 
-		requestPath := req.URL.Path // TODO: is this what we want here?
-
 		//var handle io.Reader // TODO: simplify?
 		var handle io.ReadSeeker
 
@@ -566,7 +1019,7 @@ func (obj *HTTPServerRes) handler() func(http.ResponseWriter, *http.Request) {
 		if obj.Root != "" && handle == nil {
 
 			p := filepath.Join(obj.Root, requestPath) // normal unsafe!
-			if !strings.HasPrefix(p, obj.Root) {      // root ends with /
+			if !strings.HasPrefix(p+"/", obj.Root) {  // root ends with /
 				// user might have tried a ../../etc/passwd hack
 				obj.init.Logf("join inconsistency: %s", p)
 				http.NotFound(w, req) // lie to them...
@@ -584,14 +1037,26 @@ func (obj *HTTPServerRes) handler() func(http.ResponseWriter, *http.Request) {
 			if obj.init.Debug {
 				obj.init.Logf("Got file at root: %s", p)
 			}
-			var err error
-			handle, err = os.Open(p)
+			fileInfo, err := os.Stat(p)
+			if err != nil {
+				obj.init.Logf("could not stat: %s", p)
+				msg, httpStatus := toHTTPError(err)
+				http.Error(w, msg, httpStatus)
+				return
+			}
+			if fileInfo.IsDir() {
+				obj.serveDir(w, req, p)
+				return
+			}
+			f, err := os.Open(p)
 			if err != nil {
 				obj.init.Logf("could not open: %s", p)
 				msg, httpStatus := toHTTPError(err)
 				http.Error(w, msg, httpStatus)
 				return
 			}
+			defer f.Close()
+			handle = f
 		}
 
 		// We never found a file...
@@ -786,6 +1251,173 @@ func (obj *HTTPFileRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// HTTPProxyRes is a path within an http server which is forwarded to a backend
+// http server, such as a local service. The name is used as the public path,
+// unless the path field is specified, and in that case it is used instead. Any
+// request for this path, or for anything below it, is forwarded. Like the
+// http:file resource, it autogroups at runtime with an existing http resource.
+type HTTPProxyRes struct {
+	traits.Base      // add the base methods without re-implementation
+	traits.Edgeable  // XXX: add autoedge support
+	traits.Groupable // can be grouped into HTTPServerRes
+
+	init *engine.Init
+
+	// Server is the name of the http server resource to group this into. If
+	// it is omitted, and there is only a single http resource, then it will
+	// be grouped into it automatically. If there is more than one main http
+	// resource being used, then the grouping behaviour is *undefined* when
+	// this is not specified, and it is not recommended to leave this blank!
+	Server string `lang:"server" yaml:"server"`
+
+	// Path is the public path on the http server to forward.
+	Path string `lang:"path" yaml:"path"`
+
+	// Backend is the URL of the server to forward to, such as
+	// `http://127.0.0.1:8080/`. The path of the URL is prepended to the
+	// path of each request.
+	Backend string `lang:"backend" yaml:"backend"`
+
+	// Strip removes the public path from the start of each request before
+	// it is forwarded, so that the backend can be served at its root.
+	Strip bool `lang:"strip" yaml:"strip"`
+
+	proxy *httputil.ReverseProxy
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *HTTPProxyRes) Default() engine.Res {
+	return &HTTPProxyRes{}
+}
+
+// getPath returns the actual path we respond to. When Path is not specified, we
+// use the Name.
+func (obj *HTTPProxyRes) getPath() string {
+	if obj.Path != "" {
+		return obj.Path
+	}
+	return obj.Name()
+}
+
+// Validate checks if the resource data structure was populated correctly.
+func (obj *HTTPProxyRes) Validate() error {
+	if !strings.HasPrefix(obj.getPath(), "/") {
+		return fmt.Errorf("the Path must be absolute")
+	}
+
+	u, err := url.Parse(obj.Backend)
+	if err != nil {
+		return errwrap.Wrapf(err, "the Backend is not a valid URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("the Backend must be an http or https URL")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("the Backend must have a host")
+	}
+
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *HTTPProxyRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	u, err := url.Parse(obj.Backend)
+	if err != nil {
+		return err
+	}
+	obj.proxy = httputil.NewSingleHostReverseProxy(u)
+	obj.proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		obj.init.Logf("proxy error: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *HTTPProxyRes) Close() error {
+	return nil
+}
+
+// Watch is the primary listener for this resource and it outputs events. This
+// particular one does absolutely nothing but block until we've received a done
+// signal.
+func (obj *HTTPProxyRes) Watch() error {
+	obj.init.Running() // when started, notify engine that we're running
+
+	select {
+	case <-obj.init.Done: // closed by the engine to signal shutdown
+	}
+
+	return nil
+}
+
+// CheckApply never has anything to do for this resource, so it always succeeds.
+func (obj *HTTPProxyRes) CheckApply(apply bool) (bool, error) {
+	if obj.init.Debug {
+		obj.init.Logf("CheckApply")
+	}
+
+	return true, nil // always succeeds, with nothing to do!
+}
+
+// ServeHTTP forwards the request to the backend.
+func (obj *HTTPProxyRes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if obj.Strip {
+		r := req.Clone(req.Context())
+		r.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, obj.getPath()), "/")
+		r.URL.RawPath = ""
+		req = r
+	}
+	obj.proxy.ServeHTTP(w, req)
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *HTTPProxyRes) Cmp(r engine.Res) error {
+	// we can only compare HTTPProxyRes to others of the same resource kind
+	res, ok := r.(*HTTPProxyRes)
+	if !ok {
+		return fmt.Errorf("res is not the same kind")
+	}
+
+	if obj.Server != res.Server {
+		return fmt.Errorf("the Server field differs")
+	}
+	if obj.Path != res.Path {
+		return fmt.Errorf("the Path differs")
+	}
+	if obj.Backend != res.Backend {
+		return fmt.Errorf("the Backend differs")
+	}
+	if obj.Strip != res.Strip {
+		return fmt.Errorf("the Strip differs")
+	}
+
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *HTTPProxyRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes HTTPProxyRes // indirection to avoid infinite recursion
+
+	def := obj.Default()           // get the default
+	res, ok := def.(*HTTPProxyRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to HTTPProxyRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = HTTPProxyRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
 // toHTTPError returns a non-specific HTTP error message and status code for a
 // given non-nil error value. It's important that toHTTPError does not actually
 // return err.Error(), since msg and httpStatus are returned to users, and
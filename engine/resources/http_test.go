@@ -0,0 +1,405 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root
+
+package resources
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+)
+
+// httpTestInit returns an engine.Init for the http tests.
+func httpTestInit(t *testing.T) *engine.Init {
+	return &engine.Init{
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+		Recv: func() map[string]*engine.Send {
+			return map[string]*engine.Send{}
+		},
+		Send: func(st interface{}) error {
+			return nil
+		},
+	}
+}
+
+// httpTestGet runs a request against the handler, and returns the status code
+// and the body.
+func httpTestGet(res *HTTPServerRes, req *http.Request) (int, string) {
+	w := httptest.NewRecorder()
+	res.handler()(w, req)
+	b, _ := ioutil.ReadAll(w.Result().Body)
+	return w.Result().StatusCode, string(b)
+}
+
+func TestHTTPServerValidate1(t *testing.T) {
+	testCases := []struct {
+		name string
+		res  *HTTPServerRes
+		fail bool
+	}{
+		{"plain", &HTTPServerRes{}, false},
+		{"tls", &HTTPServerRes{CertPath: "/a.crt", KeyPath: "/a.key"}, false},
+		{"tls pem", &HTTPServerRes{Cert: "x", Key: "y", RedirectAddress: ":8080"}, false},
+		{"cert only", &HTTPServerRes{CertPath: "/a.crt"}, true},
+		{"cert twice", &HTTPServerRes{Cert: "x", CertPath: "/a.crt", Key: "y"}, true},
+		{"relative", &HTTPServerRes{CertPath: "a.crt", KeyPath: "/a.key"}, true},
+		{"redirect", &HTTPServerRes{RedirectAddress: ":8080"}, true},
+		{"auth", &HTTPServerRes{Auth: []*HTTPAuth{{Path: "/a", Username: "u"}}}, false},
+		{"auth user", &HTTPServerRes{Auth: []*HTTPAuth{{Path: "/a"}}}, true},
+		{"auth dup", &HTTPServerRes{Auth: []*HTTPAuth{{Path: "/a", Username: "u"}, {Path: "/a", Username: "v"}}}, true},
+	}
+	for _, tc := range testCases {
+		tc.res.SetName(":8443")
+		err := tc.res.Validate()
+		if tc.fail && err == nil {
+			t.Errorf("%s: validate should have failed", tc.name)
+		}
+		if !tc.fail && err != nil {
+			t.Errorf("%s: validate failed with: %v", tc.name, err)
+		}
+	}
+}
+
+func TestHTTPServerIndex1(t *testing.T) {
+	root := t.TempDir() + "/"
+	for _, dir := range []string{"sub", "empty"} {
+		if err := os.Mkdir(path.Join(root, dir), 0755); err != nil {
+			t.Errorf("could not mkdir: %v", err)
+			return
+		}
+	}
+	files := map[string]string{
+		"a.txt":          "hello",
+		"sub/index.html": "<p>index</p>",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(path.Join(root, name), []byte(data), 0644); err != nil {
+			t.Errorf("could not write: %v", err)
+			return
+		}
+	}
+
+	res := &HTTPServerRes{Root: root}
+	res.SetKind("http:server")
+	res.SetName(":8080")
+	if err := res.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	if err := res.Init(httpTestInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+
+	if code, body := httpTestGet(res, httptest.NewRequest("GET", "/a.txt", nil)); code != 200 || body != "hello" {
+		t.Errorf("got %d: %s", code, body)
+	}
+	if code, body := httpTestGet(res, httptest.NewRequest("GET", "/sub/", nil)); code != 200 || body != "<p>index</p>" {
+		t.Errorf("got %d: %s", code, body)
+	}
+	if code, _ := httpTestGet(res, httptest.NewRequest("GET", "/sub", nil)); code != http.StatusMovedPermanently {
+		t.Errorf("expected a redirect, got %d", code)
+	}
+	if code, _ := httpTestGet(res, httptest.NewRequest("GET", "/empty/", nil)); code != http.StatusNotFound {
+		t.Errorf("expected no listing, got %d", code)
+	}
+
+	res.Index = true
+	code, body := httpTestGet(res, httptest.NewRequest("GET", "/", nil))
+	if code != 200 {
+		t.Errorf("expected a listing, got %d", code)
+	}
+	for _, s := range []string{`href="a.txt"`, `href="empty/"`, `href="sub/"`} {
+		if !strings.Contains(body, s) {
+			t.Errorf("the listing doesn't contain %s: %s", s, body)
+		}
+	}
+	if code, _ := httpTestGet(res, httptest.NewRequest("GET", "/empty/", nil)); code != 200 {
+		t.Errorf("expected a listing, got %d", code)
+	}
+	if code, _ := httpTestGet(res, httptest.NewRequest("GET", "/../../etc/passwd", nil)); code == 200 {
+		t.Errorf("escaped the root")
+	}
+}
+
+func TestHTTPServerAuth1(t *testing.T) {
+	res := &HTTPServerRes{
+		Auth: []*HTTPAuth{
+			{Path: "/private", Realm: "test", Username: "user", Password: "secret"},
+			{Path: "/private/admin", Username: "admin", Password: "hunter2"},
+		},
+	}
+	res.SetKind("http:server")
+	res.SetName(":8080")
+	file := &HTTPFileRes{Data: "hidden"}
+	file.SetKind("http:file")
+	file.SetName("/private/file")
+	admin := &HTTPFileRes{Data: "admin"}
+	admin.SetKind("http:file")
+	admin.SetName("/private/admin/file")
+	public := &HTTPFileRes{Data: "public"}
+	public.SetKind("http:file")
+	public.SetName("/privateer")
+	for _, x := range []*HTTPFileRes{file, admin, public} {
+		if err := res.GroupRes(x); err != nil {
+			t.Errorf("could not group: %v", err)
+			return
+		}
+	}
+	if err := res.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	if err := res.Init(httpTestInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+
+	req := httptest.NewRequest("GET", "/private/file", nil)
+	w := httptest.NewRecorder()
+	res.handler()(w, req)
+	if w.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized, got %d", w.Result().StatusCode)
+	}
+	if h := w.Result().Header.Get("WWW-Authenticate"); !strings.Contains(h, `realm="test"`) {
+		t.Errorf("wrong auth header: %s", h)
+	}
+
+	req = httptest.NewRequest("GET", "/private/file", nil)
+	req.SetBasicAuth("user", "wrong")
+	if code, _ := httpTestGet(res, req); code != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized, got %d", code)
+	}
+
+	req = httptest.NewRequest("GET", "/private/file", nil)
+	req.SetBasicAuth("user", "secret")
+	if code, body := httpTestGet(res, req); code != 200 || body != "hidden" {
+		t.Errorf("got %d: %s", code, body)
+	}
+
+	// the longest path wins
+	req = httptest.NewRequest("GET", "/private/admin/file", nil)
+	req.SetBasicAuth("user", "secret")
+	if code, _ := httpTestGet(res, req); code != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized, got %d", code)
+	}
+	req.SetBasicAuth("admin", "hunter2")
+	if code, body := httpTestGet(res, req); code != 200 || body != "admin" {
+		t.Errorf("got %d: %s", code, body)
+	}
+
+	// only whole path segments are protected
+	if code, body := httpTestGet(res, httptest.NewRequest("GET", "/privateer", nil)); code != 200 || body != "public" {
+		t.Errorf("got %d: %s", code, body)
+	}
+}
+
+func TestHTTPServerProxy1(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "%s %s", req.Method, req.URL.Path)
+	}))
+	defer backend.Close()
+
+	res := &HTTPServerRes{}
+	res.SetKind("http:server")
+	res.SetName(":8080")
+	api := &HTTPProxyRes{Backend: backend.URL + "/base", Strip: true}
+	api.SetKind("http:proxy")
+	api.SetName("/api")
+	raw := &HTTPProxyRes{Backend: backend.URL}
+	raw.SetKind("http:proxy")
+	raw.SetName("/raw")
+	for _, x := range []*HTTPProxyRes{api, raw} {
+		if err := x.Validate(); err != nil {
+			t.Errorf("validate failed with: %v", err)
+			return
+		}
+		if err := res.GroupCmp(x); err != nil {
+			t.Errorf("could not group: %v", err)
+			return
+		}
+		if err := res.GroupRes(x); err != nil {
+			t.Errorf("could not group: %v", err)
+			return
+		}
+	}
+	if err := res.Init(httpTestInit(t)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+
+	if code, body := httpTestGet(res, httptest.NewRequest("POST", "/api/v1/things", nil)); code != 200 || body != "POST /base/v1/things" {
+		t.Errorf("got %d: %s", code, body)
+	}
+	if code, body := httpTestGet(res, httptest.NewRequest("GET", "/raw/x", nil)); code != 200 || body != "GET /raw/x" {
+		t.Errorf("got %d: %s", code, body)
+	}
+	if code, _ := httpTestGet(res, httptest.NewRequest("POST", "/other", nil)); code != http.StatusMethodNotAllowed {
+		t.Errorf("expected method not allowed, got %d", code)
+	}
+
+	bad := &HTTPProxyRes{Backend: "127.0.0.1:8080"}
+	bad.SetName("/bad")
+	if err := bad.Validate(); err == nil {
+		t.Errorf("validate should have failed")
+	}
+}
+
+func TestHTTPServerRedirect1(t *testing.T) {
+	testCases := []struct {
+		address  string
+		url      string
+		expected string
+	}{
+		{":443", "http://example.com/a?b=c", "https://example.com/a?b=c"},
+		{":443", "http://example.com:80/", "https://example.com/"},
+		{":8443", "http://example.com:8080/x", "https://example.com:8443/x"},
+		{":8443", "http://[::1]:8080/", "https://[::1]:8443/"},
+		{":443", "http://[::1]/", "https://[::1]/"},
+	}
+	for _, tc := range testCases {
+		res := &HTTPServerRes{}
+		res.SetName(tc.address)
+		w := httptest.NewRecorder()
+		res.redirectHandler()(w, httptest.NewRequest("GET", tc.url, nil))
+		if w.Result().StatusCode != http.StatusMovedPermanently {
+			t.Errorf("%s: expected a redirect, got %d", tc.url, w.Result().StatusCode)
+		}
+		if l := w.Result().Header.Get("Location"); l != tc.expected {
+			t.Errorf("%s: got %s, expected %s", tc.url, l, tc.expected)
+		}
+	}
+}
+
+func TestHTTPServerTLS1(t *testing.T) {
+	tmpdir := t.TempDir()
+	init := httpTestInit(t)
+
+	caKeyPath := path.Join(tmpdir, "ca.key")
+	caKey := &X509KeyRes{Type: "ecdsa", Curve: "P-256", Mode: "0600"}
+	caKey.SetKind("x509:key")
+	caKey.SetName(caKeyPath)
+	caPath := path.Join(tmpdir, "ca.crt")
+	ca := &X509CARes{Key: caKeyPath, CommonName: "Test CA", Validity: 1, Mode: "0644"}
+	ca.SetKind("x509:ca")
+	ca.SetName(caPath)
+	keyPath := path.Join(tmpdir, "server.key")
+	key := &X509KeyRes{Type: "ecdsa", Curve: "P-256", Mode: "0600"}
+	key.SetKind("x509:key")
+	key.SetName(keyPath)
+	certPath := path.Join(tmpdir, "server.crt")
+	cert := &X509CertRes{
+		Key:         keyPath,
+		CA:          caPath,
+		CAKey:       caKeyPath,
+		CommonName:  "server",
+		IPAddresses: []string{"127.0.0.1"},
+		Usage:       []string{"server"},
+		Validity:    1,
+		Mode:        "0644",
+	}
+	cert.SetKind("x509:cert")
+	cert.SetName(certPath)
+	for _, x := range []engine.Res{caKey, ca, key, cert} {
+		x.Init(init)
+		if _, err := x.CheckApply(true); err != nil {
+			t.Errorf("checkapply failed with: %v", err)
+			return
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("could not listen: %v", err)
+		return
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	res := &HTTPServerRes{CertPath: certPath, KeyPath: keyPath}
+	res.SetKind("http:server")
+	res.SetName(addr)
+	file := &HTTPFileRes{Data: "secure"}
+	file.SetKind("http:file")
+	file.SetName("/file")
+	if err := res.GroupRes(file); err != nil {
+		t.Errorf("could not group: %v", err)
+		return
+	}
+	if err := res.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+
+	running := make(chan struct{})
+	done := make(chan struct{})
+	init.Running = func() { close(running) }
+	init.Event = func() {}
+	init.Done = done
+	if err := res.Init(init); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	watchErr := make(chan error)
+	go func() {
+		watchErr <- res.Watch()
+	}()
+	defer func() {
+		close(done)
+		if err := <-watchErr; err != nil {
+			t.Errorf("watch failed with: %v", err)
+		}
+	}()
+	<-running
+	if _, err := res.CheckApply(true); err != nil {
+		t.Errorf("checkapply failed with: %v", err)
+		return
+	}
+
+	caCert, _ := x509ReadCert(caPath)
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}},
+		Timeout:   10 * time.Second,
+	}
+	resp, err := client.Get("https://" + addr + "/file")
+	if err != nil {
+		t.Errorf("could not get: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if string(b) != "secure" {
+		t.Errorf("got: %s", b)
+	}
+}
@@ -0,0 +1,620 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/recwatch"
+	"github.com/purpleidea/mgmt/util/errwrap"
+	"github.com/purpleidea/mgmt/util/socketset"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	engine.RegisterResource("kmod", func() engine.Res { return &KmodRes{} })
+}
+
+const (
+	// KmodStateLoaded is the state of a module which is loaded.
+	KmodStateLoaded = "loaded"
+	// KmodStateUnloaded is the state of a module which is not loaded.
+	KmodStateUnloaded = "unloaded"
+
+	// procModules lists the loaded modules.
+	procModules = "/proc/modules"
+	// kmodModulesDir is the dir with a subdir of modules for each kernel.
+	kmodModulesDir = "/lib/modules"
+	// kmodLoadDir is the dir where the modules to load at boot are listed.
+	kmodLoadDir = "/etc/modules-load.d"
+	// kmodConfDir is the dir with the modprobe configuration files.
+	kmodConfDir = "/etc/modprobe.d"
+
+	// kmodUEventGroups is the netlink group of the kernel uevents.
+	kmodUEventGroups = 0x1
+)
+
+var (
+	kmodNameRegexp   = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	kmodOptionRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+	// kmodFinitModule and kmodInitModule are the syscalls which load a
+	// module. They are variables so that the tests can replace them.
+	kmodFinitModule = unix.FinitModule
+	kmodInitModule  = unix.InitModule
+)
+
+// KmodRes is a kernel module resource. The name is the name of the module, in
+// which dashes and underscores are equivalent. It loads and unloads the module
+// directly with the finit_module and delete_module syscalls, so it doesn't need
+// modprobe, and it manages the files in /etc/modules-load.d and /etc/modprobe.d
+// so that the module is loaded at boot, or is blacklisted.
+type KmodRes struct {
+	traits.Base // add the base methods without re-implementation
+
+	init *engine.Init
+
+	// State is either loaded or unloaded. The modules which a module
+	// depends on are loaded before it, but they aren't unloaded with it. If
+	// the State is empty, then only the files are managed.
+	State string `lang:"state" yaml:"state"`
+
+	// Boot loads the module at boot, by listing it in a file in
+	// /etc/modules-load.d.
+	Boot bool `lang:"boot" yaml:"boot"`
+
+	// Options are the parameters of the module. They are written to a file
+	// in /etc/modprobe.d, and they are also used when we load the module.
+	// A module which is already loaded isn't reloaded when they change.
+	Options map[string]string `lang:"options" yaml:"options"`
+
+	// Blacklist stops the module from being loaded automatically, such as
+	// when the hardware that it supports is found. It can still be loaded
+	// explicitly.
+	Blacklist bool `lang:"blacklist" yaml:"blacklist"`
+
+	socketFile string   // path for storing the pipe socket file
+	loadFile   *FileRes // nested file resource in modules-load.d
+	confFile   *FileRes // nested file resource in modprobe.d
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *KmodRes) Default() engine.Res {
+	return &KmodRes{
+		State: KmodStateLoaded,
+	}
+}
+
+// module returns the canonical name of the module, which uses underscores.
+func (obj *KmodRes) module() string {
+	return strings.Replace(obj.Name(), "-", "_", -1)
+}
+
+// LoadFilePath returns the path to the file which loads the module at boot.
+func (obj *KmodRes) LoadFilePath() string {
+	return path.Join(kmodLoadDir, obj.module()+".conf")
+}
+
+// ConfFilePath returns the path to the modprobe configuration file.
+func (obj *KmodRes) ConfFilePath() string {
+	return path.Join(kmodConfDir, obj.module()+".conf")
+}
+
+// params returns the options in the format that the kernel takes them.
+func (obj *KmodRes) params() string {
+	params := []string{}
+	for k, v := range obj.Options {
+		if v != "" {
+			k = k + "=" + v
+		}
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	return strings.Join(params, " ")
+}
+
+// confFileContents returns the contents of the modprobe configuration file, or
+// nil if it shouldn't exist.
+func (obj *KmodRes) confFileContents() *string {
+	s := ""
+	if len(obj.Options) > 0 {
+		s += fmt.Sprintf("options %s %s\n", obj.module(), obj.params())
+	}
+	if obj.Blacklist {
+		s += fmt.Sprintf("blacklist %s\n", obj.module())
+	}
+	if s == "" {
+		return nil
+	}
+	s = "# This file is managed by mgmt.\n" + s
+	return &s
+}
+
+// makeComposite creates the nested file resources.
+func (obj *KmodRes) makeComposite() (*FileRes, *FileRes, error) {
+	newFile := func(p string, content *string) (*FileRes, error) {
+		res, err := engine.NewNamedResource("file", p)
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "error creating nested file resource")
+		}
+		file, ok := res.(*FileRes)
+		if !ok {
+			return nil, fmt.Errorf("error casting fileres")
+		}
+		file.State = "absent"
+		if content != nil {
+			file.State = "exists"
+			file.Content = content
+			file.Mode = "0644"
+		}
+		return file, nil
+	}
+
+	var load *string
+	if obj.Boot {
+		s := "# This file is managed by mgmt.\n" + obj.module() + "\n"
+		load = &s
+	}
+	loadFile, err := newFile(obj.LoadFilePath(), load)
+	if err != nil {
+		return nil, nil, err
+	}
+	confFile, err := newFile(obj.ConfFilePath(), obj.confFileContents())
+	if err != nil {
+		return nil, nil, err
+	}
+	return loadFile, confFile, nil
+}
+
+// Validate if the params passed in are valid data.
+func (obj *KmodRes) Validate() error {
+	if !kmodNameRegexp.MatchString(obj.Name()) {
+		return fmt.Errorf("invalid module name: %s", obj.Name())
+	}
+	if obj.State != "" && obj.State != KmodStateLoaded && obj.State != KmodStateUnloaded {
+		return fmt.Errorf("state must be '%s', '%s' or empty", KmodStateLoaded, KmodStateUnloaded)
+	}
+	if obj.Boot && obj.State == KmodStateUnloaded {
+		return fmt.Errorf("a module which is loaded at boot can't be unloaded")
+	}
+	if obj.Boot && obj.Blacklist {
+		return fmt.Errorf("a module which is loaded at boot can't be blacklisted")
+	}
+	for k, v := range obj.Options {
+		if !kmodOptionRegexp.MatchString(k) {
+			return fmt.Errorf("invalid option: %s", k)
+		}
+		if strings.ContainsAny(v, " \t\n\"") {
+			return fmt.Errorf("invalid value for %s: %s", k, v)
+		}
+	}
+
+	// validate nested files
+	loadFile, confFile, err := obj.makeComposite()
+	if err != nil {
+		return errwrap.Wrapf(err, "makeComposite failed in validate")
+	}
+	for _, x := range []*FileRes{loadFile, confFile} {
+		if err := x.Validate(); err != nil { // composite resource
+			return errwrap.Wrapf(err, "validate failed for embedded file: %s", x)
+		}
+	}
+
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *KmodRes) Init(init *engine.Init) error {
+	var err error
+	obj.init = init // save for later
+
+	// tmp directory for pipe socket
+	dir, err := obj.init.VarDir("")
+	if err != nil {
+		return errwrap.Wrapf(err, "could not get VarDir in Init()")
+	}
+	obj.socketFile = path.Join(dir, socketFile) // return a unique file
+
+	obj.loadFile, obj.confFile, err = obj.makeComposite()
+	if err != nil {
+		return errwrap.Wrapf(err, "makeComposite failed in init")
+	}
+	for _, x := range []*FileRes{obj.loadFile, obj.confFile} {
+		if err := x.Init(init); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *KmodRes) Close() error {
+	var reterr error
+	for _, x := range []*FileRes{obj.loadFile, obj.confFile} {
+		if x == nil {
+			continue
+		}
+		if err := x.Close(); err != nil {
+			reterr = errwrap.Append(reterr, err)
+		}
+	}
+	if obj.socketFile == "/" {
+		return fmt.Errorf("socket file should not be the root path")
+	}
+	if obj.socketFile != "" { // safety
+		if err := os.Remove(obj.socketFile); err != nil && !os.IsNotExist(err) {
+			reterr = errwrap.Append(reterr, err)
+		}
+	}
+	return reterr
+}
+
+// kmodUEvent is used to send the uevents of the netlink socket to Watch.
+type kmodUEvent struct {
+	uevent *socketset.UEvent
+	err    error
+}
+
+// Watch is the primary listener for this resource and it outputs events. It
+// receives the uevents that the kernel sends when a module is loaded or
+// unloaded, and it watches the two files.
+func (obj *KmodRes) Watch() error {
+	loadWatcher, err := recwatch.NewRecWatcher(obj.LoadFilePath(), false)
+	if err != nil {
+		return err
+	}
+	defer loadWatcher.Close()
+	confWatcher, err := recwatch.NewRecWatcher(obj.ConfFilePath(), false)
+	if err != nil {
+		return err
+	}
+	defer confWatcher.Close()
+
+	ss, err := socketset.NewSocketSet(kmodUEventGroups, obj.socketFile, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return errwrap.Wrapf(err, "error creating socket set")
+	}
+
+	// waitgroup for netlink receive goroutine
+	wg := &sync.WaitGroup{}
+	defer ss.Close()
+	// We must wait for the Shutdown() AND the select inside of SocketSet to
+	// complete before we Close, since the unblocking in SocketSet is not a
+	// synchronous operation.
+	defer wg.Wait()
+	defer ss.Shutdown() // close the netlink socket and unblock conn.receive()
+
+	eventChan := make(chan *kmodUEvent) // closed from goroutine
+	closeChan := make(chan struct{})    // channel to unblock selects in goroutine
+	defer close(closeChan)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(eventChan)
+		for {
+			uevent, err := ss.ReceiveUEvent() // calling Shutdown will stop this from blocking
+			select {
+			case eventChan <- &kmodUEvent{
+				uevent: uevent,
+				err:    err,
+			}:
+			case <-closeChan:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	obj.init.Running() // when started, notify engine that we're running
+
+	var send = false // send event?
+	for {
+		select {
+		case event, ok := <-eventChan:
+			if !ok {
+				return nil
+			}
+			if event.err != nil {
+				return errwrap.Wrapf(event.err, "error receiving uevent")
+			}
+			if !kmodIsEvent(event.uevent, obj.module()) {
+				continue
+			}
+			if obj.init.Debug {
+				obj.init.Logf("uevent: %s %s", event.uevent.Action, event.uevent.Devpath)
+			}
+			send = true
+
+		case event, ok := <-loadWatcher.Events():
+			if !ok { // channel shutdown
+				return nil
+			}
+			if err := event.Error; err != nil {
+				return errwrap.Wrapf(err, "unknown %s watcher error", obj)
+			}
+			send = true
+
+		case event, ok := <-confWatcher.Events():
+			if !ok { // channel shutdown
+				return nil
+			}
+			if err := event.Error; err != nil {
+				return errwrap.Wrapf(err, "unknown %s watcher error", obj)
+			}
+			send = true
+
+		case <-obj.init.Done: // closed by the engine to signal shutdown
+			return nil
+		}
+
+		// do all our event sending all together to avoid duplicate msgs
+		if send {
+			send = false
+			obj.init.Event() // notify engine of an event (this can block)
+		}
+	}
+}
+
+// CheckApply is run to check the state and, if apply is true, to apply the
+// necessary changes to reach the desired state. The files are written before
+// the module is loaded or unloaded.
+func (obj *KmodRes) CheckApply(apply bool) (bool, error) {
+	checkOK := true
+	for _, x := range []*FileRes{obj.loadFile, obj.confFile} {
+		c, err := x.CheckApply(apply)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "nested file failed")
+		}
+		if !c {
+			checkOK = false
+		}
+		if !c && !apply {
+			return false, nil
+		}
+	}
+
+	if obj.State == "" {
+		return checkOK, nil
+	}
+
+	name := obj.module()
+	loaded, err := kmodLoaded(procModules)
+	if err != nil {
+		return false, err
+	}
+	dir, err := kmodDir()
+	if err != nil {
+		return false, err
+	}
+	builtin, err := kmodBuiltin(dir, name)
+	if err != nil {
+		return false, err
+	}
+	if builtin && obj.State == KmodStateUnloaded {
+		return false, fmt.Errorf("the %s module is built into the kernel", name)
+	}
+	if builtin || loaded[name] == (obj.State == KmodStateLoaded) {
+		return checkOK, nil
+	}
+	if !apply {
+		return false, nil
+	}
+
+	if obj.State == KmodStateUnloaded {
+		obj.init.Logf("unloading: %s", name)
+		if err := unix.DeleteModule(name, unix.O_NONBLOCK); err != nil {
+			return false, errwrap.Wrapf(err, "error unloading %s", name)
+		}
+		return false, nil
+	}
+
+	file, deps, err := kmodLookup(dir, name)
+	if err != nil {
+		return false, err
+	}
+	// each module comes after the ones it depends on, like modprobe does
+	for i := len(deps) - 1; i >= 0; i-- {
+		if dep := kmodFileName(deps[i]); !loaded[dep] {
+			obj.init.Logf("loading: %s", dep)
+			if err := kmodInsert(path.Join(dir, deps[i]), ""); err != nil {
+				return false, err
+			}
+		}
+	}
+	obj.init.Logf("loading: %s", name)
+	if err := kmodInsert(path.Join(dir, file), obj.params()); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *KmodRes) Cmp(r engine.Res) error {
+	// we can only compare KmodRes to others of the same resource kind
+	res, ok := r.(*KmodRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.State != res.State {
+		return fmt.Errorf("the State differs")
+	}
+	if obj.Boot != res.Boot {
+		return fmt.Errorf("the Boot differs")
+	}
+	if !strMapEq(obj.Options, res.Options) {
+		return fmt.Errorf("the Options differ")
+	}
+	if obj.Blacklist != res.Blacklist {
+		return fmt.Errorf("the Blacklist differs")
+	}
+
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *KmodRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes KmodRes // indirection to avoid infinite recursion
+
+	def := obj.Default()      // get the default
+	res, ok := def.(*KmodRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to KmodRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = KmodRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// kmodIsEvent returns true if the uevent is about the module being loaded or
+// unloaded.
+func kmodIsEvent(event *socketset.UEvent, name string) bool {
+	if event.Subsystem != "module" || event.Devpath != "/module/"+name {
+		return false
+	}
+	return event.Action == "add" || event.Action == "remove"
+}
+
+// kmodDir returns the dir with the modules of the running kernel.
+func kmodDir() (string, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return "", errwrap.Wrapf(err, "error getting the kernel release")
+	}
+	release := strings.TrimRight(string(uts.Release[:]), "\x00")
+	return path.Join(kmodModulesDir, release), nil
+}
+
+// kmodFileName returns the name of the module in the file, such as nf_nat for
+// kernel/net/netfilter/nf-nat.ko.xz.
+func kmodFileName(file string) string {
+	name := path.Base(file)
+	if i := strings.Index(name, ".ko"); i >= 0 {
+		name = name[:i]
+	}
+	return strings.Replace(name, "-", "_", -1)
+}
+
+// kmodLoaded returns the set of loaded modules from the /proc/modules file. If
+// the file doesn't exist, then the kernel doesn't support modules, and none are
+// loaded.
+func kmodLoaded(file string) (map[string]bool, error) {
+	result := make(map[string]bool)
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return result, nil
+	} else if err != nil {
+		return nil, errwrap.Wrapf(err, "error reading %s", file)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			result[fields[0]] = true
+		}
+	}
+	return result, nil
+}
+
+// kmodBuiltin returns true if the module is built into the kernel, according
+// to the modules.builtin file in the dir.
+func kmodBuiltin(dir, name string) (bool, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, "modules.builtin"))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errwrap.Wrapf(err, "error reading modules.builtin")
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" && kmodFileName(line) == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// kmodLookup returns the file of the module, and the files of all of the
+// modules that it depends on, from the modules.dep file in the dir. The paths
+// are relative to the dir. The last dependency must be loaded first.
+func kmodLookup(dir, name string) (string, []string, error) {
+	file := path.Join(dir, "modules.dep")
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", nil, errwrap.Wrapf(err, "error reading %s", file)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		i := strings.Index(line, ":")
+		if i < 0 || kmodFileName(line[:i]) != name {
+			continue
+		}
+		return line[:i], strings.Fields(line[i+1:]), nil
+	}
+	return "", nil, fmt.Errorf("module %s not found in %s", name, file)
+}
+
+// kmodInsert loads the module from the file. The kernel decompresses the
+// compressed modules itself if it supports it. Otherwise, only the modules
+// which are compressed with gzip can be loaded.
+func kmodInsert(file, params string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errwrap.Wrapf(err, "error opening module")
+	}
+	defer f.Close()
+
+	compressed := !strings.HasSuffix(file, ".ko")
+	flags := 0
+	if compressed {
+		flags = unix.MODULE_INIT_COMPRESSED_FILE
+	}
+	err = kmodFinitModule(int(f.Fd()), params, flags)
+	if compressed && strings.HasSuffix(file, ".gz") && (err == unix.EINVAL || err == unix.EOPNOTSUPP) {
+		// older kernels don't know the flag, so decompress it here
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(f); err != nil {
+			return errwrap.Wrapf(err, "error decompressing %s", file)
+		}
+		var data []byte
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return errwrap.Wrapf(err, "error decompressing %s", file)
+		}
+		err = kmodInitModule(data, params)
+	}
+	if err != nil && err != unix.EEXIST { // it was loaded in the meantime
+		return errwrap.Wrapf(err, "error loading %s", file)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root
+
+package resources
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/purpleidea/mgmt/util/socketset"
+	"golang.org/x/sys/unix"
+)
+
+func TestKmodValidate1(t *testing.T) {
+	tests := []struct {
+		name string
+		res  *KmodRes
+		fail bool
+	}{
+		{"br_netfilter", &KmodRes{State: KmodStateLoaded, Boot: true}, false},
+		{"nouveau", &KmodRes{State: KmodStateUnloaded, Blacklist: true}, false},
+		{"kvm-intel", &KmodRes{Options: map[string]string{"nested": "1", "enable_apicv": "N"}}, false},
+		{"../evil", &KmodRes{State: KmodStateLoaded}, true},                                           // bad name
+		{"loop", &KmodRes{State: "running"}, true},                                                    // bad state
+		{"loop", &KmodRes{State: KmodStateUnloaded, Boot: true}, true},                                // contradiction
+		{"loop", &KmodRes{State: KmodStateLoaded, Boot: true, Blacklist: true}, true},                 // contradiction
+		{"loop", &KmodRes{State: KmodStateLoaded, Options: map[string]string{"max loop": "8"}}, true}, // bad option
+		{"loop", &KmodRes{State: KmodStateLoaded, Options: map[string]string{"max_loop": "8 9"}}, true},
+	}
+	for i, tt := range tests {
+		tt.res.SetKind("kmod")
+		tt.res.SetName(tt.name)
+		if err := tt.res.Validate(); (err != nil) != tt.fail {
+			t.Errorf("test #%d: expected fail: %t, got: %v", i, tt.fail, err)
+		}
+	}
+}
+
+func TestKmodConfFile1(t *testing.T) {
+	res := &KmodRes{
+		Options:   map[string]string{"nested": "1", "ignore_msrs": ""},
+		Blacklist: true,
+	}
+	res.SetKind("kmod")
+	res.SetName("kvm-intel")
+	if p := res.ConfFilePath(); p != "/etc/modprobe.d/kvm_intel.conf" {
+		t.Errorf("unexpected path: %s", p)
+	}
+	const expected = "# This file is managed by mgmt.\n" +
+		"options kvm_intel ignore_msrs nested=1\n" +
+		"blacklist kvm_intel\n"
+	if s := res.confFileContents(); s == nil || *s != expected {
+		t.Errorf("unexpected contents: %v", s)
+	}
+
+	res = &KmodRes{State: KmodStateLoaded}
+	res.SetKind("kmod")
+	res.SetName("loop")
+	if s := res.confFileContents(); s != nil {
+		t.Errorf("expected no file, got: %s", *s)
+	}
+}
+
+func TestKmodLookup1(t *testing.T) {
+	dir := t.TempDir()
+	const dep = "kernel/drivers/block/loop.ko.xz:\n" +
+		"kernel/net/bridge/br_netfilter.ko.zst: kernel/net/bridge/bridge.ko.zst kernel/net/802/stp.ko.zst kernel/net/llc/llc.ko.zst\n" +
+		"kernel/drivers/net/wireguard/wireguard.ko: kernel/lib/crypto/libchacha20poly1305.ko\n"
+	if err := ioutil.WriteFile(path.Join(dir, "modules.dep"), []byte(dep), 0644); err != nil {
+		t.Errorf("could not write file: %v", err)
+		return
+	}
+	const builtin = "kernel/fs/ext4/ext4.ko\nkernel/drivers/hid/hid-generic.ko\n"
+	if err := ioutil.WriteFile(path.Join(dir, "modules.builtin"), []byte(builtin), 0644); err != nil {
+		t.Errorf("could not write file: %v", err)
+		return
+	}
+
+	file, deps, err := kmodLookup(dir, "br_netfilter")
+	if err != nil || file != "kernel/net/bridge/br_netfilter.ko.zst" || len(deps) != 3 || deps[2] != "kernel/net/llc/llc.ko.zst" {
+		t.Errorf("unexpected lookup result: %s, %v, %v", file, deps, err)
+	}
+	if file, deps, err := kmodLookup(dir, "loop"); err != nil || file != "kernel/drivers/block/loop.ko.xz" || len(deps) != 0 {
+		t.Errorf("unexpected lookup result: %s, %v, %v", file, deps, err)
+	}
+	if _, _, err := kmodLookup(dir, "nope"); err == nil {
+		t.Errorf("expected a missing module to fail")
+	}
+
+	if builtin, err := kmodBuiltin(dir, "hid_generic"); err != nil || !builtin {
+		t.Errorf("expected hid_generic to be builtin: %v", err)
+	}
+	if builtin, err := kmodBuiltin(dir, "loop"); err != nil || builtin {
+		t.Errorf("expected loop not to be builtin: %v", err)
+	}
+}
+
+func TestKmodLoaded1(t *testing.T) {
+	file := path.Join(t.TempDir(), "modules")
+	const modules = "kvm_intel 380928 0 - Live 0x0000000000000000\n" +
+		"kvm 1146880 1 kvm_intel, Live 0x0000000000000000\n"
+	if err := ioutil.WriteFile(file, []byte(modules), 0644); err != nil {
+		t.Errorf("could not write file: %v", err)
+		return
+	}
+	loaded, err := kmodLoaded(file)
+	if err != nil || len(loaded) != 2 || !loaded["kvm_intel"] || !loaded["kvm"] {
+		t.Errorf("unexpected loaded modules: %v, %v", loaded, err)
+	}
+	if loaded, err := kmodLoaded(file + "-missing"); err != nil || len(loaded) != 0 {
+		t.Errorf("expected no loaded modules: %v, %v", loaded, err)
+	}
+
+	event := &socketset.UEvent{Action: "add", Devpath: "/module/kvm", Subsystem: "module"}
+	if !kmodIsEvent(event, "kvm") || kmodIsEvent(event, "kvm_intel") {
+		t.Errorf("the uevent was not matched correctly")
+	}
+}
+
+func TestKmodInsertGzip1(t *testing.T) {
+	defer func(finit func(int, string, int) error, init func([]byte, string) error) {
+		kmodFinitModule, kmodInitModule = finit, init
+	}(kmodFinitModule, kmodInitModule)
+
+	module := []byte("\x7fELF not really a module")
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(module)
+	w.Close()
+	file := path.Join(t.TempDir(), "dummy.ko.gz")
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Errorf("could not write the module: %v", err)
+		return
+	}
+
+	// the kernel doesn't know MODULE_INIT_COMPRESSED_FILE
+	kmodFinitModule = func(fd int, params string, flags int) error {
+		if flags&unix.MODULE_INIT_COMPRESSED_FILE == 0 {
+			t.Errorf("expected the compressed flag, got: %d", flags)
+		}
+		return unix.EINVAL
+	}
+	var loaded []byte
+	var initErr error
+	kmodInitModule = func(data []byte, params string) error {
+		if params != "debug=1" {
+			t.Errorf("unexpected params: %s", params)
+		}
+		loaded = data
+		return initErr
+	}
+
+	if err := kmodInsert(file, "debug=1"); err != nil {
+		t.Errorf("expected the fallback to load the module: %v", err)
+	}
+	if !bytes.Equal(loaded, module) {
+		t.Errorf("expected the decompressed module, got: %q", loaded)
+	}
+
+	initErr = unix.EEXIST // it was loaded in the meantime
+	if err := kmodInsert(file, "debug=1"); err != nil {
+		t.Errorf("expected an already loaded module to succeed: %v", err)
+	}
+	initErr = fmt.Errorf("bad module")
+	if err := kmodInsert(file, "debug=1"); err == nil {
+		t.Errorf("expected the fallback error to be returned")
+	}
+}
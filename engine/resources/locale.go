@@ -0,0 +1,528 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	engineUtil "github.com/purpleidea/mgmt/engine/util"
+	"github.com/purpleidea/mgmt/recwatch"
+	"github.com/purpleidea/mgmt/util"
+	"github.com/purpleidea/mgmt/util/errwrap"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func init() {
+	engine.RegisterResource("locale", func() engine.Res { return &LocaleRes{} })
+}
+
+const (
+	locale1Path  = "/org/freedesktop/locale1"
+	locale1Iface = "org.freedesktop.locale1"
+
+	// localeConfPath is the file with the locale variables.
+	localeConfPath = "/etc/locale.conf"
+	// vconsoleConfPath is the file with the console keymap.
+	vconsoleConfPath = "/etc/vconsole.conf"
+)
+
+// localeVars are the variables which make up the locale, other than LANG.
+var localeVars = []string{
+	"LANGUAGE",
+	"LC_CTYPE",
+	"LC_NUMERIC",
+	"LC_TIME",
+	"LC_COLLATE",
+	"LC_MONETARY",
+	"LC_MESSAGES",
+	"LC_PAPER",
+	"LC_NAME",
+	"LC_ADDRESS",
+	"LC_TELEPHONE",
+	"LC_MEASUREMENT",
+	"LC_IDENTIFICATION",
+}
+
+// LocaleRes is a resource that sets the locale and the console keymap of the
+// system. It uses systemd's localed over D-Bus, and if that isn't available, it
+// edits /etc/locale.conf and /etc/vconsole.conf instead.
+type LocaleRes struct {
+	traits.Base // add the base methods without re-implementation
+
+	init *engine.Init
+
+	// Lang is the default locale, such as en_US.UTF-8, which is set as the
+	// LANG variable.
+	Lang string `lang:"lang" yaml:"lang"`
+
+	// Vars are the other locale variables, such as LC_TIME, which override
+	// the Lang for one category. If either the Lang or the Vars are set,
+	// then the variables which aren't listed are removed.
+	Vars map[string]string `lang:"vars" yaml:"vars"`
+
+	// Keymap is the console keymap, such as us or de-latin1. If it is
+	// empty, then it is not changed.
+	Keymap string `lang:"keymap" yaml:"keymap"`
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *LocaleRes) Default() engine.Res {
+	return &LocaleRes{}
+}
+
+// Validate if the params passed in are valid data.
+func (obj *LocaleRes) Validate() error {
+	if obj.Lang == "" && len(obj.Vars) == 0 && obj.Keymap == "" {
+		return ErrResourceInsufficientParameters
+	}
+	for k, v := range obj.Vars {
+		if !util.StrInList(k, localeVars) {
+			return fmt.Errorf("invalid locale variable: %s", k)
+		}
+		if !validLocaleValue(v) {
+			return fmt.Errorf("invalid value for %s: %s", k, v)
+		}
+	}
+	if obj.Lang != "" && !validLocaleValue(obj.Lang) {
+		return fmt.Errorf("invalid lang: %s", obj.Lang)
+	}
+	if obj.Keymap != "" && !validLocaleValue(obj.Keymap) {
+		return fmt.Errorf("invalid keymap: %s", obj.Keymap)
+	}
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *LocaleRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *LocaleRes) Close() error {
+	return nil
+}
+
+// Watch is the primary listener for this resource and it outputs events. It
+// listens for the localed signals, and also watches the files in case they are
+// changed without it.
+func (obj *LocaleRes) Watch() error {
+	return systemdDaemonWatch(obj.init, locale1Path, []string{localeConfPath, vconsoleConfPath})
+}
+
+// locale returns all of the locale variables that we're managing.
+func (obj *LocaleRes) locale() map[string]string {
+	result := make(map[string]string)
+	for k, v := range obj.Vars {
+		result[k] = v
+	}
+	if obj.Lang != "" {
+		result["LANG"] = obj.Lang
+	}
+	return result
+}
+
+// CheckApply method for Locale resource.
+func (obj *LocaleRes) CheckApply(apply bool) (bool, error) {
+	conn, err := util.SystemBusPrivateUsable()
+	if err != nil || conn == nil {
+		if obj.init.Debug {
+			obj.init.Logf("the system bus is not available: %v", err)
+		}
+		return obj.fileCheckApply(apply)
+	}
+	defer conn.Close()
+
+	object := conn.Object(locale1Iface, locale1Path)
+	checkOK := true
+
+	if obj.Lang != "" || len(obj.Vars) > 0 {
+		property, err := object.GetProperty(locale1Iface + ".Locale")
+		if dbusUnavailable(err) {
+			if obj.init.Debug {
+				obj.init.Logf("localed is not available: %v", err)
+			}
+			return obj.fileCheckApply(apply)
+		} else if err != nil {
+			return false, errwrap.Wrapf(err, "failed to get the locale")
+		}
+		values, ok := property.Value().([]string)
+		if !ok {
+			return false, fmt.Errorf("received unexpected type as Locale value, got '%T'", property.Value())
+		}
+		current := make(map[string]string)
+		for _, x := range values {
+			if i := strings.Index(x, "="); i > 0 {
+				current[x[:i]] = x[i+1:]
+			}
+		}
+
+		if expected := obj.locale(); !strMapEq(current, expected) {
+			if !apply {
+				return false, nil
+			}
+			list := localeList(expected)
+			obj.init.Logf("Changing Locale: %s => %s", strings.Join(values, " "), strings.Join(list, " "))
+			if err := object.Call(locale1Iface+".SetLocale", 0, list, false).Err; err != nil {
+				return false, errwrap.Wrapf(err, "failed to call %s.SetLocale", locale1Iface)
+			}
+			checkOK = false
+		}
+	}
+
+	if obj.Keymap != "" {
+		property, err := object.GetProperty(locale1Iface + ".VConsoleKeymap")
+		if dbusUnavailable(err) {
+			if obj.init.Debug {
+				obj.init.Logf("localed is not available: %v", err)
+			}
+			return obj.fileCheckApply(apply)
+		} else if err != nil {
+			return false, errwrap.Wrapf(err, "failed to get the keymap")
+		}
+		current, ok := property.Value().(string)
+		if !ok {
+			return false, fmt.Errorf("received unexpected type as VConsoleKeymap value, got '%T'", property.Value())
+		}
+
+		if current != obj.Keymap {
+			if !apply {
+				return false, nil
+			}
+			obj.init.Logf("Changing VConsoleKeymap: %s => %s", current, obj.Keymap)
+			// the toggle keymap is cleared, and it isn't converted to X11
+			if err := object.Call(locale1Iface+".SetVConsoleKeyboard", 0, obj.Keymap, "", false, false).Err; err != nil {
+				return false, errwrap.Wrapf(err, "failed to call %s.SetVConsoleKeyboard", locale1Iface)
+			}
+			checkOK = false
+		}
+	}
+
+	return checkOK, nil
+}
+
+// fileCheckApply sets the locale and the keymap without localed.
+func (obj *LocaleRes) fileCheckApply(apply bool) (bool, error) {
+	checkOK := true
+
+	if obj.Lang != "" || len(obj.Vars) > 0 {
+		vars, err := envFileRead(localeConfPath)
+		if err != nil {
+			return false, err
+		}
+		current := make(map[string]string)
+		for k, v := range vars {
+			if isLocaleVar(k) {
+				current[k] = v
+			}
+		}
+
+		if expected := obj.locale(); !strMapEq(current, expected) {
+			if !apply {
+				return false, nil
+			}
+			obj.init.Logf("Changing Locale: %s => %s", strings.Join(localeList(current), " "), strings.Join(localeList(expected), " "))
+			if err := envFileUpdate(localeConfPath, expected, isLocaleVar); err != nil {
+				return false, err
+			}
+			checkOK = false
+		}
+	}
+
+	if obj.Keymap != "" {
+		vars, err := envFileRead(vconsoleConfPath)
+		if err != nil {
+			return false, err
+		}
+
+		if current := vars["KEYMAP"]; current != obj.Keymap {
+			if !apply {
+				return false, nil
+			}
+			obj.init.Logf("Changing VConsoleKeymap: %s => %s", current, obj.Keymap)
+			if err := envFileUpdate(vconsoleConfPath, map[string]string{"KEYMAP": obj.Keymap}, nil); err != nil {
+				return false, err
+			}
+			checkOK = false
+		}
+	}
+
+	return checkOK, nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *LocaleRes) Cmp(r engine.Res) error {
+	// we can only compare LocaleRes to others of the same resource kind
+	res, ok := r.(*LocaleRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.Lang != res.Lang {
+		return fmt.Errorf("the Lang differs")
+	}
+	if !strMapEq(obj.Vars, res.Vars) {
+		return fmt.Errorf("the Vars differ")
+	}
+	if obj.Keymap != res.Keymap {
+		return fmt.Errorf("the Keymap differs")
+	}
+
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *LocaleRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes LocaleRes // indirection to avoid infinite recursion
+
+	def := obj.Default()        // get the default
+	res, ok := def.(*LocaleRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to LocaleRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = LocaleRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// isLocaleVar returns true if the variable is part of the locale.
+func isLocaleVar(key string) bool {
+	return key == "LANG" || util.StrInList(key, localeVars)
+}
+
+// validLocaleValue returns true if the value can be stored in one of the files
+// as is, without any quoting.
+func validLocaleValue(value string) bool {
+	return value != "" && !strings.ContainsAny(value, " \t\n=\"'$`\\#")
+}
+
+// localeList returns the locale variables in the format that localed uses, in
+// a stable order.
+func localeList(vars map[string]string) []string {
+	result := []string{}
+	for k, v := range vars {
+		result = append(result, k+"="+v)
+	}
+	sort.Strings(result) // LANG comes first
+	return result
+}
+
+// envFileLine parses a line of a file with variable assignments, such as
+// /etc/locale.conf. It returns false if the line is a comment or blank.
+func envFileLine(line string) (string, string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	i := strings.Index(line, "=")
+	if i <= 0 {
+		return "", "", false
+	}
+	key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+	return key, value, true
+}
+
+// envFileRead returns the variables from a file with variable assignments. A
+// missing file has no variables.
+func envFileRead(file string) (map[string]string, error) {
+	result := make(map[string]string)
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return result, nil
+	} else if err != nil {
+		return nil, errwrap.Wrapf(err, "error reading %s", file)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if key, value, ok := envFileLine(line); ok {
+			result[key] = value
+		}
+	}
+	return result, nil
+}
+
+// envFileUpdate sets the variables in a file with variable assignments. The
+// other variables and the comments are kept as is, unless the remove function
+// returns true for them. New variables are added at the end.
+func envFileUpdate(file string, vars map[string]string, remove func(string) bool) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return errwrap.Wrapf(err, "error reading %s", file)
+	}
+
+	lines := []string{}
+	seen := make(map[string]bool)
+	if len(data) > 0 {
+		for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			key, _, ok := envFileLine(line)
+			if !ok {
+				lines = append(lines, line)
+				continue
+			}
+			if value, exists := vars[key]; exists {
+				if !seen[key] { // drop any duplicates
+					lines = append(lines, key+"="+value)
+				}
+				seen[key] = true
+				continue
+			}
+			if remove != nil && remove(key) {
+				continue
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	keys := []string{}
+	for k := range vars {
+		if !seen[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		lines = append(lines, k+"="+vars[k])
+	}
+
+	if err := ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return errwrap.Wrapf(err, "error writing %s", file)
+	}
+	return nil
+}
+
+// dbusUnavailable returns true if the error means that the service can't be
+// reached on the bus, such as when systemd isn't the init system.
+func dbusUnavailable(err error) bool {
+	var name string
+	switch e := err.(type) {
+	case dbus.Error:
+		name = e.Name
+	case *dbus.Error:
+		name = e.Name
+	default:
+		return false
+	}
+	return name == "org.freedesktop.DBus.Error.ServiceUnknown" ||
+		name == "org.freedesktop.DBus.Error.NameHasNoOwner" ||
+		strings.HasPrefix(name, "org.freedesktop.DBus.Error.Spawn.")
+}
+
+// systemdDaemonWatch is the Watch of the resources which talk to one of the
+// small systemd daemons, such as localed. It listens for the PropertiesChanged
+// signal on the path of the daemon, if the bus is available, and it also
+// watches the files where the daemon stores its settings.
+func systemdDaemonWatch(init *engine.Init, path string, files []string) error {
+	events := make(chan error)
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for _, file := range files {
+		recWatcher, err := recwatch.NewRecWatcher(file, false)
+		if err != nil {
+			return err
+		}
+		defer recWatcher.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case event, ok := <-recWatcher.Events():
+					if !ok { // channel shutdown
+						return
+					}
+					select {
+					case events <- event.Error:
+					case <-done:
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(done) // the forwarders exit before the watchers are closed
+
+	var signals chan *dbus.Signal // nil channels block forever
+	// if we share the bus with others, we will get each others messages!!
+	bus, err := util.SystemBusPrivateUsable() // don't share the bus connection!
+	if err != nil || bus == nil {
+		if init.Debug {
+			init.Logf("the system bus is not available: %v", err)
+		}
+	} else {
+		defer bus.Close()
+		args := fmt.Sprintf(
+			"type='signal', path='%s', interface='%s', member='PropertiesChanged'",
+			path,
+			dbusPropertiesIface,
+		)
+		if call := bus.BusObject().Call(engineUtil.DBusAddMatch, 0, args); call.Err != nil {
+			return errwrap.Wrapf(call.Err, "failed to subscribe to DBus events for %s", path)
+		}
+		defer bus.BusObject().Call(engineUtil.DBusRemoveMatch, 0, args) // ignore the error
+
+		signals = make(chan *dbus.Signal, 10) // closed by dbus package
+		bus.Signal(signals)
+	}
+
+	init.Running() // when started, notify engine that we're running
+
+	var send = false // send event?
+	for {
+		select {
+		case _, ok := <-signals:
+			if !ok {
+				return fmt.Errorf("the bus connection was closed")
+			}
+			send = true
+
+		case err := <-events:
+			if err != nil {
+				return errwrap.Wrapf(err, "unknown watcher error")
+			}
+			send = true
+
+		case <-init.Done: // closed by the engine to signal shutdown
+			return nil
+		}
+
+		// do all our event sending all together to avoid duplicate msgs
+		if send {
+			send = false
+			init.Event() // notify engine of an event (this can block)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root
+
+package resources
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestLocaleValidate1(t *testing.T) {
+	tests := []struct {
+		res  *LocaleRes
+		fail bool
+	}{
+		{&LocaleRes{Lang: "en_US.UTF-8"}, false},
+		{&LocaleRes{Lang: "en_CA.UTF-8", Vars: map[string]string{"LC_TIME": "en_DK.UTF-8"}}, false},
+		{&LocaleRes{Keymap: "de-latin1"}, false},
+		{&LocaleRes{}, true},                                                  // nothing to do
+		{&LocaleRes{Vars: map[string]string{"LANG": "C.UTF-8"}}, true},        // use lang
+		{&LocaleRes{Vars: map[string]string{"LC_NOPE": "C.UTF-8"}}, true},     // unknown var
+		{&LocaleRes{Lang: "en_US.UTF-8 evil"}, true},                          // whitespace
+		{&LocaleRes{Lang: "C", Vars: map[string]string{"LC_TIME": ""}}, true}, // empty value
+	}
+	for i, tt := range tests {
+		tt.res.SetKind("locale")
+		tt.res.SetName("locale")
+		if err := tt.res.Validate(); (err != nil) != tt.fail {
+			t.Errorf("test #%d: expected fail: %t, got: %v", i, tt.fail, err)
+		}
+	}
+}
+
+func TestEnvFileUpdate1(t *testing.T) {
+	file := path.Join(t.TempDir(), "locale.conf")
+
+	// a missing file is created
+	if err := envFileUpdate(file, map[string]string{"LANG": "C.UTF-8"}, isLocaleVar); err != nil {
+		t.Errorf("update failed with: %v", err)
+		return
+	}
+	if b, err := ioutil.ReadFile(file); err != nil || string(b) != "LANG=C.UTF-8\n" {
+		t.Errorf("unexpected file contents: %q, %v", b, err)
+	}
+
+	const mock = "# managed by hand\nLANG=\"en_US.UTF-8\"\nLC_TIME=en_DK.UTF-8\nLANG=C\nFONT=eurlatgr\n"
+	if err := ioutil.WriteFile(file, []byte(mock), 0644); err != nil {
+		t.Errorf("could not write file: %v", err)
+		return
+	}
+	vars, err := envFileRead(file)
+	if err != nil {
+		t.Errorf("read failed with: %v", err)
+		return
+	}
+	if vars["LANG"] != "C" || vars["LC_TIME"] != "en_DK.UTF-8" || vars["FONT"] != "eurlatgr" {
+		t.Errorf("unexpected variables: %+v", vars)
+	}
+
+	// the unlisted locale vars and the duplicates are removed
+	expected := map[string]string{"LANG": "en_CA.UTF-8", "LC_PAPER": "en_US.UTF-8"}
+	if err := envFileUpdate(file, expected, isLocaleVar); err != nil {
+		t.Errorf("update failed with: %v", err)
+		return
+	}
+	const result = "# managed by hand\nLANG=en_CA.UTF-8\nFONT=eurlatgr\nLC_PAPER=en_US.UTF-8\n"
+	if b, err := ioutil.ReadFile(file); err != nil || string(b) != result {
+		t.Errorf("unexpected file contents: %q, %v", b, err)
+	}
+
+	// without a remove function, the other vars are kept
+	if err := envFileUpdate(file, map[string]string{"KEYMAP": "us"}, nil); err != nil {
+		t.Errorf("update failed with: %v", err)
+		return
+	}
+	if b, err := ioutil.ReadFile(file); err != nil || string(b) != result+"KEYMAP=us\n" {
+		t.Errorf("unexpected file contents: %q, %v", b, err)
+	}
+}
+
+func TestLocaleList1(t *testing.T) {
+	list := localeList(map[string]string{"LC_TIME": "en_DK.UTF-8", "LANGUAGE": "fr:en", "LANG": "fr_CA.UTF-8"})
+	if len(list) != 3 || list[0] != "LANG=fr_CA.UTF-8" || list[1] != "LANGUAGE=fr:en" || list[2] != "LC_TIME=en_DK.UTF-8" {
+		t.Errorf("unexpected list: %v", list)
+	}
+}
@@ -23,7 +23,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 	"unsafe"
@@ -52,6 +55,11 @@ const (
 	procFilesystems = "/proc/filesystems"
 	// procPath is the path to /proc/mounts which contains all active mounts.
 	procPath = "/proc/mounts"
+	// procMountInfo is the path to the mountinfo file of this process, which
+	// also contains the bind mount roots and the propagation of each mount.
+	procMountInfo = "/proc/self/mountinfo"
+	// procSwaps is the path to the file which lists the active swap areas.
+	procSwaps = "/proc/swaps"
 	// fstabPath is the path to the fstab file which defines mounts.
 	fstabPath = "/etc/fstab"
 	// fstabUmask is the umask (permissions) used to edit /etc/fstab.
@@ -99,11 +107,42 @@ const (
 	// dbusSignalJobRemoved is the name of the dbus signal that produces a
 	// message when a dbus job is done (or has errored.)
 	dbusSignalJobRemoved = "JobRemoved"
+
+	// MountTypeSwap is the filesystem type of a swap file or partition.
+	MountTypeSwap = "swap"
+
+	// MountBind makes a bind mount of the Device onto the mount point.
+	MountBind = "bind"
+
+	// MountRBind makes a recursive bind mount, which also includes all of
+	// the mounts below the Device.
+	MountRBind = "rbind"
+
+	// swapFstabFile is the mount point field that is used in fstab for swap.
+	swapFstabFile = "none"
 )
 
+// mountPropagations maps the valid mount propagation types to their flags.
+var mountPropagations = map[string]uintptr{
+	"private":     unix.MS_PRIVATE,
+	"shared":      unix.MS_SHARED,
+	"slave":       unix.MS_SLAVE,
+	"unbindable":  unix.MS_UNBINDABLE,
+	"rprivate":    unix.MS_PRIVATE | unix.MS_REC,
+	"rshared":     unix.MS_SHARED | unix.MS_REC,
+	"rslave":      unix.MS_SLAVE | unix.MS_REC,
+	"runbindable": unix.MS_UNBINDABLE | unix.MS_REC,
+}
+
 // MountRes is a systemd mount resource that adds/removes entries from
 // /etc/fstab, and makes sure the defined device is mounted or unmounted
 // accordingly. The mount point is set according to the resource's name.
+//
+// Swap and bind mounts are applied directly instead of through systemd, so they
+// also work on hosts without it, and inside of a mount namespace. For swap, the
+// Device is the swap file or partition and the name is only an identifier. A
+// missing swap file is created if a Size is given, and the Device is formatted
+// with mkswap if it is blank.
 type MountRes struct {
 	traits.Base
 
@@ -117,6 +156,19 @@ type MountRes struct {
 	Freq    int               `yaml:"freq"`    // dump frequency
 	PassNo  int               `yaml:"passno"`  // verification order
 
+	// Bind is either bind or rbind, to bind mount the Device, which is then
+	// a path, onto the mount point. The Type must be empty or none.
+	Bind string `yaml:"bind"`
+
+	// Propagation is the propagation type of the mount, such as private,
+	// shared, slave or unbindable, and their recursive variants which start
+	// with an r, such as rprivate.
+	Propagation string `yaml:"propagation"`
+
+	// Size is the size in MiB of the swap file to create, if the Device
+	// doesn't exist. An existing swap file is never resized.
+	Size uint64 `yaml:"size"`
+
 	mount *fstab.Mount // struct representing the mount
 }
 
@@ -136,6 +188,25 @@ func (obj *MountRes) Validate() error {
 		return fmt.Errorf("state must be 'exists', or 'absent'")
 	}
 
+	if obj.Bind != "" && obj.Bind != MountBind && obj.Bind != MountRBind {
+		return fmt.Errorf("bind must be '%s' or '%s'", MountBind, MountRBind)
+	}
+	if obj.Bind != "" && obj.Type != "" && obj.Type != "none" {
+		return fmt.Errorf("type must be empty or 'none' for a bind mount")
+	}
+	if _, exists := mountPropagations[obj.Propagation]; obj.Propagation != "" && !exists {
+		return fmt.Errorf("propagation must be a valid propagation type")
+	}
+	if obj.Size > 0 && obj.Type != MountTypeSwap {
+		return fmt.Errorf("size can only be used with swap")
+	}
+	if obj.Type == MountTypeSwap {
+		if obj.Bind != "" || obj.Propagation != "" {
+			return fmt.Errorf("swap can't be bind mounted or have a propagation")
+		}
+		return obj.validateSwap()
+	}
+
 	// validate type
 	fs, err := ioutil.ReadFile(procFilesystems)
 	if err != nil {
@@ -147,7 +218,7 @@ func (obj *MountRes) Validate() error {
 			fsSlice = append(fsSlice[:i], fsSlice[i+1:]...)
 		}
 	}
-	if obj.State != "absent" && !util.StrInList(obj.Type, fsSlice) {
+	if obj.State != "absent" && obj.Bind == "" && !util.StrInList(obj.Type, fsSlice) {
 		return fmt.Errorf("type must be a valid filesystem type (see /proc/filesystems)")
 	}
 
@@ -170,6 +241,28 @@ func (obj *MountRes) Validate() error {
 	return nil
 }
 
+// validateSwap validates the params of a swap file or partition. The Device
+// must already exist, unless it's a file which we can create.
+func (obj *MountRes) validateSwap() error {
+	if obj.Size > 0 {
+		if !strings.HasPrefix(obj.Device, "/") {
+			return fmt.Errorf("device must be an absolute path to create a swap file")
+		}
+		return nil
+	}
+	if obj.State == "absent" {
+		return nil
+	}
+	device, err := evalSpec(obj.Device) // eval symlink
+	if err != nil {
+		return errwrap.Wrapf(err, "error evaluating spec: %s", obj.Device)
+	}
+	if err := unix.Access(device, unix.R_OK); err != nil {
+		return errwrap.Wrapf(err, "error validating device: %s", device)
+	}
+	return nil
+}
+
 // Init runs some startup code for this resource.
 func (obj *MountRes) Init(init *engine.Init) error {
 	obj.init = init //save for later
@@ -182,6 +275,23 @@ func (obj *MountRes) Init(init *engine.Init) error {
 		Freq:    obj.Freq,
 		PassNo:  obj.PassNo,
 	}
+	if obj.Type == MountTypeSwap {
+		obj.mount.File = swapFstabFile
+	}
+	if obj.Bind != "" || obj.Propagation != "" {
+		// the fstab options are what mount(8) uses for these
+		obj.mount.MntOps = make(map[string]string)
+		for k, v := range obj.Options {
+			obj.mount.MntOps[k] = v
+		}
+		if obj.Bind != "" {
+			obj.mount.VfsType = "none"
+			obj.mount.MntOps[obj.Bind] = ""
+		}
+		if obj.Propagation != "" {
+			obj.mount.MntOps[obj.Propagation] = ""
+		}
+	}
 	return nil
 }
 
@@ -191,35 +301,52 @@ func (obj *MountRes) Close() error {
 }
 
 // Watch listens for signals from the mount unit associated with the resource.
-// It also watch for changes to /etc/fstab, where mounts are defined.
+// It also watch for changes to /etc/fstab, where mounts are defined. Swap and
+// bind mounts don't use systemd, so the mount table is watched for the latter,
+// and only the fstab for the former, since the active swap areas can't be
+// watched.
 func (obj *MountRes) Watch() error {
-	// make sure systemd is running
-	if !systemdUtil.IsRunningSystemd() {
-		return fmt.Errorf("systemd is not running")
-	}
+	var ch chan *dbus.Signal // nil channels block forever
+	if obj.Type != MountTypeSwap && obj.Bind == "" {
+		// make sure systemd is running
+		if !systemdUtil.IsRunningSystemd() {
+			return fmt.Errorf("systemd is not running")
+		}
 
-	// establish a godbus connection
-	conn, err := util.SystemBusPrivateUsable()
-	if err != nil {
-		return errwrap.Wrapf(err, "error establishing dbus connection")
-	}
-	defer conn.Close()
+		// establish a godbus connection
+		conn, err := util.SystemBusPrivateUsable()
+		if err != nil {
+			return errwrap.Wrapf(err, "error establishing dbus connection")
+		}
+		defer conn.Close()
+
+		// add a dbus rule to watch signals from the mount unit.
+		args := fmt.Sprintf("type='signal', path='%s', arg0='%s'",
+			dbusUnitPath+sdbus.PathBusEscape(unit.UnitNamePathEscape((obj.Name()+".mount"))),
+			dbusMountInterface,
+		)
+		if call := conn.BusObject().Call(engineUtil.DBusAddMatch, 0, args); call.Err != nil {
+			return errwrap.Wrapf(call.Err, "error creating dbus call")
+		}
+		defer conn.BusObject().Call(engineUtil.DBusRemoveMatch, 0, args) // ignore the error
 
-	// add a dbus rule to watch signals from the mount unit.
-	args := fmt.Sprintf("type='signal', path='%s', arg0='%s'",
-		dbusUnitPath+sdbus.PathBusEscape(unit.UnitNamePathEscape((obj.Name()+".mount"))),
-		dbusMountInterface,
-	)
-	if call := conn.BusObject().Call(engineUtil.DBusAddMatch, 0, args); call.Err != nil {
-		return errwrap.Wrapf(call.Err, "error creating dbus call")
-	}
-	defer conn.BusObject().Call(engineUtil.DBusRemoveMatch, 0, args) // ignore the error
+		ch = make(chan *dbus.Signal)
+		defer close(ch)
 
-	ch := make(chan *dbus.Signal)
-	defer close(ch)
+		conn.Signal(ch)
+		defer conn.RemoveSignal(ch)
+	}
 
-	conn.Signal(ch)
-	defer conn.RemoveSignal(ch)
+	// the propagation isn't part of the mount unit
+	var mountEvents <-chan error // nil channels block forever
+	if obj.Bind != "" || obj.Propagation != "" {
+		done := make(chan struct{})
+		defer close(done)
+		var err error
+		if mountEvents, err = mountTableEvents(done); err != nil {
+			return err
+		}
+	}
 
 	// watch the fstab file
 	recWatcher, err := recwatch.NewRecWatcher(fstabPath, false)
@@ -266,6 +393,19 @@ func (obj *MountRes) Watch() error {
 
 			send = true
 
+		case err, ok := <-mountEvents:
+			if !ok {
+				return nil
+			}
+			if err != nil {
+				return errwrap.Wrapf(err, "unknown mount table watcher error")
+			}
+			if obj.init.Debug {
+				obj.init.Logf("event: the mount table changed")
+			}
+
+			send = true
+
 		case <-obj.init.Done: // closed by the engine to signal shutdown
 			return nil
 		}
@@ -311,6 +451,13 @@ func (obj *MountRes) fstabCheckApply(apply bool) (bool, error) {
 // mountCheckApply checks if the defined resource is mounted, and mounts or
 // unmounts it according to the defined state.
 func (obj *MountRes) mountCheckApply(apply bool) (bool, error) {
+	if obj.Type == MountTypeSwap {
+		return obj.swapCheckApply(apply)
+	}
+	if obj.Bind != "" {
+		return obj.bindCheckApply(apply)
+	}
+
 	exists, err := mountExists(procPath, obj.mount)
 	if err != nil {
 		return false, errwrap.Wrapf(err, "error checking if mount exists")
@@ -359,9 +506,149 @@ func (obj *MountRes) CheckApply(apply bool) (bool, error) {
 		checkOK = false
 	}
 
+	if obj.State == "exists" && obj.Propagation != "" {
+		if c, err := obj.propagationCheckApply(apply); err != nil {
+			return false, err
+		} else if !c {
+			checkOK = false
+		}
+	}
+
 	return checkOK, nil
 }
 
+// swapCheckApply creates and formats the swap file if needed, and makes sure
+// that it's active or inactive according to the defined state.
+func (obj *MountRes) swapCheckApply(apply bool) (bool, error) {
+	checkOK := true
+	device := obj.Device
+	if obj.State == "exists" {
+		if _, err := os.Stat(device); os.IsNotExist(err) && obj.Size > 0 {
+			if !apply {
+				return false, nil
+			}
+			obj.init.Logf("creating swap file: %s", device)
+			if err := createFile(device, obj.Size*1024*1024, false); err != nil {
+				return false, errwrap.Wrapf(err, "error creating swap file")
+			}
+			checkOK = false
+		} else if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		var err error
+		if device, err = evalSpec(obj.Device); err != nil {
+			return false, errwrap.Wrapf(err, "error evaluating spec: %s", obj.Device)
+		}
+
+		typ, err := blkidType(device)
+		if err != nil {
+			return false, err
+		}
+		if typ != "" && typ != MountTypeSwap {
+			return false, fmt.Errorf("refusing to mkswap %s which contains %s", device, typ)
+		}
+		if typ == "" {
+			if !apply {
+				return false, nil
+			}
+			obj.init.Logf("mkswap: %s", device)
+			if out, err := exec.Command("mkswap", device).CombinedOutput(); err != nil {
+				return false, errwrap.Wrapf(err, "mkswap failed: %s", strings.TrimSpace(string(out)))
+			}
+			checkOK = false
+		}
+	} else if d, err := evalSpec(obj.Device); err == nil {
+		device = d
+	}
+
+	active, err := swapActive(procSwaps, device)
+	if err != nil {
+		return false, err
+	}
+	if active == (obj.State == "exists") {
+		return checkOK, nil
+	}
+	if !apply {
+		return false, nil
+	}
+
+	if obj.State == "exists" {
+		obj.init.Logf("swapon: %s", device)
+		return false, swapOn(device)
+	}
+	obj.init.Logf("swapoff: %s", device)
+	return false, swapOff(device)
+}
+
+// bindCheckApply checks if the Device is bind mounted onto the mount point, and
+// mounts or unmounts it according to the defined state.
+func (obj *MountRes) bindCheckApply(apply bool) (bool, error) {
+	exists, err := bindMounted(procMountInfo, obj.Device, obj.Name())
+	if err != nil {
+		return false, errwrap.Wrapf(err, "error checking if bind mount exists")
+	}
+	if exists == (obj.State == "exists") {
+		return true, nil
+	}
+	if !apply {
+		return false, nil
+	}
+	obj.init.Logf("bindCheckApply(%t)", apply)
+
+	if obj.State == "absent" {
+		var flags int
+		if obj.Bind == MountRBind {
+			flags = unix.MNT_DETACH // there can be mounts below it
+		}
+		if err := unix.Unmount(obj.Name(), flags); err != nil {
+			return false, errwrap.Wrapf(err, "error unmounting %s", obj.Name())
+		}
+		return false, nil
+	}
+
+	var flags uintptr = unix.MS_BIND
+	if obj.Bind == MountRBind {
+		flags |= unix.MS_REC
+	}
+	if err := unix.Mount(obj.Device, obj.Name(), "", flags, ""); err != nil {
+		return false, errwrap.Wrapf(err, "error bind mounting %s", obj.Device)
+	}
+	// the other flags are ignored on the initial bind, so remount for them
+	if f, _ := mountFlags(obj.Options); f != 0 {
+		if err := unix.Mount("", obj.Name(), "", f|unix.MS_REMOUNT|unix.MS_BIND, ""); err != nil {
+			return false, errwrap.Wrapf(err, "error remounting %s", obj.Name())
+		}
+	}
+	return false, nil
+}
+
+// propagationCheckApply checks the propagation type of the mount, and changes
+// it if needed. It must be run after the mount exists.
+func (obj *MountRes) propagationCheckApply(apply bool) (bool, error) {
+	info, err := mountInfoLookup(procMountInfo, obj.Name())
+	if err != nil {
+		return false, err
+	}
+	if info == nil { // not mounted (yet) so there's nothing to change
+		if !apply {
+			return false, nil
+		}
+		return false, fmt.Errorf("%s is not mounted", obj.Name())
+	}
+	// only the top mount is checked for the recursive variants
+	if info.Propagation() == strings.TrimPrefix(obj.Propagation, "r") {
+		return true, nil
+	}
+	if !apply {
+		return false, nil
+	}
+	obj.init.Logf("propagation: %s", obj.Propagation)
+	if err := unix.Mount("", obj.Name(), "", mountPropagations[obj.Propagation], ""); err != nil {
+		return false, errwrap.Wrapf(err, "error changing the propagation of %s", obj.Name())
+	}
+	return false, nil
+}
+
 // Cmp compares two resources and return if they are equivalent.
 func (obj *MountRes) Cmp(r engine.Res) error {
 	// we can only compare MountRes to others of the same resource kind
@@ -384,6 +671,18 @@ func (obj *MountRes) Cmp(r engine.Res) error {
 	if obj.PassNo != res.PassNo {
 		return fmt.Errorf("the PassNo differs")
 	}
+	if obj.Device != res.Device {
+		return fmt.Errorf("the Device differs")
+	}
+	if obj.Bind != res.Bind {
+		return fmt.Errorf("the Bind differs")
+	}
+	if obj.Propagation != res.Propagation {
+		return fmt.Errorf("the Propagation differs")
+	}
+	if obj.Size != res.Size {
+		return fmt.Errorf("the Size differs")
+	}
 
 	return nil
 }
@@ -490,13 +789,16 @@ func (obj *MountRes) fstabEntryRemove(file string, mount *fstab.Mount) error {
 	if err != nil {
 		return errwrap.Wrapf(err, "error parsing file: %s", file)
 	}
-	for i, m := range mounts {
-		// remove any entry with the defined mountpoint
-		if m.File == mount.File {
-			mounts = append(mounts[:i], mounts[i+1:]...)
+	keep := fstab.Mounts{}
+	for _, m := range mounts {
+		// remove any entry with the defined mountpoint, or the same device
+		// for swap, since they all share the same mountpoint
+		if m.File == mount.File && (mount.VfsType != MountTypeSwap || m.Spec == mount.Spec) {
+			continue
 		}
+		keep = append(keep, m)
 	}
-	return obj.fstabWrite(file, mounts)
+	return obj.fstabWrite(file, keep)
 }
 
 // fstabWrite generates an fstab file with the given mounts, and writes them to
@@ -726,3 +1028,281 @@ func getLoopInfo(loop string) (*loopInfo, error) {
 
 	return retInfo, nil
 }
+
+// mountInfo is an entry of the mountinfo file of a process. See proc(5).
+type mountInfo struct {
+	// Root is the path of the dir in the filesystem which is mounted, which
+	// is only different from / for a bind mount.
+	Root string
+	// MountPoint is the path of the mount point.
+	MountPoint string
+	// Optional are the optional fields, such as the shared:X peer group.
+	Optional []string
+	// FsType is the type of the filesystem.
+	FsType string
+	// Source is the mounted device.
+	Source string
+}
+
+// Propagation returns the propagation type of the mount.
+func (obj *mountInfo) Propagation() string {
+	for _, x := range obj.Optional {
+		switch {
+		case strings.HasPrefix(x, "shared:"):
+			return "shared"
+		case strings.HasPrefix(x, "master:"):
+			return "slave"
+		case x == "unbindable":
+			return "unbindable"
+		}
+	}
+	return "private"
+}
+
+// parseMountInfo parses the contents of a mountinfo file.
+func parseMountInfo(data string) ([]*mountInfo, error) {
+	result := []*mountInfo{}
+	for _, line := range strings.Split(data, "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		sep := -1 // the optional fields end with a single hyphen
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || len(fields) < sep+3 {
+			return nil, fmt.Errorf("invalid mountinfo line: %s", line)
+		}
+		result = append(result, &mountInfo{
+			Root:       unescapeMountPath(fields[3]),
+			MountPoint: unescapeMountPath(fields[4]),
+			Optional:   fields[6:sep],
+			FsType:     fields[sep+1],
+			Source:     unescapeMountPath(fields[sep+2]),
+		})
+	}
+	return result, nil
+}
+
+// mountInfoLookup returns the top mount on the mount point, or nil if there is
+// nothing mounted on it.
+func mountInfoLookup(file, mountPoint string) (*mountInfo, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "error reading %s", file)
+	}
+	infos, err := parseMountInfo(string(data))
+	if err != nil {
+		return nil, err
+	}
+	mountPoint = filepath.Clean(mountPoint)
+	var result *mountInfo
+	for _, x := range infos { // the later mounts are on top
+		if x.MountPoint == mountPoint {
+			result = x
+		}
+	}
+	return result, nil
+}
+
+// unescapeMountPath decodes the octal escapes, such as \040 for a space, which
+// are used in the paths of the mount tables.
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// bindMounted returns true if the source is bind mounted onto the mount point.
+// After a bind mount, the mount point is the same inode as the source.
+func bindMounted(file, source, mountPoint string) (bool, error) {
+	info, err := mountInfoLookup(file, mountPoint)
+	if err != nil || info == nil {
+		return false, err
+	}
+	var src, dst unix.Stat_t
+	if err := unix.Stat(source, &src); err != nil {
+		return false, errwrap.Wrapf(err, "error reading %s", source)
+	}
+	if err := unix.Stat(mountPoint, &dst); err != nil {
+		return false, errwrap.Wrapf(err, "error reading %s", mountPoint)
+	}
+	return src.Dev == dst.Dev && src.Ino == dst.Ino, nil
+}
+
+// mountFlags splits the mount options into the flags which the mount syscall
+// takes, and the data string for the remaining filesystem specific options.
+func mountFlags(options map[string]string) (uintptr, string) {
+	known := map[string]uintptr{
+		"defaults":   0,
+		"rw":         0,
+		"ro":         unix.MS_RDONLY,
+		"nosuid":     unix.MS_NOSUID,
+		"nodev":      unix.MS_NODEV,
+		"noexec":     unix.MS_NOEXEC,
+		"noatime":    unix.MS_NOATIME,
+		"nodiratime": unix.MS_NODIRATIME,
+		"relatime":   unix.MS_RELATIME,
+		"sync":       unix.MS_SYNCHRONOUS,
+	}
+	var flags uintptr
+	data := []string{}
+	for k, v := range options {
+		if f, exists := known[k]; exists {
+			flags |= f
+			continue
+		}
+		if v != "" {
+			k = k + "=" + v
+		}
+		data = append(data, k)
+	}
+	sort.Strings(data)
+	return flags, strings.Join(data, ",")
+}
+
+// mountTableEvents returns a channel which receives a nil error whenever the
+// mount table of this process changes. The kernel signals this with POLLPRI on
+// the mountinfo file. It stops when the done channel is closed.
+func mountTableEvents(done <-chan struct{}) (<-chan error, error) {
+	f, err := os.Open(procMountInfo)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan error)
+	go func() {
+		defer close(ch)
+		defer f.Close()
+		fds := []unix.PollFd{{Fd: int32(f.Fd()), Events: unix.POLLPRI}}
+		for {
+			n, err := unix.Poll(fds, 1000) // wake up to check for done
+			if err == unix.EINTR {
+				continue
+			}
+			var event error
+			if err != nil {
+				event = err
+			} else if n == 0 {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				continue
+			}
+			select {
+			case ch <- event:
+				if event != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// createFile creates a file of the given size. A sparse file doesn't allocate
+// any space, which a swap file must not be.
+func createFile(name string, size uint64, sparse bool) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if sparse {
+		err = f.Truncate(int64(size))
+	} else if err = unix.Fallocate(int(f.Fd()), 0, 0, int64(size)); err == unix.EOPNOTSUPP {
+		// not every filesystem supports it, so write the zeroes instead
+		zeroes := make([]byte, 1024*1024)
+		for written := uint64(0); written < size && err == nil; written += uint64(len(zeroes)) {
+			if size-written < uint64(len(zeroes)) {
+				zeroes = zeroes[:size-written]
+			}
+			_, err = f.Write(zeroes)
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(name) // don't leave a broken file behind
+	}
+	return err
+}
+
+// blkidType returns the type of the filesystem or other signature, such as
+// swap, that blkid finds on the device or file. It is empty if there is none.
+func blkidType(device string) (string, error) {
+	cmd := exec.Command("blkid", "-p", "-o", "value", "-s", "TYPE", device)
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+		return "", nil // nothing was found
+	}
+	if err != nil {
+		return "", errwrap.Wrapf(err, "error running blkid on %s", device)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// swapActive returns true if the device is an active swap area according to
+// the given file (typically /proc/swaps.)
+func swapActive(file, device string) (bool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "error reading %s", file)
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if i == 0 || len(fields) == 0 { // skip the header
+			continue
+		}
+		if unescapeMountPath(fields[0]) == device {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// swapOn activates the swap area on the device.
+func swapOn(device string) error {
+	p, err := unix.BytePtrFromString(device)
+	if err != nil {
+		return err
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_SWAPON, uintptr(unsafe.Pointer(p)), 0, 0); errno != 0 {
+		return errwrap.Wrapf(errno, "error activating swap on %s", device)
+	}
+	return nil
+}
+
+// swapOff deactivates the swap area on the device.
+func swapOff(device string) error {
+	p, err := unix.BytePtrFromString(device)
+	if err != nil {
+		return err
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_SWAPOFF, uintptr(unsafe.Pointer(p)), 0, 0); errno != 0 {
+		return errwrap.Wrapf(errno, "error deactivating swap on %s", device)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build root && !darwin
+
+package resources
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+
+	"github.com/purpleidea/mgmt/engine"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountnsTest runs the test function inside of a new mount namespace, with an
+// empty fstab, so that the mounts that it creates don't touch the host. The
+// test is skipped if we don't have the privileges to create one.
+func mountnsTest(t *testing.T, fn func(init *engine.Init, tmpdir string)) {
+	tmpdir := t.TempDir()
+	fstabMock := path.Join(tmpdir, "fstab")
+	if err := ioutil.WriteFile(fstabMock, []byte{}, 0644); err != nil {
+		t.Errorf("could not write the fstab: %v", err)
+		return
+	}
+
+	skip := make(chan error)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// the namespace belongs to this thread, so it must never be reused
+		runtime.LockOSThread()
+
+		if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+			skip <- err
+			return
+		}
+		close(skip)
+		if err := unix.Mount("", "/", "", unix.MS_PRIVATE|unix.MS_REC, ""); err != nil {
+			t.Errorf("could not make the mounts private: %v", err)
+			return
+		}
+		if err := unix.Mount(fstabMock, fstabPath, "", unix.MS_BIND, ""); err != nil {
+			t.Errorf("could not mock the fstab: %v", err)
+			return
+		}
+		// /proc/self is the main thread, which is in the old namespace
+		if err := unix.Mount("/proc/thread-self/mountinfo", procMountInfo, "", unix.MS_BIND, ""); err != nil {
+			t.Errorf("could not mock the mountinfo: %v", err)
+			return
+		}
+
+		fn(&engine.Init{
+			Logf: func(format string, v ...interface{}) {
+				t.Logf("test: "+format, v...)
+			},
+		}, tmpdir)
+	}()
+	if err, ok := <-skip; ok {
+		<-done
+		t.Skipf("could not create a mount namespace: %v", err)
+		return
+	}
+	<-done
+}
+
+// mountRes builds, validates and initializes a resource.
+func mountRes(t *testing.T, init *engine.Init, res engine.Res, kind, name string) bool {
+	res.SetKind(kind)
+	res.SetName(name)
+	if err := res.Validate(); err != nil {
+		t.Errorf("%s: validate failed with: %v", name, err)
+		return false
+	}
+	if err := res.Init(init); err != nil {
+		t.Errorf("%s: init failed with: %v", name, err)
+		return false
+	}
+	return true
+}
+
+// mountApply runs CheckApply twice, and expects a change and then none.
+func mountApply(t *testing.T, res engine.Res) bool {
+	if checkOK, err := res.CheckApply(true); err != nil || checkOK {
+		t.Errorf("%s: expected a change, got: %t, %v", res.Name(), checkOK, err)
+		return false
+	}
+	if checkOK, err := res.CheckApply(true); err != nil || !checkOK {
+		t.Errorf("%s: expected no change, got: %t, %v", res.Name(), checkOK, err)
+		return false
+	}
+	return true
+}
+
+func TestMountBind1(t *testing.T) {
+	mountnsTest(t, func(init *engine.Init, tmpdir string) {
+		src := path.Join(tmpdir, "src")
+		dst := path.Join(tmpdir, "dst")
+		for _, dir := range []string{src, dst} {
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Errorf("could not make dir: %v", err)
+				return
+			}
+		}
+		if err := ioutil.WriteFile(path.Join(src, "hello"), []byte("hello\n"), 0644); err != nil {
+			t.Errorf("could not write file: %v", err)
+			return
+		}
+
+		res := (&MountRes{}).Default().(*MountRes)
+		res.State = "exists"
+		res.Device = src
+		res.Bind = MountBind
+		res.Propagation = "private"
+		res.Options = map[string]string{"ro": ""}
+		if !mountRes(t, init, res, "mount", dst) || !mountApply(t, res) {
+			return
+		}
+		if _, err := os.Stat(path.Join(dst, "hello")); err != nil {
+			t.Errorf("the bind mount is missing: %v", err)
+		}
+		if err := ioutil.WriteFile(path.Join(dst, "nope"), []byte{}, 0644); err == nil {
+			t.Errorf("the bind mount is not read-only")
+		}
+		if exists, err := fstabEntryExists(fstabPath, res.mount); err != nil || !exists {
+			t.Errorf("the fstab entry is missing: %v", err)
+		}
+
+		res.State = "absent"
+		if !mountApply(t, res) {
+			return
+		}
+		if _, err := os.Stat(path.Join(dst, "hello")); !os.IsNotExist(err) {
+			t.Errorf("the bind mount still exists: %v", err)
+		}
+		if exists, err := fstabEntryExists(fstabPath, res.mount); err != nil || exists {
+			t.Errorf("the fstab entry still exists: %v", err)
+		}
+	})
+}
+
+func TestMountSwap1(t *testing.T) {
+	mountnsTest(t, func(init *engine.Init, tmpdir string) {
+		file := path.Join(tmpdir, "swapfile")
+		res := (&MountRes{}).Default().(*MountRes)
+		res.State = "exists"
+		res.Device = file
+		res.Type = MountTypeSwap
+		res.Size = 16
+		if !mountRes(t, init, res, "mount", "swap") {
+			return
+		}
+
+		checkOK, err := res.CheckApply(true)
+		if active, _ := swapActive(procSwaps, file); active {
+			defer swapOff(file)
+		}
+		if err == unix.EPERM || err == unix.EINVAL {
+			t.Skipf("swap is not supported here: %v", err)
+			return
+		}
+		if err != nil || checkOK {
+			t.Errorf("expected a change, got: %t, %v", checkOK, err)
+			return
+		}
+		if typ, err := blkidType(file); err != nil || typ != MountTypeSwap {
+			t.Errorf("the swap file was not formatted: %s, %v", typ, err)
+		}
+		if exists, err := fstabEntryExists(fstabPath, res.mount); err != nil || !exists {
+			t.Errorf("the fstab entry is missing: %v", err)
+		}
+		if checkOK, err := res.CheckApply(true); err != nil || !checkOK {
+			t.Errorf("expected no change, got: %t, %v", checkOK, err)
+		}
+
+		res.State = "absent"
+		if !mountApply(t, res) {
+			return
+		}
+		if active, err := swapActive(procSwaps, file); err != nil || active {
+			t.Errorf("the swap is still active: %v", err)
+		}
+	})
+}
+
+func TestDiskImage1(t *testing.T) {
+	mountnsTest(t, func(init *engine.Init, tmpdir string) {
+		image := path.Join(tmpdir, "disk.img")
+		mnt := path.Join(tmpdir, "mnt")
+		res := (&DiskImageRes{}).Default().(*DiskImageRes)
+		res.Size = 16
+		res.Type = "ext4"
+		res.Mount = mnt
+		res.Options = map[string]string{"noatime": ""}
+		if !mountRes(t, init, res, "disk:image", image) || !mountApply(t, res) {
+			return
+		}
+		if err := ioutil.WriteFile(path.Join(mnt, "hello"), []byte("hello\n"), 0644); err != nil {
+			t.Errorf("could not write to the image: %v", err)
+		}
+
+		res.State = "absent"
+		if !mountApply(t, res) {
+			return
+		}
+		if _, err := os.Stat(image); !os.IsNotExist(err) {
+			t.Errorf("the image still exists: %v", err)
+		}
+		if info, err := mountInfoLookup(procMountInfo, mnt); err != nil || info != nil {
+			t.Errorf("the image is still mounted: %+v, %v", info, err)
+		}
+	})
+}
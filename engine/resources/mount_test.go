@@ -25,6 +25,7 @@ import (
 	"testing"
 
 	fstab "github.com/deniswernert/go-fstab"
+	"golang.org/x/sys/unix"
 )
 
 const fstabMock1 = `UUID=ef5726f2-615c-4350-b0ab-f106e5fc90ad / ext4 defaults 1 1` + "\n"
@@ -293,3 +294,121 @@ func TestMountCompare(t *testing.T) {
 		}
 	}
 }
+
+const mountInfoMock1 = `22 1 253:0 / / rw,relatime shared:1 - ext4 /dev/mapper/root rw
+35 22 0:32 / /tmp rw,nosuid,nodev shared:15 - tmpfs tmpfs rw
+61 22 253:0 /srv/data /mnt/my\040data rw,relatime master:1 - ext4 /dev/mapper/root rw
+62 35 7:0 / /tmp/image rw,relatime - ext4 /dev/loop0 rw
+63 35 0:45 / /tmp/image rw,relatime unbindable - tmpfs tmpfs rw
+`
+
+func TestParseMountInfo(t *testing.T) {
+	infos, err := parseMountInfo(mountInfoMock1)
+	if err != nil {
+		t.Errorf("error parsing mountinfo: %v", err)
+		return
+	}
+	if len(infos) != 5 {
+		t.Errorf("expected 5 mounts, got: %d", len(infos))
+		return
+	}
+	tests := []struct {
+		root        string
+		mountPoint  string
+		source      string
+		propagation string
+	}{
+		{"/", "/", "/dev/mapper/root", "shared"},
+		{"/", "/tmp", "tmpfs", "shared"},
+		{"/srv/data", "/mnt/my data", "/dev/mapper/root", "slave"},
+		{"/", "/tmp/image", "/dev/loop0", "private"},
+		{"/", "/tmp/image", "tmpfs", "unbindable"},
+	}
+	for i, tt := range tests {
+		info := infos[i]
+		if info.Root != tt.root || info.MountPoint != tt.mountPoint || info.Source != tt.source {
+			t.Errorf("mount #%d: unexpected result: %+v", i, info)
+		}
+		if p := info.Propagation(); p != tt.propagation {
+			t.Errorf("mount #%d: expected propagation: %s, got: %s", i, tt.propagation, p)
+		}
+	}
+
+	if _, err := parseMountInfo("22 1 253:0 / / rw shared:1\n"); err == nil {
+		t.Errorf("expected a line without a separator to fail")
+	}
+}
+
+func TestMountInfoLookup(t *testing.T) {
+	file, err := ioutil.TempFile("", "mountinfo")
+	if err != nil {
+		t.Errorf("error creating temp file: %v", err)
+		return
+	}
+	defer os.Remove(file.Name())
+	if err := ioutil.WriteFile(file.Name(), []byte(mountInfoMock1), 0644); err != nil {
+		t.Errorf("error writing mountinfo file: %v", err)
+		return
+	}
+
+	// the last mount on top of the mount point wins
+	info, err := mountInfoLookup(file.Name(), "/tmp/image/")
+	if err != nil || info == nil || info.Source != "tmpfs" {
+		t.Errorf("unexpected lookup result: %+v, %v", info, err)
+	}
+	info, err = mountInfoLookup(file.Name(), "/mnt")
+	if err != nil || info != nil {
+		t.Errorf("expected nothing to be mounted: %+v, %v", info, err)
+	}
+}
+
+func TestMountFlags(t *testing.T) {
+	tests := []struct {
+		options map[string]string
+		flags   uintptr
+		data    string
+	}{
+		{map[string]string{"defaults": ""}, 0, ""},
+		{map[string]string{"ro": "", "noexec": ""}, unix.MS_RDONLY | unix.MS_NOEXEC, ""},
+		{map[string]string{"nosuid": "", "size": "64m", "mode": "0755"}, unix.MS_NOSUID, "mode=0755,size=64m"},
+		{map[string]string{"discard": ""}, 0, "discard"},
+	}
+	for i, tt := range tests {
+		flags, data := mountFlags(tt.options)
+		if flags != tt.flags || data != tt.data {
+			t.Errorf("test #%d: expected: %d, %q, got: %d, %q", i, tt.flags, tt.data, flags, data)
+		}
+	}
+}
+
+func TestSwapActive(t *testing.T) {
+	const swapsMock = "Filename\t\t\t\tType\t\tSize\t\tUsed\t\tPriority\n" +
+		"/dev/dm-1                               partition\t8388604\t\t0\t\t-2\n" +
+		"/var/swap\\040file                       file\t\t1048572\t\t0\t\t-3\n"
+	file, err := ioutil.TempFile("", "swaps")
+	if err != nil {
+		t.Errorf("error creating temp file: %v", err)
+		return
+	}
+	defer os.Remove(file.Name())
+	if err := ioutil.WriteFile(file.Name(), []byte(swapsMock), 0644); err != nil {
+		t.Errorf("error writing swaps file: %v", err)
+		return
+	}
+
+	for device, expected := range map[string]bool{
+		"/dev/dm-1":      true,
+		"/var/swap file": true,
+		"/var/swap":      false,
+		"Filename":       false,
+	} {
+		active, err := swapActive(file.Name(), device)
+		if err != nil {
+			t.Errorf("error reading swaps: %v", err)
+			return
+		}
+		if active != expected {
+			t.Errorf("swapActive(%s) wanted: %t, got: %t", device, expected, active)
+		}
+	}
+}
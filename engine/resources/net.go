@@ -56,6 +56,9 @@ const (
 	networkdUnitFileDir = "/etc/systemd/network/"
 	// networkdUnitFileExt is the file extension for networkd unit files.
 	networkdUnitFileExt = ".network"
+	// networkdNetdevFileExt is the file extension for networkd files which
+	// define the virtual links that we create.
+	networkdNetdevFileExt = ".netdev"
 	// networkdUnitFileUmask sets the permissions on the systemd unit file.
 	networkdUnitFileUmask = 0644
 
@@ -63,6 +66,15 @@ const (
 	ifaceUp = "up"
 	// ifaceDown is the down (off) interface state.
 	ifaceDown = "down"
+	// ifaceAbsent is the state where a link that we create is removed.
+	ifaceAbsent = "absent"
+
+	// NetTypeVlan is the link type of a vlan interface.
+	NetTypeVlan = "vlan"
+	// NetTypeBridge is the link type of a bridge interface.
+	NetTypeBridge = "bridge"
+	// NetTypeDummy is the link type of a dummy interface.
+	NetTypeDummy = "dummy"
 
 	// Netlink multicast groups to watch for events. For all groups see:
 	// https://github.com/torvalds/linux/blob/master/include/uapi/linux/rtnetlink.h
@@ -71,6 +83,7 @@ const (
 	rtmGrpIPv4IfAddr  = 0x10  // add/delete IPv4 addresses
 	rtmGrpIPv6IfAddr  = 0x100 // add/delete IPv6 addresses
 	rtmGrpIPv4IfRoute = 0x40  // add delete routes
+	rtmGrpIPv6IfRoute = 0x400 // add delete IPv6 routes
 
 	// IP routing protocols for used for netlink route messages. For all
 	// protocols see:
@@ -85,16 +98,36 @@ const (
 // of a network link. Configuration is also stored in a networkd configuration
 // file, so the network is available upon reboot. The name of the resource is
 // the string representing the network interface name. This could be "eth0" for
-// example.
+// example. If a Type is specified, then the link is created if it is missing.
 type NetRes struct {
 	traits.Base // add the base methods without re-implementation
+	traits.Edgeable
 
 	init *engine.Init
 
 	// State is the desired state of the interface. It can be "up", "down",
-	// or the empty string to leave that unspecified.
+	// or the empty string to leave that unspecified. A link with a Type can
+	// also be "absent" so that it gets removed.
 	State string `lang:"state" yaml:"state"`
 
+	// Type is the kind of virtual link to create if it doesn't exist. It
+	// can be "vlan", "bridge" or "dummy". If this is empty, then the link
+	// must already exist, which is the case for physical interfaces. If
+	// the link exists with a different type, then this is an error.
+	Type string `lang:"type" yaml:"type"`
+
+	// Parent is the name of the link that a vlan is created on. It is only
+	// used with the vlan Type.
+	Parent string `lang:"parent" yaml:"parent"`
+
+	// VlanID is the vlan id, from 1 to 4094. It is only used with the vlan
+	// Type.
+	VlanID uint16 `lang:"vlan_id" yaml:"vlan_id"`
+
+	// Master is the name of the bridge that this link should be a member
+	// of. If this is empty, then the membership is left unspecified.
+	Master string `lang:"master" yaml:"master"`
+
 	// Addrs is the list of addresses to set on the interface. They must
 	// each be in CIDR notation such as: 192.0.2.42/24 for example.
 	Addrs []string `lang:"addrs" yaml:"addrs"`
@@ -108,8 +141,9 @@ type NetRes struct {
 	// XXX: this could also be "ipv4" or "ipv6", add those as a second option?
 	IPForward *bool `lang:"ip_forward" yaml:"ip_forward"`
 
-	iface        *iface // a struct containing the net.Interface and netlink.Link
-	unitFilePath string // the interface unit file path
+	iface          *iface // a struct containing the net.Interface and netlink.Link
+	unitFilePath   string // the interface unit file path
+	netdevFilePath string // the netdev unit file path, if we create the link
 
 	socketFile string // path for storing the pipe socket file
 }
@@ -129,8 +163,31 @@ func (obj *NetRes) Default() engine.Res {
 // Validate if the params passed in are valid data.
 func (obj *NetRes) Validate() error {
 	// validate state
-	if obj.State != ifaceUp && obj.State != ifaceDown && obj.State != "" {
-		return fmt.Errorf("state must be up, down or empty")
+	if obj.State != ifaceUp && obj.State != ifaceDown && obj.State != ifaceAbsent && obj.State != "" {
+		return fmt.Errorf("state must be up, down, absent or empty")
+	}
+	if obj.State == ifaceAbsent && obj.Type == "" {
+		return fmt.Errorf("only a link with a type can be absent")
+	}
+
+	// validate the link type
+	switch obj.Type {
+	case "", NetTypeBridge, NetTypeDummy:
+		if obj.Parent != "" || obj.VlanID != 0 {
+			return fmt.Errorf("the parent and vlan id can only be used with a vlan")
+		}
+	case NetTypeVlan:
+		if obj.Parent == "" {
+			return fmt.Errorf("a vlan needs a parent")
+		}
+		if obj.VlanID < 1 || obj.VlanID > 4094 {
+			return fmt.Errorf("the vlan id must be between 1 and 4094")
+		}
+	default:
+		return fmt.Errorf("unknown link type: %s", obj.Type)
+	}
+	if obj.Master == obj.Name() || obj.Parent == obj.Name() {
+		return fmt.Errorf("a link can't refer to itself")
 	}
 
 	// validate network address input
@@ -147,10 +204,12 @@ func (obj *NetRes) Validate() error {
 		}
 	}
 
-	// validate the interface name
-	_, err := net.InterfaceByName(obj.Name())
-	if err != nil {
-		return errwrap.Wrapf(err, "error finding interface: %s", obj.Name())
+	// validate the interface name, links with a type might not exist yet
+	if obj.Type == "" {
+		_, err := net.InterfaceByName(obj.Name())
+		if err != nil {
+			return errwrap.Wrapf(err, "error finding interface: %s", obj.Name())
+		}
 	}
 
 	return nil
@@ -169,18 +228,18 @@ func (obj *NetRes) Init(init *engine.Init) error {
 	}
 	obj.socketFile = path.Join(dir, socketFile) // return a unique file
 
-	// store the network interface in the struct
+	// store the network interface in the struct, if we create the link
+	// then it's looked up again once it exists
 	obj.iface = &iface{}
-	if obj.iface.iface, err = net.InterfaceByName(obj.Name()); err != nil {
-		return errwrap.Wrapf(err, "error finding interface: %s", obj.Name())
-	}
-	// store the netlink link to use as interface input in netlink functions
-	if obj.iface.link, err = netlink.LinkByName(obj.Name()); err != nil {
-		return errwrap.Wrapf(err, "error finding link: %s", obj.Name())
+	if err := obj.iface.lookup(obj.Name()); err != nil && obj.Type == "" {
+		return err
 	}
 
 	// build the path to the networkd configuration file
 	obj.unitFilePath = networkdUnitFileDir + IfacePrefix + obj.Name() + networkdUnitFileExt
+	if obj.Type != "" {
+		obj.netdevFilePath = networkdUnitFileDir + IfacePrefix + obj.Name() + networkdNetdevFileExt
+	}
 
 	return nil
 }
@@ -226,6 +285,17 @@ func (obj *NetRes) Watch() error {
 	// close the recwatcher when we're done
 	defer recWatcher.Close()
 
+	// watch the systemd-networkd netdev file if we create the link
+	var netdevEvents chan recwatch.Event // nil channels block forever
+	if obj.netdevFilePath != "" {
+		netdevWatcher, err := recwatch.NewRecWatcher(obj.netdevFilePath, false)
+		if err != nil {
+			return err
+		}
+		defer netdevWatcher.Close()
+		netdevEvents = netdevWatcher.Events()
+	}
+
 	// channel for netlink messages
 	nlChan := make(chan *nlChanStruct) // closed from goroutine
 
@@ -299,6 +369,19 @@ func (obj *NetRes) Watch() error {
 
 			send = true
 
+		case event, ok := <-netdevEvents:
+			if !ok {
+				return fmt.Errorf("unexpected close")
+			}
+			if err := event.Error; err != nil {
+				return errwrap.Wrapf(err, "unknown recwatcher error")
+			}
+			if obj.init.Debug {
+				obj.init.Logf("Event(%s): %v", event.Body.Name, event.Body.Op)
+			}
+
+			send = true
+
 		case <-obj.init.Done: // closed by the engine to signal shutdown
 			return nil
 		}
@@ -311,6 +394,117 @@ func (obj *NetRes) Watch() error {
 	}
 }
 
+// linkCheckApply creates or removes the link if it has a Type. It returns true
+// in exists if the link exists once it's done, so that the other checks can
+// run. If a link with the same name but a different type exists, it errors.
+func (obj *NetRes) linkCheckApply(apply bool) (checkOK bool, exists bool, err error) {
+	link, err := netlink.LinkByName(obj.Name())
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		link, err = nil, nil
+	}
+	if err != nil {
+		return false, false, errwrap.Wrapf(err, "error finding link: %s", obj.Name())
+	}
+
+	if link != nil && obj.Type != "" && link.Type() != obj.Type {
+		return false, false, fmt.Errorf("link %s is a %s, not a %s", obj.Name(), link.Type(), obj.Type)
+	}
+	if link != nil && obj.Type == NetTypeVlan {
+		vlan, ok := link.(*netlink.Vlan)
+		if !ok {
+			return false, false, fmt.Errorf("link %s is not a vlan", obj.Name())
+		}
+		parent, err := netlink.LinkByName(obj.Parent)
+		if err != nil {
+			return false, false, errwrap.Wrapf(err, "error finding parent link: %s", obj.Parent)
+		}
+		// these can't be changed, the link would have to be recreated
+		if vlan.VlanId != int(obj.VlanID) || vlan.ParentIndex != parent.Attrs().Index {
+			return false, false, fmt.Errorf("vlan %s has a different parent or id", obj.Name())
+		}
+	}
+
+	if obj.State == ifaceAbsent {
+		if link == nil {
+			return true, false, nil
+		}
+		if !apply {
+			return false, true, nil
+		}
+		obj.init.Logf("deleting link: %s", obj.Name())
+		if err := netlink.LinkDel(link); err != nil {
+			return false, false, errwrap.Wrapf(err, "error deleting link: %s", obj.Name())
+		}
+		return false, false, nil
+	}
+
+	if link != nil {
+		// the link might have been recreated since we last looked
+		if err := obj.iface.lookup(obj.Name()); err != nil {
+			return false, false, err
+		}
+		return true, true, nil
+	}
+	if obj.Type == "" { // we can't create physical links
+		return false, false, fmt.Errorf("link %s does not exist", obj.Name())
+	}
+	if !apply {
+		return false, false, nil
+	}
+
+	obj.init.Logf("creating %s link: %s", obj.Type, obj.Name())
+	attrs := netlink.LinkAttrs{Name: obj.Name()}
+	switch obj.Type {
+	case NetTypeVlan:
+		parent, err := netlink.LinkByName(obj.Parent)
+		if err != nil {
+			return false, false, errwrap.Wrapf(err, "error finding parent link: %s", obj.Parent)
+		}
+		attrs.ParentIndex = parent.Attrs().Index
+		link = &netlink.Vlan{LinkAttrs: attrs, VlanId: int(obj.VlanID)}
+	case NetTypeBridge:
+		link = &netlink.Bridge{LinkAttrs: attrs}
+	case NetTypeDummy:
+		link = &netlink.Dummy{LinkAttrs: attrs}
+	}
+	if err := netlink.LinkAdd(link); err != nil {
+		return false, false, errwrap.Wrapf(err, "error creating link: %s", obj.Name())
+	}
+	if err := obj.iface.lookup(obj.Name()); err != nil {
+		return false, false, err
+	}
+
+	return false, true, nil
+}
+
+// masterCheckApply checks that the link is a member of the Master bridge.
+func (obj *NetRes) masterCheckApply(apply bool) (bool, error) {
+	if obj.Master == "" {
+		return true, nil
+	}
+	master, err := netlink.LinkByName(obj.Master)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "error finding master link: %s", obj.Master)
+	}
+	link, err := netlink.LinkByName(obj.Name())
+	if err != nil {
+		return false, errwrap.Wrapf(err, "error finding link: %s", obj.Name())
+	}
+	if link.Attrs().MasterIndex == master.Attrs().Index {
+		return true, nil
+	}
+
+	if !apply {
+		return false, nil
+	}
+	obj.init.Logf("masterCheckApply(%t)", apply)
+
+	if err := netlink.LinkSetMasterByIndex(link, master.Attrs().Index); err != nil {
+		return false, errwrap.Wrapf(err, "error adding %s to %s", obj.Name(), obj.Master)
+	}
+	return false, nil
+}
+
 // ifaceCheckApply checks the state of the network device and brings it up or
 // down as necessary.
 func (obj *NetRes) ifaceCheckApply(apply bool) (bool, error) {
@@ -472,12 +666,86 @@ func (obj *NetRes) fileCheckApply(apply bool) (bool, error) {
 	return false, nil
 }
 
+// netdevCheckApply checks and maintains the systemd-networkd netdev file which
+// defines the link that we create, or removes it if the link is absent.
+func (obj *NetRes) netdevCheckApply(apply bool) (bool, error) {
+	if obj.netdevFilePath == "" {
+		return true, nil
+	}
+	unitFile, err := ioutil.ReadFile(obj.netdevFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errwrap.Wrapf(err, "error reading file")
+	}
+	exists := err == nil
+
+	if obj.State == ifaceAbsent {
+		checkOK := true
+		for _, p := range []string{obj.netdevFilePath, obj.unitFilePath} {
+			if _, err := os.Stat(p); os.IsNotExist(err) {
+				continue
+			}
+			checkOK = false
+			if !apply {
+				return false, nil
+			}
+			if err := os.Remove(p); err != nil {
+				return false, errwrap.Wrapf(err, "error removing configuration file")
+			}
+		}
+		return checkOK, nil
+	}
+
+	contents := obj.netdevFileContents()
+	if exists && bytes.Equal(unitFile, contents) {
+		return true, nil
+	}
+
+	if !apply {
+		return false, nil
+	}
+	obj.init.Logf("netdevCheckApply(%t)", apply)
+
+	if err := ioutil.WriteFile(obj.netdevFilePath, contents, networkdUnitFileUmask); err != nil {
+		return false, errwrap.Wrapf(err, "error writing configuration file")
+	}
+	return false, nil
+}
+
 // CheckApply is run to check the state and, if apply is true, to apply the
 // necessary changes to reach the desired state. This is run before Watch and
 // again if Watch finds a change occurring to the state.
 func (obj *NetRes) CheckApply(apply bool) (bool, error) {
 	checkOK := true
 
+	// create or remove the link
+	c, exists, err := obj.linkCheckApply(apply)
+	if err != nil {
+		return false, err
+	} else if !c {
+		checkOK = false
+	}
+
+	// like the network file, the netdev file is only used with a state
+	if obj.State != "" {
+		if c, err := obj.netdevCheckApply(apply); err != nil {
+			return false, err
+		} else if !c {
+			checkOK = false
+		}
+	}
+
+	// if the link is missing or removed, there's nothing else to check
+	if !exists || obj.State == ifaceAbsent {
+		return checkOK, nil
+	}
+
+	// check the bridge membership
+	if c, err := obj.masterCheckApply(apply); err != nil {
+		return false, err
+	} else if !c {
+		checkOK = false
+	}
+
 	// check the network device
 	if c, err := obj.ifaceCheckApply(apply); err != nil {
 		return false, err
@@ -539,6 +807,18 @@ func (obj *NetRes) Cmp(r engine.Res) error {
 	if obj.Gateway != res.Gateway {
 		return fmt.Errorf("the Gateway differs")
 	}
+	if obj.Type != res.Type {
+		return fmt.Errorf("the Type differs")
+	}
+	if obj.Parent != res.Parent {
+		return fmt.Errorf("the Parent differs")
+	}
+	if obj.VlanID != res.VlanID {
+		return fmt.Errorf("the VlanID differs")
+	}
+	if obj.Master != res.Master {
+		return fmt.Errorf("the Master differs")
+	}
 
 	return nil
 }
@@ -563,6 +843,58 @@ func (obj *NetUID) IFF(uid engine.ResUID) bool {
 	return obj.name == res.name
 }
 
+// NetResAutoEdges holds the state of the auto edge generator.
+type NetResAutoEdges struct {
+	UIDs    []engine.ResUID
+	pointer int
+}
+
+// Next returns the next automatic edge.
+func (obj *NetResAutoEdges) Next() []engine.ResUID {
+	if len(obj.UIDs) == 0 {
+		return nil
+	}
+	value := obj.UIDs[obj.pointer]
+	obj.pointer++
+	return []engine.ResUID{value}
+}
+
+// Test gets results of the earlier Next() call, & returns if we should
+// continue.
+func (obj *NetResAutoEdges) Test(input []bool) bool {
+	if len(obj.UIDs) <= obj.pointer {
+		return false
+	}
+	if len(input) != 1 { // in case we get given bad data
+		panic(fmt.Sprintf("Expecting a single value!"))
+	}
+	return true // keep going
+}
+
+// AutoEdges returns edges from the parent link of a vlan and from the master
+// bridge, since they must exist before this link can use them.
+func (obj *NetRes) AutoEdges() (engine.AutoEdge, error) {
+	reversed := true
+	result := []engine.ResUID{}
+	for _, x := range []string{obj.Parent, obj.Master} {
+		if x == "" {
+			continue
+		}
+		result = append(result, &NetUID{
+			BaseUID: engine.BaseUID{
+				Name:     obj.Name(),
+				Kind:     obj.Kind(),
+				Reversed: &reversed,
+			},
+			name: x,
+		})
+	}
+	return &NetResAutoEdges{
+		UIDs:    result,
+		pointer: 0,
+	}, nil
+}
+
 // UIDs includes all params to make a unique identification of this object. Most
 // resources only return one although some resources can return multiple.
 func (obj *NetRes) UIDs() []engine.ResUID {
@@ -605,6 +937,9 @@ func (obj *NetRes) unitFileContents() []byte {
 	if obj.Gateway != "" {
 		u = append(u, fmt.Sprintf("Gateway=%s", obj.Gateway))
 	}
+	if obj.Master != "" {
+		u = append(u, fmt.Sprintf("Bridge=%s", obj.Master))
+	}
 	if obj.IPForward != nil {
 		b := "false"
 		if *obj.IPForward {
@@ -616,12 +951,40 @@ func (obj *NetRes) unitFileContents() []byte {
 	return []byte(c)
 }
 
+// netdevFileContents builds the netdev file contents from the definition.
+// XXX: for a vlan to come up on boot, the .network file of the parent needs a
+// VLAN= line, which we can't add from here.
+func (obj *NetRes) netdevFileContents() []byte {
+	u := []string{"[NetDev]"}
+	u = append(u, fmt.Sprintf("Name=%s", obj.Name()))
+	u = append(u, fmt.Sprintf("Kind=%s", obj.Type))
+	if obj.Type == NetTypeVlan {
+		u = append(u, "[VLAN]")
+		u = append(u, fmt.Sprintf("Id=%d", obj.VlanID))
+	}
+	c := strings.Join(u, "\n")
+	return []byte(c)
+}
+
 // iface wraps net.Interface to add additional methods.
 type iface struct {
 	iface *net.Interface
 	link  netlink.Link
 }
 
+// lookup finds the interface and the netlink link by name.
+func (obj *iface) lookup(name string) error {
+	var err error
+	if obj.iface, err = net.InterfaceByName(name); err != nil {
+		return errwrap.Wrapf(err, "error finding interface: %s", name)
+	}
+	// store the netlink link to use as interface input in netlink functions
+	if obj.link, err = netlink.LinkByName(name); err != nil {
+		return errwrap.Wrapf(err, "error finding link: %s", name)
+	}
+	return nil
+}
+
 // state reports the state of the interface as up or down.
 func (obj *iface) state() (string, error) {
 	var err error
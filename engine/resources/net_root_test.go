@@ -0,0 +1,259 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build root && !darwin
+
+package resources
+
+import (
+	"testing"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/vishvananda/netlink"
+)
+
+// netLinkRes builds, validates and initializes a net resource for a link.
+func netLinkRes(t *testing.T, init *engine.Init, res *NetRes, name string) bool {
+	res.SetKind("net")
+	res.SetName(name)
+	if err := res.Validate(); err != nil {
+		t.Errorf("%s: validate failed with: %v", name, err)
+		return false
+	}
+	if err := res.Init(init); err != nil {
+		t.Errorf("%s: init failed with: %v", name, err)
+		return false
+	}
+	return true
+}
+
+// netLinkApply runs CheckApply twice, and expects a change and then none.
+func netLinkApply(t *testing.T, res *NetRes) bool {
+	if checkOK, err := res.CheckApply(true); err != nil || checkOK {
+		t.Errorf("%s: expected a change, got: %t, %v", res.Name(), checkOK, err)
+		return false
+	}
+	if checkOK, err := res.CheckApply(true); err != nil || !checkOK {
+		t.Errorf("%s: expected no change, got: %t, %v", res.Name(), checkOK, err)
+		return false
+	}
+	return true
+}
+
+// netLinkSupported skips the test if the kernel can't create this link type.
+func netLinkSupported(t *testing.T, link netlink.Link) bool {
+	if err := netlink.LinkAdd(link); err != nil {
+		t.Skipf("%s links are not supported: %v", link.Type(), err)
+		return false
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		t.Errorf("could not remove probe link: %v", err)
+		return false
+	}
+	return true
+}
+
+func TestNetLinks1(t *testing.T) {
+	netnsTest(t, func(init *engine.Init) {
+		bridge := &NetRes{Type: NetTypeBridge}
+		if !netLinkRes(t, init, bridge, "br0") || !netLinkApply(t, bridge) {
+			return
+		}
+		if _, err := netlink.LinkByName("br0"); err != nil {
+			t.Errorf("could not find the bridge: %v", err)
+			return
+		}
+
+		// a link of a different type is an error
+		wrong := &NetRes{Type: NetTypeDummy}
+		if !netLinkRes(t, init, wrong, "br0") {
+			return
+		}
+		if _, err := wrong.CheckApply(false); err == nil {
+			t.Errorf("expected an error for the wrong type")
+		}
+
+		// the bridge is removed
+		bridge.State = ifaceAbsent
+		if !netLinkApply(t, bridge) {
+			return
+		}
+		if _, err := netlink.LinkByName("br0"); err == nil {
+			t.Errorf("the bridge still exists")
+		}
+	})
+}
+
+func TestNetVlan1(t *testing.T) {
+	netnsTest(t, func(init *engine.Init) {
+		bridge := &NetRes{Type: NetTypeBridge}
+		if !netLinkRes(t, init, bridge, "br0") || !netLinkApply(t, bridge) {
+			return
+		}
+		br, err := netlink.LinkByName("br0")
+		if err != nil {
+			t.Errorf("could not find the bridge: %v", err)
+			return
+		}
+		probe := &netlink.Vlan{
+			LinkAttrs: netlink.LinkAttrs{Name: "probe0", ParentIndex: br.Attrs().Index},
+			VlanId:    1,
+		}
+		if !netLinkSupported(t, probe) {
+			return
+		}
+
+		vlan := &NetRes{Type: NetTypeVlan, Parent: "br0", VlanID: 100}
+		if !netLinkRes(t, init, vlan, "vlan100") || !netLinkApply(t, vlan) {
+			return
+		}
+		link, err := netlink.LinkByName("vlan100")
+		if err != nil {
+			t.Errorf("could not find the vlan: %v", err)
+			return
+		}
+		if v, ok := link.(*netlink.Vlan); !ok || v.VlanId != 100 {
+			t.Errorf("got the wrong link: %+v", link)
+		}
+
+		vlan.State = ifaceAbsent
+		if !netLinkApply(t, vlan) {
+			return
+		}
+		if _, err := netlink.LinkByName("vlan100"); err == nil {
+			t.Errorf("the vlan still exists")
+		}
+	})
+}
+
+func TestNetMaster1(t *testing.T) {
+	netnsTest(t, func(init *engine.Init) {
+		probe := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "probe0"}}
+		if !netLinkSupported(t, probe) {
+			return
+		}
+
+		bridge := &NetRes{Type: NetTypeBridge}
+		if !netLinkRes(t, init, bridge, "br0") || !netLinkApply(t, bridge) {
+			return
+		}
+		dummy := &NetRes{Type: NetTypeDummy, Master: "br0"}
+		if !netLinkRes(t, init, dummy, "dummy0") || !netLinkApply(t, dummy) {
+			return
+		}
+
+		br, err := netlink.LinkByName("br0")
+		if err != nil {
+			t.Errorf("could not find the bridge: %v", err)
+			return
+		}
+		link, err := netlink.LinkByName("dummy0")
+		if err != nil {
+			t.Errorf("could not find the dummy: %v", err)
+			return
+		}
+		if link.Attrs().MasterIndex != br.Attrs().Index {
+			t.Errorf("the dummy is not in the bridge")
+		}
+	})
+}
+
+func TestNetRoute1(t *testing.T) {
+	netnsTest(t, func(init *engine.Init) {
+		link := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}
+		if err := netlink.LinkAdd(link); err != nil {
+			t.Errorf("could not add link: %v", err)
+			return
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			t.Errorf("could not set link up: %v", err)
+			return
+		}
+		addr, _ := netlink.ParseAddr("10.1.0.1/24")
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			t.Errorf("could not add addr: %v", err)
+			return
+		}
+
+		res := &NetRouteRes{
+			State:   NetRouteStateExists,
+			Dst:     "10.2.0.0/24",
+			Gateway: "10.1.0.254",
+			Metric:  10,
+		}
+		res.SetKind("net:route")
+		res.SetName("route")
+		if err := res.Validate(); err != nil {
+			t.Errorf("validate failed with: %v", err)
+			return
+		}
+		if err := res.Init(init); err != nil {
+			t.Errorf("init failed with: %v", err)
+			return
+		}
+		defer res.Close()
+
+		expect := func(name string, expected bool) bool {
+			checkOK, err := res.CheckApply(true)
+			if err != nil {
+				t.Errorf("%s: checkapply failed with: %v", name, err)
+				return false
+			}
+			if checkOK != expected {
+				t.Errorf("%s: expected checkOK of %t, got: %t", name, expected, checkOK)
+				return false
+			}
+			return true
+		}
+		if !expect("add", false) || !expect("added", true) {
+			return
+		}
+
+		res.Gateway = "10.1.0.253"
+		if !expect("change", false) || !expect("changed", true) {
+			return
+		}
+
+		routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+		if err != nil {
+			t.Errorf("could not list routes: %v", err)
+			return
+		}
+		found := 0
+		for _, x := range routes {
+			if x.Dst != nil && x.Dst.String() == "10.2.0.0/24" {
+				found++
+				if x.Gw.String() != "10.1.0.253" || x.Priority != 10 {
+					t.Errorf("got wrong route: %s", x.String())
+				}
+			}
+		}
+		if found != 1 {
+			t.Errorf("expected one route, found: %d", found)
+		}
+
+		res.Dst = NetRouteDefault
+		if !expect("default", false) || !expect("default added", true) {
+			return
+		}
+
+		res.State = NetRouteStateAbsent
+		if !expect("remove", false) || !expect("removed", true) {
+			return
+		}
+	})
+}
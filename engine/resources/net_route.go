@@ -0,0 +1,515 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !darwin
+
+package resources
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/util/errwrap"
+	"github.com/purpleidea/mgmt/util/socketset"
+
+	// XXX: Do NOT use subscribe methods from this lib, as they are racey and
+	// do not clean up spawned goroutines. Should be replaced when a suitable
+	// alternative is available.
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	engine.RegisterResource("net:route", func() engine.Res { return &NetRouteRes{} })
+}
+
+const (
+	// NetRouteStateExists is the state where the route is present.
+	NetRouteStateExists = "exists"
+
+	// NetRouteStateAbsent is the state where the route is removed.
+	NetRouteStateAbsent = "absent"
+
+	// NetRouteDefault is the destination which specifies a default route.
+	NetRouteDefault = "default"
+
+	// rtmGrpsRoute are the netlink multicast groups for route events. Link
+	// events are included, since the routes on a link go away with it.
+	rtmGrpsRoute = rtmGrpLink | rtmGrpIPv4IfRoute | rtmGrpIPv6IfRoute
+)
+
+// NetRouteRes is a static route resource based on netlink. A route is uniquely
+// identified by its destination, table and metric, which is the same as what
+// the kernel uses. Everything else is changed in place if it differs.
+type NetRouteRes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Edgeable
+
+	init *engine.Init
+
+	// State is either "exists" or "absent". The default is "exists".
+	State string `lang:"state" yaml:"state"`
+
+	// Dst is the destination network in CIDR notation, such as
+	// 192.0.2.0/24, or "default" for a default route. If this is empty,
+	// then the Name is used.
+	Dst string `lang:"dst" yaml:"dst"`
+
+	// Gateway is the address of the next hop. It can be empty if the Dev
+	// is specified, for a route which is directly reachable on a link.
+	Gateway string `lang:"gateway" yaml:"gateway"`
+
+	// Dev is the name of the link to send the traffic out of.
+	Dev string `lang:"dev" yaml:"dev"`
+
+	// Src is the optional preferred source address.
+	Src string `lang:"src" yaml:"src"`
+
+	// Metric is the priority of the route. Lower values are preferred.
+	Metric uint32 `lang:"metric" yaml:"metric"`
+
+	// Table is the routing table to use. If this is zero, then the main
+	// table is used.
+	Table uint32 `lang:"table" yaml:"table"`
+
+	socketFile string // path for storing the pipe socket file
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *NetRouteRes) Default() engine.Res {
+	return &NetRouteRes{
+		State: NetRouteStateExists,
+	}
+}
+
+// getDst returns the actual destination to use. When Dst is not specified, we
+// use the Name.
+func (obj *NetRouteRes) getDst() string {
+	if obj.Dst != "" {
+		return obj.Dst
+	}
+	return obj.Name()
+}
+
+// getTable returns the routing table to use.
+func (obj *NetRouteRes) getTable() int {
+	if obj.Table == 0 {
+		return unix.RT_TABLE_MAIN
+	}
+	return int(obj.Table)
+}
+
+// dstNet returns the parsed destination, which is nil for a default route, and
+// the address family.
+func (obj *NetRouteRes) dstNet() (*net.IPNet, int, error) {
+	dst := obj.getDst()
+	if dst == NetRouteDefault {
+		family := netlink.FAMILY_V4
+		if ip := net.ParseIP(obj.Gateway); ip != nil && ip.To4() == nil {
+			family = netlink.FAMILY_V6
+		}
+		return nil, family, nil
+	}
+	_, ipNet, err := net.ParseCIDR(dst)
+	if err != nil {
+		return nil, 0, errwrap.Wrapf(err, "error parsing destination: %s", dst)
+	}
+	if ipNet.IP.To4() != nil {
+		return ipNet, netlink.FAMILY_V4, nil
+	}
+	return ipNet, netlink.FAMILY_V6, nil
+}
+
+// Validate if the params passed in are valid data.
+func (obj *NetRouteRes) Validate() error {
+	if obj.State != NetRouteStateExists && obj.State != NetRouteStateAbsent {
+		return fmt.Errorf("the State must be either %s or %s", NetRouteStateExists, NetRouteStateAbsent)
+	}
+
+	_, family, err := obj.dstNet()
+	if err != nil {
+		return err
+	}
+	for name, x := range map[string]string{"gateway": obj.Gateway, "src": obj.Src} {
+		if x == "" {
+			continue
+		}
+		ip := net.ParseIP(x)
+		if ip == nil {
+			return fmt.Errorf("error parsing %s: %s", name, x)
+		}
+		if (ip.To4() != nil) != (family == netlink.FAMILY_V4) {
+			return fmt.Errorf("the %s is not in the same address family as the destination", name)
+		}
+	}
+
+	if obj.State == NetRouteStateExists && obj.Gateway == "" && obj.Dev == "" {
+		return fmt.Errorf("a route needs a gateway or a dev")
+	}
+
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *NetRouteRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	// tmp directory for pipe socket
+	dir, err := obj.init.VarDir("")
+	if err != nil {
+		return errwrap.Wrapf(err, "could not get VarDir in Init()")
+	}
+	obj.socketFile = path.Join(dir, socketFile) // return a unique file
+
+	return nil
+}
+
+// Close cleans up when we're done.
+func (obj *NetRouteRes) Close() error {
+	if obj.socketFile == "/" {
+		return fmt.Errorf("socket file should not be the root path")
+	}
+	if obj.socketFile != "" { // safety
+		if err := os.Remove(obj.socketFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Watch listens for route events via a netlink socket.
+// TODO: currently gets events from ALL routes, would be nice to reject events
+// for routes that aren't ours.
+func (obj *NetRouteRes) Watch() error {
+	// create a netlink socket for receiving route events
+	conn, err := socketset.NewSocketSet(rtmGrpsRoute, obj.socketFile, unix.NETLINK_ROUTE)
+	if err != nil {
+		return errwrap.Wrapf(err, "error creating socket set")
+	}
+
+	// waitgroup for netlink receive goroutine
+	wg := &sync.WaitGroup{}
+	defer conn.Close()
+	// We must wait for the Shutdown() AND the select inside of SocketSet to
+	// complete before we Close, since the unblocking in SocketSet is not a
+	// synchronous operation.
+	defer wg.Wait()
+	defer conn.Shutdown() // close the netlink socket and unblock conn.receive()
+
+	// channel for netlink messages
+	nlChan := make(chan *nlChanStruct) // closed from goroutine
+
+	// channel to unblock selects in goroutine
+	closeChan := make(chan struct{})
+	defer close(closeChan)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(nlChan)
+		for {
+			// receive messages from the socket set
+			msgs, err := conn.ReceiveNetlinkMessages()
+			if err != nil {
+				select {
+				case nlChan <- &nlChanStruct{
+					err: errwrap.Wrapf(err, "error receiving messages"),
+				}:
+				case <-closeChan:
+					return
+				}
+			}
+			select {
+			case nlChan <- &nlChanStruct{
+				msg: msgs,
+			}:
+			case <-closeChan:
+				return
+			}
+		}
+	}()
+
+	obj.init.Running() // when started, notify engine that we're running
+
+	var send = false // send event?
+	for {
+		select {
+		case s, ok := <-nlChan:
+			if !ok {
+				return nil
+			}
+			if err := s.err; err != nil {
+				return errwrap.Wrapf(s.err, "unknown netlink error")
+			}
+			if obj.init.Debug {
+				obj.init.Logf("Event: %+v", s.msg)
+			}
+
+			send = true
+
+		case <-obj.init.Done: // closed by the engine to signal shutdown
+			return nil
+		}
+
+		// do all our event sending all together to avoid duplicate msgs
+		if send {
+			send = false
+			obj.init.Event() // notify engine of an event (this can block)
+		}
+	}
+}
+
+// route builds the netlink route from the definition.
+func (obj *NetRouteRes) route() (*netlink.Route, error) {
+	dst, family, err := obj.dstNet()
+	if err != nil {
+		return nil, err
+	}
+	route := &netlink.Route{
+		Dst:      dst,
+		Priority: int(obj.Metric),
+		Table:    obj.getTable(),
+		Protocol: rtProtoStatic,
+		Scope:    netlink.SCOPE_UNIVERSE,
+		Family:   family,
+	}
+	if obj.Gateway != "" {
+		route.Gw = net.ParseIP(obj.Gateway)
+	} else {
+		route.Scope = netlink.SCOPE_LINK // directly reachable
+	}
+	if obj.Src != "" {
+		route.Src = net.ParseIP(obj.Src)
+	}
+	if obj.Dev != "" {
+		link, err := netlink.LinkByName(obj.Dev)
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "error finding link: %s", obj.Dev)
+		}
+		route.LinkIndex = link.Attrs().Index
+	}
+	return route, nil
+}
+
+// find returns the existing routes with the same destination, table and metric.
+func (obj *NetRouteRes) find(route *netlink.Route) ([]netlink.Route, error) {
+	filter := &netlink.Route{Table: route.Table}
+	routes, err := netlink.RouteListFiltered(route.Family, filter, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "error listing routes")
+	}
+	result := []netlink.Route{}
+	for _, x := range routes {
+		if x.Priority != route.Priority || !netRouteDstEqual(x.Dst, route.Dst) {
+			continue
+		}
+		result = append(result, x)
+	}
+	return result, nil
+}
+
+// CheckApply is run to check the state and, if apply is true, to apply the
+// necessary changes to reach the desired state.
+func (obj *NetRouteRes) CheckApply(apply bool) (bool, error) {
+	// when absent, we don't care if the dev is gone
+	if obj.State == NetRouteStateAbsent && obj.Dev != "" {
+		if _, err := netlink.LinkByName(obj.Dev); err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				return true, nil
+			}
+		}
+	}
+
+	route, err := obj.route()
+	if err != nil {
+		return false, err
+	}
+	existing, err := obj.find(route)
+	if err != nil {
+		return false, err
+	}
+
+	if obj.State == NetRouteStateAbsent {
+		if len(existing) == 0 {
+			return true, nil
+		}
+		if !apply {
+			return false, nil
+		}
+		for i := range existing {
+			obj.init.Logf("deleting route: %s", existing[i].String())
+			if err := netlink.RouteDel(&existing[i]); err != nil {
+				return false, errwrap.Wrapf(err, "error deleting route")
+			}
+		}
+		return false, nil
+	}
+
+	if len(existing) == 1 && netRouteEqual(&existing[0], route) {
+		return true, nil
+	}
+	if !apply {
+		return false, nil
+	}
+
+	// replace changes the existing route with the same key, or adds it
+	obj.init.Logf("replacing route: %s", route.String())
+	if err := netlink.RouteReplace(route); err != nil {
+		return false, errwrap.Wrapf(err, "error replacing route")
+	}
+	return false, nil
+}
+
+// netRouteDstEqual returns true if the two destinations are the same. A default
+// route can be represented by nil or by an all zeroes network.
+func netRouteDstEqual(a, b *net.IPNet) bool {
+	isDefault := func(x *net.IPNet) bool {
+		if x == nil {
+			return true
+		}
+		ones, _ := x.Mask.Size()
+		return ones == 0 && x.IP.IsUnspecified()
+	}
+	if isDefault(a) || isDefault(b) {
+		return isDefault(a) && isDefault(b)
+	}
+	return a.String() == b.String()
+}
+
+// netRouteEqual returns true if the existing route matches the expected one.
+// Only the fields which we specify are compared.
+func netRouteEqual(existing, expected *netlink.Route) bool {
+	if !existing.Gw.Equal(expected.Gw) {
+		return false
+	}
+	if expected.Src != nil && !existing.Src.Equal(expected.Src) {
+		return false
+	}
+	if expected.LinkIndex != 0 && existing.LinkIndex != expected.LinkIndex {
+		return false
+	}
+	return true
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *NetRouteRes) Cmp(r engine.Res) error {
+	// we can only compare NetRouteRes to others of the same resource kind
+	res, ok := r.(*NetRouteRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.State != res.State {
+		return fmt.Errorf("the State differs")
+	}
+	if obj.getDst() != res.getDst() {
+		return fmt.Errorf("the Dst differs")
+	}
+	if obj.Gateway != res.Gateway {
+		return fmt.Errorf("the Gateway differs")
+	}
+	if obj.Dev != res.Dev {
+		return fmt.Errorf("the Dev differs")
+	}
+	if obj.Src != res.Src {
+		return fmt.Errorf("the Src differs")
+	}
+	if obj.Metric != res.Metric {
+		return fmt.Errorf("the Metric differs")
+	}
+	if obj.getTable() != res.getTable() {
+		return fmt.Errorf("the Table differs")
+	}
+
+	return nil
+}
+
+// NetRouteUID is a unique resource identifier.
+type NetRouteUID struct {
+	engine.BaseUID
+
+	dst    string
+	table  int
+	metric uint32
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *NetRouteUID) IFF(uid engine.ResUID) bool {
+	res, ok := uid.(*NetRouteUID)
+	if !ok {
+		return false
+	}
+	return obj.dst == res.dst && obj.table == res.table && obj.metric == res.metric
+}
+
+// UIDs includes all params to make a unique identification of this object. Most
+// resources only return one although some resources can return multiple.
+func (obj *NetRouteRes) UIDs() []engine.ResUID {
+	x := &NetRouteUID{
+		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
+		dst:     obj.getDst(),
+		table:   obj.getTable(),
+		metric:  obj.Metric,
+	}
+	return []engine.ResUID{x}
+}
+
+// AutoEdges returns an edge from the net resource of the Dev, since the link
+// and its addresses must be there before a route can use it.
+func (obj *NetRouteRes) AutoEdges() (engine.AutoEdge, error) {
+	reversed := obj.State == NetRouteStateExists
+	result := []engine.ResUID{}
+	if obj.Dev != "" {
+		result = append(result, &NetUID{
+			BaseUID: engine.BaseUID{
+				Name:     obj.Name(),
+				Kind:     obj.Kind(),
+				Reversed: &reversed,
+			},
+			name: obj.Dev,
+		})
+	}
+	return &NetResAutoEdges{
+		UIDs:    result,
+		pointer: 0,
+	}, nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *NetRouteRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes NetRouteRes // indirection to avoid infinite recursion
+
+	def := obj.Default()          // get the default
+	res, ok := def.(*NetRouteRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to NetRouteRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = NetRouteRes(raw) // restore from indirection with type conversion!
+	return nil
+}
@@ -0,0 +1,67 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !darwin
+
+package resources
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/vishvananda/netns"
+)
+
+// netnsTest runs the test function inside of a new network namespace, so that
+// the links, routes and rules that it creates don't touch the host. The test is
+// skipped if we don't have the privileges to create one.
+func netnsTest(t *testing.T, fn func(init *engine.Init)) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := netns.Get()
+	if err != nil {
+		t.Errorf("could not get the network namespace: %v", err)
+		return
+	}
+	defer orig.Close()
+	ns, err := netns.New() // this also switches to it
+	if err != nil {
+		// run with `unshare -rn` to get the privileges without root
+		t.Skipf("could not create a network namespace: %v", err)
+		return
+	}
+	defer ns.Close()
+	defer netns.Set(orig)
+
+	tmpdir, err := ioutil.TempDir("", "mgmt-test-net-")
+	if err != nil {
+		t.Errorf("could not make tmpdir: %v", err)
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	fn(&engine.Init{
+		VarDir: func(string) (string, error) { return tmpdir, nil },
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+	})
+}
@@ -0,0 +1,1363 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !darwin
+
+package resources
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/util/errwrap"
+	"github.com/purpleidea/mgmt/util/socketset"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	engine.RegisterResource("nft:table", func() engine.Res { return &NftTableRes{} })
+	engine.RegisterResource("nft:rule", func() engine.Res { return &NftRuleRes{} })
+}
+
+const (
+	// NftStateExists is the state where the table is present.
+	NftStateExists = "exists"
+
+	// NftStateAbsent is the state where the table is removed.
+	NftStateAbsent = "absent"
+
+	// NftDefaultFamily is the table family that is used when none is given.
+	NftDefaultFamily = "inet"
+
+	// nftCommentMax is the longest rule comment that the kernel will store.
+	nftCommentMax = 127
+
+	// nftUdataRuleComment is the userdata type which holds the rule comment.
+	// It's the same type that the nft tool uses, so that the rules show up
+	// with their comments when listed there.
+	nftUdataRuleComment = 0
+)
+
+var (
+	// nftFamilies are the valid table families.
+	nftFamilies = map[string]nftables.TableFamily{
+		"inet":   nftables.TableFamilyINet,
+		"ip":     nftables.TableFamilyIPv4,
+		"ip6":    nftables.TableFamilyIPv6,
+		"arp":    nftables.TableFamilyARP,
+		"bridge": nftables.TableFamilyBridge,
+		"netdev": nftables.TableFamilyNetdev,
+	}
+
+	// nftHooks are the valid base chain hooks.
+	nftHooks = map[string]nftables.ChainHook{
+		"prerouting":  *nftables.ChainHookPrerouting,
+		"input":       *nftables.ChainHookInput,
+		"forward":     *nftables.ChainHookForward,
+		"output":      *nftables.ChainHookOutput,
+		"postrouting": *nftables.ChainHookPostrouting,
+	}
+
+	// nftChainTypes are the valid base chain types.
+	nftChainTypes = map[string]nftables.ChainType{
+		"filter": nftables.ChainTypeFilter,
+		"nat":    nftables.ChainTypeNAT,
+		"route":  nftables.ChainTypeRoute,
+	}
+
+	// nftPolicies are the valid base chain policies.
+	nftPolicies = map[string]nftables.ChainPolicy{
+		"accept": nftables.ChainPolicyAccept,
+		"drop":   nftables.ChainPolicyDrop,
+	}
+
+	// nftProtocols are the layer four protocols that a rule can match on.
+	nftProtocols = map[string]byte{
+		"icmp":   unix.IPPROTO_ICMP,
+		"tcp":    unix.IPPROTO_TCP,
+		"udp":    unix.IPPROTO_UDP,
+		"icmpv6": unix.IPPROTO_ICMPV6,
+		"sctp":   unix.IPPROTO_SCTP,
+	}
+
+	// nftCtStates are the conntrack state bits that a rule can match on.
+	nftCtStates = map[string]uint32{
+		"invalid":     1,
+		"established": 2,
+		"related":     4,
+		"new":         8,
+		"untracked":   64,
+	}
+
+	// nftVerdicts are the valid rule verdicts. Reject is not included, since
+	// it is an expression of its own.
+	nftVerdicts = map[string]expr.VerdictKind{
+		"accept":   expr.VerdictAccept,
+		"drop":     expr.VerdictDrop,
+		"return":   expr.VerdictReturn,
+		"continue": expr.VerdictContinue,
+		"jump":     expr.VerdictJump,
+		"goto":     expr.VerdictGoto,
+	}
+)
+
+// NftTableRes is an nftables table resource. The name is used as the table
+// name. It manages the table and its chains using the netlink nftables API. Any
+// nft:rule resources with a matching table and family get autogrouped into
+// this resource at runtime, and all of the changes are then applied together
+// in a single atomic transaction. The table is owned exclusively by this
+// resource, so chains and rules that weren't specified get removed. Drift is
+// detected by listing the ruleset and comparing it to what we expect.
+type NftTableRes struct {
+	traits.Base      // add the base methods without re-implementation
+	traits.Edgeable  // XXX: add autoedge support
+	traits.Groupable // can have NftRuleRes grouped into it
+
+	init *engine.Init
+
+	// State is either "exists" or "absent". The default is "exists".
+	State string `lang:"state" yaml:"state"`
+
+	// Family is the table family. It can be "inet", "ip", "ip6", "arp",
+	// "bridge" or "netdev". The default is "inet".
+	Family string `lang:"family" yaml:"family"`
+
+	// Chains is the list of chains in this table. Chains that are used by
+	// a rule but aren't listed here are created as regular chains.
+	Chains []*NftChain `lang:"chains" yaml:"chains"`
+
+	conn       *nftables.Conn
+	socketFile string // path for storing the pipe socket file
+}
+
+// NftChain is a chain in an nft:table. If the hook is specified, then this is a
+// base chain which gets packets from the network stack, otherwise it's a
+// regular chain which can only be reached from a jump or goto rule.
+type NftChain struct {
+	// Name is the name of the chain.
+	Name string `lang:"name" yaml:"name"`
+
+	// Type is the type of a base chain. It can be "filter", "nat" or
+	// "route". The default for a base chain is "filter".
+	Type string `lang:"type" yaml:"type"`
+
+	// Hook is the hook of a base chain. It can be "prerouting", "input",
+	// "forward", "output" or "postrouting".
+	Hook string `lang:"hook" yaml:"hook"`
+
+	// Priority is the priority of a base chain. Lower values run first.
+	Priority int64 `lang:"priority" yaml:"priority"`
+
+	// Policy is the policy of a base chain, either "accept" or "drop". The
+	// default is "accept".
+	Policy string `lang:"policy" yaml:"policy"`
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *NftTableRes) Default() engine.Res {
+	return &NftTableRes{
+		State:  NftStateExists,
+		Family: NftDefaultFamily,
+	}
+}
+
+// Validate if the params passed in are valid data.
+func (obj *NftTableRes) Validate() error {
+	if obj.Name() == "" {
+		return fmt.Errorf("empty table name")
+	}
+	if obj.State != NftStateExists && obj.State != NftStateAbsent {
+		return fmt.Errorf("the State must be %s or %s", NftStateExists, NftStateAbsent)
+	}
+	if _, exists := nftFamilies[obj.Family]; !exists {
+		return fmt.Errorf("invalid Family: %s", obj.Family)
+	}
+
+	names := make(map[string]struct{})
+	for _, x := range obj.Chains {
+		if x == nil {
+			return fmt.Errorf("nil chain")
+		}
+		if x.Name == "" {
+			return fmt.Errorf("empty chain name")
+		}
+		if _, exists := names[x.Name]; exists {
+			return fmt.Errorf("duplicate chain: %s", x.Name)
+		}
+		names[x.Name] = struct{}{}
+
+		if x.Hook == "" {
+			if x.Type != "" || x.Priority != 0 || x.Policy != "" {
+				return fmt.Errorf("chain %s is not a base chain, and can't have a type, priority or policy", x.Name)
+			}
+			continue
+		}
+		if _, exists := nftHooks[x.Hook]; !exists {
+			return fmt.Errorf("chain %s has an invalid hook: %s", x.Name, x.Hook)
+		}
+		if _, exists := nftChainTypes[x.Type]; x.Type != "" && !exists {
+			return fmt.Errorf("chain %s has an invalid type: %s", x.Name, x.Type)
+		}
+		if _, exists := nftPolicies[x.Policy]; x.Policy != "" && !exists {
+			return fmt.Errorf("chain %s has an invalid policy: %s", x.Name, x.Policy)
+		}
+		if x.Priority < math.MinInt32 || x.Priority > math.MaxInt32 {
+			return fmt.Errorf("chain %s has an out of range priority: %d", x.Name, x.Priority)
+		}
+	}
+
+	for _, x := range obj.GetGroup() { // grouped elements
+		res, ok := x.(*NftRuleRes)
+		if !ok {
+			return fmt.Errorf("grouped resource is not the right kind")
+		}
+		if err := res.Validate(); err != nil {
+			return errwrap.Wrapf(err, "the grouped rule %s is invalid", res)
+		}
+	}
+
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *NftTableRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	// NOTE: If we don't Init anything that's autogrouped, then it won't
+	// even get an Init call on it.
+	for _, res := range obj.GetGroup() { // grouped elements
+		if err := res.Init(init); err != nil {
+			return errwrap.Wrapf(err, "autogrouped Init failed")
+		}
+	}
+
+	// tmp directory for pipe socket
+	dir, err := obj.init.VarDir("")
+	if err != nil {
+		return errwrap.Wrapf(err, "could not get VarDir in Init()")
+	}
+	obj.socketFile = path.Join(dir, socketFile) // return a unique file
+
+	// This doesn't dial anything yet, each operation uses its own socket.
+	// XXX: a lasting connection gets out of sync after a batch is flushed.
+	obj.conn, err = nftables.New()
+	if err != nil {
+		return errwrap.Wrapf(err, "could not connect to nftables")
+	}
+
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *NftTableRes) Close() error {
+	if obj.socketFile == "/" {
+		return fmt.Errorf("socket file should not be the root path")
+	}
+	if obj.socketFile != "" { // safety
+		if err := os.Remove(obj.socketFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Watch listens for nftables events via a netlink socket.
+// TODO: currently gets events from ALL tables, would be nice to reject events
+// for tables that aren't ours.
+func (obj *NftTableRes) Watch() error {
+	// create a netlink socket for receiving nftables events
+	groups := uint32(1 << (unix.NFNLGRP_NFTABLES - 1))
+	conn, err := socketset.NewSocketSet(groups, obj.socketFile, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return errwrap.Wrapf(err, "error creating socket set")
+	}
+
+	// waitgroup for netlink receive goroutine
+	wg := &sync.WaitGroup{}
+	defer conn.Close()
+	// We must wait for the Shutdown() AND the select inside of SocketSet to
+	// complete before we Close, since the unblocking in SocketSet is not a
+	// synchronous operation.
+	defer wg.Wait()
+	defer conn.Shutdown() // close the netlink socket and unblock conn.receive()
+
+	// channel for netlink messages
+	nlChan := make(chan *nlChanStruct) // closed from goroutine
+
+	// channel to unblock selects in goroutine
+	closeChan := make(chan struct{})
+	defer close(closeChan)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(nlChan)
+		for {
+			// receive messages from the socket set
+			msgs, err := conn.ReceiveNetlinkMessages()
+			if err != nil {
+				select {
+				case nlChan <- &nlChanStruct{
+					err: errwrap.Wrapf(err, "error receiving messages"),
+				}:
+				case <-closeChan:
+					return
+				}
+			}
+			select {
+			case nlChan <- &nlChanStruct{
+				msg: msgs,
+			}:
+			case <-closeChan:
+				return
+			}
+		}
+	}()
+
+	obj.init.Running() // when started, notify engine that we're running
+
+	var send = false // send event?
+	for {
+		select {
+		case s, ok := <-nlChan:
+			if !ok {
+				return nil
+			}
+			if err := s.err; err != nil {
+				return errwrap.Wrapf(s.err, "unknown netlink error")
+			}
+			if obj.init.Debug {
+				obj.init.Logf("Event: %+v", s.msg)
+			}
+
+			send = true
+
+		case <-obj.init.Done: // closed by the engine to signal shutdown
+			return nil
+		}
+
+		// do all our event sending all together to avoid duplicate msgs
+		if send {
+			send = false
+			obj.init.Event() // notify engine of an event (this can block)
+		}
+	}
+}
+
+// table returns the nftables table that we manage.
+func (obj *NftTableRes) table() *nftables.Table {
+	return &nftables.Table{
+		Name:   obj.Name(),
+		Family: nftFamilies[obj.Family],
+	}
+}
+
+// rules returns the grouped rules that we should apply, sorted by chain, index
+// and name.
+func (obj *NftTableRes) rules() []*NftRuleRes {
+	rules := []*NftRuleRes{}
+	for _, x := range obj.GetGroup() { // grouped elements
+		res, ok := x.(*NftRuleRes)
+		if !ok {
+			continue
+		}
+		if res.State == NftStateAbsent {
+			continue
+		}
+		rules = append(rules, res)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Chain != rules[j].Chain {
+			return rules[i].Chain < rules[j].Chain
+		}
+		if rules[i].Index != rules[j].Index {
+			return rules[i].Index < rules[j].Index
+		}
+		return rules[i].Name() < rules[j].Name()
+	})
+	return rules
+}
+
+// chains returns the chains that we expect, including the regular chains that
+// are only used by the rules, in a stable order.
+func (obj *NftTableRes) chains(table *nftables.Table, rules []*NftRuleRes) []*nftables.Chain {
+	chains := []*nftables.Chain{}
+	seen := make(map[string]struct{})
+	for _, x := range obj.Chains {
+		chain := &nftables.Chain{
+			Name:  x.Name,
+			Table: table,
+		}
+		if x.Hook != "" {
+			hook := nftHooks[x.Hook]
+			priority := nftables.ChainPriority(x.Priority)
+			policy := nftables.ChainPolicyAccept
+			if x.Policy != "" {
+				policy = nftPolicies[x.Policy]
+			}
+			chain.Type = nftables.ChainTypeFilter
+			if x.Type != "" {
+				chain.Type = nftChainTypes[x.Type]
+			}
+			chain.Hooknum = &hook
+			chain.Priority = &priority
+			chain.Policy = &policy
+		}
+		chains = append(chains, chain)
+		seen[x.Name] = struct{}{}
+	}
+
+	for _, x := range rules {
+		for _, name := range []string{x.Chain, x.Target} {
+			if name == "" {
+				continue
+			}
+			if _, exists := seen[name]; exists {
+				continue
+			}
+			chains = append(chains, &nftables.Chain{
+				Name:  name,
+				Table: table,
+			})
+			seen[name] = struct{}{}
+		}
+	}
+
+	return chains
+}
+
+// CheckApply method for the nft:table resource. Everything that changes gets
+// added to a single batch, which the kernel commits atomically.
+func (obj *NftTableRes) CheckApply(apply bool) (bool, error) {
+	table := obj.table()
+
+	tables, err := obj.conn.ListTablesOfFamily(table.Family)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "could not list tables")
+	}
+	exists := false
+	for _, x := range tables {
+		if x.Name == table.Name {
+			exists = true
+			break
+		}
+	}
+
+	if obj.State == NftStateAbsent {
+		if !exists {
+			return true, nil
+		}
+		if !apply {
+			return false, nil
+		}
+		obj.init.Logf("deleting table: %s", table.Name)
+		obj.conn.DelTable(table)
+		if err := obj.conn.Flush(); err != nil {
+			return false, errwrap.Wrapf(err, "could not delete table")
+		}
+		return false, nil
+	}
+
+	rules := obj.rules()
+	expected := obj.chains(table, rules)
+
+	// build the rules first, so that an invalid one doesn't change anything
+	ruleMap := make(map[string][]*nftables.Rule) // chain name -> rules
+	for _, x := range rules {
+		exprs, err := x.exprs(table.Family)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "could not build rule %s", x)
+		}
+		ruleMap[x.Chain] = append(ruleMap[x.Chain], &nftables.Rule{
+			Table:    table,
+			Chain:    &nftables.Chain{Name: x.Chain, Table: table},
+			Exprs:    exprs,
+			UserData: nftUserData(x.Name()),
+		})
+	}
+
+	current := make(map[string]*nftables.Chain)
+	if exists {
+		chains, err := obj.conn.ListChainsOfTableFamily(table.Family)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "could not list chains")
+		}
+		for _, x := range chains {
+			if x.Table == nil || x.Table.Name != table.Name {
+				continue
+			}
+			x.Table = table
+			current[x.Name] = x
+		}
+	}
+
+	flush := []*nftables.Chain{}  // chains to empty
+	remove := []*nftables.Chain{} // chains to delete
+	add := []*nftables.Chain{}    // chains to add or update
+	fill := []*nftables.Chain{}   // chains to add the rules to
+
+	wanted := make(map[string]struct{})
+	for _, chain := range expected {
+		wanted[chain.Name] = struct{}{}
+
+		have, exists := current[chain.Name]
+		if !exists {
+			add = append(add, chain)
+			fill = append(fill, chain)
+			continue
+		}
+
+		if !nftChainHookEqual(have, chain) { // must recreate it
+			flush = append(flush, have)
+			remove = append(remove, have)
+			add = append(add, chain)
+			fill = append(fill, chain)
+			continue
+		}
+		if !nftChainPolicyEqual(have, chain) { // can update it in place
+			add = append(add, chain)
+		}
+
+		got, err := obj.conn.GetRules(table, have)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "could not list rules in chain %s", chain.Name)
+		}
+		if !nftRulesEqual(byte(table.Family), got, ruleMap[chain.Name]) {
+			flush = append(flush, have)
+			fill = append(fill, chain)
+		}
+	}
+	// sort these so that the batch is deterministic
+	names := []string{}
+	for name := range current {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, exists := wanted[name]; exists {
+			continue
+		}
+		flush = append(flush, current[name])
+		remove = append(remove, current[name])
+	}
+
+	if exists && len(flush) == 0 && len(remove) == 0 && len(add) == 0 && len(fill) == 0 {
+		return true, nil
+	}
+	if !apply {
+		return false, nil
+	}
+
+	if !exists {
+		obj.init.Logf("adding table: %s", table.Name)
+		obj.conn.AddTable(table)
+	}
+	// Rules can jump to chains that we remove, so everything needs to be
+	// flushed before any of those chains are deleted.
+	for _, x := range flush {
+		obj.conn.FlushChain(x)
+	}
+	for _, x := range remove {
+		obj.init.Logf("deleting chain: %s", x.Name)
+		obj.conn.DelChain(x)
+	}
+	for _, x := range add {
+		obj.init.Logf("adding chain: %s", x.Name)
+		obj.conn.AddChain(x)
+	}
+	for _, x := range fill {
+		obj.init.Logf("setting %d rule(s) in chain: %s", len(ruleMap[x.Name]), x.Name)
+		for _, rule := range ruleMap[x.Name] {
+			obj.conn.AddRule(rule)
+		}
+	}
+
+	if err := obj.conn.Flush(); err != nil {
+		return false, errwrap.Wrapf(err, "could not apply the ruleset")
+	}
+
+	return false, nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *NftTableRes) Cmp(r engine.Res) error {
+	// we can only compare NftTableRes to others of the same resource kind
+	res, ok := r.(*NftTableRes)
+	if !ok {
+		return fmt.Errorf("res is not the same kind")
+	}
+
+	if obj.State != res.State {
+		return fmt.Errorf("the State differs")
+	}
+	if obj.Family != res.Family {
+		return fmt.Errorf("the Family differs")
+	}
+	if len(obj.Chains) != len(res.Chains) {
+		return fmt.Errorf("the number of Chains differs")
+	}
+	for i, x := range obj.Chains {
+		if err := x.Cmp(res.Chains[i]); err != nil {
+			return errwrap.Wrapf(err, "chain %d differs", i)
+		}
+	}
+
+	return nil
+}
+
+// Cmp compares two chains and returns an error if they are not equivalent.
+func (obj *NftChain) Cmp(chain *NftChain) error {
+	if (obj == nil) != (chain == nil) { // xor
+		return fmt.Errorf("the chain is missing")
+	}
+	if obj == nil {
+		return nil
+	}
+	if obj.Name != chain.Name {
+		return fmt.Errorf("the Name differs")
+	}
+	if obj.Type != chain.Type {
+		return fmt.Errorf("the Type differs")
+	}
+	if obj.Hook != chain.Hook {
+		return fmt.Errorf("the Hook differs")
+	}
+	if obj.Priority != chain.Priority {
+		return fmt.Errorf("the Priority differs")
+	}
+	if obj.Policy != chain.Policy {
+		return fmt.Errorf("the Policy differs")
+	}
+	return nil
+}
+
+// NftTableUID is the UID struct for NftTableRes.
+type NftTableUID struct {
+	engine.BaseUID
+
+	name   string
+	family string
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *NftTableUID) IFF(uid engine.ResUID) bool {
+	res, ok := uid.(*NftTableUID)
+	if !ok {
+		return false
+	}
+	return obj.name == res.name && obj.family == res.family
+}
+
+// UIDs includes all params to make a unique identification of this object.
+// Most resources only return one, although some resources can return multiple.
+func (obj *NftTableRes) UIDs() []engine.ResUID {
+	x := &NftTableUID{
+		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
+		name:    obj.Name(),
+		family:  obj.Family,
+	}
+	return []engine.ResUID{x}
+}
+
+// GroupCmp returns whether two resources can be grouped together or not. Can
+// these two resources be merged, aka, does this resource support doing so? Will
+// resource allow itself to be grouped _into_ this obj?
+func (obj *NftTableRes) GroupCmp(r engine.GroupableRes) error {
+	res, ok := r.(*NftRuleRes) // different from what we usually do!
+	if !ok {
+		return fmt.Errorf("resource is not the right kind")
+	}
+	if res.Table != obj.Name() {
+		return fmt.Errorf("resource groups with a different table name")
+	}
+	if res.Family != obj.Family {
+		return fmt.Errorf("resource groups with a different table family")
+	}
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *NftTableRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes NftTableRes // indirection to avoid infinite recursion
+
+	def := obj.Default()          // get the default
+	res, ok := def.(*NftTableRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to NftTableRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = NftTableRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// NftRuleRes is a rule in an nftables chain. It autogroups at runtime into the
+// nft:table resource with the same table name and family, which then applies
+// it. On its own it does nothing. The rules in a chain are ordered by their
+// index, and then by their name. The name is stored as the rule comment, which
+// is how the rule is recognized when the ruleset is listed. All of the matches
+// which are specified must match for the verdict to be applied.
+type NftRuleRes struct {
+	traits.Base      // add the base methods without re-implementation
+	traits.Edgeable  // XXX: add autoedge support
+	traits.Groupable // can be grouped into NftTableRes
+
+	init *engine.Init
+
+	// State is either "exists" or "absent". The default is "exists". An
+	// absent rule is removed from its chain.
+	State string `lang:"state" yaml:"state"`
+
+	// Table is the name of the nft:table resource to group this into.
+	Table string `lang:"table" yaml:"table"`
+
+	// Family is the family of the table. The default is "inet".
+	Family string `lang:"family" yaml:"family"`
+
+	// Chain is the name of the chain that this rule is in.
+	Chain string `lang:"chain" yaml:"chain"`
+
+	// Index is used to order the rules in a chain. Lower values are first.
+	Index int64 `lang:"index" yaml:"index"`
+
+	// Protocol is the layer four protocol to match. It can be "tcp",
+	// "udp", "sctp", "icmp" or "icmpv6".
+	Protocol string `lang:"protocol" yaml:"protocol"`
+
+	// Saddr is the source address or network in CIDR notation to match.
+	Saddr string `lang:"saddr" yaml:"saddr"`
+
+	// Daddr is the destination address or network in CIDR notation to
+	// match.
+	Daddr string `lang:"daddr" yaml:"daddr"`
+
+	// Sport is the source port or port range such as "1024-65535" to
+	// match. It needs a tcp, udp or sctp protocol.
+	Sport string `lang:"sport" yaml:"sport"`
+
+	// Dport is the destination port or port range such as "8000-8080" to
+	// match. It needs a tcp, udp or sctp protocol.
+	Dport string `lang:"dport" yaml:"dport"`
+
+	// Iif is the name of the input interface to match.
+	Iif string `lang:"iif" yaml:"iif"`
+
+	// Oif is the name of the output interface to match.
+	Oif string `lang:"oif" yaml:"oif"`
+
+	// CtState is the list of conntrack states to match. Any of them match.
+	// They can be "new", "established", "related", "invalid" or
+	// "untracked".
+	CtState []string `lang:"ct_state" yaml:"ct_state"`
+
+	// Counter adds a packet and byte counter to the rule.
+	Counter bool `lang:"counter" yaml:"counter"`
+
+	// Verdict is what happens to a packet that matches. It can be
+	// "accept", "drop", "reject", "return", "continue", "jump" or "goto".
+	// If it's empty, the packet continues to the next rule.
+	Verdict string `lang:"verdict" yaml:"verdict"`
+
+	// Target is the chain to jump or goto.
+	Target string `lang:"target" yaml:"target"`
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *NftRuleRes) Default() engine.Res {
+	return &NftRuleRes{
+		State:  NftStateExists,
+		Family: NftDefaultFamily,
+	}
+}
+
+// Validate if the params passed in are valid data.
+func (obj *NftRuleRes) Validate() error {
+	if obj.State != NftStateExists && obj.State != NftStateAbsent {
+		return fmt.Errorf("the State must be %s or %s", NftStateExists, NftStateAbsent)
+	}
+	if len(obj.Name()) > nftCommentMax {
+		return fmt.Errorf("the name is longer than %d characters", nftCommentMax)
+	}
+	if obj.Table == "" {
+		return fmt.Errorf("empty table name")
+	}
+	family, exists := nftFamilies[obj.Family]
+	if !exists {
+		return fmt.Errorf("invalid Family: %s", obj.Family)
+	}
+	if obj.Chain == "" {
+		return fmt.Errorf("empty chain name")
+	}
+	if _, exists := nftVerdicts[obj.Verdict]; obj.Verdict != "" && obj.Verdict != "reject" && !exists {
+		return fmt.Errorf("invalid Verdict: %s", obj.Verdict)
+	}
+	jump := obj.Verdict == "jump" || obj.Verdict == "goto"
+	if jump && obj.Target == "" {
+		return fmt.Errorf("the %s verdict needs a Target", obj.Verdict)
+	}
+	if !jump && obj.Target != "" {
+		return fmt.Errorf("the Target is only used by the jump and goto verdicts")
+	}
+	if obj.Target == obj.Chain && obj.Target != "" {
+		return fmt.Errorf("the Target can't be the same chain")
+	}
+
+	// building the expressions checks all the matches
+	if _, err := obj.exprs(family); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *NftRuleRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *NftRuleRes) Close() error {
+	return nil
+}
+
+// Watch is the primary listener for this resource and it outputs events. This
+// particular one does absolutely nothing but block until we've received a done
+// signal.
+func (obj *NftRuleRes) Watch() error {
+	obj.init.Running() // when started, notify engine that we're running
+
+	select {
+	case <-obj.init.Done: // closed by the engine to signal shutdown
+	}
+
+	//obj.init.Event() // notify engine of an event (this can block)
+
+	return nil
+}
+
+// CheckApply never has anything to do for this resource, so it always succeeds.
+// The nft:table resource that it's grouped into applies it.
+func (obj *NftRuleRes) CheckApply(apply bool) (bool, error) {
+	if obj.init.Debug {
+		obj.init.Logf("CheckApply")
+	}
+
+	return true, nil // always succeeds, with nothing to do!
+}
+
+// exprs builds the list of nftables expressions for this rule.
+func (obj *NftRuleRes) exprs(family nftables.TableFamily) ([]expr.Any, error) {
+	exprs := []expr.Any{}
+
+	if obj.Iif != "" {
+		e, err := nftIfname(expr.MetaKeyIIFNAME, obj.Iif)
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "invalid Iif")
+		}
+		exprs = append(exprs, e...)
+	}
+	if obj.Oif != "" {
+		e, err := nftIfname(expr.MetaKeyOIFNAME, obj.Oif)
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "invalid Oif")
+		}
+		exprs = append(exprs, e...)
+	}
+
+	if obj.Saddr != "" || obj.Daddr != "" {
+		e, err := nftAddrs(family, obj.Saddr, obj.Daddr)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e...)
+	}
+
+	if obj.Protocol != "" {
+		proto, exists := nftProtocols[obj.Protocol]
+		if !exists {
+			return nil, fmt.Errorf("invalid Protocol: %s", obj.Protocol)
+		}
+		if !nftIPFamily(family) {
+			return nil, fmt.Errorf("the Protocol can't be matched in the %s family", obj.Family)
+		}
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		)
+	}
+
+	ports := obj.Protocol == "tcp" || obj.Protocol == "udp" || obj.Protocol == "sctp"
+	for _, x := range []struct {
+		name   string
+		value  string
+		offset uint32
+	}{
+		{"Sport", obj.Sport, 0},
+		{"Dport", obj.Dport, 2},
+	} {
+		if x.value == "" {
+			continue
+		}
+		if !ports {
+			return nil, fmt.Errorf("the %s needs a tcp, udp or sctp Protocol", x.name)
+		}
+		e, err := nftPort(x.offset, x.value)
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "invalid %s", x.name)
+		}
+		exprs = append(exprs, e...)
+	}
+
+	if len(obj.CtState) > 0 {
+		var mask uint32
+		for _, x := range obj.CtState {
+			bit, exists := nftCtStates[x]
+			if !exists {
+				return nil, fmt.Errorf("invalid CtState: %s", x)
+			}
+			mask |= bit
+		}
+		exprs = append(exprs,
+			&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4,
+				Mask:           binaryutil.NativeEndian.PutUint32(mask),
+				Xor:            binaryutil.NativeEndian.PutUint32(0),
+			},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0, 0, 0, 0}},
+		)
+	}
+
+	if obj.Counter {
+		exprs = append(exprs, &expr.Counter{})
+	}
+
+	switch obj.Verdict {
+	case "":
+		// nothing to do
+
+	case "reject":
+		e, err := nftReject(family)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+
+	default:
+		exprs = append(exprs, &expr.Verdict{
+			Kind:  nftVerdicts[obj.Verdict],
+			Chain: obj.Target,
+		})
+	}
+
+	return exprs, nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *NftRuleRes) Cmp(r engine.Res) error {
+	// we can only compare NftRuleRes to others of the same resource kind
+	res, ok := r.(*NftRuleRes)
+	if !ok {
+		return fmt.Errorf("res is not the same kind")
+	}
+
+	if obj.State != res.State {
+		return fmt.Errorf("the State differs")
+	}
+	if obj.Table != res.Table {
+		return fmt.Errorf("the Table differs")
+	}
+	if obj.Family != res.Family {
+		return fmt.Errorf("the Family differs")
+	}
+	if obj.Chain != res.Chain {
+		return fmt.Errorf("the Chain differs")
+	}
+	if obj.Index != res.Index {
+		return fmt.Errorf("the Index differs")
+	}
+	if obj.Protocol != res.Protocol {
+		return fmt.Errorf("the Protocol differs")
+	}
+	if obj.Saddr != res.Saddr {
+		return fmt.Errorf("the Saddr differs")
+	}
+	if obj.Daddr != res.Daddr {
+		return fmt.Errorf("the Daddr differs")
+	}
+	if obj.Sport != res.Sport {
+		return fmt.Errorf("the Sport differs")
+	}
+	if obj.Dport != res.Dport {
+		return fmt.Errorf("the Dport differs")
+	}
+	if obj.Iif != res.Iif {
+		return fmt.Errorf("the Iif differs")
+	}
+	if obj.Oif != res.Oif {
+		return fmt.Errorf("the Oif differs")
+	}
+	if len(obj.CtState) != len(res.CtState) {
+		return fmt.Errorf("the number of CtState values differs")
+	}
+	for i, x := range obj.CtState {
+		if x != res.CtState[i] {
+			return fmt.Errorf("the CtState at index %d differs", i)
+		}
+	}
+	if obj.Counter != res.Counter {
+		return fmt.Errorf("the Counter differs")
+	}
+	if obj.Verdict != res.Verdict {
+		return fmt.Errorf("the Verdict differs")
+	}
+	if obj.Target != res.Target {
+		return fmt.Errorf("the Target differs")
+	}
+
+	return nil
+}
+
+// NftRuleUID is the UID struct for NftRuleRes.
+type NftRuleUID struct {
+	engine.BaseUID
+
+	table  string
+	family string
+	name   string
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *NftRuleUID) IFF(uid engine.ResUID) bool {
+	res, ok := uid.(*NftRuleUID)
+	if !ok {
+		return false
+	}
+	return obj.table == res.table && obj.family == res.family && obj.name == res.name
+}
+
+// UIDs includes all params to make a unique identification of this object.
+// Most resources only return one, although some resources can return multiple.
+func (obj *NftRuleRes) UIDs() []engine.ResUID {
+	x := &NftRuleUID{
+		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
+		table:   obj.Table,
+		family:  obj.Family,
+		name:    obj.Name(),
+	}
+	return []engine.ResUID{x}
+}
+
+// GroupCmp returns whether two resources can be grouped together or not. Rules
+// only get grouped into an nft:table resource, and never into each other.
+func (obj *NftRuleRes) GroupCmp(r engine.GroupableRes) error {
+	return fmt.Errorf("rules can only be grouped into a table")
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *NftRuleRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes NftRuleRes // indirection to avoid infinite recursion
+
+	def := obj.Default()         // get the default
+	res, ok := def.(*NftRuleRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to NftRuleRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = NftRuleRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// nftIPFamily returns true if addresses and protocols can be matched in this
+// table family.
+func nftIPFamily(family nftables.TableFamily) bool {
+	switch family {
+	case nftables.TableFamilyINet, nftables.TableFamilyIPv4, nftables.TableFamilyIPv6:
+		return true
+	}
+	return false
+}
+
+// nftIfname returns the expressions that match an interface name.
+func nftIfname(key expr.MetaKey, name string) ([]expr.Any, error) {
+	if len(name) >= unix.IFNAMSIZ {
+		return nil, fmt.Errorf("the interface name is too long")
+	}
+	data := make([]byte, unix.IFNAMSIZ)
+	copy(data, name)
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data},
+	}, nil
+}
+
+// nftAddrs returns the expressions that match the source and destination
+// addresses. Both must be in the same address family. In the inet family, the
+// network protocol gets checked first, since the header offsets depend on it.
+func nftAddrs(family nftables.TableFamily, saddr, daddr string) ([]expr.Any, error) {
+	if !nftIPFamily(family) {
+		return nil, fmt.Errorf("addresses can't be matched in this table family")
+	}
+
+	exprs := []expr.Any{}
+	var ipv4 *bool
+	for _, x := range []struct {
+		name  string
+		value string
+	}{
+		{"Saddr", saddr},
+		{"Daddr", daddr},
+	} {
+		if x.value == "" {
+			continue
+		}
+		ipnet, err := nftParseNet(x.value)
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "invalid %s", x.name)
+		}
+		is4 := ipnet.IP.To4() != nil
+		if ipv4 != nil && *ipv4 != is4 {
+			return nil, fmt.Errorf("the Saddr and Daddr are not in the same address family")
+		}
+		if is4 && family == nftables.TableFamilyIPv6 || !is4 && family == nftables.TableFamilyIPv4 {
+			return nil, fmt.Errorf("the %s is not in the same address family as the table", x.name)
+		}
+		if ipv4 == nil && family == nftables.TableFamilyINet {
+			proto := byte(unix.NFPROTO_IPV6)
+			if is4 {
+				proto = unix.NFPROTO_IPV4
+			}
+			exprs = append(exprs,
+				&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+			)
+		}
+		ipv4 = &is4
+
+		// these are the header offsets of the addresses
+		ip := ipnet.IP.To16()
+		offset := uint32(8) // ipv6 saddr
+		if is4 {
+			ip = ipnet.IP.To4()
+			offset = 12 // ipv4 saddr
+		}
+		if x.name == "Daddr" {
+			offset += uint32(len(ip))
+		}
+
+		exprs = append(exprs, &expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          uint32(len(ip)),
+		})
+		if ones, bits := ipnet.Mask.Size(); ones != bits {
+			exprs = append(exprs, &expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            uint32(len(ip)),
+				Mask:           []byte(ipnet.Mask),
+				Xor:            make([]byte, len(ip)),
+			})
+		}
+		exprs = append(exprs, &expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte(ip.Mask(ipnet.Mask)),
+		})
+	}
+
+	return exprs, nil
+}
+
+// nftParseNet parses an address or a network in CIDR notation. A plain address
+// is treated as a network with a full mask.
+func nftParseNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		if ip := ipnet.IP.To4(); ip != nil { // normalize the length
+			ipnet.IP = ip
+			ipnet.Mask = ipnet.Mask[len(ipnet.Mask)-net.IPv4len:]
+		}
+		return ipnet, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address: %s", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// nftPort returns the expressions that match a transport header port or a port
+// range at the given offset.
+func nftPort(offset uint32, s string) ([]expr.Any, error) {
+	split := strings.SplitN(s, "-", 2)
+	ports := []uint16{}
+	for _, x := range split {
+		port, err := strconv.ParseUint(strings.TrimSpace(x), 10, 16)
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "invalid port: %s", x)
+		}
+		ports = append(ports, uint16(port))
+	}
+
+	exprs := []expr.Any{
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       offset,
+			Len:          2,
+		},
+	}
+	if len(ports) == 1 {
+		return append(exprs, &expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     binaryutil.BigEndian.PutUint16(ports[0]),
+		}), nil
+	}
+	if ports[0] > ports[1] {
+		return nil, fmt.Errorf("the port range is backwards: %s", s)
+	}
+	return append(exprs,
+		&expr.Cmp{
+			Op:       expr.CmpOpGte,
+			Register: 1,
+			Data:     binaryutil.BigEndian.PutUint16(ports[0]),
+		},
+		&expr.Cmp{
+			Op:       expr.CmpOpLte,
+			Register: 1,
+			Data:     binaryutil.BigEndian.PutUint16(ports[1]),
+		},
+	), nil
+}
+
+// nftReject returns the reject expression for a table family. It rejects with
+// an icmp port unreachable, which is what the nft tool does by default.
+func nftReject(family nftables.TableFamily) (expr.Any, error) {
+	switch family {
+	case nftables.TableFamilyINet:
+		return &expr.Reject{Type: unix.NFT_REJECT_ICMPX_UNREACH, Code: unix.NFT_REJECT_ICMPX_PORT_UNREACH}, nil
+	case nftables.TableFamilyIPv4:
+		return &expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: 3}, nil // port unreachable
+	case nftables.TableFamilyIPv6:
+		return &expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: 4}, nil // port unreachable
+	}
+	return nil, fmt.Errorf("the reject verdict can't be used in this table family")
+}
+
+// nftUserData returns the rule userdata which holds the comment.
+func nftUserData(comment string) []byte {
+	data := []byte{nftUdataRuleComment, byte(len(comment) + 1)}
+	data = append(data, comment...)
+	return append(data, 0) // the nft tool expects the null
+}
+
+// nftChainHookEqual returns true if the two chains have the same type, hook and
+// priority. These can't be changed without recreating the chain.
+func nftChainHookEqual(a, b *nftables.Chain) bool {
+	if (a.Hooknum == nil) != (b.Hooknum == nil) {
+		return false
+	}
+	if a.Hooknum == nil {
+		return true // both are regular chains
+	}
+	if *a.Hooknum != *b.Hooknum || a.Type != b.Type {
+		return false
+	}
+	if (a.Priority == nil) != (b.Priority == nil) {
+		return false
+	}
+	return a.Priority == nil || *a.Priority == *b.Priority
+}
+
+// nftChainPolicyEqual returns true if the two chains have the same policy.
+func nftChainPolicyEqual(a, b *nftables.Chain) bool {
+	if (a.Policy == nil) != (b.Policy == nil) {
+		return false
+	}
+	return a.Policy == nil || *a.Policy == *b.Policy
+}
+
+// nftRulesEqual returns true if the listed rules match the expected rules in
+// the same order. The counter values are ignored, since they change.
+func nftRulesEqual(family byte, got, expected []*nftables.Rule) bool {
+	if len(got) != len(expected) {
+		return false
+	}
+	for i, x := range got {
+		if !bytes.Equal(x.UserData, expected[i].UserData) {
+			return false
+		}
+		if len(x.Exprs) != len(expected[i].Exprs) {
+			return false
+		}
+		for j, e := range x.Exprs {
+			if _, ok := e.(*expr.Counter); ok {
+				e = &expr.Counter{}
+			}
+			b1, err := expr.Marshal(family, e)
+			if err != nil {
+				return false
+			}
+			b2, err := expr.Marshal(family, expected[i].Exprs[j])
+			if err != nil {
+				return false
+			}
+			if !bytes.Equal(b1, b2) {
+				return false
+			}
+		}
+	}
+	return true
+}
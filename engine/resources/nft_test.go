@@ -0,0 +1,277 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !darwin
+
+package resources
+
+import (
+	"testing"
+
+	"github.com/purpleidea/mgmt/engine"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+func TestNftRuleValidate1(t *testing.T) {
+	type test struct { // an individual test
+		name string
+		rule *NftRuleRes
+		fail bool
+	}
+	testCases := []test{}
+
+	testCases = append(testCases, test{
+		name: "ssh",
+		rule: &NftRuleRes{Protocol: "tcp", Dport: "22", Verdict: "accept"},
+	})
+	testCases = append(testCases, test{
+		name: "port range",
+		rule: &NftRuleRes{Protocol: "udp", Sport: "1024-65535", Saddr: "10.0.0.0/8"},
+	})
+	testCases = append(testCases, test{
+		name: "ipv6 network",
+		rule: &NftRuleRes{Daddr: "fd00::/64", Verdict: "drop"},
+	})
+	testCases = append(testCases, test{
+		name: "jump",
+		rule: &NftRuleRes{Iif: "eth0", Verdict: "jump", Target: "trusted"},
+	})
+	testCases = append(testCases, test{
+		name: "port without protocol",
+		rule: &NftRuleRes{Dport: "22"},
+		fail: true,
+	})
+	testCases = append(testCases, test{
+		name: "backwards port range",
+		rule: &NftRuleRes{Protocol: "tcp", Dport: "80-22"},
+		fail: true,
+	})
+	testCases = append(testCases, test{
+		name: "mixed address families",
+		rule: &NftRuleRes{Saddr: "10.0.0.1", Daddr: "fd00::1"},
+		fail: true,
+	})
+	testCases = append(testCases, test{
+		name: "ipv6 in an ip table",
+		rule: &NftRuleRes{Family: "ip", Saddr: "fd00::1"},
+		fail: true,
+	})
+	testCases = append(testCases, test{
+		name: "reject in an arp table",
+		rule: &NftRuleRes{Family: "arp", Verdict: "reject"},
+		fail: true,
+	})
+	testCases = append(testCases, test{
+		name: "bad ct state",
+		rule: &NftRuleRes{CtState: []string{"established", "sleepy"}},
+		fail: true,
+	})
+	testCases = append(testCases, test{
+		name: "jump without target",
+		rule: &NftRuleRes{Verdict: "jump"},
+		fail: true,
+	})
+	testCases = append(testCases, test{
+		name: "target without jump",
+		rule: &NftRuleRes{Verdict: "accept", Target: "trusted"},
+		fail: true,
+	})
+
+	for index, tc := range testCases { // run all the tests
+		rule := tc.rule
+		rule.SetKind("nft:rule")
+		rule.SetName(tc.name)
+		rule.State = NftStateExists
+		rule.Table = "filter"
+		rule.Chain = "input"
+		if rule.Family == "" {
+			rule.Family = NftDefaultFamily
+		}
+		err := rule.Validate()
+		if !tc.fail && err != nil {
+			t.Errorf("test #%d (%s): validate failed with: %v", index, tc.name, err)
+		}
+		if tc.fail && err == nil {
+			t.Errorf("test #%d (%s): validate passed, expected fail", index, tc.name)
+		}
+	}
+}
+
+// nftTestRule builds a rule for the table tests.
+func nftTestRule(name, chain string, index int64) *NftRuleRes {
+	rule := &NftRuleRes{
+		State:  NftStateExists,
+		Table:  "filter",
+		Family: NftDefaultFamily,
+		Chain:  chain,
+		Index:  index,
+	}
+	rule.SetKind("nft:rule")
+	rule.SetName(name)
+	return rule
+}
+
+func TestNftTable1(t *testing.T) {
+	netnsTest(t, func(init *engine.Init) {
+		res := &NftTableRes{
+			State:  NftStateExists,
+			Family: NftDefaultFamily,
+			Chains: []*NftChain{
+				{Name: "input", Type: "filter", Hook: "input", Policy: "drop"},
+			},
+		}
+		res.SetKind("nft:table")
+		res.SetName("filter")
+
+		established := nftTestRule("established", "input", 0)
+		established.CtState = []string{"established", "related"}
+		established.Verdict = "accept"
+
+		ssh := nftTestRule("ssh", "input", 10)
+		ssh.Protocol = "tcp"
+		ssh.Dport = "22"
+		ssh.Counter = true
+		ssh.Verdict = "accept"
+
+		lan := nftTestRule("lan", "input", 20)
+		lan.Saddr = "192.168.0.0/16"
+		lan.Verdict = "jump"
+		lan.Target = "trusted"
+
+		loopback := nftTestRule("loopback", "trusted", 0)
+		loopback.Iif = "lo"
+		loopback.Daddr = "fd00::/8"
+		loopback.Verdict = "reject"
+
+		for _, x := range []*NftRuleRes{established, ssh, lan, loopback} {
+			if err := res.GroupRes(x); err != nil {
+				t.Errorf("could not group: %v", err)
+				return
+			}
+		}
+
+		if err := res.Validate(); err != nil {
+			t.Errorf("validate failed with: %v", err)
+			return
+		}
+		if err := res.Init(init); err != nil {
+			t.Errorf("init failed with: %v", err)
+			return
+		}
+		defer res.Close()
+
+		expect := func(name string, expected bool) bool {
+			checkOK, err := res.CheckApply(true)
+			if err != nil {
+				t.Errorf("%s: checkapply failed with: %v", name, err)
+				return false
+			}
+			if checkOK != expected {
+				t.Errorf("%s: expected checkOK of %t, got: %t", name, expected, checkOK)
+				return false
+			}
+			return true
+		}
+		if !expect("create", false) || !expect("created", true) {
+			return
+		}
+
+		conn, err := nftables.New()
+		if err != nil {
+			t.Errorf("could not connect to nftables: %v", err)
+			return
+		}
+		table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyINet}
+		input := &nftables.Chain{Name: "input", Table: table}
+		rules, err := conn.GetRules(table, input)
+		if err != nil {
+			t.Errorf("could not list rules: %v", err)
+			return
+		}
+		if len(rules) != 3 {
+			t.Errorf("expected 3 rules, got: %d", len(rules))
+			return
+		}
+		if string(rules[1].UserData) != string(nftUserData("ssh")) {
+			t.Errorf("the rules are in the wrong order")
+		}
+
+		// someone else adds a rule
+		conn.AddRule(&nftables.Rule{
+			Table: table,
+			Chain: input,
+			Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}},
+		})
+		if err := conn.Flush(); err != nil {
+			t.Errorf("could not add rule: %v", err)
+			return
+		}
+		if !expect("rule drift", false) || !expect("rule drift fixed", true) {
+			return
+		}
+
+		// someone else adds a chain
+		conn.AddChain(&nftables.Chain{Name: "extra", Table: table})
+		if err := conn.Flush(); err != nil {
+			t.Errorf("could not add chain: %v", err)
+			return
+		}
+		if !expect("chain drift", false) || !expect("chain drift fixed", true) {
+			return
+		}
+
+		// a rule changes
+		ssh.Dport = "2222"
+		if !expect("rule change", false) || !expect("rule changed", true) {
+			return
+		}
+
+		// the policy changes
+		res.Chains[0].Policy = "accept"
+		if !expect("policy change", false) || !expect("policy changed", true) {
+			return
+		}
+
+		// the hook changes
+		res.Chains[0].Hook = "forward"
+		if !expect("hook change", false) || !expect("hook changed", true) {
+			return
+		}
+
+		// a rule is removed, and the chain it jumped to isn't needed
+		lan.State = NftStateAbsent
+		loopback.State = NftStateAbsent
+		if !expect("rule remove", false) || !expect("rule removed", true) {
+			return
+		}
+		chains, err := conn.ListChainsOfTableFamily(nftables.TableFamilyINet)
+		if err != nil {
+			t.Errorf("could not list chains: %v", err)
+			return
+		}
+		if len(chains) != 1 {
+			t.Errorf("expected 1 chain, got: %d", len(chains))
+		}
+
+		res.State = NftStateAbsent
+		if !expect("remove", false) || !expect("removed", true) {
+			return
+		}
+	})
+}
@@ -0,0 +1,582 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/util/errwrap"
+)
+
+func init() {
+	engine.RegisterResource("notify:webhook", func() engine.Res { return &NotifyWebhookRes{} })
+}
+
+const (
+	// NotifyWebhookEventRefresh is the event of a refresh notification.
+	NotifyWebhookEventRefresh = "refresh"
+	// NotifyWebhookEventError is the event of an upstream resource which
+	// failed.
+	NotifyWebhookEventError = "error"
+
+	// NotifyWebhookDefaultTemplate is the default template of the payload,
+	// which works with most chat systems, such as Slack and Mattermost.
+	NotifyWebhookDefaultTemplate = `{"text": {{ json .Message }}}`
+
+	// notifyWebhookQueueSize is the number of upstream errors which can be
+	// waiting to be sent. The others are spooled right away.
+	notifyWebhookQueueSize = 16
+	// notifyWebhookSpoolInterval is how often the spooled messages are
+	// sent again.
+	notifyWebhookSpoolInterval = time.Minute
+)
+
+var (
+	// notifyWebhookRunningMutex guards the running field of the resources.
+	// It's not part of the resource, since the engine can tell a resource
+	// about an upstream error before its Init, or after its Close.
+	notifyWebhookRunningMutex = &sync.Mutex{}
+)
+
+// NotifyWebhookRes is a resource which posts a JSON payload to a webhook. It
+// sends a message when it receives a refresh notification, and when one of the
+// resources with an edge to it fails permanently. A failed post is retried with
+// an increasing delay, and if it still fails, the message is spooled in the
+// VarDir and is sent again later, so that none are lost while the endpoint is
+// down.
+type NotifyWebhookRes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Refreshable
+
+	init *engine.Init
+
+	// URL is the http or https url of the webhook.
+	URL string `lang:"url" yaml:"url"`
+
+	// Message is the message that is sent on a refresh. It defaults to the
+	// name of the resource.
+	Message string `lang:"message" yaml:"message"`
+
+	// Template is the text/template of the JSON payload. It runs with the
+	// Event, the Message, the Hostname, the Name of this resource, and the
+	// Time. For errors, the Message is a summary, and the Resource and the
+	// Error are also set. The json function quotes a string as JSON. It
+	// defaults to NotifyWebhookDefaultTemplate.
+	Template string `lang:"template" yaml:"template"`
+
+	// Headers are the extra http headers, such as the Authorization header.
+	Headers map[string]string `lang:"headers" yaml:"headers"`
+
+	// Retries is the number of times that a failed post is retried.
+	Retries uint32 `lang:"retries" yaml:"retries"`
+
+	// Delay is the number of milliseconds before the first retry. It is
+	// doubled after each one.
+	Delay uint32 `lang:"delay" yaml:"delay"`
+
+	// Timeout is the number of seconds that each post can take.
+	Timeout uint32 `lang:"timeout" yaml:"timeout"`
+
+	// SpoolSize is the maximum number of messages which are spooled. When
+	// it is reached, the oldest ones are dropped. If it is zero, then the
+	// messages which can't be sent are dropped right away.
+	SpoolSize uint32 `lang:"spoolsize" yaml:"spoolsize"`
+
+	template      *template.Template
+	spoolDir      string
+	spoolMutex    *sync.Mutex // guards the spool files
+	flushMutex    *sync.Mutex // so that only one flush posts at a time
+	errorChan     chan []byte // payloads of the upstream errors
+	closeChan     chan struct{}
+	interruptChan chan struct{}
+	interruptOnce *sync.Once
+	wg            *sync.WaitGroup
+	running       bool // between Init and Close
+}
+
+// notifyWebhookData is the data that the template runs with.
+type notifyWebhookData struct {
+	Event    string
+	Message  string
+	Hostname string
+	Name     string
+	Time     string
+	Resource string
+	Error    string
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *NotifyWebhookRes) Default() engine.Res {
+	return &NotifyWebhookRes{
+		Template:  NotifyWebhookDefaultTemplate,
+		Retries:   3,
+		Delay:     1000,
+		Timeout:   10,
+		SpoolSize: 100,
+	}
+}
+
+// getMessage returns the message that is sent on a refresh.
+func (obj *NotifyWebhookRes) getMessage() string {
+	if obj.Message != "" {
+		return obj.Message
+	}
+	return obj.Name()
+}
+
+// parseTemplate parses the template of the payload.
+func (obj *NotifyWebhookRes) parseTemplate() (*template.Template, error) {
+	funcs := template.FuncMap{
+		"json": func(s string) (string, error) {
+			b, err := json.Marshal(s)
+			return string(b), err
+		},
+	}
+	return template.New(obj.Name()).Funcs(funcs).Option("missingkey=error").Parse(obj.Template)
+}
+
+// Validate if the params passed in are valid data.
+func (obj *NotifyWebhookRes) Validate() error {
+	u, err := url.Parse(obj.URL)
+	if err != nil {
+		return errwrap.Wrapf(err, "invalid url")
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("the url must be an http or https url")
+	}
+	for k, v := range obj.Headers {
+		if k == "" || strings.ContainsAny(k, ": \t\r\n") {
+			return fmt.Errorf("invalid header: %s", k)
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("the value of the %s header must be on one line", k)
+		}
+	}
+	if obj.Timeout == 0 {
+		return fmt.Errorf("the timeout must be positive")
+	}
+
+	tmpl, err := obj.parseTemplate()
+	if err != nil {
+		return errwrap.Wrapf(err, "invalid template")
+	}
+	// check with an error event, which has all of the fields set
+	data := &notifyWebhookData{
+		Event:    NotifyWebhookEventError,
+		Message:  "test: \"failed\"",
+		Hostname: "hostname",
+		Name:     obj.Name(),
+		Time:     time.Now().Format(time.RFC3339),
+		Resource: "test[test]",
+		Error:    "failed",
+	}
+	if _, err := renderWebhookPayload(tmpl, data); err != nil {
+		return errwrap.Wrapf(err, "invalid template")
+	}
+
+	return nil
+}
+
+// Init runs some startup code for this resource. It starts the goroutine which
+// sends the upstream errors and the spooled messages.
+func (obj *NotifyWebhookRes) Init(init *engine.Init) error {
+	var err error
+	obj.init = init // save for later
+
+	if obj.template, err = obj.parseTemplate(); err != nil {
+		return errwrap.Wrapf(err, "invalid template")
+	}
+	dir, err := obj.init.VarDir("spool")
+	if err != nil {
+		return errwrap.Wrapf(err, "could not get VarDir in Init()")
+	}
+	obj.spoolDir = dir
+
+	obj.spoolMutex = &sync.Mutex{}
+	obj.flushMutex = &sync.Mutex{}
+	obj.errorChan = make(chan []byte, notifyWebhookQueueSize)
+	obj.closeChan = make(chan struct{})
+	obj.interruptChan = make(chan struct{})
+	obj.interruptOnce = &sync.Once{}
+	obj.wg = &sync.WaitGroup{}
+
+	obj.wg.Add(1)
+	go func() {
+		defer obj.wg.Done()
+		ticker := time.NewTicker(notifyWebhookSpoolInterval)
+		defer ticker.Stop()
+
+		obj.flushSpool(obj.closeChan) // from a previous run
+		for {
+			select {
+			case payload := <-obj.errorChan:
+				if err := obj.send(payload, obj.closeChan); err != nil {
+					obj.init.Logf("could not send the error: %v", err)
+				}
+
+			case <-ticker.C:
+				obj.flushSpool(obj.closeChan)
+
+			case <-obj.closeChan:
+				for { // keep what we didn't get to for the next run
+					select {
+					case payload := <-obj.errorChan:
+						obj.spool(payload)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	notifyWebhookRunningMutex.Lock()
+	obj.running = true
+	notifyWebhookRunningMutex.Unlock()
+
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *NotifyWebhookRes) Close() error {
+	notifyWebhookRunningMutex.Lock()
+	obj.running = false // no more upstream errors
+	notifyWebhookRunningMutex.Unlock()
+
+	close(obj.closeChan)
+	obj.wg.Wait()
+	return nil
+}
+
+// Watch is the primary listener for this resource and it outputs events. This
+// resource only does something when it's notified, so it has nothing to watch.
+func (obj *NotifyWebhookRes) Watch() error {
+	obj.init.Running() // when started, notify engine that we're running
+
+	select {
+	case <-obj.init.Done: // closed by the engine to signal shutdown
+	}
+
+	return nil
+}
+
+// CheckApply sends the message if we received a refresh notification.
+func (obj *NotifyWebhookRes) CheckApply(apply bool) (bool, error) {
+	if !obj.init.Refresh() {
+		return true, nil
+	}
+	if !apply {
+		return false, nil
+	}
+
+	payload, err := obj.render(&notifyWebhookData{
+		Event:   NotifyWebhookEventRefresh,
+		Message: obj.getMessage(),
+	})
+	if err != nil {
+		return false, err
+	}
+	obj.init.Logf("sending: %s", obj.getMessage())
+	if err := obj.send(payload, obj.interruptChan); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// UpstreamError is called by the engine when a resource with an edge to this
+// one fails permanently. The message is sent in the background. If we're not
+// running, because we weren't started yet or we're already closed, then the
+// error is dropped.
+func (obj *NotifyWebhookRes) UpstreamError(res engine.Res, err error) {
+	notifyWebhookRunningMutex.Lock()
+	defer notifyWebhookRunningMutex.Unlock()
+	if !obj.running {
+		return
+	}
+
+	payload, e := obj.render(&notifyWebhookData{
+		Event:    NotifyWebhookEventError,
+		Message:  fmt.Sprintf("%s failed: %v", res, err),
+		Resource: res.String(),
+		Error:    err.Error(),
+	})
+	if e != nil {
+		obj.init.Logf("could not render the error of %s: %v", res, e)
+		return
+	}
+	select {
+	case obj.errorChan <- payload:
+	default: // don't block the engine
+		obj.init.Logf("too many errors to send, spooling the error of %s", res)
+		obj.spool(payload)
+	}
+}
+
+// Interrupt is called to ask the CheckApply to stop retrying.
+func (obj *NotifyWebhookRes) Interrupt() error {
+	obj.interruptOnce.Do(func() { close(obj.interruptChan) }) // idempotent
+	return nil
+}
+
+// render returns the payload of the message.
+func (obj *NotifyWebhookRes) render(data *notifyWebhookData) ([]byte, error) {
+	data.Hostname = obj.init.Hostname
+	data.Name = obj.Name()
+	data.Time = time.Now().Format(time.RFC3339)
+	return renderWebhookPayload(obj.template, data)
+}
+
+// send posts the payload, with retries, after the spooled messages have been
+// sent. If it still fails, then the payload is spooled for later. It only
+// errors if the payload was rejected by the server, which retrying won't fix.
+func (obj *NotifyWebhookRes) send(payload []byte, cancel <-chan struct{}) error {
+	if !obj.flushSpool(cancel) { // keep the messages in order
+		obj.spool(payload)
+		return nil
+	}
+
+	delay := time.Duration(obj.Delay) * time.Millisecond
+	for i := uint32(0); ; i++ {
+		retry, err := obj.post(payload)
+		if err == nil {
+			return nil
+		}
+		if !retry {
+			return err
+		}
+		if i >= obj.Retries {
+			obj.init.Logf("spooling the message: %v", err)
+			obj.spool(payload)
+			return nil
+		}
+		obj.init.Logf("retrying in %s: %v", delay, err)
+		select {
+		case <-time.After(delay):
+		case <-cancel:
+			obj.spool(payload)
+			return nil
+		}
+		delay *= 2
+	}
+}
+
+// post posts the payload once. It returns true if a failure could succeed when
+// it's retried.
+func (obj *NotifyWebhookRes) post(payload []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, obj.URL, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range obj.Headers {
+		req.Header.Set(k, v)
+	}
+	client := &http.Client{
+		Timeout: time.Duration(obj.Timeout) * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024)) // so the connection can be reused
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return true, nil
+	}
+	err = fmt.Errorf("unexpected status: %s", resp.Status)
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests {
+		return true, err
+	}
+	return false, err // the other client errors are permanent
+}
+
+// spool stores the payload so that it can be sent later. The oldest payloads
+// are removed if there are too many.
+func (obj *NotifyWebhookRes) spool(payload []byte) {
+	obj.spoolMutex.Lock()
+	defer obj.spoolMutex.Unlock()
+
+	if obj.SpoolSize == 0 {
+		obj.init.Logf("dropping the message")
+		return
+	}
+	file := path.Join(obj.spoolDir, fmt.Sprintf("%020d.json", time.Now().UnixNano()))
+	if err := ioutil.WriteFile(file, payload, 0600); err != nil {
+		obj.init.Logf("could not spool the message: %v", err)
+		return
+	}
+
+	files, err := spoolFiles(obj.spoolDir)
+	if err != nil {
+		obj.init.Logf("could not list the spool: %v", err)
+		return
+	}
+	for i := 0; i < len(files)-int(obj.SpoolSize); i++ {
+		obj.init.Logf("the spool is full, dropping a message")
+		os.Remove(path.Join(obj.spoolDir, files[i]))
+	}
+}
+
+// flushSpool sends the spooled payloads, in order, without any retries. It
+// returns true if the spool is now empty. The spool lock isn't held while
+// posting, so that spooling a new message never waits for the network.
+func (obj *NotifyWebhookRes) flushSpool(cancel <-chan struct{}) bool {
+	obj.flushMutex.Lock()
+	defer obj.flushMutex.Unlock()
+
+	obj.spoolMutex.Lock()
+	files, err := spoolFiles(obj.spoolDir)
+	obj.spoolMutex.Unlock()
+	if err != nil {
+		obj.init.Logf("could not list the spool: %v", err)
+		return false
+	}
+	for _, name := range files {
+		select {
+		case <-cancel:
+			return false
+		default:
+		}
+		file := path.Join(obj.spoolDir, name)
+		obj.spoolMutex.Lock()
+		payload, err := ioutil.ReadFile(file)
+		obj.spoolMutex.Unlock()
+		if os.IsNotExist(err) {
+			continue // it was dropped because the spool was full
+		} else if err != nil {
+			obj.init.Logf("could not read the spool: %v", err)
+			return false
+		}
+		if retry, err := obj.post(payload); err != nil && retry {
+			if obj.init.Debug {
+				obj.init.Logf("could not send the spooled messages: %v", err)
+			}
+			return false
+		} else if err != nil {
+			obj.init.Logf("dropping a spooled message: %v", err)
+		}
+		obj.spoolMutex.Lock()
+		err = os.Remove(file)
+		obj.spoolMutex.Unlock()
+		if err != nil && !os.IsNotExist(err) {
+			obj.init.Logf("could not remove from the spool: %v", err)
+			return false
+		}
+	}
+	return true
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *NotifyWebhookRes) Cmp(r engine.Res) error {
+	// we can only compare NotifyWebhookRes to others of the same resource kind
+	res, ok := r.(*NotifyWebhookRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.URL != res.URL {
+		return fmt.Errorf("the URL differs")
+	}
+	if obj.getMessage() != res.getMessage() {
+		return fmt.Errorf("the Message differs")
+	}
+	if obj.Template != res.Template {
+		return fmt.Errorf("the Template differs")
+	}
+	if !strMapEq(obj.Headers, res.Headers) {
+		return fmt.Errorf("the Headers differ")
+	}
+	if obj.Retries != res.Retries {
+		return fmt.Errorf("the Retries differs")
+	}
+	if obj.Delay != res.Delay {
+		return fmt.Errorf("the Delay differs")
+	}
+	if obj.Timeout != res.Timeout {
+		return fmt.Errorf("the Timeout differs")
+	}
+	if obj.SpoolSize != res.SpoolSize {
+		return fmt.Errorf("the SpoolSize differs")
+	}
+
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *NotifyWebhookRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes NotifyWebhookRes // indirection to avoid infinite recursion
+
+	def := obj.Default()               // get the default
+	res, ok := def.(*NotifyWebhookRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to NotifyWebhookRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = NotifyWebhookRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// renderWebhookPayload runs the template, and checks that the result is JSON.
+func renderWebhookPayload(tmpl *template.Template, data *notifyWebhookData) ([]byte, error) {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return nil, err
+	}
+	if !json.Valid(b.Bytes()) {
+		return nil, fmt.Errorf("the payload is not valid JSON: %s", b.String())
+	}
+	return b.Bytes(), nil
+}
+
+// spoolFiles returns the names of the spooled payloads, oldest first.
+func spoolFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".json") {
+			files = append(files, info.Name())
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
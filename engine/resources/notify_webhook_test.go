@@ -0,0 +1,287 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root
+
+package resources
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+)
+
+func TestNotifyWebhookValidate1(t *testing.T) {
+	def := func(res *NotifyWebhookRes) *NotifyWebhookRes {
+		x := (&NotifyWebhookRes{}).Default().(*NotifyWebhookRes)
+		x.URL, x.Headers = res.URL, res.Headers
+		if res.Template != "" {
+			x.Template = res.Template
+		}
+		return x
+	}
+	tests := []struct {
+		res  *NotifyWebhookRes
+		fail bool
+	}{
+		{&NotifyWebhookRes{URL: "https://hooks.example.com/T0/B0"}, false},
+		{&NotifyWebhookRes{URL: "http://localhost:8080/", Headers: map[string]string{"Authorization": "Bearer secret"}}, false},
+		{&NotifyWebhookRes{URL: "http://localhost/", Template: `{"event": "{{ .Event }}", "error": {{ json .Error }}}`}, false},
+		{&NotifyWebhookRes{URL: "ftp://example.com/"}, true},                                               // not http
+		{&NotifyWebhookRes{URL: "http:///path"}, true},                                                     // no host
+		{&NotifyWebhookRes{URL: "http://localhost/", Headers: map[string]string{"Bad Header": "x"}}, true}, // bad header
+		{&NotifyWebhookRes{URL: "http://localhost/", Template: `{"text": {{ .Message }}}`}, true},          // not quoted
+		{&NotifyWebhookRes{URL: "http://localhost/", Template: `{{ .Nope }}`}, true},                       // unknown field
+	}
+	for i, tt := range tests {
+		res := def(tt.res)
+		res.SetKind("notify:webhook")
+		res.SetName("webhook")
+		if err := res.Validate(); (err != nil) != tt.fail {
+			t.Errorf("test #%d: expected fail: %t, got: %v", i, tt.fail, err)
+		}
+	}
+}
+
+func TestNotifyWebhook1(t *testing.T) {
+	mutex := &sync.Mutex{}
+	messages := []map[string]string{}
+	fail := 0 // the number of requests to fail
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if fail > 0 {
+			fail--
+			w.WriteHeader(status)
+			return
+		}
+		m := map[string]string{}
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		messages = append(messages, m)
+	}))
+	defer server.Close()
+	received := func() []map[string]string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]map[string]string{}, messages...)
+	}
+
+	tmpdir := t.TempDir()
+	refresh := true
+	init := &engine.Init{
+		Hostname: "h1",
+		Refresh: func() bool {
+			return refresh
+		},
+		VarDir: func(string) (string, error) {
+			return tmpdir, nil
+		},
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+	}
+	res := (&NotifyWebhookRes{}).Default().(*NotifyWebhookRes)
+	res.URL = server.URL
+	res.Message = "deployed"
+	res.Template = `{"event": "{{ .Event }}", "text": {{ json .Message }}, "host": "{{ .Hostname }}"}`
+	res.Headers = map[string]string{"Authorization": "Bearer secret"}
+	res.Retries = 2
+	res.Delay = 10
+	res.SetKind("notify:webhook")
+	res.SetName("webhook")
+	if err := res.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	if err := res.Init(init); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	defer res.Close()
+
+	// it's sent after two failures
+	fail = 2
+	if checkOK, err := res.CheckApply(true); err != nil || checkOK {
+		t.Errorf("expected the message to be sent: %t, %v", checkOK, err)
+	}
+	if m := received(); len(m) != 1 || m[0]["event"] != "refresh" || m[0]["text"] != "deployed" || m[0]["host"] != "h1" {
+		t.Errorf("unexpected messages: %v", m)
+	}
+	refresh = false
+	if checkOK, err := res.CheckApply(true); err != nil || !checkOK {
+		t.Errorf("expected nothing to send: %t, %v", checkOK, err)
+	}
+
+	// it's spooled when it keeps on failing, and sent before the next one
+	refresh = true
+	fail = 3
+	if _, err := res.CheckApply(true); err != nil {
+		t.Errorf("expected the message to be spooled: %v", err)
+	}
+	if files, err := spoolFiles(tmpdir); err != nil || len(files) != 1 {
+		t.Errorf("expected a spooled message: %v, %v", files, err)
+	}
+	res.Message = "deployed again"
+	if _, err := res.CheckApply(true); err != nil {
+		t.Errorf("expected the message to be sent: %v", err)
+	}
+	if m := received(); len(m) != 3 || m[1]["text"] != "deployed" || m[2]["text"] != "deployed again" {
+		t.Errorf("unexpected messages: %v", m)
+	}
+	if files, err := spoolFiles(tmpdir); err != nil || len(files) != 0 {
+		t.Errorf("expected an empty spool: %v, %v", files, err)
+	}
+
+	// a client error isn't retried
+	fail = 1
+	status = http.StatusBadRequest
+	if _, err := res.CheckApply(true); err == nil {
+		t.Errorf("expected the rejected message to fail")
+	}
+
+	// the upstream errors are sent in the background
+	res.UpstreamError(res, fmt.Errorf("oops"))
+	for i := 0; i < 100 && len(received()) < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m := received(); len(m) != 4 || m[3]["event"] != "error" || m[3]["text"] != "notify:webhook[webhook] failed: oops" {
+		t.Errorf("unexpected messages: %v", m)
+	}
+}
+
+func TestNotifyWebhookSpool1(t *testing.T) {
+	tmpdir := t.TempDir()
+	res := &NotifyWebhookRes{SpoolSize: 2}
+	res.init = &engine.Init{
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+	}
+	res.spoolDir = tmpdir
+	res.spoolMutex = &sync.Mutex{}
+	for i := 0; i < 3; i++ {
+		res.spool([]byte(fmt.Sprintf(`{"n": %d}`, i)))
+		time.Sleep(time.Millisecond) // the names use the time
+	}
+	files, err := spoolFiles(tmpdir)
+	if err != nil || len(files) != 2 {
+		t.Errorf("expected two spooled messages: %v, %v", files, err)
+		return
+	}
+	if b, err := ioutil.ReadFile(tmpdir + "/" + files[0]); err != nil || string(b) != `{"n": 1}` {
+		t.Errorf("expected the oldest message to be dropped: %s, %v", b, err)
+	}
+}
+
+func TestNotifyWebhookSpool2(t *testing.T) {
+	posting := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(posting)
+		<-release // a slow server
+	}))
+	defer server.Close()
+
+	tmpdir := t.TempDir()
+	res := &NotifyWebhookRes{URL: server.URL, Timeout: 10, SpoolSize: 16}
+	res.init = &engine.Init{
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+	}
+	res.spoolDir = tmpdir
+	res.spoolMutex = &sync.Mutex{}
+	res.flushMutex = &sync.Mutex{}
+	res.spool([]byte(`{"n": 0}`))
+
+	flushed := make(chan bool)
+	go func() {
+		flushed <- res.flushSpool(make(chan struct{}))
+	}()
+	<-posting
+
+	// spooling must not wait for the post that is in progress
+	spooled := make(chan struct{})
+	go func() {
+		res.spool([]byte(`{"n": 1}`))
+		close(spooled)
+	}()
+	select {
+	case <-spooled:
+	case <-time.After(5 * time.Second):
+		t.Errorf("spooling blocked on the flush")
+	}
+	close(release)
+	if !<-flushed {
+		t.Errorf("expected the flush to succeed")
+	}
+	if files, err := spoolFiles(tmpdir); err != nil || len(files) != 1 {
+		t.Errorf("expected only the new message to be spooled: %v, %v", files, err)
+	}
+}
+
+func TestNotifyWebhookNotRunning1(t *testing.T) {
+	res := (&NotifyWebhookRes{}).Default().(*NotifyWebhookRes)
+	res.URL = "http://localhost/"
+	res.SetKind("notify:webhook")
+	res.SetName("webhook")
+
+	// the errors from before Init and after Close are dropped
+	res.UpstreamError(res, fmt.Errorf("oops"))
+	init := &engine.Init{
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+		VarDir: func(string) (string, error) {
+			return t.TempDir(), nil
+		},
+	}
+	if err := res.Init(init); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	if err := res.Interrupt(); err != nil {
+		t.Errorf("interrupt failed with: %v", err)
+	}
+	if err := res.Interrupt(); err != nil { // twice is fine
+		t.Errorf("interrupt failed with: %v", err)
+	}
+	if err := res.Close(); err != nil {
+		t.Errorf("close failed with: %v", err)
+	}
+	for i := 0; i < notifyWebhookQueueSize+1; i++ { // would spool if running
+		res.UpstreamError(res, fmt.Errorf("oops"))
+	}
+	if files, err := spoolFiles(res.spoolDir); err != nil || len(files) != 0 {
+		t.Errorf("expected nothing to be spooled: %v, %v", files, err)
+	}
+}
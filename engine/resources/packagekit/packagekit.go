@@ -43,8 +43,9 @@ const (
 	// FIXME: if PkBufferSize is too low, install seems to drop signals
 	PkBufferSize = 1000
 	// TODO: the PkSignalTimeout value might be too low
-	PkSignalPackageTimeout = 60 // 60 seconds, arbitrary
-	PkSignalDestroyTimeout = 15 // 15 seconds, arbitrary
+	PkSignalPackageTimeout = 60  // 60 seconds, arbitrary
+	PkSignalDestroyTimeout = 15  // 15 seconds, arbitrary
+	PkSignalRefreshTimeout = 600 // 10 minutes, downloads can be slow
 	PkPath                 = "/org/freedesktop/PackageKit"
 	PkIface                = "org.freedesktop.PackageKit"
 	PkIfaceTransaction     = PkIface + ".Transaction"
@@ -568,6 +569,50 @@ loop:
 	return nil
 }
 
+// RefreshCache refreshes the package metadata from all of the repositories. If
+// force is true, then the cache is refreshed even if it's not out of date. This
+// is useful after a repository has changed.
+func (obj *Conn) RefreshCache(force bool) error {
+	ch := make(chan *dbus.Signal, PkBufferSize) // we need to buffer :(
+	interfacePath, err := obj.CreateTransaction()
+	if err != nil {
+		return err
+	}
+
+	var signals = []string{"ErrorCode", "Finished", "Destroy"}
+	removeSignals, err := obj.matchSignal(ch, interfacePath, PkIfaceTransaction, signals)
+	if err != nil {
+		return err
+	}
+	defer removeSignals()
+
+	bus := obj.GetBus().Object(PkIface, interfacePath) // pass in found transaction path
+	call := bus.Call(FmtTransactionMethod("RefreshCache"), 0, force)
+	if call.Err != nil {
+		return call.Err
+	}
+	for {
+		select {
+		case signal := <-ch:
+			if signal.Path != interfacePath {
+				continue // not our transaction
+			}
+
+			if signal.Name == FmtTransactionMethod("ErrorCode") {
+				return fmt.Errorf("error in body: %v", signal.Body)
+			} else if signal.Name == FmtTransactionMethod("Finished") {
+				return nil // no need to wait for the Destroy signal
+			} else if signal.Name == FmtTransactionMethod("Destroy") {
+				return nil // should have seen Finished first
+			} else {
+				return fmt.Errorf("error in body: %v", signal.Body)
+			}
+		case <-util.TimeAfterOrBlock(PkSignalRefreshTimeout): // in case signals are dropped
+			return fmt.Errorf("timeout refreshing the cache")
+		}
+	}
+}
+
 // GetFilesByPackageID gets the list of files that are contained inside a list
 // of packageIDs.
 func (obj *Conn) GetFilesByPackageID(packageIDs []string) (files map[string][]string, err error) {
@@ -18,7 +18,10 @@
 package resources
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path"
 	"strings"
 
@@ -47,6 +50,17 @@ const (
 	PkgStateNewest = "newest"
 )
 
+var (
+	// pkgVersionlockFile is the list of the dnf versionlock plugin, which is
+	// used for the holds and excludes when apt isn't. It is a variable so
+	// that the tests can change it.
+	pkgVersionlockFile = "/etc/dnf/plugins/versionlock.list"
+
+	// errPkgUnknown is returned when the package can't be found, which can
+	// happen if it comes from a pkg:repo which hasn't been applied yet.
+	errPkgUnknown = errors.New("unknown package")
+)
+
 // PkgRes is a package resource for packagekit.
 type PkgRes struct {
 	traits.Base // add the base methods without re-implementation
@@ -59,6 +73,17 @@ type PkgRes struct {
 	AllowUntrusted   bool   `yaml:"allowuntrusted"`   // allow untrusted packages to be installed?
 	AllowNonFree     bool   `yaml:"allownonfree"`     // allow nonfree packages to be found?
 	AllowUnsupported bool   `yaml:"allowunsupported"` // allow unsupported packages to be found?
+
+	// Hold keeps the package at the version in State, so that nothing else
+	// can update it. It requires State to be a version. With apt, this is a
+	// pin in the preferences dir, and otherwise it is an entry in the list
+	// of the dnf versionlock plugin, which must be installed.
+	Hold bool `lang:"hold" yaml:"hold"`
+
+	// Exclude is a list of version patterns, such as "2.*", which must
+	// never be installed. They are stored in the same way as the Hold.
+	Exclude []string `lang:"exclude" yaml:"exclude"`
+
 	//bus              *packagekit.Conn    // pk bus connection
 	fileList []string // FIXME: update if pkg changes
 }
@@ -79,6 +104,18 @@ func (obj *PkgRes) Validate() error {
 		return fmt.Errorf("state is invalid, did you mean `newest` ?")
 	}
 
+	if obj.Hold && !stateIsVersion(obj.State) {
+		return fmt.Errorf("hold needs the state to be a version")
+	}
+	for _, x := range obj.Exclude {
+		if x == "" || strings.ContainsAny(x, " \n") {
+			return fmt.Errorf("invalid exclude pattern: %s", x)
+		}
+	}
+	if (obj.Hold || len(obj.Exclude) > 0) && strings.ContainsAny(obj.Name(), "/ \n") {
+		return fmt.Errorf("invalid package name for a hold: %s", obj.Name())
+	}
+
 	return nil
 }
 
@@ -87,7 +124,13 @@ func (obj *PkgRes) Init(init *engine.Init) error {
 	obj.init = init // save for later
 
 	if obj.fileList == nil {
-		if err := obj.populateFileList(); err != nil {
+		// The package might come from a pkg:repo which isn't there yet,
+		// so we can't find it until that has been applied.
+		if err := obj.populateFileList(); err == errPkgUnknown {
+			if obj.init.Debug {
+				obj.init.Logf("can't find the package yet, so there's no file list")
+			}
+		} else if err != nil {
 			return errwrap.Wrapf(err, "error populating file list in init")
 		}
 	}
@@ -241,7 +284,7 @@ func (obj *PkgRes) populateFileList() error {
 	data, ok := result[obj.Name()] // lookup single package (init does just one)
 	// package doesn't exist, this is an error!
 	if !ok || !data.Found {
-		return fmt.Errorf("can't find package named '%s'", obj.Name())
+		return errPkgUnknown // the caller decides if this is an error
 	}
 	if data.PackageID == "" {
 		// this can happen if you specify a bad version like "latest"
@@ -265,6 +308,24 @@ func (obj *PkgRes) populateFileList() error {
 func (obj *PkgRes) CheckApply(apply bool) (bool, error) {
 	obj.init.Logf("Check: %s", obj.fmtNames(obj.getNames()))
 
+	// The holds are applied first, so that they're used by the install.
+	pinOK := true
+	all := []*PkgRes{obj}
+	for _, x := range obj.GetGroup() { // grouped elements
+		if res, ok := x.(*PkgRes); ok {
+			all = append(all, res)
+		}
+	}
+	for _, res := range all {
+		c, err := res.pinCheckApply(apply)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "the hold of %s failed", res.Name())
+		}
+		if !c {
+			pinOK = false
+		}
+	}
+
 	bus := packagekit.NewBus()
 	if bus == nil {
 		return false, fmt.Errorf("can't connect to PackageKit bus")
@@ -303,11 +364,11 @@ func (obj *PkgRes) CheckApply(apply bool) (bool, error) {
 		fallthrough
 	case PkgStateNewest:
 		if validState {
-			return true, nil // state is correct, exit!
+			return pinOK, nil // state is correct, exit!
 		}
 	default: // version string
 		if obj.State == data.Version && data.Version != "" {
-			return true, nil
+			return pinOK, nil
 		}
 	}
 
@@ -396,6 +457,17 @@ func (obj *PkgRes) Adapts(r engine.CompatibleRes) error {
 	if obj.AllowUnsupported != res.AllowUnsupported {
 		return fmt.Errorf("allowunsupported differs: %t vs %t", obj.AllowUnsupported, res.AllowUnsupported)
 	}
+	if obj.Hold != res.Hold {
+		return fmt.Errorf("hold differs: %t vs %t", obj.Hold, res.Hold)
+	}
+	if len(obj.Exclude) != len(res.Exclude) {
+		return fmt.Errorf("the number of excludes differs")
+	}
+	for i, x := range obj.Exclude {
+		if x != res.Exclude[i] {
+			return fmt.Errorf("the exclude at index %d differs", i)
+		}
+	}
 
 	return nil
 }
@@ -436,11 +508,20 @@ func (obj *PkgRes) Merge(r engine.CompatibleRes) (engine.CompatibleRes, error) {
 // Copy copies the resource. Don't call it directly, use engine.ResCopy instead.
 // TODO: should this copy internal state?
 func (obj *PkgRes) Copy() engine.CopyableRes {
+	var exclude []string
+	if obj.Exclude != nil {
+		exclude = []string{}
+		for _, x := range obj.Exclude {
+			exclude = append(exclude, x)
+		}
+	}
 	return &PkgRes{
 		State:            obj.State,
 		AllowUntrusted:   obj.AllowUntrusted,
 		AllowNonFree:     obj.AllowNonFree,
 		AllowUnsupported: obj.AllowUnsupported,
+		Hold:             obj.Hold,
+		Exclude:          exclude,
 	}
 }
 
@@ -564,7 +645,10 @@ func (obj *PkgRes) AutoEdges() (engine.AutoEdge, error) {
 	// are contained in the Test() method! This design is completely okay!
 
 	if obj.fileList == nil {
-		if err := obj.populateFileList(); err != nil {
+		// The package might come from a pkg:repo which isn't there yet,
+		// in which case we can only have the edge from the repo. The
+		// file list stays nil, so we look again the next time around.
+		if err := obj.populateFileList(); err != nil && err != errPkgUnknown {
 			return nil, errwrap.Wrapf(err, "error populating file list for automatic edges")
 		}
 	}
@@ -629,6 +713,9 @@ func (obj *PkgRes) GroupCmp(r engine.GroupableRes) error {
 	if obj.State != res.State {
 		return fmt.Errorf("resource is of a different state")
 	}
+	if len(obj.Exclude) > 0 || len(res.Exclude) > 0 {
+		return fmt.Errorf("resource uses excludes")
+	}
 	return nil
 }
 
@@ -652,6 +739,117 @@ func (obj *PkgRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// pinCheckApply applies the holds and the excludes of the package. If they are
+// both empty, then any that were previously added are removed.
+func (obj *PkgRes) pinCheckApply(apply bool) (bool, error) {
+	if _, err := os.Stat(pkgAptDir); err == nil {
+		return obj.aptPinCheckApply(apply)
+	}
+	return obj.versionlockCheckApply(apply)
+}
+
+// aptPinContents returns the contents of the apt preferences file, which is
+// empty if there is nothing to pin.
+func (obj *PkgRes) aptPinContents() string {
+	stanzas := []string{}
+	stanza := "Package: %s\nPin: version %s\nPin-Priority: %d\n"
+	if obj.Hold {
+		stanzas = append(stanzas, fmt.Sprintf(stanza, obj.Name(), obj.State, 1001))
+	}
+	for _, x := range obj.Exclude {
+		stanzas = append(stanzas, fmt.Sprintf(stanza, obj.Name(), x, -1))
+	}
+	if len(stanzas) == 0 {
+		return ""
+	}
+	return "# This file is managed by mgmt.\n" + strings.Join(stanzas, "\n")
+}
+
+// aptPinCheckApply manages the apt preferences file of the package.
+func (obj *PkgRes) aptPinCheckApply(apply bool) (bool, error) {
+	p := path.Join(pkgAptDir, "preferences.d", "mgmt-"+obj.Name()+".pref")
+	contents := obj.aptPinContents()
+
+	b, err := ioutil.ReadFile(p)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errwrap.Wrapf(err, "could not read the preferences")
+	}
+	exists := err == nil
+	if (contents == "" && !exists) || (exists && string(b) == contents) {
+		return true, nil
+	}
+	if !apply {
+		return false, nil
+	}
+
+	if contents == "" {
+		obj.init.Logf("removing the hold")
+		return false, os.Remove(p)
+	}
+	obj.init.Logf("writing the hold")
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return false, err
+	}
+	return false, ioutil.WriteFile(p, []byte(contents), 0644)
+}
+
+// versionlockLines returns the lines of the dnf versionlock list for the
+// package.
+func (obj *PkgRes) versionlockLines() []string {
+	lines := []string{}
+	if obj.Hold {
+		lines = append(lines, fmt.Sprintf("%s-*:%s.*", obj.Name(), obj.State))
+	}
+	for _, x := range obj.Exclude {
+		if !strings.HasSuffix(x, "*") {
+			x += ".*" // the arch is at the end
+		}
+		lines = append(lines, fmt.Sprintf("!%s-*:%s", obj.Name(), x))
+	}
+	return lines
+}
+
+// versionlockCheckApply manages the lines of the package in the dnf versionlock
+// list. The lines that were added by somebody else are kept exactly as they are.
+func (obj *PkgRes) versionlockCheckApply(apply bool) (bool, error) {
+	want := obj.versionlockLines()
+
+	b, err := ioutil.ReadFile(pkgVersionlockFile)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errwrap.Wrapf(err, "could not read the versionlock list")
+	}
+
+	prefix := obj.Name() + "-*:" // only we add the lines with this epoch
+	have := []string{}
+	other := "" // the rest of the file, including the newlines
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		if l := strings.TrimSuffix(line, "\n"); strings.HasPrefix(strings.TrimPrefix(l, "!"), prefix) {
+			have = append(have, l)
+			continue
+		}
+		other += line
+	}
+	if strings.Join(have, "\n") == strings.Join(want, "\n") { // or nothing to do
+		return true, nil
+	}
+	contents := other
+	if len(want) > 0 {
+		if contents != "" && !strings.HasSuffix(contents, "\n") {
+			contents += "\n"
+		}
+		contents += strings.Join(want, "\n") + "\n"
+	}
+	if !apply {
+		return false, nil
+	}
+
+	if _, err := os.Stat(path.Dir(pkgVersionlockFile)); os.IsNotExist(err) {
+		return false, fmt.Errorf("the dnf versionlock plugin is needed for holds")
+	}
+	obj.init.Logf("updating the hold")
+	return false, ioutil.WriteFile(pkgVersionlockFile, []byte(contents), 0644)
+}
+
 // ReturnSvcInFileList returns a list of svc names for matches like:
 // `/usr/lib/systemd/system/*.service`.
 func ReturnSvcInFileList(fileList []string) []string {
@@ -0,0 +1,576 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/resources/packagekit"
+	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/recwatch"
+	"github.com/purpleidea/mgmt/util/errwrap"
+)
+
+func init() {
+	engine.RegisterResource("pkg:repo", func() engine.Res { return &PkgRepoRes{} })
+}
+
+const (
+	// PkgRepoTypeYum is the type of repository which is used by yum and dnf.
+	PkgRepoTypeYum = "yum"
+
+	// PkgRepoTypeApt is the type of repository which is used by apt.
+	PkgRepoTypeApt = "apt"
+)
+
+var (
+	// pkgRepoNameRegexp matches the valid repository names, which are also
+	// used as file names.
+	pkgRepoNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+	// pkgAptDir is the apt config dir. If it exists, then apt is the default
+	// type of repository. It is a variable so that the tests can change it.
+	pkgAptDir = "/etc/apt/"
+)
+
+// PkgRepoRes is a package repository resource. It manages the repository file
+// in the `yum.repos.d` or the `sources.list.d` dir, and the signing key of the
+// repository. Every pkg resource gets an automatic edge from every repository,
+// so that the repositories are in place before any package is installed. When
+// a repository changes, the PackageKit cache is refreshed.
+type PkgRepoRes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Edgeable
+	traits.Recvable // needed because we embed a file res
+
+	init *engine.Init
+
+	// State must be "exists" or "absent". The default is "exists".
+	State string `lang:"state" yaml:"state"`
+
+	// Type is either "yum" or "apt". If it is not specified, then it is
+	// "apt" when the apt config dir exists, and "yum" otherwise.
+	Type string `lang:"type" yaml:"type"`
+
+	// URL is the location of the repository, such as the baseurl of a yum
+	// repository or the URI of an apt repository. A file:// URL can be used
+	// for a local repository.
+	URL string `lang:"url" yaml:"url"`
+
+	// Description is the human readable name of a yum repository. If it is
+	// not specified, then the resource name is used instead.
+	Description string `lang:"description" yaml:"description"`
+
+	// Suite is the suite of an apt repository, such as "bookworm". If it
+	// ends with a slash, then it is the path of a flat repository, and no
+	// components can be specified. It defaults to "./".
+	Suite string `lang:"suite" yaml:"suite"`
+
+	// Components is the list of components of an apt repository, such as
+	// "main".
+	Components []string `lang:"components" yaml:"components"`
+
+	// Key is the ASCII armored public key which the repository is signed
+	// with. It is stored next to the repository file, and only this key is
+	// trusted for the repository.
+	Key string `lang:"key" yaml:"key"`
+
+	// Trusted skips the signature checks of the repository. This is useful
+	// for an unsigned local repository, but should otherwise be avoided.
+	Trusted bool `lang:"trusted" yaml:"trusted"`
+
+	// Dir is the dir that the repository file is written to. It defaults to
+	// /etc/yum.repos.d/ or /etc/apt/sources.list.d/ depending on the Type.
+	Dir string `lang:"dir" yaml:"dir"`
+
+	// KeyDir is the dir that the signing key is written to. It defaults to
+	// /etc/pki/rpm-gpg/ or /etc/apt/keyrings/ depending on the Type.
+	KeyDir string `lang:"keydir" yaml:"keydir"`
+
+	keyDir  *FileRes // nested dir resource for the key, which can be nil
+	keyFile *FileRes // nested file resource for the key
+	file    *FileRes // nested file resource
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *PkgRepoRes) Default() engine.Res {
+	return &PkgRepoRes{
+		State: "exists",
+		Suite: "./",
+	}
+}
+
+// getType returns the actual type to use. When Type is not specified, we look
+// for the apt config dir.
+func (obj *PkgRepoRes) getType() string {
+	if obj.Type != "" {
+		return obj.Type
+	}
+	if _, err := os.Stat(pkgAptDir); err == nil {
+		return PkgRepoTypeApt
+	}
+	return PkgRepoTypeYum
+}
+
+// getDescription returns the actual description to use. When Description is
+// not specified, we use the Name.
+func (obj *PkgRepoRes) getDescription() string {
+	if obj.Description != "" {
+		return obj.Description
+	}
+	return obj.Name()
+}
+
+// RepoFilePath returns the path to the repository file.
+func (obj *PkgRepoRes) RepoFilePath() string {
+	if obj.getType() == PkgRepoTypeApt {
+		dir := obj.Dir
+		if dir == "" {
+			dir = path.Join(pkgAptDir, "sources.list.d")
+		}
+		return path.Join(dir, obj.Name()+".list")
+	}
+	dir := obj.Dir
+	if dir == "" {
+		dir = "/etc/yum.repos.d/"
+	}
+	return path.Join(dir, obj.Name()+".repo")
+}
+
+// KeyFilePath returns the path to the signing key file.
+func (obj *PkgRepoRes) KeyFilePath() string {
+	if obj.getType() == PkgRepoTypeApt {
+		dir := obj.KeyDir
+		if dir == "" {
+			dir = path.Join(pkgAptDir, "keyrings")
+		}
+		return path.Join(dir, obj.Name()+".asc")
+	}
+	dir := obj.KeyDir
+	if dir == "" {
+		dir = "/etc/pki/rpm-gpg/"
+	}
+	return path.Join(dir, "RPM-GPG-KEY-"+obj.Name())
+}
+
+// repoFileContents returns the contents of the repository file.
+func (obj *PkgRepoRes) repoFileContents() string {
+	header := "# This file is managed by mgmt.\n"
+
+	if obj.getType() == PkgRepoTypeApt {
+		opts := []string{}
+		if obj.Key != "" {
+			opts = append(opts, "signed-by="+obj.KeyFilePath())
+		}
+		if obj.Trusted {
+			opts = append(opts, "trusted=yes")
+		}
+		fields := []string{"deb"}
+		if len(opts) > 0 {
+			fields = append(fields, "["+strings.Join(opts, " ")+"]")
+		}
+		fields = append(fields, obj.URL, obj.Suite)
+		fields = append(fields, obj.Components...)
+		return header + strings.Join(fields, " ") + "\n"
+	}
+
+	gpgcheck := "1"
+	if obj.Trusted {
+		gpgcheck = "0"
+	}
+	s := header
+	s += fmt.Sprintf("[%s]\n", obj.Name())
+	s += fmt.Sprintf("name=%s\n", obj.getDescription())
+	s += fmt.Sprintf("baseurl=%s\n", obj.URL)
+	s += "enabled=1\n"
+	s += fmt.Sprintf("gpgcheck=%s\n", gpgcheck)
+	if obj.Key != "" {
+		s += fmt.Sprintf("gpgkey=file://%s\n", obj.KeyFilePath())
+	}
+	return s
+}
+
+// makeComposite creates the nested file resources. The first one is the dir of
+// the key, and the second is the key file. Both are nil if there is no key.
+func (obj *PkgRepoRes) makeComposite() (*FileRes, *FileRes, *FileRes, error) {
+	newFile := func(p string) (*FileRes, error) {
+		res, err := engine.NewNamedResource("file", p)
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "error creating nested file resource")
+		}
+		file, ok := res.(*FileRes)
+		if !ok {
+			return nil, fmt.Errorf("error casting fileres")
+		}
+		return file, nil
+	}
+
+	file, err := newFile(obj.RepoFilePath())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	file.State = obj.State
+	if obj.State != "absent" {
+		s := obj.repoFileContents()
+		file.Content = &s
+		file.Mode = "0644"
+	}
+
+	if obj.Key == "" {
+		return nil, nil, file, nil
+	}
+
+	keyFile, err := newFile(obj.KeyFilePath())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keyFile.State = obj.State
+	if obj.State != "absent" {
+		s := obj.Key
+		keyFile.Content = &s
+		keyFile.Mode = "0644"
+	}
+	if obj.State == "absent" {
+		return nil, keyFile, file, nil
+	}
+
+	// the key dir might not exist yet
+	keyDir, err := newFile(path.Dir(obj.KeyFilePath()) + "/")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keyDir.State = "exists"
+
+	return keyDir, keyFile, file, nil
+}
+
+// Validate if the params passed in are valid data.
+func (obj *PkgRepoRes) Validate() error {
+	if obj.State != "absent" && obj.State != "exists" {
+		return fmt.Errorf("state must be 'absent' or 'exists'")
+	}
+	if !pkgRepoNameRegexp.MatchString(obj.Name()) {
+		return fmt.Errorf("invalid repository name: %s", obj.Name())
+	}
+
+	typ := obj.getType()
+	if typ != PkgRepoTypeYum && typ != PkgRepoTypeApt {
+		return fmt.Errorf("type must be '%s' or '%s'", PkgRepoTypeYum, PkgRepoTypeApt)
+	}
+
+	if obj.State != "absent" && obj.URL == "" {
+		return fmt.Errorf("the URL is empty")
+	}
+	if strings.ContainsAny(obj.URL, " \n") || strings.ContainsAny(obj.getDescription(), "\n") {
+		return fmt.Errorf("the URL and the Description must be on one line")
+	}
+
+	if typ == PkgRepoTypeApt {
+		if obj.Suite == "" || strings.ContainsAny(obj.Suite, " \n") {
+			return fmt.Errorf("invalid suite: %s", obj.Suite)
+		}
+		if strings.HasSuffix(obj.Suite, "/") && len(obj.Components) > 0 {
+			return fmt.Errorf("a flat repository can't have components")
+		}
+		if !strings.HasSuffix(obj.Suite, "/") && len(obj.Components) == 0 {
+			return fmt.Errorf("a repository with a suite needs components")
+		}
+		for _, x := range obj.Components {
+			if x == "" || strings.ContainsAny(x, " \n") {
+				return fmt.Errorf("invalid component: %s", x)
+			}
+		}
+	}
+	if typ == PkgRepoTypeYum && len(obj.Components) > 0 {
+		return fmt.Errorf("components are only used by apt")
+	}
+
+	if obj.Key != "" && !strings.Contains(obj.Key, "-----BEGIN PGP PUBLIC KEY BLOCK-----") {
+		return fmt.Errorf("the key is not an ASCII armored public key")
+	}
+	if obj.Key != "" && obj.Trusted {
+		return fmt.Errorf("a trusted repository doesn't need a key")
+	}
+
+	// validate nested files
+	keyDir, keyFile, file, err := obj.makeComposite()
+	if err != nil {
+		return errwrap.Wrapf(err, "makeComposite failed in validate")
+	}
+	for _, x := range []*FileRes{keyDir, keyFile, file} {
+		if x == nil {
+			continue
+		}
+		if err := x.Validate(); err != nil { // composite resource
+			return errwrap.Wrapf(err, "validate failed for embedded file: %s", x)
+		}
+	}
+
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *PkgRepoRes) Init(init *engine.Init) error {
+	var err error
+	obj.init = init // save for later
+
+	obj.keyDir, obj.keyFile, obj.file, err = obj.makeComposite()
+	if err != nil {
+		return errwrap.Wrapf(err, "makeComposite failed in init")
+	}
+	for _, x := range []*FileRes{obj.keyDir, obj.keyFile, obj.file} {
+		if x == nil {
+			continue
+		}
+		if err := x.Init(init); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *PkgRepoRes) Close() error {
+	var reterr error
+	for _, x := range []*FileRes{obj.keyDir, obj.keyFile, obj.file} {
+		if x == nil {
+			continue
+		}
+		if err := x.Close(); err != nil {
+			reterr = errwrap.Append(reterr, err)
+		}
+	}
+	return reterr
+}
+
+// Watch is the primary listener for this resource and it outputs events. The
+// repository file and the key file are watched.
+func (obj *PkgRepoRes) Watch() error {
+	recWatcher, err := recwatch.NewRecWatcher(obj.RepoFilePath(), false)
+	if err != nil {
+		return err
+	}
+	defer recWatcher.Close()
+
+	var keyEvents chan recwatch.Event // nil if there's no key
+	if obj.keyFile != nil {
+		keyWatcher, err := recwatch.NewRecWatcher(obj.KeyFilePath(), false)
+		if err != nil {
+			return err
+		}
+		defer keyWatcher.Close()
+		keyEvents = keyWatcher.Events()
+	}
+
+	obj.init.Running() // when started, notify engine that we're running
+
+	for {
+		var event recwatch.Event
+		var ok bool
+		select {
+		case event, ok = <-recWatcher.Events():
+		case event, ok = <-keyEvents:
+		case <-obj.init.Done: // closed by the engine to signal shutdown
+			return nil
+		}
+		if !ok { // channel shutdown
+			return nil
+		}
+		if err := event.Error; err != nil {
+			return errwrap.Wrapf(err, "unknown %s watcher error", obj)
+		}
+		if obj.init.Debug {
+			obj.init.Logf("Event(%s): %v", event.Body.Name, event.Body.Op)
+		}
+
+		obj.init.Event() // notify engine of an event (this can block)
+	}
+}
+
+// CheckApply is run to check the state and, if apply is true, to apply the
+// necessary changes to reach the desired state. The key is written before the
+// repository file, and the PackageKit cache is refreshed if anything changed.
+func (obj *PkgRepoRes) CheckApply(apply bool) (bool, error) {
+	checkOK := true
+	for _, x := range []*FileRes{obj.keyDir, obj.keyFile, obj.file} {
+		if x == nil {
+			continue
+		}
+		c, err := x.CheckApply(apply)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "nested file failed")
+		}
+		if !c {
+			checkOK = false
+		}
+		if !c && !apply {
+			return false, nil
+		}
+	}
+	if checkOK {
+		return true, nil
+	}
+
+	bus := packagekit.NewBus()
+	if bus == nil { // if it's not running, then there's no cache to refresh
+		obj.init.Logf("can't connect to PackageKit bus, not refreshing")
+		return false, nil
+	}
+	defer bus.Close()
+	bus.Debug = obj.init.Debug
+	bus.Logf = func(format string, v ...interface{}) {
+		obj.init.Logf("packagekit: "+format, v...)
+	}
+	obj.init.Logf("refreshing the package cache")
+	if err := bus.RefreshCache(true); err != nil {
+		return false, errwrap.Wrapf(err, "can't refresh the package cache")
+	}
+
+	return false, nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *PkgRepoRes) Cmp(r engine.Res) error {
+	// we can only compare PkgRepoRes to others of the same resource kind
+	res, ok := r.(*PkgRepoRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.State != res.State {
+		return fmt.Errorf("the State differs")
+	}
+	if obj.getType() != res.getType() {
+		return fmt.Errorf("the Type differs")
+	}
+	if obj.RepoFilePath() != res.RepoFilePath() {
+		return fmt.Errorf("the Dir differs")
+	}
+	if obj.KeyFilePath() != res.KeyFilePath() {
+		return fmt.Errorf("the KeyDir differs")
+	}
+	if obj.repoFileContents() != res.repoFileContents() {
+		return fmt.Errorf("the repository differs")
+	}
+	if obj.Key != res.Key {
+		return fmt.Errorf("the Key differs")
+	}
+
+	return nil
+}
+
+// PkgRepoUID is the UID struct for PkgRepoRes.
+type PkgRepoUID struct {
+	engine.BaseUID
+	name string // repository name
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *PkgRepoUID) IFF(uid engine.ResUID) bool {
+	res, ok := uid.(*PkgRepoUID)
+	if !ok {
+		return false
+	}
+	return obj.name == res.name
+}
+
+// pkgAnyUID matches every PkgUID. It gets an edge to all of them at once, since
+// it's a MatchAllUID.
+type pkgAnyUID struct {
+	engine.BaseUID
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *pkgAnyUID) IFF(uid engine.ResUID) bool {
+	_, ok := uid.(*PkgUID)
+	return ok
+}
+
+// MatchAll returns true, since we want an edge to every pkg resource.
+func (obj *pkgAnyUID) MatchAll() bool {
+	return true
+}
+
+// PkgRepoResAutoEdges holds the state of the repo -> pkg auto edge generator.
+type PkgRepoResAutoEdges struct {
+	uid *pkgAnyUID
+}
+
+// Next returns the next automatic edge.
+func (obj *PkgRepoResAutoEdges) Next() []engine.ResUID {
+	return []engine.ResUID{obj.uid}
+}
+
+// Test gets results of the earlier Next() call, & returns if we should
+// continue!
+func (obj *PkgRepoResAutoEdges) Test(input []bool) bool {
+	return false // the one uid matched all of the pkg resources at once
+}
+
+// AutoEdges returns the AutoEdge interface. In this case, an edge to every pkg
+// resource, since any of them might need the repository.
+func (obj *PkgRepoRes) AutoEdges() (engine.AutoEdge, error) {
+	if obj.State == "absent" {
+		return nil, nil
+	}
+	reversed := false // the pkg depends on us
+	return &PkgRepoResAutoEdges{
+		uid: &pkgAnyUID{
+			BaseUID: engine.BaseUID{
+				Name:     obj.Name(),
+				Kind:     obj.Kind(),
+				Reversed: &reversed,
+			},
+		},
+	}, nil
+}
+
+// UIDs includes all params to make a unique identification of this object. Most
+// resources only return one, although some resources can return multiple.
+func (obj *PkgRepoRes) UIDs() []engine.ResUID {
+	x := &PkgRepoUID{
+		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
+		name:    obj.Name(),
+	}
+	return []engine.ResUID{x}
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *PkgRepoRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes PkgRepoRes // indirection to avoid infinite recursion
+
+	def := obj.Default()         // get the default
+	res, ok := def.(*PkgRepoRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to PkgRepoRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = PkgRepoRes(raw) // restore from indirection with type conversion!
+	return nil
+}
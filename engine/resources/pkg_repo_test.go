@@ -0,0 +1,212 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root
+
+package resources
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/graph/autoedge"
+	"github.com/purpleidea/mgmt/pgraph"
+)
+
+const pkgRepoTestKey = `-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mDMEZQAAABYJKwYBBAHaRw8BAQdAtest
+-----END PGP PUBLIC KEY BLOCK-----
+`
+
+func TestPkgRepoValidate1(t *testing.T) {
+	testCases := []struct {
+		name string
+		res  *PkgRepoRes
+		fail bool
+	}{
+		{"yum", &PkgRepoRes{Type: "yum", URL: "file:///srv/repo/"}, false},
+		{"apt flat", &PkgRepoRes{Type: "apt", URL: "file:///srv/repo", Suite: "./", Trusted: true}, false},
+		{"apt suite", &PkgRepoRes{Type: "apt", URL: "http://deb.example.com/", Suite: "stable", Components: []string{"main"}, Key: pkgRepoTestKey}, false},
+		{"apt no components", &PkgRepoRes{Type: "apt", URL: "http://deb.example.com/", Suite: "stable"}, true},
+		{"apt flat components", &PkgRepoRes{Type: "apt", URL: "file:///srv/repo", Suite: "./", Components: []string{"main"}}, true},
+		{"yum components", &PkgRepoRes{Type: "yum", URL: "file:///srv/repo/", Components: []string{"main"}}, true},
+		{"no url", &PkgRepoRes{Type: "yum"}, true},
+		{"bad type", &PkgRepoRes{Type: "pacman", URL: "file:///srv/repo/"}, true},
+		{"bad key", &PkgRepoRes{Type: "yum", URL: "file:///srv/repo/", Key: "hello"}, true},
+		{"trusted key", &PkgRepoRes{Type: "yum", URL: "file:///srv/repo/", Key: pkgRepoTestKey, Trusted: true}, true},
+	}
+	for _, tc := range testCases {
+		tc.res.SetKind("pkg:repo")
+		tc.res.SetName("test")
+		if tc.res.State == "" {
+			tc.res.State = "exists"
+		}
+		err := tc.res.Validate()
+		if tc.fail && err == nil {
+			t.Errorf("%s: validate should have failed", tc.name)
+		}
+		if !tc.fail && err != nil {
+			t.Errorf("%s: validate failed with: %v", tc.name, err)
+		}
+	}
+}
+
+func TestPkgRepo1(t *testing.T) {
+	for _, typ := range []string{PkgRepoTypeYum, PkgRepoTypeApt} {
+		tmpdir := t.TempDir()
+		local := path.Join(tmpdir, "repo") // a local repo
+		res := &PkgRepoRes{
+			State:  "exists",
+			Type:   typ,
+			URL:    "file://" + local,
+			Suite:  "./",
+			Key:    pkgRepoTestKey,
+			Dir:    path.Join(tmpdir, "repos"),
+			KeyDir: path.Join(tmpdir, "keys"), // doesn't exist yet
+		}
+		res.SetKind("pkg:repo")
+		res.SetName("local")
+		if err := os.Mkdir(res.Dir, 0755); err != nil {
+			t.Errorf("could not make the dir: %v", err)
+			return
+		}
+
+		expected := map[string]string{
+			PkgRepoTypeYum: "# This file is managed by mgmt.\n" +
+				"[local]\n" +
+				"name=local\n" +
+				"baseurl=file://" + local + "\n" +
+				"enabled=1\n" +
+				"gpgcheck=1\n" +
+				"gpgkey=file://" + path.Join(tmpdir, "keys", "RPM-GPG-KEY-local") + "\n",
+			PkgRepoTypeApt: "# This file is managed by mgmt.\n" +
+				"deb [signed-by=" + path.Join(tmpdir, "keys", "local.asc") + "] file://" + local + " ./\n",
+		}
+
+		init := &engine.Init{
+			Logf: func(format string, v ...interface{}) {
+				t.Logf("test: "+format, v...)
+			},
+			Recv: func() map[string]*engine.Send {
+				return map[string]*engine.Send{}
+			},
+		}
+		if err := res.Validate(); err != nil {
+			t.Errorf("%s: validate failed with: %v", typ, err)
+			return
+		}
+		if err := res.Init(init); err != nil {
+			t.Errorf("%s: init failed with: %v", typ, err)
+			return
+		}
+		if _, err := res.CheckApply(true); err != nil {
+			t.Errorf("%s: checkapply failed with: %v", typ, err)
+			return
+		}
+		if checkOK, err := res.CheckApply(true); err != nil || !checkOK {
+			t.Errorf("%s: the second checkapply was not a noop: %v", typ, err)
+		}
+		res.Close()
+
+		b, err := ioutil.ReadFile(res.RepoFilePath())
+		if err != nil {
+			t.Errorf("%s: could not read the repo file: %v", typ, err)
+			return
+		}
+		if s := string(b); s != expected[typ] {
+			t.Errorf("%s: got wrong contents:\n%s\nexpected:\n%s", typ, s, expected[typ])
+		}
+		if b, err := ioutil.ReadFile(res.KeyFilePath()); err != nil || string(b) != pkgRepoTestKey {
+			t.Errorf("%s: the key was not written: %v", typ, err)
+		}
+
+		// removing the repo removes both files
+		res.State = "absent"
+		if err := res.Init(init); err != nil {
+			t.Errorf("%s: init failed with: %v", typ, err)
+			return
+		}
+		if _, err := res.CheckApply(true); err != nil {
+			t.Errorf("%s: checkapply failed with: %v", typ, err)
+			return
+		}
+		res.Close()
+		for _, p := range []string{res.RepoFilePath(), res.KeyFilePath()} {
+			if _, err := os.Stat(p); !os.IsNotExist(err) {
+				t.Errorf("%s: the file %s was not removed", typ, p)
+			}
+		}
+	}
+}
+
+func TestPkgRepoAutoEdge1(t *testing.T) {
+	g, err := pgraph.NewGraph("TestGraph")
+	if err != nil {
+		t.Errorf("error creating graph: %v", err)
+		return
+	}
+
+	newRes := func(kind, name string) engine.Res {
+		res, err := engine.NewNamedResource(kind, name)
+		if err != nil {
+			t.Fatalf("error creating %s resource: %v", kind, err)
+		}
+		return res
+	}
+	repo1 := newRes("pkg:repo", "repo1")
+	repo2 := newRes("pkg:repo", "repo2")
+	pkg1 := newRes("pkg", "pkg1")
+	pkg2 := newRes("pkg", "pkg2")
+	pkg1.(*PkgRes).fileList = []string{} // don't look for the files
+	pkg2.(*PkgRes).fileList = []string{}
+	g.AddVertex(repo1, repo2, pkg1, pkg2)
+
+	debug := testing.Verbose() // set via the -test.v flag to `go test`
+	logf := func(format string, v ...interface{}) {
+		t.Logf("test: "+format, v...)
+	}
+	if err := autoedge.AutoEdge(g, debug, logf); err != nil {
+		t.Errorf("error running autoedges: %v", err)
+		return
+	}
+
+	expected, err := pgraph.NewGraph("Expected")
+	if err != nil {
+		t.Errorf("error creating graph: %v", err)
+		return
+	}
+	expectEdge := func(from, to pgraph.Vertex) {
+		edge := &engine.Edge{Name: fmt.Sprintf("%s -> %s (expected)", from, to)}
+		expected.AddEdge(from, to, edge)
+	}
+	expectEdge(repo1, pkg1)
+	expectEdge(repo1, pkg2)
+	expectEdge(repo2, pkg1)
+	expectEdge(repo2, pkg2)
+
+	vertexCmp := func(v1, v2 pgraph.Vertex) (bool, error) { return v1 == v2, nil } // pointer compare is sufficient
+	edgeCmp := func(e1, e2 pgraph.Edge) (bool, error) { return true, nil }         // we don't care about edges here
+
+	if err := expected.GraphCmp(g, vertexCmp, edgeCmp); err != nil {
+		t.Errorf("graph doesn't match expected: %s", err)
+	}
+}
@@ -20,7 +20,12 @@
 package resources
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
+
+	"github.com/purpleidea/mgmt/engine"
 )
 
 func TestNilList1(t *testing.T) {
@@ -33,3 +38,97 @@ func TestNilList1(t *testing.T) {
 		t.Errorf("list should have been empty, was: %+v", x)
 	}
 }
+
+func TestPkgHold1(t *testing.T) {
+	tmpdir := t.TempDir()
+	defer func(aptDir, versionlockFile string) {
+		pkgAptDir, pkgVersionlockFile = aptDir, versionlockFile
+	}(pkgAptDir, pkgVersionlockFile)
+	pkgAptDir = path.Join(tmpdir, "apt")
+	pkgVersionlockFile = path.Join(tmpdir, "dnf", "versionlock.list")
+
+	res := &PkgRes{State: "1.2-3.fc36", Hold: true, Exclude: []string{"2.*"}}
+	res.SetKind("pkg")
+	res.SetName("foo")
+	res.init = &engine.Init{
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+	}
+	if err := res.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	apply := func() {
+		if _, err := res.pinCheckApply(true); err != nil {
+			t.Errorf("checkapply failed with: %v", err)
+			return
+		}
+		if checkOK, err := res.pinCheckApply(true); err != nil || !checkOK {
+			t.Errorf("the second checkapply was not a noop: %v", err)
+		}
+	}
+
+	// dnf, without the plugin
+	if _, err := res.pinCheckApply(true); err == nil {
+		t.Errorf("the hold should fail without the versionlock plugin")
+	}
+	if err := os.MkdirAll(path.Dir(pkgVersionlockFile), 0755); err != nil {
+		t.Errorf("could not make the dir: %v", err)
+		return
+	}
+	other := "# added by hand\n\nbar-0:1.0-1.fc36.*\n\n"
+	if err := ioutil.WriteFile(pkgVersionlockFile, []byte(other), 0644); err != nil {
+		t.Errorf("could not write the list: %v", err)
+		return
+	}
+	apply()
+	expected := other + "foo-*:1.2-3.fc36.*\n!foo-*:2.*\n"
+	if b, _ := ioutil.ReadFile(pkgVersionlockFile); string(b) != expected {
+		t.Errorf("got wrong contents:\n%s\nexpected:\n%s", b, expected)
+	}
+	res.Hold = false
+	res.Exclude = nil
+	apply()
+	if b, _ := ioutil.ReadFile(pkgVersionlockFile); string(b) != other {
+		t.Errorf("the hold was not removed, got:\n%s", b)
+	}
+	// a package without holds doesn't need to touch the list
+	if err := ioutil.WriteFile(pkgVersionlockFile, []byte("bar-0:1.0-1.fc36.*"), 0644); err != nil {
+		t.Errorf("could not write the list: %v", err)
+		return
+	}
+	if checkOK, err := res.pinCheckApply(false); err != nil || !checkOK {
+		t.Errorf("expected no changes to the list: %t, %v", checkOK, err)
+	}
+
+	// apt
+	if err := os.Mkdir(pkgAptDir, 0755); err != nil {
+		t.Errorf("could not make the dir: %v", err)
+		return
+	}
+	res.Hold = true
+	res.Exclude = []string{"2.*"}
+	apply()
+	p := path.Join(pkgAptDir, "preferences.d", "mgmt-foo.pref")
+	expected = "# This file is managed by mgmt.\n" +
+		"Package: foo\nPin: version 1.2-3.fc36\nPin-Priority: 1001\n" +
+		"\n" +
+		"Package: foo\nPin: version 2.*\nPin-Priority: -1\n"
+	if b, _ := ioutil.ReadFile(p); string(b) != expected {
+		t.Errorf("got wrong contents:\n%s\nexpected:\n%s", b, expected)
+	}
+	res.Hold = false
+	res.Exclude = nil
+	apply()
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("the hold was not removed")
+	}
+
+	// a hold needs a version
+	res.State = "installed"
+	res.Hold = true
+	if err := res.Validate(); err == nil {
+		t.Errorf("validate should have failed")
+	}
+}
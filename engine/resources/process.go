@@ -0,0 +1,573 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/util/errwrap"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	engine.RegisterResource("process", func() engine.Res { return &ProcessRes{} })
+}
+
+const (
+	// ProcessStateRunning is the state where the process is kept running.
+	ProcessStateRunning = "running"
+
+	// ProcessStateStopped is the state where the process is stopped.
+	ProcessStateStopped = "stopped"
+
+	// ProcessRestartAlways restarts the process whenever it exits.
+	ProcessRestartAlways = "always"
+
+	// ProcessRestartOnFailure only restarts the process when it exits with
+	// an error or because of a signal.
+	ProcessRestartOnFailure = "on-failure"
+
+	// ProcessRestartNever never restarts the process once it has exited.
+	ProcessRestartNever = "never"
+
+	// ProcessDefaultDelay is the default number of milliseconds to wait
+	// before restarting a process which exited.
+	ProcessDefaultDelay = 1000
+
+	// ProcessDefaultMaxDelay is the default upper bound of the backoff, in
+	// milliseconds.
+	ProcessDefaultMaxDelay = 60 * 1000
+
+	// ProcessDefaultStopTimeout is the default number of seconds to wait
+	// for the process to exit after the StopSignal, before it gets killed.
+	ProcessDefaultStopTimeout = 10
+
+	// ProcessLogLimit is the number of bytes of process output which are
+	// streamed to the log on each start, when it isn't stored in a file.
+	ProcessLogLimit = 64 * 1024
+
+	// processStableTime is how long a process must have run for its exit to
+	// not count as a failure which increases the backoff.
+	processStableTime = 10 * time.Second
+)
+
+// ProcessRes is a resource which runs a command and supervises it, for hosts
+// without systemd, where the svc resource can't be used. It restarts the
+// process when it exits, with an exponential backoff when it keeps on failing.
+// A refresh notification restarts a running process. The process is stopped on
+// Close, which also happens when the resource is removed from the graph. The
+// process is started in its own process group, and is sent a SIGTERM if mgmt
+// dies, so that it never outlives its supervisor.
+type ProcessRes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Refreshable
+
+	init *engine.Init
+
+	// State is either running or stopped.
+	State string `lang:"state" yaml:"state"`
+
+	// Cmd is the command to run. If it is empty, then the name is used.
+	Cmd string `lang:"cmd" yaml:"cmd"`
+
+	// Args are the arguments of the Cmd. If it is empty and there's no
+	// Shell, then the Cmd is split on whitespace.
+	Args []string `lang:"args" yaml:"args"`
+
+	// Shell is the (optional) shell to run the Cmd with.
+	Shell string `lang:"shell" yaml:"shell"`
+
+	// Cwd is the dir to run the process in. If empty, then this will use
+	// the working directory of the calling process.
+	Cwd string `lang:"cwd" yaml:"cwd"`
+
+	// Env are the environment variables of the process. Nothing else is
+	// inherited from mgmt.
+	Env map[string]string `lang:"env" yaml:"env"`
+
+	// User is the (optional) user to run the process as.
+	User string `lang:"user" yaml:"user"`
+
+	// Group is the (optional) group to run the process as.
+	Group string `lang:"group" yaml:"group"`
+
+	// Output is the (optional) path of a file that the output of the
+	// process is appended to. If it is empty, the output is logged, up to
+	// the default log limit of the exec resource for each run.
+	Output string `lang:"output" yaml:"output"`
+
+	// Restart is either always, on-failure or never.
+	Restart string `lang:"restart" yaml:"restart"`
+
+	// Delay is the number of milliseconds to wait before a restart. It is
+	// doubled every time that the process fails again shortly after it was
+	// started.
+	Delay uint64 `lang:"delay" yaml:"delay"`
+
+	// MaxDelay is the maximum number of milliseconds to wait before a
+	// restart.
+	MaxDelay uint64 `lang:"maxdelay" yaml:"maxdelay"`
+
+	// StopSignal is the name of the signal which asks the process to stop.
+	StopSignal string `lang:"stopsignal" yaml:"stopsignal"`
+
+	// StopTimeout is the number of seconds to wait for the process to exit
+	// after the StopSignal, before it gets killed.
+	StopTimeout uint64 `lang:"stoptimeout" yaml:"stoptimeout"`
+
+	mutex     *sync.Mutex
+	cmd       *exec.Cmd     // the running process, nil if there's none
+	done      chan struct{} // closed when the running process has exited
+	started   time.Time     // when the running process was started
+	exited    bool          // the last process exited on its own
+	exitOK    bool          // the last process exited successfully
+	failures  uint          // consecutive failures, for the backoff
+	nextStart time.Time     // the earliest time for a restart
+	exitChan  chan struct{} // signals an exit to Watch
+	wg        *sync.WaitGroup
+}
+
+// getCmd returns the actual command to run. When Cmd is not specified, we use
+// the Name.
+func (obj *ProcessRes) getCmd() string {
+	if obj.Cmd != "" {
+		return obj.Cmd
+	}
+	return obj.Name()
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *ProcessRes) Default() engine.Res {
+	return &ProcessRes{
+		State:       ProcessStateRunning,
+		Restart:     ProcessRestartAlways,
+		Delay:       ProcessDefaultDelay,
+		MaxDelay:    ProcessDefaultMaxDelay,
+		StopSignal:  "SIGTERM",
+		StopTimeout: ProcessDefaultStopTimeout,
+	}
+}
+
+// Validate if the params passed in are valid data.
+func (obj *ProcessRes) Validate() error {
+	if obj.State != ProcessStateRunning && obj.State != ProcessStateStopped {
+		return fmt.Errorf("the State is invalid")
+	}
+
+	if strings.TrimSpace(obj.getCmd()) == "" {
+		return fmt.Errorf("the Cmd can't be empty")
+	}
+	if len(obj.Args) > 0 && obj.Shell != "" {
+		return fmt.Errorf("the Args param can't be used with a Shell")
+	}
+	if len(obj.Args) > 0 && len(strings.Fields(obj.getCmd())) > 1 {
+		return fmt.Errorf("the Args param can't be used when Cmd has args")
+	}
+	for key := range obj.Env {
+		if err := isNameValid(key); err != nil {
+			return errwrap.Wrapf(err, "invalid variable name")
+		}
+	}
+	if obj.Output != "" && !strings.HasPrefix(obj.Output, "/") {
+		return fmt.Errorf("the Output must be an absolute path")
+	}
+
+	// check that, if an user or a group is set, we're running as root
+	if obj.User != "" || obj.Group != "" {
+		currentUser, err := user.Current()
+		if err != nil {
+			return errwrap.Wrapf(err, "error looking up current user")
+		}
+		if currentUser.Uid != "0" {
+			return fmt.Errorf("running as root is required if you want to use process with a different user/group")
+		}
+	}
+
+	if obj.Restart != ProcessRestartAlways && obj.Restart != ProcessRestartOnFailure && obj.Restart != ProcessRestartNever {
+		return fmt.Errorf("the Restart is invalid")
+	}
+	if obj.MaxDelay < obj.Delay {
+		return fmt.Errorf("the MaxDelay can't be smaller than the Delay")
+	}
+	if unix.SignalNum(obj.StopSignal) == 0 {
+		return fmt.Errorf("the StopSignal `%s` is unknown", obj.StopSignal)
+	}
+
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *ProcessRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	obj.mutex = &sync.Mutex{}
+	obj.exitChan = make(chan struct{}, 1) // never block the exit
+	obj.wg = &sync.WaitGroup{}
+
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done. It stops
+// the process, so that it doesn't keep on running without a supervisor.
+func (obj *ProcessRes) Close() error {
+	err := obj.stop()
+	obj.wg.Wait()
+	return err
+}
+
+// Watch is the primary listener for this resource and it outputs events. It is
+// told when the process exits, and sends the event once the backoff is over.
+func (obj *ProcessRes) Watch() error {
+	obj.init.Running() // when started, notify engine that we're running
+
+	var retry <-chan time.Time // nil channels block forever
+	for {
+		select {
+		case <-obj.exitChan:
+			obj.mutex.Lock()
+			d := time.Until(obj.nextStart)
+			obj.mutex.Unlock()
+			if obj.init.Debug {
+				obj.init.Logf("the process exited, next start in %s", d)
+			}
+			retry = time.After(d)
+			continue
+
+		case <-retry:
+			retry = nil
+
+		case <-obj.init.Done: // closed by the engine to signal shutdown
+			return nil
+		}
+
+		obj.init.Event() // notify engine of an event (this can block)
+	}
+}
+
+// CheckApply starts or stops the process as needed. A refresh restarts the
+// process if it's running. A process which exited is only started again once
+// its backoff is over, and if the Restart policy allows it.
+func (obj *ProcessRes) CheckApply(apply bool) (bool, error) {
+	var refresh = obj.init.Refresh() // do we have a pending restart to apply?
+
+	obj.mutex.Lock()
+	running := obj.cmd != nil
+	exited, exitOK := obj.exited, obj.exitOK
+	wait := time.Until(obj.nextStart)
+	obj.mutex.Unlock()
+
+	if obj.State == ProcessStateStopped {
+		if !running {
+			return true, nil
+		}
+		if !apply {
+			return false, nil
+		}
+		obj.init.Logf("stopping")
+		return false, obj.stop()
+	}
+
+	if running && !refresh {
+		return true, nil
+	}
+	if !running && !refresh && exited {
+		if obj.Restart == ProcessRestartNever || (obj.Restart == ProcessRestartOnFailure && exitOK) {
+			return true, nil // it's done, and we leave it like this
+		}
+	}
+	if !apply {
+		return false, nil
+	}
+
+	if running { // refresh
+		obj.init.Logf("restarting")
+		if err := obj.stop(); err != nil {
+			return false, err
+		}
+	} else if wait > 0 && !refresh {
+		// Watch sends an event once the backoff is over
+		obj.init.Logf("waiting %s before restarting", wait.Round(time.Millisecond))
+		return false, nil
+	}
+
+	return false, obj.start()
+}
+
+// start starts the process, and a goroutine which waits for it to exit.
+func (obj *ProcessRes) start() error {
+	var cmdName string
+	var cmdArgs []string
+	if obj.Shell == "" {
+		split := strings.Fields(obj.getCmd())
+		cmdName = split[0]
+		cmdArgs = split[1:]
+		if len(obj.Args) > 0 {
+			cmdArgs = obj.Args
+		}
+	} else {
+		cmdName = obj.Shell // usually bash, or sh
+		cmdArgs = []string{"-c", obj.getCmd()}
+	}
+	cmd := exec.Command(cmdName, cmdArgs...)
+	cmd.Dir = obj.Cwd // run program in pwd if ""
+
+	envKeys := []string{}
+	for key := range obj.Env {
+		envKeys = append(envKeys, key)
+	}
+	sort.Strings(envKeys)
+	cmdEnv := []string{}
+	for _, k := range envKeys {
+		cmdEnv = append(cmdEnv, k+"="+obj.Env[k])
+	}
+	cmd.Env = cmdEnv
+
+	// ignore signals sent to parent process (we're in our own group), but
+	// don't outlive mgmt
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:   true,
+		Pgid:      0,
+		Pdeathsig: syscall.SIGTERM,
+	}
+	var err error
+	if cmd.SysProcAttr.Credential, err = userCredential(obj.User, obj.Group); err != nil {
+		return errwrap.Wrapf(err, "error while setting credential")
+	}
+
+	var output io.WriteCloser
+	if obj.Output != "" {
+		f, err := os.OpenFile(obj.Output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return errwrap.Wrapf(err, "could not open the output file")
+		}
+		output = f
+		cmd.Stdout = f
+		cmd.Stderr = f
+	} else {
+		// if they're the same writer, only one goroutine writes at a time
+		logWriter := &lineLogWriter{
+			Logf:  obj.init.Logf,
+			Limit: ProcessLogLimit,
+		}
+		cmd.Stdout = logWriter
+		cmd.Stderr = logWriter
+		output = &lineLogFlusher{logWriter}
+	}
+
+	if err := cmd.Start(); err != nil {
+		output.Close()
+		return errwrap.Wrapf(err, "error starting cmd")
+	}
+	obj.init.Logf("started with pid %d", cmd.Process.Pid)
+
+	done := make(chan struct{})
+	obj.mutex.Lock()
+	obj.cmd = cmd
+	obj.done = done
+	obj.started = time.Now()
+	obj.exited = false
+	obj.mutex.Unlock()
+
+	obj.wg.Add(1)
+	go func() {
+		defer obj.wg.Done()
+		err := cmd.Wait()
+		output.Close()
+
+		obj.mutex.Lock()
+		stopped := obj.cmd != cmd // stop() already took it away
+		obj.cmd = nil
+		if !stopped {
+			obj.exited = true
+			obj.exitOK = err == nil
+			if time.Since(obj.started) < processStableTime {
+				obj.failures++
+			} else {
+				obj.failures = 0
+			}
+			obj.nextStart = time.Now().Add(obj.backoff())
+		}
+		obj.mutex.Unlock()
+		close(done)
+
+		if stopped {
+			return
+		}
+		if err != nil {
+			obj.init.Logf("exited with: %v", err)
+		} else {
+			obj.init.Logf("exited")
+		}
+		select {
+		case obj.exitChan <- struct{}{}:
+		default: // an exit is already pending
+		}
+	}()
+
+	return nil
+}
+
+// stop sends the StopSignal to the process group of the running process, and
+// kills it if it didn't exit before the StopTimeout. It is a noop if there is
+// no running process.
+func (obj *ProcessRes) stop() error {
+	obj.mutex.Lock()
+	cmd, done := obj.cmd, obj.done
+	obj.cmd = nil // tell the goroutine that this exit was expected
+	obj.mutex.Unlock()
+	if cmd == nil {
+		return nil
+	}
+
+	pgid := -cmd.Process.Pid // the negative pid is the whole group
+	if err := syscall.Kill(pgid, unix.SignalNum(obj.StopSignal)); err != nil && err != syscall.ESRCH {
+		return errwrap.Wrapf(err, "could not signal the process")
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(time.Duration(obj.StopTimeout) * time.Second):
+	}
+
+	obj.init.Logf("killing the process which didn't stop")
+	if err := syscall.Kill(pgid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return errwrap.Wrapf(err, "could not kill the process")
+	}
+	<-done
+	return nil
+}
+
+// backoff returns how long to wait before the next start. The caller must hold
+// the mutex.
+func (obj *ProcessRes) backoff() time.Duration {
+	delay := obj.Delay
+	for i := uint(1); i < obj.failures && delay < obj.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > obj.MaxDelay {
+		delay = obj.MaxDelay
+	}
+	return time.Duration(delay) * time.Millisecond
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *ProcessRes) Cmp(r engine.Res) error {
+	// we can only compare ProcessRes to others of the same resource kind
+	res, ok := r.(*ProcessRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.State != res.State {
+		return fmt.Errorf("the State differs")
+	}
+	if obj.getCmd() != res.getCmd() {
+		return fmt.Errorf("the Cmd differs")
+	}
+	if len(obj.Args) != len(res.Args) {
+		return fmt.Errorf("the Args differ")
+	}
+	for i, x := range obj.Args {
+		if x != res.Args[i] {
+			return fmt.Errorf("the Args differ at index: %d", i)
+		}
+	}
+	if obj.Shell != res.Shell {
+		return fmt.Errorf("the Shell differs")
+	}
+	if obj.Cwd != res.Cwd {
+		return fmt.Errorf("the Cwd differs")
+	}
+	if len(obj.Env) != len(res.Env) {
+		return fmt.Errorf("the Env differs")
+	}
+	for key, value := range obj.Env {
+		if x, exists := res.Env[key]; !exists || x != value {
+			return fmt.Errorf("the Env differs at key: %s", key)
+		}
+	}
+	if obj.User != res.User {
+		return fmt.Errorf("the User differs")
+	}
+	if obj.Group != res.Group {
+		return fmt.Errorf("the Group differs")
+	}
+	if obj.Output != res.Output {
+		return fmt.Errorf("the Output differs")
+	}
+	if obj.Restart != res.Restart {
+		return fmt.Errorf("the Restart differs")
+	}
+	if obj.Delay != res.Delay {
+		return fmt.Errorf("the Delay differs")
+	}
+	if obj.MaxDelay != res.MaxDelay {
+		return fmt.Errorf("the MaxDelay differs")
+	}
+	if obj.StopSignal != res.StopSignal {
+		return fmt.Errorf("the StopSignal differs")
+	}
+	if obj.StopTimeout != res.StopTimeout {
+		return fmt.Errorf("the StopTimeout differs")
+	}
+
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *ProcessRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes ProcessRes // indirection to avoid infinite recursion
+
+	def := obj.Default()         // get the default
+	res, ok := def.(*ProcessRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to ProcessRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = ProcessRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// lineLogFlusher flushes a lineLogWriter when it is closed.
+type lineLogFlusher struct {
+	*lineLogWriter
+}
+
+// Close flushes any remaining partial line.
+func (obj *lineLogFlusher) Close() error {
+	obj.Flush()
+	return nil
+}
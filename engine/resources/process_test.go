@@ -0,0 +1,204 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root
+
+package resources
+
+import (
+	"io/ioutil"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+)
+
+func TestProcessValidate1(t *testing.T) {
+	def := func(res *ProcessRes) *ProcessRes {
+		x := (&ProcessRes{}).Default().(*ProcessRes)
+		x.Cmd, x.Args, x.Shell, x.Output = res.Cmd, res.Args, res.Shell, res.Output
+		if res.Restart != "" {
+			x.Restart = res.Restart
+		}
+		if res.StopSignal != "" {
+			x.StopSignal = res.StopSignal
+		}
+		return x
+	}
+	tests := []struct {
+		res  *ProcessRes
+		fail bool
+	}{
+		{&ProcessRes{Cmd: "/usr/bin/sleep 10"}, false},
+		{&ProcessRes{Cmd: "/usr/bin/sleep", Args: []string{"10"}}, false},
+		{&ProcessRes{Cmd: "sleep 10 && true", Shell: "/bin/sh", Restart: "on-failure", StopSignal: "SIGINT"}, false},
+		{&ProcessRes{Cmd: "sleep", Args: []string{"10"}, Shell: "/bin/sh"}, true}, // args with a shell
+		{&ProcessRes{Cmd: "sleep 10", Args: []string{"10"}}, true},                // args twice
+		{&ProcessRes{Cmd: "sleep 10", Output: "relative"}, true},                  // relative output
+		{&ProcessRes{Cmd: "sleep 10", Restart: "sometimes"}, true},                // bad restart
+		{&ProcessRes{Cmd: "sleep 10", StopSignal: "SIGNOPE"}, true},               // bad signal
+	}
+	for i, tt := range tests {
+		res := def(tt.res)
+		res.SetKind("process")
+		res.SetName("process")
+		if err := res.Validate(); (err != nil) != tt.fail {
+			t.Errorf("test #%d: expected fail: %t, got: %v", i, tt.fail, err)
+		}
+	}
+}
+
+func TestProcess1(t *testing.T) {
+	refresh := false
+	init := &engine.Init{
+		Refresh: func() bool {
+			return refresh
+		},
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+	}
+	res := (&ProcessRes{}).Default().(*ProcessRes)
+	res.Cmd = "sleep 30"
+	res.StopTimeout = 1
+	res.SetKind("process")
+	res.SetName("sleep")
+	if err := res.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	if err := res.Init(init); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+
+	if checkOK, err := res.CheckApply(true); err != nil || checkOK {
+		t.Errorf("the start failed: %t, %v", checkOK, err)
+		return
+	}
+	pid := res.cmd.Process.Pid
+	if checkOK, err := res.CheckApply(true); err != nil || !checkOK {
+		t.Errorf("the second checkapply was not a noop: %v", err)
+	}
+
+	refresh = true
+	if checkOK, err := res.CheckApply(true); err != nil || checkOK {
+		t.Errorf("the restart failed: %t, %v", checkOK, err)
+	}
+	refresh = false
+	if res.cmd == nil || res.cmd.Process.Pid == pid {
+		t.Errorf("the process was not restarted")
+		return
+	}
+	if err := syscall.Kill(pid, 0); err != syscall.ESRCH {
+		t.Errorf("the old process still exists: %v", err)
+	}
+	pid = res.cmd.Process.Pid
+
+	if err := res.Close(); err != nil {
+		t.Errorf("close failed with: %v", err)
+	}
+	if err := syscall.Kill(pid, 0); err != syscall.ESRCH {
+		t.Errorf("the process still exists after close: %v", err)
+	}
+}
+
+func TestProcessRestart1(t *testing.T) {
+	tmpdir := t.TempDir()
+	output := path.Join(tmpdir, "output")
+	init := &engine.Init{
+		Refresh: func() bool {
+			return false
+		},
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+	}
+	res := (&ProcessRes{}).Default().(*ProcessRes)
+	res.Cmd = "echo hello && exit 3"
+	res.Shell = "/bin/sh"
+	res.Output = output
+	res.Restart = ProcessRestartOnFailure
+	res.Delay = 200
+	res.MaxDelay = 300
+	res.SetKind("process")
+	res.SetName("failing")
+	if err := res.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	if err := res.Init(init); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	defer res.Close()
+
+	// waitExit waits for the exit that Watch would have been told about
+	waitExit := func() bool {
+		select {
+		case <-res.exitChan:
+			return true
+		case <-time.After(5 * time.Second):
+			t.Errorf("the process didn't exit")
+			return false
+		}
+	}
+
+	if _, err := res.CheckApply(true); err != nil {
+		t.Errorf("the start failed: %v", err)
+		return
+	}
+	if !waitExit() {
+		return
+	}
+	if b, err := ioutil.ReadFile(output); err != nil || string(b) != "hello\n" {
+		t.Errorf("the output is wrong: %s, %v", b, err)
+	}
+
+	// it doesn't restart during the backoff
+	if checkOK, err := res.CheckApply(true); err != nil || checkOK || res.cmd != nil {
+		t.Errorf("expected to wait for the backoff: %t, %v", checkOK, err)
+	}
+	time.Sleep(res.backoff())
+	if _, err := res.CheckApply(true); err != nil {
+		t.Errorf("the restart failed: %v", err)
+	}
+	if !waitExit() { // it was restarted if it exits again
+		return
+	}
+	res.mutex.Lock()
+	if d := res.backoff(); d != 300*time.Millisecond { // doubled, but capped
+		t.Errorf("unexpected backoff of %s", d)
+	}
+	res.mutex.Unlock()
+
+	// a successful exit isn't restarted with on-failure
+	res.Cmd = "true"
+	res.Output = ""
+	time.Sleep(300 * time.Millisecond)
+	if _, err := res.CheckApply(true); err != nil {
+		t.Errorf("the restart failed: %v", err)
+	}
+	if !waitExit() {
+		return
+	}
+	if checkOK, err := res.CheckApply(true); err != nil || !checkOK {
+		t.Errorf("expected the process to stay stopped: %t, %v", checkOK, err)
+	}
+}
@@ -33,6 +33,7 @@ import (
 	"time"
 
 	"github.com/purpleidea/mgmt/engine"
+	engineUtil "github.com/purpleidea/mgmt/engine/util"
 	"github.com/purpleidea/mgmt/pgraph"
 	"github.com/purpleidea/mgmt/util"
 	"github.com/purpleidea/mgmt/util/errwrap"
@@ -1684,6 +1685,230 @@ func TestResources2(t *testing.T) {
 			cleanup:  func() error { return os.RemoveAll(p) },
 		})
 	}
+	{
+		//file "/tmp/somelink" {
+		//	state => $const.res.file.state.symlink,
+		//	target => "somelinktarget",
+		//
+		//	Meta:reverse => true,
+		//}
+		r1 := makeRes("file", "r1")
+		res := r1.(*FileRes) // if this panics, the test will panic
+		p := "/tmp/somelink"
+		p2 := "/tmp/somelinktarget"
+		res.Path = p
+		res.State = FileStateSymlink
+		res.Target = "somelinktarget" // relative
+		content := "i am the link target\n"
+		var r2 engine.Res // future reversed resource
+
+		timeline := []func() error{
+			fileRemove(p),
+			fileWrite(p2, content),
+			resValidate(r1),
+			resReversal(r1, &r2), // runs in Init to snapshot
+			resInit(r1),
+			resCheckApply(r1, false), // changed
+			fileExpect(p, content),   // read through the link
+			func() error {
+				target, err := os.Readlink(p)
+				if err != nil {
+					return err
+				}
+				if target != "somelinktarget" {
+					return fmt.Errorf("unexpected link target: %s", target)
+				}
+				return nil
+			},
+			resCheckApply(r1, true), // it's already good
+			resClose(r1),
+			func() error {
+				// wrap it b/c it is currently nil
+				return r2.Validate()
+			},
+			func() error {
+				return resInit(r2)()
+			},
+			func() error {
+				return resCheckApply(r2, false)()
+			},
+			func() error {
+				return resClose(r2)()
+			},
+			fileAbsent(p),           // the link is gone
+			fileExpect(p2, content), // but the target is not
+		}
+
+		testCases = append(testCases, test{
+			name:     "symlink",
+			timeline: timeline,
+			expect:   func() error { return nil },
+			startup:  func() error { return nil },
+			cleanup:  func() error { return os.Remove(p2) },
+		})
+	}
+	{
+		//file "/tmp/somelink" {
+		//	state => $const.res.file.state.symlink,
+		//	target => "/tmp/somelinktarget",
+		//}
+		//# and there's a regular file at this path...
+		r1 := makeRes("file", "r1")
+		res := r1.(*FileRes) // if this panics, the test will panic
+		p := "/tmp/somelink"
+		p2 := "/tmp/somelinktarget"
+		res.Path = p
+		res.State = FileStateSymlink
+		res.Target = p2
+		content := "i am the link target\n"
+		errForce := func(e error) error {
+			if e == nil {
+				return fmt.Errorf("expected an error without force")
+			}
+			return nil
+		}
+
+		timeline := []func() error{
+			fileWrite(p, "whatever"),
+			fileWrite(p2, content),
+			resValidate(r1),
+			resInit(r1),
+			resCheckApplyError(r1, false, errForce), // needs force
+			resClose(r1),
+			func() error {
+				res.Force = true
+				return nil
+			},
+			resValidate(r1),
+			resInit(r1),
+			resCheckApply(r1, false), // changed
+			fileExpect(p, content),
+			resCheckApply(r1, true), // it's already good
+			resClose(r1),
+		}
+
+		testCases = append(testCases, test{
+			name:     "symlink force",
+			timeline: timeline,
+			expect:   func() error { return nil },
+			startup:  func() error { return nil },
+			cleanup: func() error {
+				if err := os.Remove(p); err != nil {
+					return err
+				}
+				return os.Remove(p2)
+			},
+		})
+	}
+	{
+		//file "/tmp/somelink" {
+		//	state => $const.res.file.state.hardlink,
+		//	target => "/tmp/somelinktarget",
+		//}
+		r1 := makeRes("file", "r1")
+		res := r1.(*FileRes) // if this panics, the test will panic
+		p := "/tmp/somelink"
+		p2 := "/tmp/somelinktarget"
+		res.Path = p
+		res.State = FileStateHardlink
+		res.Target = p2
+		content := "i am the link target\n"
+
+		timeline := []func() error{
+			fileRemove(p),
+			fileWrite(p2, content),
+			resValidate(r1),
+			resInit(r1),
+			resCheckApply(r1, false), // changed
+			fileExpect(p, content),
+			resCheckApply(r1, true), // it's already good
+			fileWrite(p2, "new content\n"),
+			fileExpect(p, "new content\n"), // same inode
+			resCheckApply(r1, true),        // still good
+			resClose(r1),
+		}
+
+		testCases = append(testCases, test{
+			name:     "hardlink",
+			timeline: timeline,
+			expect:   func() error { return nil },
+			startup:  func() error { return nil },
+			cleanup: func() error {
+				if err := os.Remove(p); err != nil {
+					return err
+				}
+				return os.Remove(p2)
+			},
+		})
+	}
+	{
+		//file "/tmp/somedir/" {
+		//	state => $const.res.file.state.exists,
+		//	recurse => true,
+		//	xattrs => {"user.mgmt" => "hello",},
+		//	acl => ["user:0:rw-", "default:user:0:r--",],
+		//}
+		r1 := makeRes("file", "r1")
+		res := r1.(*FileRes) // if this panics, the test will panic
+		p := "/tmp/somedir/"
+		res.Path = p
+		res.State = FileStateExists
+		res.Recurse = true
+		res.Xattrs = map[string]string{"user.mgmt": "hello"}
+		res.ACL = []string{"user:0:rw-", "default:user:0:r--"}
+
+		f1 := path.Join(p, "f1")
+		d1 := path.Join(p, "d1/")
+
+		xattrExpect := func(p, name, value string) func() error {
+			return func() error {
+				b, err := getXattr(p, name)
+				if err != nil {
+					return err
+				}
+				if string(b) != value {
+					return fmt.Errorf("xattr `%s` did not match in %s", name, p)
+				}
+				return nil
+			}
+		}
+		aclExists := func(p, name string, exists bool) func() error {
+			return func() error {
+				b, err := getXattr(p, name)
+				if err != nil {
+					return err
+				}
+				if (b != nil) != exists {
+					return fmt.Errorf("acl `%s` presence was not %t in %s", name, exists, p)
+				}
+				return nil
+			}
+		}
+
+		timeline := []func() error{
+			fileMkdir(d1, true),
+			fileWrite(f1, "f1\n"),
+			resValidate(r1),
+			resInit(r1),
+			resCheckApply(r1, false), // changed
+			xattrExpect(p, "user.mgmt", "hello"),
+			xattrExpect(f1, "user.mgmt", "hello"),
+			xattrExpect(d1, "user.mgmt", "hello"),
+			aclExists(f1, engineUtil.ACLXattrAccess, true),
+			aclExists(f1, engineUtil.ACLXattrDefault, false), // not a dir
+			aclExists(d1, engineUtil.ACLXattrDefault, true),
+			resCheckApply(r1, true), // it's already good
+			resClose(r1),
+		}
+
+		testCases = append(testCases, test{
+			name:     "dir xattrs and acl",
+			timeline: timeline,
+			expect:   func() error { return nil },
+			startup:  func() error { return nil },
+			cleanup:  func() error { return os.RemoveAll(p) },
+		})
+	}
 	names := []string{}
 	for index, tc := range testCases { // run all the tests
 		if tc.name == "" {
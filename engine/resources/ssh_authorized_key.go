@@ -0,0 +1,711 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/recwatch"
+	"github.com/purpleidea/mgmt/util/errwrap"
+)
+
+func init() {
+	engine.RegisterResource("ssh:authorized_key", func() engine.Res { return &SSHAuthorizedKeyRes{} })
+}
+
+const (
+	// SSHAuthorizedKeyStateExists is the state where the key is present.
+	SSHAuthorizedKeyStateExists = "exists"
+
+	// SSHAuthorizedKeyStateAbsent is the state where the key is removed.
+	SSHAuthorizedKeyStateAbsent = "absent"
+
+	// sshAuthorizedKeysFile is the path of the keys file relative to the
+	// home directory of the user.
+	sshAuthorizedKeysFile = ".ssh/authorized_keys"
+)
+
+// sshKeyTypes is the list of key types that we know about.
+var sshKeyTypes = []string{
+	"ssh-rsa",
+	"ssh-dss",
+	"ssh-ed25519",
+	"ecdsa-sha2-nistp256",
+	"ecdsa-sha2-nistp384",
+	"ecdsa-sha2-nistp521",
+	"sk-ssh-ed25519@openssh.com",
+	"sk-ecdsa-sha2-nistp256@openssh.com",
+}
+
+// SSHAuthorizedKeyRes is a resource which manages a single public key in the
+// authorized_keys file of a user. Only the lines containing this key are ever
+// changed, so it can be used alongside keys which are managed by hand. The file
+// and the .ssh directory are created with the correct ownership and modes if
+// needed. Resources for the same user and file are grouped together, so that
+// the file is only written once for all of them.
+type SSHAuthorizedKeyRes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Edgeable
+	traits.Groupable
+
+	init *engine.Init
+
+	// User is the name of the user whose authorized_keys file is managed.
+	User string `lang:"user" yaml:"user"`
+
+	// Type is the type of the key, such as ssh-ed25519 or ssh-rsa.
+	Type string `lang:"type" yaml:"type"`
+
+	// Key is the base64 encoded public key. This is what identifies the
+	// lines in the file which belong to this resource.
+	Key string `lang:"key" yaml:"key"`
+
+	// Options is the list of options for the key, such as `no-pty` or
+	// `from="10.0.0.0/8"`. See the AUTHORIZED_KEYS section of sshd(8).
+	Options []string `lang:"options" yaml:"options"`
+
+	// Comment is the comment at the end of the key line. It is usually
+	// used to identify who the key belongs to.
+	Comment string `lang:"comment" yaml:"comment"`
+
+	// State is either "exists" or "absent". The default is "exists".
+	State string `lang:"state" yaml:"state"`
+
+	// Path is the absolute path to the authorized_keys file. If this is
+	// empty, then the .ssh/authorized_keys file in the home directory of
+	// the user is used.
+	Path string `lang:"path" yaml:"path"`
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *SSHAuthorizedKeyRes) Default() engine.Res {
+	return &SSHAuthorizedKeyRes{
+		State: SSHAuthorizedKeyStateExists,
+	}
+}
+
+// Validate if the params passed in are valid data.
+func (obj *SSHAuthorizedKeyRes) Validate() error {
+	if obj.User == "" {
+		return fmt.Errorf("the User must not be empty")
+	}
+
+	valid := false
+	for _, x := range sshKeyTypes {
+		if obj.Type == x {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return fmt.Errorf("unknown key Type: %s", obj.Type)
+	}
+
+	if obj.Key == "" {
+		return fmt.Errorf("the Key must not be empty")
+	}
+	if _, err := base64.StdEncoding.DecodeString(obj.Key); err != nil {
+		return errwrap.Wrapf(err, "the Key is not valid base64")
+	}
+
+	for _, x := range obj.Options {
+		if x == "" || strings.ContainsAny(x, "\n\r") {
+			return fmt.Errorf("invalid option: %q", x)
+		}
+		if _, err := sshSplitOptions(x); err != nil {
+			return err
+		}
+	}
+	if strings.ContainsAny(obj.Comment, "\n\r") {
+		return fmt.Errorf("the Comment must not contain a newline")
+	}
+
+	if obj.State != SSHAuthorizedKeyStateExists && obj.State != SSHAuthorizedKeyStateAbsent {
+		return fmt.Errorf("the State must be either %s or %s", SSHAuthorizedKeyStateExists, SSHAuthorizedKeyStateAbsent)
+	}
+
+	if obj.Path != "" && !strings.HasPrefix(obj.Path, "/") {
+		return fmt.Errorf("the Path must be absolute")
+	}
+	if strings.HasSuffix(obj.Path, "/") {
+		return fmt.Errorf("the Path must be a file")
+	}
+
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *SSHAuthorizedKeyRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	// NOTE: If we don't Init anything that's autogrouped, then it won't
+	// even get an Init call on it.
+	for _, res := range obj.GetGroup() { // grouped elements
+		if err := res.Init(init); err != nil {
+			return errwrap.Wrapf(err, "autogrouped Init failed")
+		}
+	}
+
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *SSHAuthorizedKeyRes) Close() error {
+	return nil
+}
+
+// keysPath returns the path of the authorized_keys file along with the uid and
+// gid of the user. It errors if the user doesn't exist.
+func (obj *SSHAuthorizedKeyRes) keysPath() (string, int, int, error) {
+	usr, err := user.Lookup(obj.User)
+	if err != nil {
+		return "", -1, -1, errwrap.Wrapf(err, "error looking up user")
+	}
+	uid, err := strconv.Atoi(usr.Uid)
+	if err != nil {
+		return "", -1, -1, errwrap.Wrapf(err, "error casting UID to int")
+	}
+	gid, err := strconv.Atoi(usr.Gid)
+	if err != nil {
+		return "", -1, -1, errwrap.Wrapf(err, "error casting GID to int")
+	}
+	if obj.Path != "" {
+		return obj.Path, uid, gid, nil
+	}
+	if usr.HomeDir == "" {
+		return "", -1, -1, fmt.Errorf("user %s has no home directory", obj.User)
+	}
+	return path.Join(usr.HomeDir, sshAuthorizedKeysFile), uid, gid, nil
+}
+
+// Watch is the primary listener for this resource and it outputs events. It
+// watches the users file as well, since the home directory could change.
+func (obj *SSHAuthorizedKeyRes) Watch() error {
+	passwdWatcher, err := recwatch.NewRecWatcher(passwdFile, false)
+	if err != nil {
+		return err
+	}
+	defer passwdWatcher.Close()
+
+	var keysWatcher *recwatch.RecWatcher
+	defer func() {
+		if keysWatcher != nil {
+			keysWatcher.Close()
+		}
+	}()
+	watching := ""
+	// watch returns true if the path of the keys file changed
+	watch := func() (bool, error) {
+		p, _, _, err := obj.keysPath()
+		if err != nil { // the user probably doesn't exist yet
+			p = ""
+		}
+		if p == watching {
+			return false, nil
+		}
+		if keysWatcher != nil {
+			keysWatcher.Close()
+			keysWatcher = nil
+		}
+		watching = p
+		if p == "" {
+			return true, nil
+		}
+		if obj.init.Debug {
+			obj.init.Logf("watching: %s", p)
+		}
+		keysWatcher, err = recwatch.NewRecWatcher(p, false)
+		return true, err
+	}
+	if _, err := watch(); err != nil {
+		return err
+	}
+
+	obj.init.Running() // when started, notify engine that we're running
+
+	var send = false // send event?
+	for {
+		var keysEvents chan recwatch.Event // nil channels block forever
+		if keysWatcher != nil {
+			keysEvents = keysWatcher.Events()
+		}
+
+		select {
+		case event, ok := <-passwdWatcher.Events():
+			if !ok { // channel shutdown
+				return nil
+			}
+			if err := event.Error; err != nil {
+				return errwrap.Wrapf(err, "unknown %s watcher error", obj)
+			}
+			changed, err := watch()
+			if err != nil {
+				return err
+			}
+			if changed {
+				send = true
+			}
+
+		case event, ok := <-keysEvents:
+			if !ok { // channel shutdown
+				return nil
+			}
+			if err := event.Error; err != nil {
+				return errwrap.Wrapf(err, "unknown %s watcher error", obj)
+			}
+			if obj.init.Debug { // don't access event.Body if event.Error isn't nil
+				obj.init.Logf("event(%s): %v", event.Body.Name, event.Body.Op)
+			}
+			send = true
+
+		case <-obj.init.Done: // closed by the engine to signal shutdown
+			return nil
+		}
+
+		// do all our event sending all together to avoid duplicate msgs
+		if send {
+			send = false
+			obj.init.Event() // notify engine of an event (this can block)
+		}
+	}
+}
+
+// line returns the authorized_keys line for this key.
+func (obj *SSHAuthorizedKeyRes) line() string {
+	fields := []string{}
+	if len(obj.Options) > 0 {
+		fields = append(fields, strings.Join(obj.Options, ","))
+	}
+	fields = append(fields, obj.Type, obj.Key)
+	if obj.Comment != "" {
+		fields = append(fields, obj.Comment)
+	}
+	return strings.Join(fields, " ")
+}
+
+// getKeys returns this resource and all of the grouped resources.
+func (obj *SSHAuthorizedKeyRes) getKeys() []*SSHAuthorizedKeyRes {
+	keys := []*SSHAuthorizedKeyRes{obj}
+	for _, x := range obj.GetGroup() { // grouped elements
+		res, ok := x.(*SSHAuthorizedKeyRes) // convert from Res
+		if !ok {
+			panic(fmt.Sprintf("grouped member %v is not a %s", x, obj.Kind()))
+		}
+		keys = append(keys, res)
+	}
+	return keys
+}
+
+// CheckApply method for the authorized key resource. It also applies all of
+// the grouped keys, since they share the same file.
+func (obj *SSHAuthorizedKeyRes) CheckApply(apply bool) (bool, error) {
+	p, uid, gid, err := obj.keysPath()
+	if err != nil {
+		return false, err
+	}
+	keys := obj.getKeys()
+
+	exists := true
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		exists = false
+	} else if err != nil {
+		return false, errwrap.Wrapf(err, "could not read the keys file")
+	}
+
+	content := sshAuthorizedKeysEdit(string(b), keys)
+	if !exists && content == "" { // all keys are absent
+		return true, nil
+	}
+
+	checkOK := true
+	if content != string(b) {
+		checkOK = false
+	}
+	if exists {
+		fileInfo, err := os.Stat(p)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "could not stat the keys file")
+		}
+		stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+		if !ok {
+			return false, fmt.Errorf("can't get file stat")
+		}
+		if fileInfo.Mode().Perm() != 0600 || int(stat.Uid) != uid || int(stat.Gid) != gid {
+			checkOK = false
+		}
+	}
+	if checkOK {
+		return true, nil
+	}
+	if !apply {
+		return false, nil
+	}
+
+	dir := path.Dir(p)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		obj.init.Logf("creating directory: %s", dir)
+		if err := os.Mkdir(dir, 0700); err != nil {
+			return false, errwrap.Wrapf(err, "could not create the key directory")
+		}
+		if err := os.Chown(dir, uid, gid); err != nil {
+			return false, errwrap.Wrapf(err, "could not chown the key directory")
+		}
+	} else if err != nil {
+		return false, errwrap.Wrapf(err, "could not stat the key directory")
+	}
+
+	// write to a temporary file and rename it, so that sshd never sees a
+	// partially written file
+	obj.init.Logf("writing: %s", p)
+	tmp := path.Join(dir, "."+path.Base(p)+".tmp")
+	if err := ioutil.WriteFile(tmp, []byte(content), 0600); err != nil {
+		return false, errwrap.Wrapf(err, "could not write the keys file")
+	}
+	defer os.Remove(tmp) // this is a noop after the rename
+
+	// the mode is only used by WriteFile if the file didn't already exist
+	if err := os.Chmod(tmp, 0600); err != nil {
+		return false, errwrap.Wrapf(err, "could not chmod the keys file")
+	}
+	if err := os.Chown(tmp, uid, gid); err != nil {
+		return false, errwrap.Wrapf(err, "could not chown the keys file")
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return false, errwrap.Wrapf(err, "could not rename the keys file")
+	}
+
+	return false, nil
+}
+
+// sshAuthorizedKeysEdit returns the new contents of an authorized_keys file.
+// Lines with a key that is managed by one of the resources are changed or
+// removed, and any missing keys are appended. All other lines are kept as-is.
+func sshAuthorizedKeysEdit(content string, keys []*SSHAuthorizedKeyRes) string {
+	lines := strings.SplitAfter(content, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	found := make(map[*SSHAuthorizedKeyRes]bool)
+	result := []string{}
+	for _, line := range lines {
+		parsed, err := sshParseAuthorizedKey(strings.TrimRight(line, "\r\n"))
+		if err != nil || parsed == nil { // comment, blank or unknown line
+			result = append(result, line)
+			continue
+		}
+		var res *SSHAuthorizedKeyRes
+		for _, x := range keys {
+			if x.Key == parsed.Key {
+				res = x
+				break
+			}
+		}
+		if res == nil { // not one of ours
+			result = append(result, line)
+			continue
+		}
+		if res.State == SSHAuthorizedKeyStateAbsent || found[res] {
+			continue // remove it, or remove any duplicates
+		}
+		found[res] = true
+		result = append(result, res.line()+"\n")
+	}
+
+	for _, x := range keys {
+		if x.State == SSHAuthorizedKeyStateExists && !found[x] {
+			found[x] = true // in case the same key is in the group twice
+			result = append(result, x.line()+"\n")
+		}
+	}
+
+	// make sure the last existing line is terminated before we add more
+	for i := 0; i < len(result)-1; i++ {
+		if !strings.HasSuffix(result[i], "\n") {
+			result[i] += "\n"
+		}
+	}
+
+	return strings.Join(result, "")
+}
+
+// sshAuthorizedKey is a parsed line of an authorized_keys file.
+type sshAuthorizedKey struct {
+	Options []string
+	Type    string
+	Key     string
+	Comment string
+}
+
+// sshParseAuthorizedKey parses a line of an authorized_keys file. It returns
+// nil if the line is blank or a comment.
+func sshParseAuthorizedKey(line string) (*sshAuthorizedKey, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	isType := func(s string) bool {
+		for _, x := range sshKeyTypes {
+			if s == x {
+				return true
+			}
+		}
+		return false
+	}
+
+	result := &sshAuthorizedKey{}
+	if field := strings.Fields(line)[0]; !isType(field) {
+		// the options may contain quoted spaces, so find where they end
+		quoted := false
+		end := len(line)
+		for i, c := range line {
+			if c == '"' && (i == 0 || line[i-1] != '\\') {
+				quoted = !quoted
+			}
+			if !quoted && (c == ' ' || c == '\t') {
+				end = i
+				break
+			}
+		}
+		options, err := sshSplitOptions(line[:end])
+		if err != nil {
+			return nil, err
+		}
+		result.Options = options
+		line = strings.TrimSpace(line[end:])
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !isType(fields[0]) {
+		return nil, fmt.Errorf("invalid authorized key line")
+	}
+	result.Type = fields[0]
+	result.Key = fields[1]
+	// the comment is everything after the key
+	if i := strings.Index(line, fields[1]) + len(fields[1]); i < len(line) {
+		result.Comment = strings.TrimSpace(line[i:])
+	}
+	return result, nil
+}
+
+// sshSplitOptions splits a comma separated list of options, while respecting
+// commas inside of quoted values.
+func sshSplitOptions(s string) ([]string, error) {
+	result := []string{}
+	quoted := false
+	start := 0
+	for i, c := range s {
+		switch {
+		case c == '"' && (i == 0 || s[i-1] != '\\'):
+			quoted = !quoted
+		case c == ',' && !quoted:
+			result = append(result, s[start:i])
+			start = i + 1
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in options: %s", s)
+	}
+	return append(result, s[start:]), nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *SSHAuthorizedKeyRes) Cmp(r engine.Res) error {
+	// we can only compare SSHAuthorizedKeyRes to others of the same kind
+	res, ok := r.(*SSHAuthorizedKeyRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.User != res.User {
+		return fmt.Errorf("the User differs")
+	}
+	if obj.Type != res.Type {
+		return fmt.Errorf("the Type differs")
+	}
+	if obj.Key != res.Key {
+		return fmt.Errorf("the Key differs")
+	}
+	if len(obj.Options) != len(res.Options) {
+		return fmt.Errorf("the Options differ")
+	}
+	for i, x := range obj.Options {
+		if x != res.Options[i] {
+			return fmt.Errorf("the Options differ at index: %d", i)
+		}
+	}
+	if obj.Comment != res.Comment {
+		return fmt.Errorf("the Comment differs")
+	}
+	if obj.State != res.State {
+		return fmt.Errorf("the State differs")
+	}
+	if obj.Path != res.Path {
+		return fmt.Errorf("the Path differs")
+	}
+
+	return nil
+}
+
+// SSHAuthorizedKeyUID is the UID struct for SSHAuthorizedKeyRes.
+type SSHAuthorizedKeyUID struct {
+	engine.BaseUID
+
+	user string
+	key  string
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *SSHAuthorizedKeyUID) IFF(uid engine.ResUID) bool {
+	res, ok := uid.(*SSHAuthorizedKeyUID)
+	if !ok {
+		return false
+	}
+	return obj.user == res.user && obj.key == res.key
+}
+
+// UIDs includes all params to make a unique identification of this object. Most
+// resources only return one, although some resources can return multiple.
+func (obj *SSHAuthorizedKeyRes) UIDs() []engine.ResUID {
+	x := &SSHAuthorizedKeyUID{
+		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
+		user:    obj.User,
+		key:     obj.Key,
+	}
+	return []engine.ResUID{x}
+}
+
+// SSHAuthorizedKeyResAutoEdges holds the state of the auto edge generator.
+type SSHAuthorizedKeyResAutoEdges struct {
+	UIDs    []engine.ResUID
+	pointer int
+}
+
+// Next returns the next automatic edge.
+func (obj *SSHAuthorizedKeyResAutoEdges) Next() []engine.ResUID {
+	if len(obj.UIDs) == 0 {
+		return nil
+	}
+	value := obj.UIDs[obj.pointer]
+	obj.pointer++
+	return []engine.ResUID{value}
+}
+
+// Test gets results of the earlier Next() call, & returns if we should
+// continue.
+func (obj *SSHAuthorizedKeyResAutoEdges) Test(input []bool) bool {
+	if len(obj.UIDs) <= obj.pointer {
+		return false
+	}
+	if len(input) != 1 { // in case we get given bad data
+		panic(fmt.Sprintf("Expecting a single value!"))
+	}
+	return true // keep going
+}
+
+// AutoEdges returns edges to the user resource, and to the file resources for
+// the home directory and the .ssh directory of the user, so that they all exist
+// before the key gets added. If the user doesn't exist yet, then we guess that
+// the home directory is in /home/, since that is the default for useradd.
+func (obj *SSHAuthorizedKeyRes) AutoEdges() (engine.AutoEdge, error) {
+	reversed := true
+	result := []engine.ResUID{
+		&UserUID{
+			BaseUID: engine.BaseUID{
+				Name:     obj.Name(),
+				Kind:     obj.Kind(),
+				Reversed: &reversed,
+			},
+			name: obj.User,
+		},
+	}
+
+	dirs := []string{}
+	if obj.Path != "" {
+		dirs = append(dirs, path.Dir(obj.Path)+"/")
+	} else {
+		home := path.Join("/home", obj.User)
+		if usr, err := user.Lookup(obj.User); err == nil && usr.HomeDir != "" {
+			home = usr.HomeDir
+		}
+		dirs = append(dirs, path.Clean(home)+"/", path.Join(home, path.Dir(sshAuthorizedKeysFile))+"/")
+	}
+	for _, x := range dirs {
+		result = append(result, &FileUID{
+			BaseUID: engine.BaseUID{
+				Name:     obj.Name(),
+				Kind:     obj.Kind(),
+				Reversed: &reversed,
+			},
+			path: x,
+		})
+	}
+
+	return &SSHAuthorizedKeyResAutoEdges{
+		UIDs:    result,
+		pointer: 0,
+	}, nil
+}
+
+// GroupCmp returns whether two resources can be grouped together or not. Keys
+// can be grouped if they are for the same user and file.
+func (obj *SSHAuthorizedKeyRes) GroupCmp(r engine.GroupableRes) error {
+	res, ok := r.(*SSHAuthorizedKeyRes)
+	if !ok {
+		return fmt.Errorf("resource is not the same kind")
+	}
+	if obj.User != res.User {
+		return fmt.Errorf("resource is for a different user")
+	}
+	if obj.Path != res.Path {
+		return fmt.Errorf("resource is for a different path")
+	}
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *SSHAuthorizedKeyRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes SSHAuthorizedKeyRes // indirection to avoid infinite recursion
+
+	def := obj.Default()                  // get the default
+	res, ok := def.(*SSHAuthorizedKeyRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to SSHAuthorizedKeyRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = SSHAuthorizedKeyRes(raw) // restore from indirection with type conversion!
+	return nil
+}
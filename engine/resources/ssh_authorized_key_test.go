@@ -0,0 +1,181 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root
+
+package resources
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/purpleidea/mgmt/engine"
+)
+
+func TestSSHParseAuthorizedKey1(t *testing.T) {
+	testCases := []struct {
+		line     string
+		expected *sshAuthorizedKey
+		fail     bool
+	}{
+		{"", nil, false},
+		{"  # a comment", nil, false},
+		{"ssh-ed25519 AAAA", &sshAuthorizedKey{Type: "ssh-ed25519", Key: "AAAA"}, false},
+		{"ssh-rsa AAAA alice@example.com laptop", &sshAuthorizedKey{Type: "ssh-rsa", Key: "AAAA", Comment: "alice@example.com laptop"}, false},
+		{`no-pty,command="echo a, b" ssh-ed25519 AAAA c`, &sshAuthorizedKey{Options: []string{"no-pty", `command="echo a, b"`}, Type: "ssh-ed25519", Key: "AAAA", Comment: "c"}, false},
+		{"no-pty AAAA", nil, true},
+		{`command="oops ssh-rsa AAAA`, nil, true},
+	}
+	for i, tc := range testCases {
+		result, err := sshParseAuthorizedKey(tc.line)
+		if tc.fail {
+			if err == nil {
+				t.Errorf("test #%d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test #%d: failed with: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, tc.expected) {
+			t.Errorf("test #%d: expected %+v, got: %+v", i, tc.expected, result)
+		}
+	}
+}
+
+func TestSSHAuthorizedKeysEdit1(t *testing.T) {
+	keep := &SSHAuthorizedKeyRes{Type: "ssh-ed25519", Key: "AAAA", Comment: "new", State: "exists"}
+	add := &SSHAuthorizedKeyRes{Type: "ssh-rsa", Key: "BBBB", Options: []string{"no-pty"}, State: "exists"}
+	remove := &SSHAuthorizedKeyRes{Type: "ssh-rsa", Key: "CCCC", State: "absent"}
+	keys := []*SSHAuthorizedKeyRes{keep, add, remove}
+
+	content := "# managed by hand\n" +
+		"ssh-ed25519 AAAA old\n" +
+		"ssh-rsa CCCC bye\n" +
+		"ssh-ed25519 DDDD other\n" +
+		"ssh-ed25519 AAAA duplicate" // no trailing newline
+
+	expected := "# managed by hand\n" +
+		"ssh-ed25519 AAAA new\n" +
+		"ssh-ed25519 DDDD other\n" +
+		"no-pty ssh-rsa BBBB\n"
+
+	if s := sshAuthorizedKeysEdit(content, keys); s != expected {
+		t.Errorf("got wrong content:\n%s", s)
+	}
+	if s := sshAuthorizedKeysEdit(expected, keys); s != expected {
+		t.Errorf("edit is not idempotent:\n%s", s)
+	}
+	if s := sshAuthorizedKeysEdit("", []*SSHAuthorizedKeyRes{remove}); s != "" {
+		t.Errorf("expected empty content, got:\n%s", s)
+	}
+}
+
+func TestSSHAuthorizedKeyCheckApply1(t *testing.T) {
+	usr, err := user.Current()
+	if err != nil {
+		t.Errorf("could not get the current user: %v", err)
+		return
+	}
+	tmpdir, err := ioutil.TempDir("", "mgmt-test-ssh-")
+	if err != nil {
+		t.Errorf("could not make tmpdir: %v", err)
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+	p := path.Join(tmpdir, ".ssh", "authorized_keys")
+
+	r1 := &SSHAuthorizedKeyRes{
+		User:  usr.Username,
+		Type:  "ssh-ed25519",
+		Key:   "AAAA",
+		State: "exists",
+		Path:  p,
+	}
+	r2 := &SSHAuthorizedKeyRes{
+		User:  usr.Username,
+		Type:  "ssh-ed25519",
+		Key:   "BBBB",
+		State: "exists",
+		Path:  p,
+	}
+	if err := r1.GroupCmp(r2); err != nil {
+		t.Errorf("keys should group: %v", err)
+		return
+	}
+	if err := r1.GroupRes(r2); err != nil {
+		t.Errorf("could not group: %v", err)
+		return
+	}
+	for _, res := range []*SSHAuthorizedKeyRes{r1, r2} {
+		if err := res.Validate(); err != nil {
+			t.Errorf("validate failed with: %v", err)
+			return
+		}
+	}
+	init := &engine.Init{
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+	}
+	if err := r1.Init(init); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+
+	if checkOK, err := r1.CheckApply(true); err != nil || checkOK {
+		t.Errorf("expected a change, got: %t, %v", checkOK, err)
+		return
+	}
+	if checkOK, err := r1.CheckApply(true); err != nil || !checkOK {
+		t.Errorf("expected no change, got: %t, %v", checkOK, err)
+		return
+	}
+
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Errorf("could not read keys file: %v", err)
+		return
+	}
+	if s := string(b); s != "ssh-ed25519 AAAA\nssh-ed25519 BBBB\n" {
+		t.Errorf("got wrong content:\n%s", s)
+	}
+	for x, mode := range map[string]os.FileMode{p: 0600, path.Dir(p): 0700} {
+		fileInfo, err := os.Stat(x)
+		if err != nil {
+			t.Errorf("could not stat: %v", err)
+			continue
+		}
+		if m := fileInfo.Mode().Perm(); m != mode {
+			t.Errorf("wrong mode of %s: %o", x, m)
+		}
+	}
+
+	// the mode gets fixed
+	if err := os.Chmod(p, 0644); err != nil {
+		t.Errorf("could not chmod: %v", err)
+		return
+	}
+	if checkOK, err := r1.CheckApply(true); err != nil || checkOK {
+		t.Errorf("expected a change, got: %t, %v", checkOK, err)
+	}
+}
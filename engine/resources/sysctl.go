@@ -0,0 +1,465 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/recwatch"
+	"github.com/purpleidea/mgmt/util/errwrap"
+)
+
+func init() {
+	engine.RegisterResource("sysctl", func() engine.Res { return &SysctlRes{} })
+}
+
+// sysctlDir is where the live kernel parameters are found. It is a variable so
+// that the tests can change it.
+var sysctlDir = "/proc/sys"
+
+// SysctlRes is a resource which sets a kernel parameter. The live value is set
+// in /proc/sys, and it can optionally be persisted to a sysctl.d drop-in file
+// so that it survives a reboot. Values are compared after normalizing the
+// whitespace, since multi-value keys such as kernel.printk are tab separated
+// in /proc/sys. All the sysctls which use the same file are grouped together so
+// that the file is only written once.
+type SysctlRes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Edgeable
+	traits.Groupable
+
+	init *engine.Init
+
+	// Key is the name of the parameter, such as net.ipv4.ip_forward. The
+	// slash separated form, such as net/ipv4/conf/eth0.100/forwarding, is
+	// also accepted, and then the dots are part of a name. The key is
+	// persisted in the form that it's given in. If this is empty, then the
+	// Name is used.
+	Key string `lang:"key" yaml:"key"`
+
+	// Value is the value to set.
+	Value string `lang:"value" yaml:"value"`
+
+	// File is the absolute path of a drop-in file, usually something in
+	// /etc/sysctl.d/, where the value is persisted. Only the line for this
+	// key is changed. If this is empty, then the value is not persisted.
+	File string `lang:"file" yaml:"file"`
+
+	// Poll is the number of seconds between checks of the live value. The
+	// files in /proc/sys don't support inotify, so this is the only way to
+	// notice when something else changes them. If this is zero, then only
+	// the drop-in file is watched.
+	Poll uint32 `lang:"poll" yaml:"poll"`
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *SysctlRes) Default() engine.Res {
+	return &SysctlRes{}
+}
+
+// getKey returns the actual key to use. When Key is not specified, we use the
+// Name. It is in the form that it was given in, which is what gets persisted.
+func (obj *SysctlRes) getKey() string {
+	if obj.Key != "" {
+		return obj.Key
+	}
+	return obj.Name()
+}
+
+// sysctlCanonical returns the key in the slash form, which is used to compare
+// keys. Like systemd-sysctl does, if the first separator is a slash, then the
+// dots are part of a name, such as with `net/ipv4/conf/eth0.100/forwarding`,
+// and the key is already in this form. Otherwise the dots and the slashes are
+// swapped.
+func sysctlCanonical(key string) string {
+	if i := strings.IndexAny(key, "./"); i < 0 || key[i] == '/' {
+		return key
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.':
+			return '/'
+		case '/':
+			return '.'
+		}
+		return r
+	}, key)
+}
+
+// procPath returns the path of the live value.
+func (obj *SysctlRes) procPath() string {
+	return path.Join(sysctlDir, sysctlCanonical(obj.getKey()))
+}
+
+// Validate if the params passed in are valid data.
+func (obj *SysctlRes) Validate() error {
+	key := obj.Key
+	if key == "" {
+		key = obj.Name()
+	}
+	if key == "" {
+		return fmt.Errorf("the Key must not be empty")
+	}
+	if strings.ContainsAny(key, " \t\n=") {
+		return fmt.Errorf("the Key contains invalid character(s)")
+	}
+	if strings.Contains(key, "..") {
+		return fmt.Errorf("the Key must not contain `..`")
+	}
+	if strings.HasPrefix(key, ".") || strings.HasPrefix(key, "/") {
+		return fmt.Errorf("the Key must be relative")
+	}
+
+	if strings.ContainsAny(obj.Value, "\n\r") {
+		return fmt.Errorf("the Value must not contain a newline")
+	}
+
+	if obj.File != "" && !strings.HasPrefix(obj.File, "/") {
+		return fmt.Errorf("the File must be absolute")
+	}
+	if strings.HasSuffix(obj.File, "/") {
+		return fmt.Errorf("the File must not be a directory")
+	}
+
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *SysctlRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	// NOTE: If we don't Init anything that's autogrouped, then it won't
+	// even get an Init call on it.
+	for _, res := range obj.GetGroup() { // grouped elements
+		if err := res.Init(init); err != nil {
+			return errwrap.Wrapf(err, "autogrouped Init failed")
+		}
+	}
+
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *SysctlRes) Close() error {
+	return nil
+}
+
+// getSysctls returns this resource and all of the grouped resources.
+func (obj *SysctlRes) getSysctls() []*SysctlRes {
+	sysctls := []*SysctlRes{obj}
+	for _, x := range obj.GetGroup() { // grouped elements
+		res, ok := x.(*SysctlRes) // convert from Res
+		if !ok {
+			panic(fmt.Sprintf("grouped member %v is not a %s", x, obj.Kind()))
+		}
+		sysctls = append(sysctls, res)
+	}
+	return sysctls
+}
+
+// Watch is the primary listener for this resource and it outputs events. It
+// watches the drop-in file, and polls the live values if asked to.
+func (obj *SysctlRes) Watch() error {
+	var fileEvents chan recwatch.Event // nil channels block forever
+	if obj.File != "" {
+		recWatcher, err := recwatch.NewRecWatcher(obj.File, false)
+		if err != nil {
+			return err
+		}
+		defer recWatcher.Close()
+		fileEvents = recWatcher.Events()
+	}
+
+	// use the smallest poll interval of the group
+	var poll uint32
+	for _, x := range obj.getSysctls() {
+		if x.Poll > 0 && (poll == 0 || x.Poll < poll) {
+			poll = x.Poll
+		}
+	}
+	var tick <-chan time.Time // nil channels block forever
+	if poll > 0 {
+		ticker := time.NewTicker(time.Duration(poll) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	obj.init.Running() // when started, notify engine that we're running
+
+	var send = false // send event?
+	for {
+		select {
+		case event, ok := <-fileEvents:
+			if !ok { // channel shutdown
+				return nil
+			}
+			if err := event.Error; err != nil {
+				return errwrap.Wrapf(err, "unknown %s watcher error", obj)
+			}
+			if obj.init.Debug { // don't access event.Body if event.Error isn't nil
+				obj.init.Logf("event(%s): %v", event.Body.Name, event.Body.Op)
+			}
+			send = true
+
+		case <-tick:
+			// only send an event if something actually changed
+			for _, x := range obj.getSysctls() {
+				value, err := ioutil.ReadFile(x.procPath())
+				if err != nil || sysctlNormalize(string(value)) != sysctlNormalize(x.Value) {
+					send = true
+					break
+				}
+			}
+
+		case <-obj.init.Done: // closed by the engine to signal shutdown
+			return nil
+		}
+
+		// do all our event sending all together to avoid duplicate msgs
+		if send {
+			send = false
+			obj.init.Event() // notify engine of an event (this can block)
+		}
+	}
+}
+
+// CheckApply method for the sysctl resource. It also applies all of the grouped
+// sysctls, and writes the drop-in file once for all of them.
+func (obj *SysctlRes) CheckApply(apply bool) (bool, error) {
+	checkOK := true
+
+	for _, x := range obj.getSysctls() {
+		p := x.procPath()
+		value, err := ioutil.ReadFile(p)
+		if os.IsNotExist(err) {
+			return false, fmt.Errorf("unknown sysctl: %s", x.getKey())
+		} else if err != nil {
+			return false, errwrap.Wrapf(err, "could not read sysctl %s", x.getKey())
+		}
+		if sysctlNormalize(string(value)) == sysctlNormalize(x.Value) {
+			continue
+		}
+		checkOK = false
+		if !apply {
+			return false, nil
+		}
+
+		obj.init.Logf("setting %s = %s", x.getKey(), x.Value)
+		// don't use WriteFile, we don't want to create anything in here
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_TRUNC, 0)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "could not open sysctl %s", x.getKey())
+		}
+		_, err = f.Write([]byte(x.Value + "\n"))
+		if err1 := f.Close(); err == nil {
+			err = err1
+		}
+		if err != nil {
+			return false, errwrap.Wrapf(err, "could not set sysctl %s", x.getKey())
+		}
+	}
+
+	if obj.File == "" {
+		return checkOK, nil
+	}
+
+	b, err := ioutil.ReadFile(obj.File)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errwrap.Wrapf(err, "could not read the drop-in file")
+	}
+	content := sysctlFileEdit(string(b), obj.getSysctls())
+	if err == nil && content == string(b) {
+		return checkOK, nil
+	}
+	if !apply {
+		return false, nil
+	}
+
+	obj.init.Logf("writing: %s", obj.File)
+	tmp := path.Join(path.Dir(obj.File), "."+path.Base(obj.File)+".tmp")
+	if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return false, errwrap.Wrapf(err, "could not write the drop-in file")
+	}
+	defer os.Remove(tmp) // this is a noop after the rename
+	if err := os.Rename(tmp, obj.File); err != nil {
+		return false, errwrap.Wrapf(err, "could not rename the drop-in file")
+	}
+
+	return false, nil
+}
+
+// sysctlNormalize returns the value with all the whitespace between the fields
+// replaced by a single space.
+func sysctlNormalize(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// sysctlFileEdit returns the new contents of a sysctl.d drop-in file. Lines for
+// the keys of the sysctls are changed, and any missing keys are appended in
+// sorted order. All other lines, including comments, are kept as-is.
+func sysctlFileEdit(content string, sysctls []*SysctlRes) string {
+	lines := strings.SplitAfter(content, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	values := make(map[string]string) // keyed by the canonical key
+	keys := make(map[string]string)   // the canonical key to our key
+	for _, x := range sysctls {
+		values[sysctlCanonical(x.getKey())] = sysctlNormalize(x.Value)
+		keys[sysctlCanonical(x.getKey())] = x.getKey()
+	}
+
+	found := make(map[string]bool)
+	result := []string{}
+	for _, line := range lines {
+		s := strings.TrimSpace(line)
+		if s == "" || strings.HasPrefix(s, "#") || strings.HasPrefix(s, ";") {
+			result = append(result, line)
+			continue
+		}
+		// a leading dash means errors are ignored, we keep it if present
+		key := strings.TrimSpace(strings.SplitN(strings.TrimPrefix(s, "-"), "=", 2)[0])
+		key = sysctlCanonical(key)
+		value, exists := values[key]
+		if !exists { // not one of ours
+			result = append(result, line)
+			continue
+		}
+		if found[key] {
+			continue // remove any duplicates, since the last one wins
+		}
+		found[key] = true
+		prefix := ""
+		if strings.HasPrefix(s, "-") {
+			prefix = "-"
+		}
+		result = append(result, fmt.Sprintf("%s%s = %s\n", prefix, keys[key], value))
+	}
+
+	missing := []string{}
+	for key := range values {
+		if !found[key] {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+	for _, key := range missing {
+		result = append(result, fmt.Sprintf("%s = %s\n", keys[key], values[key]))
+	}
+
+	// make sure the last existing line is terminated before we add more
+	for i := 0; i < len(result)-1; i++ {
+		if !strings.HasSuffix(result[i], "\n") {
+			result[i] += "\n"
+		}
+	}
+
+	return strings.Join(result, "")
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *SysctlRes) Cmp(r engine.Res) error {
+	// we can only compare SysctlRes to others of the same resource kind
+	res, ok := r.(*SysctlRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if sysctlCanonical(obj.getKey()) != sysctlCanonical(res.getKey()) {
+		return fmt.Errorf("the Key differs")
+	}
+	if obj.Value != res.Value {
+		return fmt.Errorf("the Value differs")
+	}
+	if obj.File != res.File {
+		return fmt.Errorf("the File differs")
+	}
+	if obj.Poll != res.Poll {
+		return fmt.Errorf("the Poll differs")
+	}
+
+	return nil
+}
+
+// SysctlUID is the UID struct for SysctlRes.
+type SysctlUID struct {
+	engine.BaseUID
+
+	key string
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *SysctlUID) IFF(uid engine.ResUID) bool {
+	res, ok := uid.(*SysctlUID)
+	if !ok {
+		return false
+	}
+	return obj.key == res.key
+}
+
+// UIDs includes all params to make a unique identification of this object. Most
+// resources only return one, although some resources can return multiple.
+func (obj *SysctlRes) UIDs() []engine.ResUID {
+	x := &SysctlUID{
+		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
+		key:     sysctlCanonical(obj.getKey()),
+	}
+	return []engine.ResUID{x}
+}
+
+// GroupCmp returns whether two resources can be grouped together or not. They
+// can be grouped if they use the same drop-in file.
+func (obj *SysctlRes) GroupCmp(r engine.GroupableRes) error {
+	res, ok := r.(*SysctlRes)
+	if !ok {
+		return fmt.Errorf("resource is not the same kind")
+	}
+	if obj.File != res.File {
+		return fmt.Errorf("resource uses a different file")
+	}
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *SysctlRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes SysctlRes // indirection to avoid infinite recursion
+
+	def := obj.Default()        // get the default
+	res, ok := def.(*SysctlRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to SysctlRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = SysctlRes(raw) // restore from indirection with type conversion!
+	return nil
+}
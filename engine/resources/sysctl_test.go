@@ -0,0 +1,175 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root
+
+package resources
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/purpleidea/mgmt/engine"
+)
+
+func TestSysctlKeys1(t *testing.T) {
+	testCases := []struct {
+		key       string
+		canonical string
+		proc      string
+	}{
+		{"net.ipv4.ip_forward", "net/ipv4/ip_forward", "/proc/sys/net/ipv4/ip_forward"},
+		{"net/ipv4/conf/eth0.100/rp_filter", "net/ipv4/conf/eth0.100/rp_filter", "/proc/sys/net/ipv4/conf/eth0.100/rp_filter"},
+		{"net.ipv4.conf.eth0/100.rp_filter", "net/ipv4/conf/eth0.100/rp_filter", "/proc/sys/net/ipv4/conf/eth0.100/rp_filter"},
+	}
+	for _, tc := range testCases {
+		res := &SysctlRes{Key: tc.key}
+		if err := res.Validate(); err != nil {
+			t.Errorf("key %s: validate failed with: %v", tc.key, err)
+		}
+		if s := sysctlCanonical(res.getKey()); s != tc.canonical {
+			t.Errorf("key %s: got wrong key: %s", tc.key, s)
+		}
+		if s := res.procPath(); s != tc.proc {
+			t.Errorf("key %s: got wrong path: %s", tc.key, s)
+		}
+	}
+
+	for _, key := range []string{"/net/ipv4", "net/../../etc", "a b", "a=b"} {
+		if err := (&SysctlRes{Key: key}).Validate(); err == nil {
+			t.Errorf("key %s: expected validate to fail", key)
+		}
+	}
+}
+
+func TestSysctlFileEdit1(t *testing.T) {
+	sysctls := []*SysctlRes{
+		{Key: "net.ipv4.ip_forward", Value: "1"},
+		{Key: "kernel.printk", Value: "4\t4  1 7"},
+		{Key: "vm.swappiness", Value: "10"},
+	}
+	content := "# comment\n" +
+		"net.ipv4.ip_forward=0\n" +
+		"fs.file-max = 100\n" +
+		"-vm/swappiness = 60\n" +
+		"net.ipv4.ip_forward = 0"
+	expected := "# comment\n" +
+		"net.ipv4.ip_forward = 1\n" +
+		"fs.file-max = 100\n" +
+		"-vm.swappiness = 10\n" +
+		"kernel.printk = 4 4 1 7\n"
+
+	if s := sysctlFileEdit(content, sysctls); s != expected {
+		t.Errorf("got wrong content:\n%s", s)
+	}
+	if s := sysctlFileEdit(expected, sysctls); s != expected {
+		t.Errorf("edit is not idempotent:\n%s", s)
+	}
+}
+
+func TestSysctlFileEdit2(t *testing.T) {
+	// the dot is part of the name of the vlan interface
+	sysctls := []*SysctlRes{
+		{Key: "net/ipv4/conf/eth0.100/forwarding", Value: "1"},
+		{Key: "net/ipv4/conf/eth0/forwarding", Value: "0"},
+	}
+	content := "net.ipv4.conf.eth0/100.forwarding = 0\n" +
+		"net.ipv4.conf.eth0.forwarding = 1\n" +
+		"net.ipv4.conf.eth0.100.forwarding = 1\n" // eth0/100 is not ours
+	expected := "net/ipv4/conf/eth0.100/forwarding = 1\n" +
+		"net/ipv4/conf/eth0/forwarding = 0\n" +
+		"net.ipv4.conf.eth0.100.forwarding = 1\n"
+
+	if s := sysctlFileEdit(content, sysctls); s != expected {
+		t.Errorf("got wrong content:\n%s", s)
+	}
+	if s := sysctlFileEdit("", sysctls); s != "net/ipv4/conf/eth0.100/forwarding = 1\nnet/ipv4/conf/eth0/forwarding = 0\n" {
+		t.Errorf("got wrong content:\n%s", s)
+	}
+}
+
+func TestSysctlCheckApply1(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "mgmt-test-sysctl-")
+	if err != nil {
+		t.Errorf("could not make tmpdir: %v", err)
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	old := sysctlDir
+	defer func() { sysctlDir = old }()
+	sysctlDir = path.Join(tmpdir, "proc")
+
+	if err := os.MkdirAll(path.Join(sysctlDir, "kernel"), 0755); err != nil {
+		t.Errorf("could not mkdir: %v", err)
+		return
+	}
+	printk := path.Join(sysctlDir, "kernel", "printk")
+	if err := ioutil.WriteFile(printk, []byte("4\t4\t1\t7\n"), 0644); err != nil {
+		t.Errorf("could not write: %v", err)
+		return
+	}
+
+	file := path.Join(tmpdir, "99-mgmt.conf")
+	res := &SysctlRes{Key: "kernel.printk", Value: "4 4 1 7", File: file}
+	if err := res.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	init := &engine.Init{
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+	}
+	if err := res.Init(init); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+
+	// the live value is the same, but the file needs to be written
+	if checkOK, err := res.CheckApply(true); err != nil || checkOK {
+		t.Errorf("expected a change, got: %t, %v", checkOK, err)
+		return
+	}
+	if checkOK, err := res.CheckApply(true); err != nil || !checkOK {
+		t.Errorf("expected no change, got: %t, %v", checkOK, err)
+		return
+	}
+
+	res.Value = "3 4 1 7"
+	if checkOK, err := res.CheckApply(true); err != nil || checkOK {
+		t.Errorf("expected a change, got: %t, %v", checkOK, err)
+		return
+	}
+	for p, expected := range map[string]string{printk: "3 4 1 7\n", file: "kernel.printk = 3 4 1 7\n"} {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Errorf("could not read: %v", err)
+			continue
+		}
+		if string(b) != expected {
+			t.Errorf("got wrong content in %s: %q", p, string(b))
+		}
+	}
+
+	res.Key = "kernel.nope"
+	if _, err := res.CheckApply(false); err == nil {
+		t.Errorf("expected an error for an unknown sysctl")
+	}
+}
@@ -0,0 +1,621 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"bytes"
+	"fmt"
+	"os/user"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/recwatch"
+	"github.com/purpleidea/mgmt/util/errwrap"
+
+	sdbus "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/coreos/go-systemd/v22/unit"
+	systemdUtil "github.com/coreos/go-systemd/v22/util"
+)
+
+func init() {
+	engine.RegisterResource("systemd:unit", func() engine.Res { return &SystemdUnitRes{} })
+}
+
+var (
+	// systemdSystemUnitDir is where the system unit files are written. It is
+	// a variable so that the tests can change it.
+	systemdSystemUnitDir = "/etc/systemd/system/"
+
+	// systemdUnitTypes are the valid unit name suffixes.
+	systemdUnitTypes = []string{
+		".service",
+		".socket",
+		".device",
+		".mount",
+		".automount",
+		".swap",
+		".target",
+		".path",
+		".timer",
+		".slice",
+		".scope",
+	}
+)
+
+// SystemdUnitRes is a systemd unit file resource. It renders the unit file from
+// the sections that are specified, and writes it into the systemd unit dir. It
+// can also manage a drop-in file for an existing unit instead. Once a file has
+// changed, or if systemd reports that it needs it, a daemon-reload is run over
+// D-Bus. All the unit resources for the same bus get autogrouped together, so
+// that many changed files only cause a single daemon-reload. If the unit is a
+// service, then an automatic edge to the matching svc resource is added, so
+// that the service is started after its unit file is in place.
+type SystemdUnitRes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Edgeable
+	traits.Groupable
+	traits.Recvable // needed because we embed a file res
+
+	init *engine.Init
+
+	// State must be "exists" or "absent". The default is "exists".
+	State string `lang:"state" yaml:"state"`
+
+	// Unit is the name of the unit, such as "foo.service". If it is not
+	// specified, then the resource name is used instead.
+	Unit string `lang:"unit" yaml:"unit"`
+
+	// DropIn is the name of a drop-in file for the unit. If it is set, then
+	// this manages the "<unit>.d/<dropin>.conf" file instead of the unit
+	// file itself.
+	DropIn string `lang:"dropin" yaml:"dropin"`
+
+	// Session, if true, manages a unit for the current user, rather than a
+	// system unit. It defaults to false.
+	Session bool `lang:"session" yaml:"session"`
+
+	// Sections maps each section name, such as "Service", to its options.
+	// Each option has a list of values, since some of them, such as
+	// "ExecStartPre", can be repeated. An empty value resets the option,
+	// which is useful in drop-in files. The "Unit" section is written
+	// first and the "Install" section is written last. Everything else is
+	// sorted, so the file doesn't change if the map order does.
+	Sections map[string]map[string][]string `lang:"sections" yaml:"sections"`
+
+	dir  *FileRes // nested file resource for the drop-in dir
+	file *FileRes // nested file resource
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *SystemdUnitRes) Default() engine.Res {
+	return &SystemdUnitRes{
+		State: "exists",
+	}
+}
+
+// getUnit returns the actual unit name to use. When Unit is not specified, we
+// use the Name.
+func (obj *SystemdUnitRes) getUnit() string {
+	if obj.Unit != "" {
+		return obj.Unit
+	}
+	return obj.Name()
+}
+
+// makeComposite creates the nested file resources. The first one is the drop-in
+// dir, which is nil if we don't need it.
+func (obj *SystemdUnitRes) makeComposite() (*FileRes, *FileRes, error) {
+	p, err := obj.UnitFilePath()
+	if err != nil {
+		return nil, nil, errwrap.Wrapf(err, "error generating unit file path")
+	}
+	res, err := engine.NewNamedResource("file", p)
+	if err != nil {
+		return nil, nil, errwrap.Wrapf(err, "error creating nested file resource")
+	}
+	file, ok := res.(*FileRes)
+	if !ok {
+		return nil, nil, fmt.Errorf("error casting fileres")
+	}
+	file.State = obj.State
+	if obj.State != "absent" {
+		s := obj.unitFileContents()
+		file.Content = &s
+		file.Mode = "0644"
+	}
+
+	if obj.DropIn == "" || obj.State == "absent" {
+		return nil, file, nil
+	}
+
+	// the drop-in dir might not exist yet
+	res, err = engine.NewNamedResource("file", path.Dir(p)+"/")
+	if err != nil {
+		return nil, nil, errwrap.Wrapf(err, "error creating nested dir resource")
+	}
+	dir, ok := res.(*FileRes)
+	if !ok {
+		return nil, nil, fmt.Errorf("error casting fileres")
+	}
+	dir.State = "exists"
+
+	return dir, file, nil
+}
+
+// Validate if the params passed in are valid data.
+func (obj *SystemdUnitRes) Validate() error {
+	if obj.State != "absent" && obj.State != "exists" {
+		return fmt.Errorf("state must be 'absent' or 'exists'")
+	}
+
+	name := obj.getUnit()
+	if name == "" {
+		return fmt.Errorf("empty unit name")
+	}
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("the unit name must not contain a slash")
+	}
+	valid := false
+	for _, x := range systemdUnitTypes {
+		if strings.HasSuffix(name, x) && len(name) > len(x) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return fmt.Errorf("the unit name must end with a unit type such as .service")
+	}
+	if strings.Contains(obj.DropIn, "/") {
+		return fmt.Errorf("the drop-in name must not contain a slash")
+	}
+
+	for section, options := range obj.Sections {
+		if section == "" || strings.ContainsAny(section, "[]\n") {
+			return fmt.Errorf("invalid section name: %s", section)
+		}
+		for option, values := range options {
+			if option == "" || strings.ContainsAny(option, "=\n") {
+				return fmt.Errorf("invalid option name in section %s: %s", section, option)
+			}
+			for _, x := range values {
+				if strings.Contains(x, "\n") {
+					return fmt.Errorf("the value of %s.%s must not contain a newline", section, option)
+				}
+			}
+		}
+	}
+
+	// validate nested files
+	dir, file, err := obj.makeComposite()
+	if err != nil {
+		return errwrap.Wrapf(err, "makeComposite failed in validate")
+	}
+	if dir != nil {
+		if err := dir.Validate(); err != nil { // composite resource
+			return errwrap.Wrapf(err, "validate failed for embedded dir: %s", dir)
+		}
+	}
+	if err := file.Validate(); err != nil { // composite resource
+		return errwrap.Wrapf(err, "validate failed for embedded file: %s", file)
+	}
+
+	for _, x := range obj.GetGroup() { // grouped elements
+		res, ok := x.(*SystemdUnitRes)
+		if !ok {
+			return fmt.Errorf("grouped resource is not the right kind")
+		}
+		if err := res.Validate(); err != nil {
+			return errwrap.Wrapf(err, "the grouped unit %s is invalid", res)
+		}
+	}
+
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *SystemdUnitRes) Init(init *engine.Init) error {
+	var err error
+	obj.init = init // save for later
+
+	// NOTE: If we don't Init anything that's autogrouped, then it won't
+	// even get an Init call on it.
+	for _, res := range obj.GetGroup() { // grouped elements
+		if err := res.Init(init); err != nil {
+			return errwrap.Wrapf(err, "autogrouped Init failed")
+		}
+	}
+
+	obj.dir, obj.file, err = obj.makeComposite()
+	if err != nil {
+		return errwrap.Wrapf(err, "makeComposite failed in init")
+	}
+	if obj.dir != nil {
+		if err := obj.dir.Init(init); err != nil {
+			return err
+		}
+	}
+	return obj.file.Init(init)
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *SystemdUnitRes) Close() error {
+	var reterr error
+	for _, x := range obj.GetGroup() { // grouped elements
+		if err := x.Close(); err != nil {
+			reterr = errwrap.Append(reterr, err)
+		}
+	}
+	if obj.dir != nil {
+		if err := obj.dir.Close(); err != nil {
+			reterr = errwrap.Append(reterr, err)
+		}
+	}
+	if obj.file != nil {
+		if err := obj.file.Close(); err != nil {
+			reterr = errwrap.Append(reterr, err)
+		}
+	}
+	return reterr
+}
+
+// Watch is the primary listener for this resource and it outputs events. The
+// whole unit dir is watched, since all the grouped units are somewhere in it.
+func (obj *SystemdUnitRes) Watch() error {
+	dir, err := systemdUnitDir(obj.Session)
+	if err != nil {
+		return err
+	}
+	recWatcher, err := recwatch.NewRecWatcher(dir, true)
+	if err != nil {
+		return err
+	}
+	defer recWatcher.Close()
+
+	obj.init.Running() // when started, notify engine that we're running
+
+	var send = false // send event?
+	for {
+		select {
+		case event, ok := <-recWatcher.Events():
+			if !ok { // channel shutdown
+				return nil
+			}
+			if err := event.Error; err != nil {
+				return errwrap.Wrapf(err, "unknown %s watcher error", obj)
+			}
+			if obj.init.Debug {
+				obj.init.Logf("Event(%s): %v", event.Body.Name, event.Body.Op)
+			}
+			send = true
+
+		case <-obj.init.Done: // closed by the engine to signal shutdown
+			return nil
+		}
+
+		// do all our event sending all together to avoid duplicate msgs
+		if send {
+			send = false
+			obj.init.Event() // notify engine of an event (this can block)
+		}
+	}
+}
+
+// fileCheckApply uses the embedded file resources to apply the file state.
+func (obj *SystemdUnitRes) fileCheckApply(apply bool) (bool, error) {
+	checkOK := true
+	if obj.dir != nil {
+		c, err := obj.dir.CheckApply(apply)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "nested dir failed")
+		}
+		if !c {
+			checkOK = false
+		}
+		if !c && !apply {
+			return false, nil // the file can't be checked without a dir
+		}
+	}
+	c, err := obj.file.CheckApply(apply)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "nested file failed")
+	}
+	if !c {
+		checkOK = false
+	}
+	return checkOK, nil
+}
+
+// CheckApply is run to check the state and, if apply is true, to apply the
+// necessary changes to reach the desired state. The files of all the grouped
+// units are applied first, and then a single daemon-reload is run if anything
+// changed, or if systemd says that one of the units needs it.
+func (obj *SystemdUnitRes) CheckApply(apply bool) (bool, error) {
+	all := []*SystemdUnitRes{obj}
+	for _, x := range obj.GetGroup() { // grouped elements
+		res, ok := x.(*SystemdUnitRes)
+		if !ok {
+			return false, fmt.Errorf("grouped resource is not the right kind")
+		}
+		all = append(all, res)
+	}
+
+	checkOK := true
+	for _, res := range all {
+		c, err := res.fileCheckApply(apply)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "the unit %s failed", res.getUnit())
+		}
+		if !c {
+			checkOK = false
+		}
+	}
+
+	if !systemdUtil.IsRunningSystemd() {
+		return checkOK, nil // there's nothing to reload
+	}
+
+	var conn *sdbus.Conn
+	var err error
+	if obj.Session {
+		conn, err = sdbus.NewUserConnection() // user session
+	} else {
+		conn, err = sdbus.New() // system bus
+	}
+	if err != nil {
+		return false, errwrap.Wrapf(err, "error making go-systemd dbus connection")
+	}
+	defer conn.Close()
+
+	if checkOK { // is a reload needed, even though the files are correct?
+		for _, res := range all {
+			prop, err := conn.GetUnitProperty(res.getUnit(), "NeedDaemonReload")
+			if err != nil {
+				return false, errwrap.Wrapf(err, "failed to get the reload state")
+			}
+			if need, ok := prop.Value.Value().(bool); ok && need {
+				checkOK = false
+				break
+			}
+		}
+	}
+
+	if checkOK {
+		return true, nil
+	}
+	if !apply {
+		return false, nil
+	}
+
+	obj.init.Logf("daemon-reload")
+	if err := conn.Reload(); err != nil {
+		return false, errwrap.Wrapf(err, "error reloading systemd")
+	}
+
+	return false, nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *SystemdUnitRes) Cmp(r engine.Res) error {
+	// we can only compare SystemdUnitRes to others of the same resource kind
+	res, ok := r.(*SystemdUnitRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.State != res.State {
+		return fmt.Errorf("the State differs")
+	}
+	if obj.getUnit() != res.getUnit() {
+		return fmt.Errorf("the Unit differs")
+	}
+	if obj.DropIn != res.DropIn {
+		return fmt.Errorf("the DropIn differs")
+	}
+	if obj.Session != res.Session {
+		return fmt.Errorf("the Session differs")
+	}
+	if obj.unitFileContents() != res.unitFileContents() {
+		return fmt.Errorf("the Sections differ")
+	}
+
+	return nil
+}
+
+// SystemdUnitUID is the UID struct for SystemdUnitRes.
+type SystemdUnitUID struct {
+	engine.BaseUID
+
+	unit    string
+	dropin  string
+	session bool
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *SystemdUnitUID) IFF(uid engine.ResUID) bool {
+	res, ok := uid.(*SystemdUnitUID)
+	if !ok {
+		return false
+	}
+	if obj.unit != res.unit {
+		return false
+	}
+	if obj.dropin != res.dropin {
+		return false
+	}
+	return obj.session == res.session
+}
+
+// SystemdUnitResAutoEdges holds the state of the unit -> svc auto edge
+// generator.
+type SystemdUnitResAutoEdges struct {
+	name    string // svc name
+	session bool   // user session
+}
+
+// Next returns the next automatic edge.
+func (obj *SystemdUnitResAutoEdges) Next() []engine.ResUID {
+	reversed := false // the svc depends on us
+	value := &SvcUID{
+		BaseUID: engine.BaseUID{
+			Kind:     "SvcRes",
+			Reversed: &reversed,
+		},
+		name:    obj.name,
+		session: obj.session,
+	}
+	return []engine.ResUID{value} // we return one, even though api supports N
+}
+
+// Test takes the output of the last call to Next() and outputs true if we
+// should continue.
+func (obj *SystemdUnitResAutoEdges) Test([]bool) bool {
+	return false // only get one unit -> svc edge
+}
+
+// AutoEdges returns the AutoEdge interface. In this case, an edge to the svc
+// resource if the unit is a service. Both the unit and the drop-in files add
+// it, so the svc waits for all of them.
+func (obj *SystemdUnitRes) AutoEdges() (engine.AutoEdge, error) {
+	name := obj.getUnit()
+	if !strings.HasSuffix(name, ".service") {
+		return nil, nil
+	}
+	return &SystemdUnitResAutoEdges{
+		name:    strings.TrimSuffix(name, ".service"),
+		session: obj.Session,
+	}, nil
+}
+
+// UIDs includes all params to make a unique identification of this object. Most
+// resources only return one, although some resources can return multiple.
+func (obj *SystemdUnitRes) UIDs() []engine.ResUID {
+	x := &SystemdUnitUID{
+		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
+		unit:    obj.getUnit(),
+		dropin:  obj.DropIn,
+		session: obj.Session,
+	}
+	return []engine.ResUID{x}
+}
+
+// GroupCmp returns whether two resources can be grouped together or not. Units
+// on the same bus are grouped, so that they share a single daemon-reload.
+func (obj *SystemdUnitRes) GroupCmp(r engine.GroupableRes) error {
+	res, ok := r.(*SystemdUnitRes)
+	if !ok {
+		return fmt.Errorf("resource is not the same kind")
+	}
+	if obj.Session != res.Session {
+		return fmt.Errorf("resource uses a different bus")
+	}
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *SystemdUnitRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes SystemdUnitRes // indirection to avoid infinite recursion
+
+	def := obj.Default()             // get the default
+	res, ok := def.(*SystemdUnitRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to SystemdUnitRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = SystemdUnitRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// UnitFilePath returns the path to the unit file, or to the drop-in file.
+func (obj *SystemdUnitRes) UnitFilePath() (string, error) {
+	dir, err := systemdUnitDir(obj.Session)
+	if err != nil {
+		return "", err
+	}
+	if obj.DropIn == "" {
+		return path.Join(dir, obj.getUnit()), nil
+	}
+	return path.Join(dir, obj.getUnit()+".d", obj.DropIn+".conf"), nil
+}
+
+// unitFileContents returns the contents of the unit file from the sections.
+func (obj *SystemdUnitRes) unitFileContents() string {
+	sections := []string{}
+	for section := range obj.Sections {
+		sections = append(sections, section)
+	}
+	sort.Slice(sections, func(i, j int) bool {
+		order := func(s string) int {
+			switch s {
+			case "Unit":
+				return 0
+			case "Install":
+				return 2
+			}
+			return 1
+		}
+		if a, b := order(sections[i]), order(sections[j]); a != b {
+			return a < b
+		}
+		return sections[i] < sections[j]
+	})
+
+	u := []*unit.UnitOption{}
+	for _, section := range sections {
+		options := []string{}
+		for option := range obj.Sections[section] {
+			options = append(options, option)
+		}
+		sort.Strings(options)
+		for _, option := range options {
+			for _, value := range obj.Sections[section][option] {
+				u = append(u, &unit.UnitOption{Section: section, Name: option, Value: value})
+			}
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(unit.Serialize(u))
+	return buf.String()
+}
+
+// systemdUnitDir returns the dir where the unit files are written, which ends
+// with a slash.
+func systemdUnitDir(session bool) (string, error) {
+	// root unit
+	if !session {
+		return systemdSystemUnitDir, nil
+	}
+	// user unit
+	u, err := user.Current()
+	if err != nil {
+		return "", errwrap.Wrapf(err, "error getting current user")
+	}
+	if u.HomeDir == "" {
+		return "", fmt.Errorf("user has no home directory")
+	}
+	return path.Join(u.HomeDir, "/.config/systemd/user/") + "/", nil
+}
@@ -0,0 +1,193 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root
+
+package resources
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/purpleidea/mgmt/engine"
+)
+
+func TestSystemdUnitContents1(t *testing.T) {
+	res := &SystemdUnitRes{
+		State: "exists",
+		Sections: map[string]map[string][]string{
+			"Install": {
+				"WantedBy": {"multi-user.target"},
+			},
+			"Service": {
+				"ExecStartPre": {"/bin/true", "/bin/echo hello"},
+				"ExecStart":    {"/usr/bin/sleep infinity"},
+			},
+			"Unit": {
+				"Description": {"a test service"},
+				"After":       {"network.target"},
+			},
+		},
+	}
+	res.SetKind("systemd:unit")
+	res.SetName("test.service")
+	if err := res.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+
+	expected := "[Unit]\n" +
+		"After=network.target\n" +
+		"Description=a test service\n" +
+		"\n" +
+		"[Service]\n" +
+		"ExecStart=/usr/bin/sleep infinity\n" +
+		"ExecStartPre=/bin/true\n" +
+		"ExecStartPre=/bin/echo hello\n" +
+		"\n" +
+		"[Install]\n" +
+		"WantedBy=multi-user.target\n"
+	if s := res.unitFileContents(); s != expected {
+		t.Errorf("got wrong contents:\n%s\nexpected:\n%s", s, expected)
+	}
+}
+
+func TestSystemdUnitValidate1(t *testing.T) {
+	testCases := []struct {
+		name  string
+		unit  string
+		fail  bool
+		extra map[string]map[string][]string
+	}{
+		{"service", "foo.service", false, nil},
+		{"timer", "foo.timer", false, nil},
+		{"no type", "foo", true, nil},
+		{"only a type", ".service", true, nil},
+		{"slash", "foo/bar.service", true, nil},
+		{"newline", "foo.service", true, map[string]map[string][]string{
+			"Service": {"ExecStart": {"/bin/true\n[Unit]"}},
+		}},
+		{"bad option", "foo.service", true, map[string]map[string][]string{
+			"Service": {"Exec=Start": {"/bin/true"}},
+		}},
+	}
+	for index, tc := range testCases {
+		res := &SystemdUnitRes{State: "exists", Unit: tc.unit, Sections: tc.extra}
+		res.SetKind("systemd:unit")
+		res.SetName(tc.name)
+		err := res.Validate()
+		if !tc.fail && err != nil {
+			t.Errorf("test #%d (%s): validate failed with: %v", index, tc.name, err)
+		}
+		if tc.fail && err == nil {
+			t.Errorf("test #%d (%s): validate passed, expected fail", index, tc.name)
+		}
+	}
+}
+
+func TestSystemdUnitFiles1(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "mgmt-test-systemd-")
+	if err != nil {
+		t.Errorf("could not make tmpdir: %v", err)
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	old := systemdSystemUnitDir
+	defer func() { systemdSystemUnitDir = old }()
+	systemdSystemUnitDir = tmpdir + "/"
+
+	init := &engine.Init{
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+		Recv: func() map[string]*engine.Send {
+			return map[string]*engine.Send{}
+		},
+	}
+
+	unit := &SystemdUnitRes{
+		State: "exists",
+		Sections: map[string]map[string][]string{
+			"Service": {"ExecStart": {"/bin/true"}},
+		},
+	}
+	unit.SetKind("systemd:unit")
+	unit.SetName("test.service")
+
+	dropin := &SystemdUnitRes{
+		State:  "exists",
+		Unit:   "test.service",
+		DropIn: "override",
+		Sections: map[string]map[string][]string{
+			"Service": {"ExecStart": {"", "/bin/false"}},
+		},
+	}
+	dropin.SetKind("systemd:unit")
+	dropin.SetName("test override")
+
+	if err := unit.GroupCmp(dropin); err != nil {
+		t.Errorf("could not group: %v", err)
+		return
+	}
+	if err := unit.GroupRes(dropin); err != nil {
+		t.Errorf("could not group: %v", err)
+		return
+	}
+	if err := unit.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	if err := unit.Init(init); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	defer unit.Close()
+
+	for _, res := range []*SystemdUnitRes{unit, dropin} {
+		if checkOK, err := res.fileCheckApply(true); err != nil || checkOK {
+			t.Errorf("%s: expected a change, got: %t, %v", res, checkOK, err)
+			return
+		}
+		if checkOK, err := res.fileCheckApply(true); err != nil || !checkOK {
+			t.Errorf("%s: expected no change, got: %t, %v", res, checkOK, err)
+			return
+		}
+	}
+
+	for p, expected := range map[string]string{
+		path.Join(tmpdir, "test.service"):                    "[Service]\nExecStart=/bin/true\n",
+		path.Join(tmpdir, "test.service.d", "override.conf"): "[Service]\nExecStart=\nExecStart=/bin/false\n",
+	} {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Errorf("could not read: %v", err)
+			continue
+		}
+		if string(b) != expected {
+			t.Errorf("got wrong content in %s: %q", p, string(b))
+		}
+	}
+
+	if edges, err := dropin.AutoEdges(); err != nil || edges == nil {
+		t.Errorf("expected an autoedge, got: %v, %v", edges, err)
+	} else if uids := edges.Next(); len(uids) != 1 || !uids[0].IFF(&SvcUID{name: "test"}) {
+		t.Errorf("got the wrong autoedge: %+v", uids)
+	}
+}
@@ -18,19 +18,46 @@
 package resources
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"sync"
 	"time"
 
 	"github.com/purpleidea/mgmt/engine"
 	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/util/errwrap"
 )
 
 func init() {
 	engine.RegisterResource("timer", func() engine.Res { return &TimerRes{} })
 }
 
+const (
+	// TimerAlgorithmFixed uses the same interval between every event.
+	TimerAlgorithmFixed = "fixed"
+
+	// TimerAlgorithmLinear grows the interval by the increment after every
+	// event.
+	TimerAlgorithmLinear = "linear"
+
+	// TimerAlgorithmExponential multiplies the interval by the factor after
+	// every event.
+	TimerAlgorithmExponential = "exponential"
+
+	// timerStateFile is the name of the file in the VarDir which stores the
+	// state of the timer so that it persists across restarts.
+	timerStateFile = "state.json"
+)
+
 // TimerRes is a timer resource for time based events. It outputs an event every
-// interval seconds.
+// interval seconds. The interval can optionally grow after each event, and it
+// can be aligned to the wall-clock. The position in the schedule is saved, so
+// that a restart of mgmt doesn't reset it.
 type TimerRes struct {
 	traits.Base // add the base methods without re-implementation
 	traits.Refreshable
@@ -39,16 +66,75 @@ type TimerRes struct {
 
 	Interval uint32 `yaml:"interval"` // interval between runs in seconds
 
-	ticker *time.Ticker
+	// Algorithm is the increment algorithm for the interval. It can be
+	// either "fixed", "linear" or "exponential". The default is "fixed".
+	Algorithm string `yaml:"algorithm"`
+	// Increment is the number of seconds that are added to the interval
+	// after each event when using the "linear" algorithm.
+	Increment uint32 `yaml:"increment"`
+	// Factor is what the interval is multiplied by after each event when
+	// using the "exponential" algorithm. It must be greater than one.
+	Factor float64 `yaml:"factor"`
+	// MaxInterval is the maximum number of seconds that the interval can
+	// grow to. If this is zero, then there is no limit.
+	MaxInterval uint32 `yaml:"maxinterval"`
+
+	// Splay is the maximum number of seconds of random delay which is added
+	// to each interval. This is useful so that many hosts with the same
+	// timer don't all fire at the same second.
+	Splay uint32 `yaml:"splay"`
+	// Align specifies that each event happens on a multiple of the current
+	// interval since the unix epoch, so that an interval of 3600 happens
+	// every hour on the hour. Any splay is added after this.
+	Align bool `yaml:"align"`
+
+	mutex     *sync.Mutex
+	state     *timerState   // guarded by the mutex
+	resetChan chan struct{} // tells Watch that the state was reset
+	statePath string
+}
+
+// timerState is the persistent state of the timer.
+type timerState struct {
+	// Count is the number of events so far. It determines the interval.
+	Count uint64 `json:"count"`
+
+	// Next is the unix time in nanoseconds when the next event happens.
+	Next int64 `json:"next"`
 }
 
 // Default returns some sensible defaults for this resource.
 func (obj *TimerRes) Default() engine.Res {
-	return &TimerRes{}
+	return &TimerRes{
+		Algorithm: TimerAlgorithmFixed,
+		Factor:    2,
+	}
 }
 
 // Validate the params that are passed to TimerRes.
 func (obj *TimerRes) Validate() error {
+	if obj.Interval == 0 {
+		return fmt.Errorf("the Interval must be greater than zero")
+	}
+
+	switch obj.Algorithm {
+	case "", TimerAlgorithmFixed:
+	case TimerAlgorithmLinear:
+		if obj.Increment == 0 {
+			return fmt.Errorf("the linear algorithm needs an Increment")
+		}
+	case TimerAlgorithmExponential:
+		if obj.Factor <= 1 {
+			return fmt.Errorf("the exponential algorithm needs a Factor greater than one")
+		}
+	default:
+		return fmt.Errorf("unknown Algorithm: %s", obj.Algorithm)
+	}
+
+	if obj.MaxInterval != 0 && obj.MaxInterval < obj.Interval {
+		return fmt.Errorf("the MaxInterval must not be less than the Interval")
+	}
+
 	return nil
 }
 
@@ -56,6 +142,38 @@ func (obj *TimerRes) Validate() error {
 func (obj *TimerRes) Init(init *engine.Init) error {
 	obj.init = init // save for later
 
+	obj.mutex = &sync.Mutex{}
+	obj.resetChan = make(chan struct{}, 1) // never block the sender
+
+	dir, err := obj.init.VarDir("")
+	if err != nil {
+		return errwrap.Wrapf(err, "could not get VarDir in Init()")
+	}
+	obj.statePath = path.Join(dir, timerStateFile)
+
+	state, err := obj.loadState()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if state != nil { // the params might have changed since it was saved
+		latest := now.Add(obj.interval(state.Count) + time.Duration(obj.Splay)*time.Second)
+		if state.Next > latest.UnixNano() {
+			state.Next = obj.next(now, state.Count).UnixNano()
+			if err := obj.saveState(state); err != nil {
+				return err
+			}
+		}
+	}
+	if state == nil { // start a new schedule
+		state = &timerState{}
+		state.Next = obj.next(now, state.Count).UnixNano()
+		if err := obj.saveState(state); err != nil {
+			return err
+		}
+	}
+	obj.state = state
+
 	return nil
 }
 
@@ -64,25 +182,119 @@ func (obj *TimerRes) Close() error {
 	return nil
 }
 
-// newTicker creates a new ticker
-func (obj *TimerRes) newTicker() *time.Ticker {
-	return time.NewTicker(time.Duration(obj.Interval) * time.Second)
+// interval returns the interval to use after the given number of events.
+func (obj *TimerRes) interval(count uint64) time.Duration {
+	seconds := float64(obj.Interval)
+	switch obj.Algorithm {
+	case TimerAlgorithmLinear:
+		seconds += float64(count) * float64(obj.Increment)
+	case TimerAlgorithmExponential:
+		seconds *= math.Pow(obj.Factor, float64(count))
+	}
+	if obj.MaxInterval != 0 && seconds > float64(obj.MaxInterval) {
+		seconds = float64(obj.MaxInterval)
+	}
+	if seconds >= math.MaxInt64/float64(time.Second) { // avoid overflow
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// next returns the time of the next event after now, given the number of
+// events so far.
+func (obj *TimerRes) next(now time.Time, count uint64) time.Time {
+	d := obj.interval(count)
+	next := now.Add(d)
+	if obj.Align { // the next multiple of the interval after now
+		next = time.Unix(0, (now.UnixNano()/int64(d)+1)*int64(d))
+	}
+	if obj.Splay > 0 {
+		splay := time.Duration(rand.Int63n(int64(obj.Splay) * int64(time.Second)))
+		next = next.Add(splay)
+	}
+	return next
+}
+
+// loadState returns the saved state, or nil if there isn't any.
+func (obj *TimerRes) loadState() (*timerState, error) {
+	b, err := ioutil.ReadFile(obj.statePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errwrap.Wrapf(err, "could not read the timer state")
+	}
+	state := &timerState{}
+	if err := json.Unmarshal(b, state); err != nil {
+		// the params might have changed, so start a new schedule
+		obj.init.Logf("discarding invalid timer state: %v", err)
+		return nil, nil
+	}
+	return state, nil
+}
+
+// saveState stores the state so that it persists across restarts.
+func (obj *TimerRes) saveState(state *timerState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return errwrap.Wrapf(err, "could not encode the timer state")
+	}
+	if err := ioutil.WriteFile(obj.statePath, b, 0600); err != nil {
+		return errwrap.Wrapf(err, "could not write the timer state")
+	}
+	return nil
+}
+
+// newTimer creates a new timer which fires at the next scheduled event. If we
+// missed an event while we weren't running, then it fires right away.
+func (obj *TimerRes) newTimer() *time.Timer {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	d := time.Until(time.Unix(0, obj.state.Next))
+	if d < 0 {
+		d = 0
+	}
+	return time.NewTimer(d)
+}
+
+// tick advances the schedule after an event.
+func (obj *TimerRes) tick() error {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	state := &timerState{
+		Count: obj.state.Count + 1,
+	}
+	if state.Count < obj.state.Count { // overflow, stay at the end
+		state.Count = obj.state.Count
+	}
+	state.Next = obj.next(time.Now(), state.Count).UnixNano()
+	obj.state = state
+	return obj.saveState(state)
 }
 
 // Watch is the primary listener for this resource and it outputs events.
 func (obj *TimerRes) Watch() error {
-	// create a time.Ticker for the given interval
-	obj.ticker = obj.newTicker()
-	defer obj.ticker.Stop()
+	// create a time.Timer for the next scheduled event
+	timer := obj.newTimer()
+	defer func() { timer.Stop() }() // the timer gets replaced below
 
 	obj.init.Running() // when started, notify engine that we're running
 
 	var send = false // send event?
 	for {
 		select {
-		case <-obj.ticker.C: // received the timer event
+		case <-timer.C: // received the timer event
 			send = true
 			obj.init.Logf("received tick")
+			if err := obj.tick(); err != nil {
+				return err
+			}
+			timer = obj.newTimer()
+
+		case <-obj.resetChan: // the schedule was reset by a refresh
+			if !timer.Stop() {
+				<-timer.C // drain so we don't leak the event
+			}
+			timer = obj.newTimer()
 
 		case <-obj.init.Done: // closed by the engine to signal shutdown
 			return nil
@@ -105,9 +317,21 @@ func (obj *TimerRes) CheckApply(apply bool) (bool, error) {
 		return false, nil // therefore state is wrong
 	}
 
-	// reset the timer since apply && refresh
-	obj.ticker.Stop()
-	obj.ticker = obj.newTicker()
+	// reset the timer since apply && refresh, this restarts the algorithm
+	obj.mutex.Lock()
+	state := &timerState{}
+	state.Next = obj.next(time.Now(), state.Count).UnixNano()
+	obj.state = state
+	err := obj.saveState(state)
+	obj.mutex.Unlock()
+	if err != nil {
+		return false, err
+	}
+
+	select {
+	case obj.resetChan <- struct{}{}:
+	default: // a reset is already pending
+	}
 	return false, nil
 }
 
@@ -122,6 +346,24 @@ func (obj *TimerRes) Cmp(r engine.Res) error {
 	if obj.Interval != res.Interval {
 		return fmt.Errorf("the Interval differs")
 	}
+	if obj.Algorithm != res.Algorithm {
+		return fmt.Errorf("the Algorithm differs")
+	}
+	if obj.Increment != res.Increment {
+		return fmt.Errorf("the Increment differs")
+	}
+	if obj.Factor != res.Factor {
+		return fmt.Errorf("the Factor differs")
+	}
+	if obj.MaxInterval != res.MaxInterval {
+		return fmt.Errorf("the MaxInterval differs")
+	}
+	if obj.Splay != res.Splay {
+		return fmt.Errorf("the Splay differs")
+	}
+	if obj.Align != res.Align {
+		return fmt.Errorf("the Align differs")
+	}
 
 	return nil
 }
@@ -0,0 +1,119 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root
+
+package resources
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+)
+
+func TestTimerInterval1(t *testing.T) {
+	testCases := []struct {
+		name     string
+		res      *TimerRes
+		count    uint64
+		expected time.Duration
+	}{
+		{"fixed", &TimerRes{Interval: 10}, 5, 10 * time.Second},
+		{"linear", &TimerRes{Interval: 10, Algorithm: TimerAlgorithmLinear, Increment: 5}, 3, 25 * time.Second},
+		{"exponential", &TimerRes{Interval: 10, Algorithm: TimerAlgorithmExponential, Factor: 2}, 3, 80 * time.Second},
+		{"capped", &TimerRes{Interval: 10, Algorithm: TimerAlgorithmExponential, Factor: 2, MaxInterval: 60}, 3, 60 * time.Second},
+		{"huge", &TimerRes{Interval: 10, Algorithm: TimerAlgorithmExponential, Factor: 2}, 1000, time.Duration(1<<63 - 1)},
+	}
+	for _, tc := range testCases {
+		if err := tc.res.Validate(); err != nil {
+			t.Errorf("test %s: validate failed with: %v", tc.name, err)
+			continue
+		}
+		if d := tc.res.interval(tc.count); d != tc.expected {
+			t.Errorf("test %s: expected %v, got: %v", tc.name, tc.expected, d)
+		}
+	}
+}
+
+func TestTimerNext1(t *testing.T) {
+	now := time.Date(2020, 1, 1, 10, 17, 3, 0, time.UTC)
+
+	res := &TimerRes{Interval: 3600, Align: true}
+	if next := res.next(now, 0); !next.Equal(time.Date(2020, 1, 1, 11, 0, 0, 0, time.UTC)) {
+		t.Errorf("aligned timer got wrong next time: %v", next.UTC())
+	}
+
+	res = &TimerRes{Interval: 60, Splay: 30}
+	for i := 0; i < 100; i++ {
+		next := res.next(now, 0)
+		if next.Before(now.Add(60*time.Second)) || !next.Before(now.Add(90*time.Second)) {
+			t.Errorf("splayed timer got wrong next time: %v", next.UTC())
+			return
+		}
+	}
+}
+
+func TestTimerState1(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "mgmt-test-timer-")
+	if err != nil {
+		t.Errorf("could not make tmpdir: %v", err)
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	init := &engine.Init{
+		VarDir: func(string) (string, error) { return tmpdir, nil },
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+	}
+	res := &TimerRes{Interval: 3600, Algorithm: TimerAlgorithmLinear, Increment: 60}
+	if err := res.Init(init); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	for i := 0; i < 3; i++ {
+		if err := res.tick(); err != nil {
+			t.Errorf("tick failed with: %v", err)
+			return
+		}
+	}
+	next := res.state.Next
+
+	// a new resource should resume where the last one left off
+	res = &TimerRes{Interval: 3600, Algorithm: TimerAlgorithmLinear, Increment: 60}
+	if err := res.Init(init); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	if res.state.Count != 3 || res.state.Next != next {
+		t.Errorf("state was not restored: %+v", res.state)
+	}
+
+	// a shorter interval reschedules an event that is too far away
+	res = &TimerRes{Interval: 60}
+	if err := res.Init(init); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	if d := time.Until(time.Unix(0, res.state.Next)); d > 60*time.Second {
+		t.Errorf("state was not rescheduled: %v", d)
+	}
+}
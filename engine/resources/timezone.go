@@ -0,0 +1,255 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/util"
+	"github.com/purpleidea/mgmt/util/errwrap"
+)
+
+func init() {
+	engine.RegisterResource("timezone", func() engine.Res { return &TimezoneRes{} })
+}
+
+const (
+	timedate1Path  = "/org/freedesktop/timedate1"
+	timedate1Iface = "org.freedesktop.timedate1"
+
+	// localtimePath is the symlink to the zoneinfo file of the timezone.
+	localtimePath = "/etc/localtime"
+	// zoneinfoDir is the directory which contains the zoneinfo files.
+	zoneinfoDir = "/usr/share/zoneinfo"
+	// timezonePath is the file with the name of the timezone that some
+	// distros, such as Debian, also use. It is only updated if it exists.
+	timezonePath = "/etc/timezone"
+)
+
+// TimezoneRes is a resource that sets the timezone of the system. It uses
+// systemd's timedated over D-Bus, and if that isn't available, it points the
+// /etc/localtime symlink at the zoneinfo file of the timezone instead.
+type TimezoneRes struct {
+	traits.Base // add the base methods without re-implementation
+
+	init *engine.Init
+
+	// Timezone is the name of the timezone, such as America/Toronto. If it
+	// is empty, the name of the resource is used.
+	Timezone string `lang:"timezone" yaml:"timezone"`
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *TimezoneRes) Default() engine.Res {
+	return &TimezoneRes{}
+}
+
+// getTimezone returns the timezone that we're managing.
+func (obj *TimezoneRes) getTimezone() string {
+	if obj.Timezone != "" {
+		return obj.Timezone
+	}
+	return obj.Name()
+}
+
+// Validate if the params passed in are valid data.
+func (obj *TimezoneRes) Validate() error {
+	tz := obj.getTimezone()
+	if tz == "" || strings.HasPrefix(tz, "/") || filepath.Clean(tz) != tz || strings.HasPrefix(tz, "..") {
+		return fmt.Errorf("the timezone must be a name such as Europe/Paris")
+	}
+	// we can only check this when the zoneinfo files are installed
+	if _, err := os.Stat(zoneinfoDir); err == nil {
+		if _, err := os.Stat(filepath.Join(zoneinfoDir, tz)); err != nil {
+			return fmt.Errorf("unknown timezone: %s", tz)
+		}
+	}
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *TimezoneRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *TimezoneRes) Close() error {
+	return nil
+}
+
+// Watch is the primary listener for this resource and it outputs events. It
+// listens for the timedated signals, and also watches the symlink in case it
+// is changed without it.
+func (obj *TimezoneRes) Watch() error {
+	return systemdDaemonWatch(obj.init, timedate1Path, []string{localtimePath})
+}
+
+// CheckApply method for Timezone resource.
+func (obj *TimezoneRes) CheckApply(apply bool) (bool, error) {
+	tz := obj.getTimezone()
+
+	conn, err := util.SystemBusPrivateUsable()
+	if err != nil || conn == nil {
+		if obj.init.Debug {
+			obj.init.Logf("the system bus is not available: %v", err)
+		}
+		return obj.fileCheckApply(apply)
+	}
+	defer conn.Close()
+
+	object := conn.Object(timedate1Iface, timedate1Path)
+	property, err := object.GetProperty(timedate1Iface + ".Timezone")
+	if dbusUnavailable(err) {
+		if obj.init.Debug {
+			obj.init.Logf("timedated is not available: %v", err)
+		}
+		return obj.fileCheckApply(apply)
+	} else if err != nil {
+		return false, errwrap.Wrapf(err, "failed to get the timezone")
+	}
+	current, ok := property.Value().(string)
+	if !ok {
+		return false, fmt.Errorf("received unexpected type as Timezone value, got '%T'", property.Value())
+	}
+
+	if current == tz {
+		return true, nil
+	}
+	if !apply {
+		return false, nil
+	}
+
+	obj.init.Logf("Changing Timezone: %s => %s", current, tz)
+	if err := object.Call(timedate1Iface+".SetTimezone", 0, tz, false).Err; err != nil {
+		return false, errwrap.Wrapf(err, "failed to call %s.SetTimezone", timedate1Iface)
+	}
+	return false, nil
+}
+
+// fileCheckApply sets the timezone without timedated.
+func (obj *TimezoneRes) fileCheckApply(apply bool) (bool, error) {
+	tz := obj.getTimezone()
+
+	current, err := localtimeZone(localtimePath)
+	if err != nil {
+		return false, err
+	}
+	if current == tz {
+		return true, nil
+	}
+	if !apply {
+		return false, nil
+	}
+
+	obj.init.Logf("Changing Timezone: %s => %s", current, tz)
+	if err := localtimeSet(localtimePath, zoneinfoDir, tz); err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(timezonePath); err == nil {
+		if err := ioutil.WriteFile(timezonePath, []byte(tz+"\n"), 0644); err != nil {
+			return false, errwrap.Wrapf(err, "error writing %s", timezonePath)
+		}
+	}
+	return false, nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *TimezoneRes) Cmp(r engine.Res) error {
+	// we can only compare TimezoneRes to others of the same resource kind
+	res, ok := r.(*TimezoneRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.getTimezone() != res.getTimezone() {
+		return fmt.Errorf("the Timezone differs")
+	}
+
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *TimezoneRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes TimezoneRes // indirection to avoid infinite recursion
+
+	def := obj.Default()          // get the default
+	res, ok := def.(*TimezoneRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to TimezoneRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = TimezoneRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// localtimeZone returns the name of the timezone that the localtime symlink
+// points to. If it's missing, or if it's a copy of the zoneinfo file instead of
+// a symlink, then the name is empty.
+func localtimeZone(link string) (string, error) {
+	fi, err := os.Lstat(link)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", errwrap.Wrapf(err, "error reading %s", link)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return "", nil
+	}
+	target, err := os.Readlink(link)
+	if err != nil {
+		return "", errwrap.Wrapf(err, "error reading %s", link)
+	}
+	const sep = "zoneinfo/"
+	i := strings.LastIndex(target, sep)
+	if i < 0 {
+		return "", nil
+	}
+	return target[i+len(sep):], nil
+}
+
+// localtimeSet atomically replaces the localtime symlink with one that points
+// to the zoneinfo file of the timezone.
+func localtimeSet(link, dir, tz string) error {
+	target := filepath.Join(dir, tz)
+	if _, err := os.Stat(target); err != nil {
+		return errwrap.Wrapf(err, "unknown timezone: %s", tz)
+	}
+	tmp := link + ".mgmt-tmp"
+	os.Remove(tmp) // left over from before
+	if err := os.Symlink(target, tmp); err != nil {
+		return errwrap.Wrapf(err, "error creating the symlink")
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return errwrap.Wrapf(err, "error replacing %s", link)
+	}
+	return nil
+}
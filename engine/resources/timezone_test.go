@@ -0,0 +1,99 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root
+
+package resources
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTimezoneValidate1(t *testing.T) {
+	tests := []struct {
+		name string
+		fail bool
+	}{
+		{"UTC", false},
+		{"America/Toronto", false},
+		{"", true},
+		{"/etc/localtime", true},
+		{"../../etc/passwd", true},
+		{"America//Toronto", true},
+	}
+	for i, tt := range tests {
+		res := &TimezoneRes{Timezone: tt.name}
+		res.SetKind("timezone")
+		res.SetName("timezone")
+		if tt.name == "" {
+			res.SetName("")
+		}
+		if err := res.Validate(); (err != nil) != tt.fail {
+			t.Errorf("test #%d: expected fail: %t, got: %v", i, tt.fail, err)
+		}
+	}
+}
+
+func TestLocaltime1(t *testing.T) {
+	tmpdir := t.TempDir()
+	zoneinfo := path.Join(tmpdir, "zoneinfo")
+	if err := os.MkdirAll(path.Join(zoneinfo, "America"), 0755); err != nil {
+		t.Errorf("could not make dir: %v", err)
+		return
+	}
+	for _, tz := range []string{"UTC", "America/Toronto"} {
+		if err := ioutil.WriteFile(path.Join(zoneinfo, tz), []byte("TZif"), 0644); err != nil {
+			t.Errorf("could not write file: %v", err)
+			return
+		}
+	}
+	link := path.Join(tmpdir, "localtime")
+
+	if tz, err := localtimeZone(link); err != nil || tz != "" {
+		t.Errorf("expected no timezone: %s, %v", tz, err)
+	}
+	if err := localtimeSet(link, zoneinfo, "America/Toronto"); err != nil {
+		t.Errorf("set failed with: %v", err)
+		return
+	}
+	if tz, err := localtimeZone(link); err != nil || tz != "America/Toronto" {
+		t.Errorf("unexpected timezone: %s, %v", tz, err)
+	}
+	if err := localtimeSet(link, zoneinfo, "UTC"); err != nil { // replace it
+		t.Errorf("set failed with: %v", err)
+		return
+	}
+	if tz, err := localtimeZone(link); err != nil || tz != "UTC" {
+		t.Errorf("unexpected timezone: %s, %v", tz, err)
+	}
+	if err := localtimeSet(link, zoneinfo, "Mars/Olympus_Mons"); err == nil {
+		t.Errorf("expected an unknown timezone to fail")
+	}
+
+	// a copy of the zoneinfo file is replaced by a symlink
+	os.Remove(link)
+	if err := ioutil.WriteFile(link, []byte("TZif"), 0644); err != nil {
+		t.Errorf("could not write file: %v", err)
+		return
+	}
+	if tz, err := localtimeZone(link); err != nil || tz != "" {
+		t.Errorf("expected no timezone: %s, %v", tz, err)
+	}
+}
@@ -18,8 +18,10 @@
 package resources
 
 import (
+	"bufio"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"os/user"
 	"sort"
@@ -29,6 +31,7 @@ import (
 
 	"github.com/purpleidea/mgmt/engine"
 	"github.com/purpleidea/mgmt/engine/traits"
+	engineUtil "github.com/purpleidea/mgmt/engine/util"
 	"github.com/purpleidea/mgmt/recwatch"
 	"github.com/purpleidea/mgmt/util/errwrap"
 )
@@ -37,12 +40,18 @@ func init() {
 	engine.RegisterResource("user", func() engine.Res { return &UserRes{} })
 }
 
-const passwdFile = "/etc/passwd"
+const (
+	passwdFile = "/etc/passwd"
+	shadowFile = "/etc/shadow"
+)
 
-// UserRes is a user account resource.
+// UserRes is a user account resource. The password and aging params are
+// compared against /etc/shadow, which requires running as root. The password is
+// never logged.
 type UserRes struct {
 	traits.Base // add the base methods without re-implementation
 	traits.Edgeable
+	traits.Recvable
 
 	init *engine.Init
 
@@ -54,6 +63,37 @@ type UserRes struct {
 	HomeDir           *string  `yaml:"homedir"`           // path to the user's home directory
 	AllowDuplicateUID bool     `yaml:"allowduplicateuid"` // allow duplicate uid
 
+	// Password is the plain text password of the user. It is usually
+	// received from a password resource with Send/Recv. It is hashed
+	// locally with SHA-512 crypt before it is set, and it is compared
+	// against the existing hash without needing to change the salt.
+	Password *string `yaml:"password"`
+
+	// PasswordHash is the crypt hash of the password of the user, as found
+	// in /etc/shadow. This can't be used with Password. The special values
+	// of "!" and "*" lock the password.
+	PasswordHash *string `yaml:"passwordhash"`
+
+	// MinDays is the minimum number of days between password changes. A
+	// value of -1 removes it. This is the fourth field in /etc/shadow.
+	MinDays *int64 `yaml:"mindays"`
+
+	// MaxDays is the maximum number of days that the password is valid. A
+	// value of -1 removes it. This is the fifth field in /etc/shadow.
+	MaxDays *int64 `yaml:"maxdays"`
+
+	// WarnDays is the number of days of warning before the password needs
+	// to be changed. A value of -1 removes it.
+	WarnDays *int64 `yaml:"warndays"`
+
+	// InactiveDays is the number of days after the password has expired
+	// before the account is locked. A value of -1 removes it.
+	InactiveDays *int64 `yaml:"inactivedays"`
+
+	// ExpireDate is the number of days since the epoch after which the
+	// account is locked. A value of -1 removes it.
+	ExpireDate *int64 `yaml:"expiredate"`
+
 	recWatcher *recwatch.RecWatcher
 }
 
@@ -94,9 +134,49 @@ func (obj *UserRes) Validate() error {
 			}
 		}
 	}
+
+	if obj.Password != nil && obj.PasswordHash != nil {
+		return fmt.Errorf("cannot use both Password and PasswordHash")
+	}
+	if obj.Password != nil && strings.ContainsAny(*obj.Password, "\n\r") {
+		return fmt.Errorf("the Password cannot contain a newline")
+	}
+	if obj.PasswordHash != nil && strings.ContainsAny(*obj.PasswordHash, ":\n\r") {
+		return fmt.Errorf("the PasswordHash contains invalid character(s)")
+	}
+	for name, x := range obj.aging() {
+		if x != nil && *x < -1 {
+			return fmt.Errorf("the %s must not be less than -1", name)
+		}
+	}
 	return nil
 }
 
+// aging returns the password aging params, indexed by name.
+func (obj *UserRes) aging() map[string]*int64 {
+	return map[string]*int64{
+		"MinDays":      obj.MinDays,
+		"MaxDays":      obj.MaxDays,
+		"WarnDays":     obj.WarnDays,
+		"InactiveDays": obj.InactiveDays,
+		"ExpireDate":   obj.ExpireDate,
+	}
+}
+
+// hasShadow returns true if any of the params that are stored in /etc/shadow
+// are used.
+func (obj *UserRes) hasShadow() bool {
+	if obj.Password != nil || obj.PasswordHash != nil {
+		return true
+	}
+	for _, x := range obj.aging() {
+		if x != nil {
+			return true
+		}
+	}
+	return false
+}
+
 // Init runs some startup code for this resource.
 func (obj *UserRes) Init(init *engine.Init) error {
 	obj.init = init // save for later
@@ -118,6 +198,16 @@ func (obj *UserRes) Watch() error {
 	}
 	defer obj.recWatcher.Close()
 
+	var shadowEvents chan recwatch.Event // nil channels block forever
+	if obj.hasShadow() {
+		shadowWatcher, err := recwatch.NewRecWatcher(shadowFile, false)
+		if err != nil {
+			return err
+		}
+		defer shadowWatcher.Close()
+		shadowEvents = shadowWatcher.Events()
+	}
+
 	obj.init.Running() // when started, notify engine that we're running
 
 	var send = false // send event?
@@ -127,6 +217,15 @@ func (obj *UserRes) Watch() error {
 		}
 
 		select {
+		case event, ok := <-shadowEvents:
+			if !ok { // channel shutdown
+				return nil
+			}
+			if err := event.Error; err != nil {
+				return errwrap.Wrapf(err, "Unknown %s watcher error", obj)
+			}
+			send = true
+
 		case event, ok := <-obj.recWatcher.Events():
 			if !ok { // channel shutdown
 				return nil
@@ -179,7 +278,8 @@ func (obj *UserRes) CheckApply(apply bool) (bool, error) {
 		return true, nil
 	}
 
-	if usercheck := true; exists && obj.State == "exists" {
+	usercheck := exists && obj.State == "exists"
+	if usercheck {
 		intUID, err := strconv.Atoi(usr.Uid)
 		if err != nil {
 			return false, errwrap.Wrapf(err, "error casting UID to int")
@@ -197,15 +297,48 @@ func (obj *UserRes) CheckApply(apply bool) (bool, error) {
 		if obj.HomeDir != nil && *obj.HomeDir != usr.HomeDir {
 			usercheck = false
 		}
-		if usercheck {
-			return true, nil
+	}
+
+	// the shadow params are only checked once the user exists
+	passwordcheck, agingcheck := true, true
+	if obj.State == "exists" && obj.hasShadow() {
+		passwordcheck, agingcheck = false, false
+		if exists {
+			if passwordcheck, agingcheck, err = obj.shadowCheck(); err != nil {
+				return false, err
+			}
 		}
 	}
 
+	if usercheck && passwordcheck && agingcheck {
+		return true, nil
+	}
+
 	if !apply {
 		return false, nil
 	}
 
+	if !usercheck {
+		if err := obj.userApply(exists); err != nil {
+			return false, err
+		}
+	}
+	if !passwordcheck {
+		if err := obj.passwordApply(); err != nil {
+			return false, err
+		}
+	}
+	if !agingcheck {
+		if err := obj.agingApply(); err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// userApply adds, modifies or deletes the user.
+func (obj *UserRes) userApply(exists bool) error {
 	var cmdName string
 	var args []string
 	if obj.State == "exists" {
@@ -242,33 +375,184 @@ func (obj *UserRes) CheckApply(apply bool) (bool, error) {
 
 	args = append(args, obj.Name())
 
+	return obj.run(cmdName, args, "")
+}
+
+// shadowCheck compares the password and the aging params against /etc/shadow.
+func (obj *UserRes) shadowCheck() (bool, bool, error) {
+	entry, err := readShadow(obj.Name())
+	if err != nil {
+		return false, false, err
+	}
+
+	passwordcheck := true
+	if obj.PasswordHash != nil && *obj.PasswordHash != entry.hash {
+		passwordcheck = false
+	}
+	if obj.Password != nil {
+		// we can only compare against a SHA-512 hash, anything else
+		// gets replaced, which is what we want anyways
+		ok, err := engineUtil.CryptCheck(entry.hash, *obj.Password)
+		if err != nil && obj.init.Debug {
+			obj.init.Logf("can't compare the password: %v", err)
+		}
+		passwordcheck = err == nil && ok
+	}
+
+	agingcheck := true
+	current := map[string]int64{
+		"MinDays":      entry.minDays,
+		"MaxDays":      entry.maxDays,
+		"WarnDays":     entry.warnDays,
+		"InactiveDays": entry.inactiveDays,
+		"ExpireDate":   entry.expireDate,
+	}
+	for name, x := range obj.aging() {
+		if x != nil && *x != current[name] {
+			agingcheck = false
+		}
+	}
+
+	return passwordcheck, agingcheck, nil
+}
+
+// passwordApply sets the password hash of the user. The hash is passed to the
+// chpasswd command on stdin, so that it isn't visible in the process list.
+func (obj *UserRes) passwordApply() error {
+	var hash string
+	if obj.PasswordHash != nil {
+		hash = *obj.PasswordHash
+	}
+	if obj.Password != nil {
+		salt, err := engineUtil.SHA512CryptSalt()
+		if err != nil {
+			return errwrap.Wrapf(err, "could not generate a salt")
+		}
+		if hash, err = engineUtil.SHA512Crypt(*obj.Password, salt); err != nil {
+			return errwrap.Wrapf(err, "could not hash the password")
+		}
+	}
+
+	obj.init.Logf("Setting password for user: %s", obj.Name()) // not the secret!
+	return obj.run("chpasswd", []string{"-e"}, fmt.Sprintf("%s:%s\n", obj.Name(), hash))
+}
+
+// agingApply sets the password aging params of the user.
+func (obj *UserRes) agingApply() error {
+	args := []string{}
+	aging := obj.aging()
+	flags := []struct{ name, flag string }{
+		{"MinDays", "-m"},
+		{"MaxDays", "-M"},
+		{"WarnDays", "-W"},
+		{"InactiveDays", "-I"},
+		{"ExpireDate", "-E"},
+	}
+	for _, x := range flags {
+		if v := aging[x.name]; v != nil {
+			args = append(args, x.flag, strconv.FormatInt(*v, 10))
+		}
+	}
+	args = append(args, obj.Name())
+
+	obj.init.Logf("Setting password aging for user: %s", obj.Name())
+	return obj.run("chage", args, "")
+}
+
+// run runs one of the user management commands. If stdin is not empty, then it
+// is passed to the command. Any error includes what the command printed.
+func (obj *UserRes) run(cmdName string, args []string, stdin string) error {
 	cmd := exec.Command(cmdName, args...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true,
 		Pgid:    0,
 	}
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
 
 	// open a pipe to get error messages from os/exec
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return false, errwrap.Wrapf(err, "failed to initialize stderr pipe")
+		return errwrap.Wrapf(err, "failed to initialize stderr pipe")
 	}
 
 	// start the command
 	if err := cmd.Start(); err != nil {
-		return false, errwrap.Wrapf(err, "cmd failed to start")
+		return errwrap.Wrapf(err, "cmd failed to start")
 	}
 	// capture any error messages
 	slurp, err := ioutil.ReadAll(stderr)
 	if err != nil {
-		return false, errwrap.Wrapf(err, "error slurping error message")
+		return errwrap.Wrapf(err, "error slurping error message")
 	}
 	// wait until cmd exits and return error message if any
 	if err := cmd.Wait(); err != nil {
-		return false, errwrap.Wrapf(err, "%s", slurp)
+		return errwrap.Wrapf(err, "%s", slurp)
 	}
+	return nil
+}
 
-	return false, nil
+// shadowEntry is the parsed line of the shadow file for a user. Any empty aging
+// field is represented by -1.
+type shadowEntry struct {
+	hash         string
+	minDays      int64
+	maxDays      int64
+	warnDays     int64
+	inactiveDays int64
+	expireDate   int64
+}
+
+// readShadow returns the shadow entry of the user.
+func readShadow(name string) (*shadowEntry, error) {
+	f, err := os.Open(shadowFile)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "could not open the shadow file")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, name+":") {
+			continue
+		}
+		return parseShadow(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errwrap.Wrapf(err, "could not read the shadow file")
+	}
+	return nil, fmt.Errorf("user %s is not in the shadow file", name)
+}
+
+// parseShadow parses a line of the shadow file. A locked hash, which starts
+// with `!` or is `*`, is kept as-is, so that it never matches a password.
+func parseShadow(line string) (*shadowEntry, error) {
+	fields := strings.Split(line, ":")
+	if len(fields) < 8 { // don't include the line, it has the hash in it
+		return nil, fmt.Errorf("invalid shadow line for user %s", fields[0])
+	}
+	ints := []int64{}
+	for _, x := range fields[3:8] {
+		if x == "" {
+			ints = append(ints, -1)
+			continue
+		}
+		i, err := strconv.ParseInt(x, 10, 64)
+		if err != nil { // don't include the line, it has the hash in it
+			return nil, fmt.Errorf("invalid shadow field for user %s", fields[0])
+		}
+		ints = append(ints, i)
+	}
+	return &shadowEntry{
+		hash:         fields[1],
+		minDays:      ints[0],
+		maxDays:      ints[1],
+		warnDays:     ints[2],
+		inactiveDays: ints[3],
+		expireDate:   ints[4],
+	}, nil
 }
 
 // Cmp compares two resources and returns an error if they are not equivalent.
@@ -326,6 +610,32 @@ func (obj *UserRes) Cmp(r engine.Res) error {
 	if obj.AllowDuplicateUID != res.AllowDuplicateUID {
 		return fmt.Errorf("the AllowDuplicateUID differs")
 	}
+	if (obj.Password == nil) != (res.Password == nil) {
+		return fmt.Errorf("the Password differs")
+	}
+	if obj.Password != nil && res.Password != nil {
+		if *obj.Password != *res.Password {
+			return fmt.Errorf("the Password differs")
+		}
+	}
+	if (obj.PasswordHash == nil) != (res.PasswordHash == nil) {
+		return fmt.Errorf("the PasswordHash differs")
+	}
+	if obj.PasswordHash != nil && res.PasswordHash != nil {
+		if *obj.PasswordHash != *res.PasswordHash {
+			return fmt.Errorf("the PasswordHash differs")
+		}
+	}
+	resAging := res.aging()
+	for name, x := range obj.aging() {
+		y := resAging[name]
+		if (x == nil) != (y == nil) {
+			return fmt.Errorf("the %s differs", name)
+		}
+		if x != nil && y != nil && *x != *y {
+			return fmt.Errorf("the %s differs", name)
+		}
+	}
 	return nil
 }
 
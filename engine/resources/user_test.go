@@ -0,0 +1,131 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root
+
+package resources
+
+import (
+	"testing"
+
+	engineUtil "github.com/purpleidea/mgmt/engine/util"
+)
+
+func TestParseShadow1(t *testing.T) {
+	hash := "$6$saltsalt$qFmFH.bQmmtXzyBY0s9v7Oicd2z4XSIecDzlB5KiA2/jctKu9YterLp8wwnSq.qc.eoxqOmSuNp2xS0ktL3nh/"
+	tests := []struct {
+		name  string
+		line  string
+		fail  bool
+		entry shadowEntry
+	}{
+		{
+			name:  "full",
+			line:  "alice:" + hash + ":19000:1:90:7:14:20000:",
+			entry: shadowEntry{hash, 1, 90, 7, 14, 20000},
+		},
+		{
+			name:  "empty fields",
+			line:  "alice:" + hash + ":19000::::::",
+			entry: shadowEntry{hash, -1, -1, -1, -1, -1},
+		},
+		{
+			name:  "no reserved field",
+			line:  "alice:" + hash + ":19000:0:99999:7::",
+			entry: shadowEntry{hash, 0, 99999, 7, -1, -1},
+		},
+		{
+			name:  "empty hash",
+			line:  "alice::19000:0:99999:7:::",
+			entry: shadowEntry{"", 0, 99999, 7, -1, -1},
+		},
+		{
+			name:  "locked hash",
+			line:  "alice:!" + hash + ":19000:0:99999:7:::",
+			entry: shadowEntry{"!" + hash, 0, 99999, 7, -1, -1},
+		},
+		{
+			name:  "locked without a hash",
+			line:  "alice:!:19000:0:99999:7:::",
+			entry: shadowEntry{"!", 0, 99999, 7, -1, -1},
+		},
+		{
+			name:  "no login",
+			line:  "daemon:*:19000:0:99999:7:::",
+			entry: shadowEntry{"*", 0, 99999, 7, -1, -1},
+		},
+		{
+			name: "too few fields",
+			line: "alice:" + hash + ":19000:0:99999",
+			fail: true,
+		},
+		{
+			name: "only a name",
+			line: "alice",
+			fail: true,
+		},
+		{
+			name: "not a number",
+			line: "alice:" + hash + ":19000:0:forever:7:::",
+			fail: true,
+		},
+		{
+			name: "a float",
+			line: "alice:" + hash + ":19000:0:1.5:7:::",
+			fail: true,
+		},
+	}
+	for _, tc := range tests {
+		entry, err := parseShadow(tc.line)
+		if tc.fail {
+			if err == nil {
+				t.Errorf("test %s: expected parse to fail", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %s: parse failed with: %v", tc.name, err)
+			continue
+		}
+		if *entry != tc.entry {
+			t.Errorf("test %s: got wrong entry: %+v", tc.name, *entry)
+		}
+	}
+}
+
+func TestParseShadowLocked1(t *testing.T) {
+	hash, err := engineUtil.SHA512Crypt("password", "$6$saltsalt$")
+	if err != nil {
+		t.Errorf("could not hash: %v", err)
+		return
+	}
+	if ok, err := engineUtil.CryptCheck(hash, "password"); err != nil || !ok {
+		t.Errorf("the password should match the hash")
+	}
+
+	// a locked hash never matches, so shadowCheck replaces it
+	for _, x := range []string{"!" + hash, "!", "*", ""} {
+		entry, err := parseShadow("alice:" + x + ":19000:0:99999:7:::")
+		if err != nil {
+			t.Errorf("parse failed with: %v", err)
+			continue
+		}
+		if ok, _ := engineUtil.CryptCheck(entry.hash, "password"); ok {
+			t.Errorf("the password should not match the hash: %s", x)
+		}
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net/url"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -53,6 +54,7 @@ const (
 )
 
 var (
+	libvirtMutex       = &sync.Mutex{}
 	libvirtInitialized = false
 )
 
@@ -105,6 +107,13 @@ type VirtRes struct {
 	// Filesystem is the list of file system devices to include.
 	Filesystem []*FilesystemDevice `lang:"filesystem" yaml:"filesystem"`
 
+	// Clone is the name of an existing domain to use as a template. When it
+	// is set and the vm doesn't exist yet, the vm is created from a copy of
+	// the template instead of from the above devices. Each disk of the
+	// template is copied to a new volume in the storage pool it's in, and
+	// the network cards get new MAC addresses. The template is not changed.
+	Clone string `lang:"clone" yaml:"clone"`
+
 	// Auth points to the libvirt credentials to use if any are necessary.
 	Auth *VirtAuth `lang:"auth" yaml:"auth"`
 
@@ -164,6 +173,14 @@ func (obj *VirtRes) Validate() error {
 	if obj.CPUs > obj.MaxCPUs {
 		return fmt.Errorf("the number of CPUs (%d) must not be greater than MaxCPUs (%d)", obj.CPUs, obj.MaxCPUs)
 	}
+	if obj.Clone != "" {
+		if obj.Clone == obj.Name() {
+			return fmt.Errorf("a vm can't be a clone of itself")
+		}
+		if len(obj.Disk) > 0 || len(obj.CDRom) > 0 || len(obj.Network) > 0 || len(obj.Filesystem) > 0 {
+			return fmt.Errorf("the devices of a clone come from its template")
+		}
+	}
 	return nil
 }
 
@@ -171,11 +188,8 @@ func (obj *VirtRes) Validate() error {
 func (obj *VirtRes) Init(init *engine.Init) error {
 	obj.init = init // save for later
 
-	if !libvirtInitialized {
-		if err := libvirt.EventRegisterDefaultImpl(); err != nil {
-			return errwrap.Wrapf(err, "method EventRegisterDefaultImpl failed")
-		}
-		libvirtInitialized = true
+	if err := virtEventInit(); err != nil {
+		return err
 	}
 	var u *url.URL
 	var err error
@@ -255,41 +269,7 @@ func (obj *VirtRes) Close() error {
 
 // connect is the connect helper for the libvirt connection. It can handle auth.
 func (obj *VirtRes) connect() (conn *libvirt.Connect, err error) {
-	if obj.Auth != nil {
-		callback := func(creds []*libvirt.ConnectCredential) {
-			// Populate credential structs with the
-			// prepared username/password values
-			for _, cred := range creds {
-				if cred.Type == libvirt.CRED_AUTHNAME {
-					cred.Result = obj.Auth.Username
-					cred.ResultLen = len(cred.Result)
-				} else if cred.Type == libvirt.CRED_PASSPHRASE {
-					cred.Result = obj.Auth.Password
-					cred.ResultLen = len(cred.Result)
-				}
-			}
-		}
-		auth := &libvirt.ConnectAuth{
-			CredType: []libvirt.ConnectCredentialType{
-				libvirt.CRED_AUTHNAME, libvirt.CRED_PASSPHRASE,
-			},
-			Callback: callback,
-		}
-		conn, err = libvirt.NewConnectWithAuth(obj.URI, auth, 0)
-		if err == nil {
-			if version, err := conn.GetLibVersion(); err == nil {
-				obj.version = version
-			}
-		}
-	}
-	if obj.Auth == nil || err != nil {
-		conn, err = libvirt.NewConnect(obj.URI)
-		if err == nil {
-			if version, err := conn.GetLibVersion(); err == nil {
-				obj.version = version
-			}
-		}
-	}
+	conn, obj.version, err = virtConnect(obj.URI, obj.Auth)
 	return
 }
 
@@ -315,24 +295,8 @@ func (obj *VirtRes) Watch() error {
 		defer obj.wg.Done()
 		defer wg.Done()
 		defer obj.init.Logf("EventRunDefaultImpl exited!")
-		for {
-			// TODO: can we merge this into our main for loop below?
-			select {
-			case <-exitChan:
-				return
-			default:
-			}
-			//obj.init.Logf("EventRunDefaultImpl started!")
-			if err := libvirt.EventRunDefaultImpl(); err != nil {
-				select {
-				case errorChan <- errwrap.Wrapf(err, "EventRunDefaultImpl failed"):
-				case <-exitChan:
-					// pass
-				}
-				return
-			}
-			//obj.init.Logf("EventRunDefaultImpl looped!")
-		}
+		// TODO: can we merge this into our main for loop below?
+		virtEventRun(exitChan, errorChan)
 	}()
 
 	// domain events callback
@@ -457,6 +421,13 @@ func (obj *VirtRes) Watch() error {
 // It doesn't check the state before hand, as it is a simple helper function.
 // The caller must run dom.Free() after use, when error was returned as nil.
 func (obj *VirtRes) domainCreate() (*libvirt.Domain, bool, error) {
+	domXML := obj.getDomainXML()
+	if obj.Clone != "" {
+		var err error
+		if domXML, err = obj.cloneDomainXML(); err != nil {
+			return nil, false, errwrap.Wrapf(err, "could not clone %s", obj.Clone)
+		}
+	}
 
 	if obj.Transient {
 		var flag libvirt.DomainCreateFlags
@@ -472,7 +443,7 @@ func (obj *VirtRes) domainCreate() (*libvirt.Domain, bool, error) {
 			// a transient, shutoff machine, means machine is absent
 			return nil, true, nil // returned dom is invalid
 		}
-		dom, err := obj.conn.DomainCreateXML(obj.getDomainXML(), flag)
+		dom, err := obj.conn.DomainCreateXML(domXML, flag)
 		if err != nil {
 			return dom, false, err // returned dom is invalid
 		}
@@ -480,7 +451,7 @@ func (obj *VirtRes) domainCreate() (*libvirt.Domain, bool, error) {
 		return dom, false, nil
 	}
 
-	dom, err := obj.conn.DomainDefineXML(obj.getDomainXML())
+	dom, err := obj.conn.DomainDefineXML(domXML)
 	if err != nil {
 		return dom, false, err // returned dom is invalid
 	}
@@ -991,6 +962,135 @@ func (obj *VirtRes) getDomainXML() string {
 	return b
 }
 
+// cloneDomainXML returns the XML for a new domain which is a copy of the Clone
+// template. It copies the disks of the template which are storage volumes, and
+// it reuses any copies which already exist from an earlier attempt.
+func (obj *VirtRes) cloneDomainXML() (string, error) {
+	tmpl, err := obj.conn.LookupDomainByName(obj.Clone)
+	if err != nil {
+		return "", errwrap.Wrapf(err, "LookupDomainByName failed")
+	}
+	defer tmpl.Free()
+
+	xmlDesc, err := tmpl.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return "", errwrap.Wrapf(err, "domain.GetXMLDesc failed")
+	}
+	domXML := &libvirtxml.Domain{}
+	if err := domXML.Unmarshal(xmlDesc); err != nil {
+		return "", errwrap.Wrapf(err, "could not unmarshal XML")
+	}
+
+	domXML.Name = obj.Name()
+	domXML.UUID = "" // libvirt generates new ones for these
+	domXML.ID = nil
+	domXML.Memory = &libvirtxml.DomainMemory{Value: uint(obj.Memory), Unit: "KiB"}
+	domXML.CurrentMemory = &libvirtxml.DomainCurrentMemory{Value: uint(obj.Memory), Unit: "KiB"}
+	domXML.VCPU = &libvirtxml.DomainVCPU{Value: obj.CPUs}
+	domXML.VCPUs = nil // the template's hotplug layout won't match ours
+	if obj.HotCPUs {
+		domXML.VCPU = &libvirtxml.DomainVCPU{Current: obj.CPUs, Value: obj.MaxCPUs}
+	}
+
+	if domXML.Devices == nil {
+		return domXML.Marshal()
+	}
+	for i := range domXML.Devices.Interfaces {
+		domXML.Devices.Interfaces[i].MAC = nil
+	}
+	for i := range domXML.Devices.Disks {
+		disk := &domXML.Devices.Disks[i]
+		if disk.Device != "" && disk.Device != "disk" { // eg: cdrom
+			continue
+		}
+		if disk.Source == nil || disk.Target == nil {
+			continue
+		}
+		if err := obj.cloneDisk(disk); err != nil {
+			return "", errwrap.Wrapf(err, "could not clone disk %s", disk.Target.Dev)
+		}
+	}
+
+	return domXML.Marshal()
+}
+
+// cloneDisk copies the volume of this disk to a new volume in the same pool,
+// and points the disk at the copy.
+func (obj *VirtRes) cloneDisk(disk *libvirtxml.DomainDisk) error {
+	var vol *libvirt.StorageVol
+	var err error
+	switch {
+	case disk.Source.File != nil:
+		vol, err = obj.conn.LookupStorageVolByPath(disk.Source.File.File)
+	case disk.Source.Volume != nil:
+		var pool *libvirt.StoragePool
+		if pool, err = obj.conn.LookupStoragePoolByName(disk.Source.Volume.Pool); err != nil {
+			return errwrap.Wrapf(err, "LookupStoragePoolByName failed")
+		}
+		defer pool.Free()
+		vol, err = pool.LookupStorageVolByName(disk.Source.Volume.Volume)
+	default:
+		return fmt.Errorf("only file and volume disks can be cloned")
+	}
+	if isVirtError(err, libvirt.ERR_NO_STORAGE_VOL) {
+		return fmt.Errorf("the disk is not in a storage pool")
+	} else if err != nil {
+		return errwrap.Wrapf(err, "storage volume lookup failed")
+	}
+	defer vol.Free()
+
+	pool, err := vol.LookupPoolByVolume()
+	if err != nil {
+		return errwrap.Wrapf(err, "storage.LookupPoolByVolume failed")
+	}
+	defer pool.Free()
+
+	xmlDesc, err := vol.GetXMLDesc(0)
+	if err != nil {
+		return errwrap.Wrapf(err, "storage.GetXMLDesc failed")
+	}
+	volXML := &libvirtxml.StorageVolume{}
+	if err := volXML.Unmarshal(xmlDesc); err != nil {
+		return errwrap.Wrapf(err, "could not unmarshal XML")
+	}
+	name := fmt.Sprintf("%s-%s%s", obj.Name(), disk.Target.Dev, filepath.Ext(volXML.Name))
+
+	clone, err := pool.LookupStorageVolByName(name)
+	if isVirtError(err, libvirt.ERR_NO_STORAGE_VOL) {
+		cloneXML := &libvirtxml.StorageVolume{
+			Name:     name,
+			Capacity: volXML.Capacity,
+		}
+		if volXML.Target != nil && volXML.Target.Format != nil {
+			cloneXML.Target = &libvirtxml.StorageVolumeTarget{
+				Format: volXML.Target.Format,
+			}
+		}
+		s, err := cloneXML.Marshal()
+		if err != nil {
+			return errwrap.Wrapf(err, "could not marshal XML")
+		}
+		if clone, err = pool.StorageVolCreateXMLFrom(s, vol, 0); err != nil {
+			return errwrap.Wrapf(err, "storage.StorageVolCreateXMLFrom failed")
+		}
+		obj.init.Logf("volume %s cloned to %s", volXML.Name, name)
+	} else if err != nil {
+		return errwrap.Wrapf(err, "storage.LookupStorageVolByName failed")
+	}
+	defer clone.Free()
+
+	if disk.Source.Volume != nil {
+		disk.Source.Volume.Volume = name
+		return nil
+	}
+	path, err := clone.GetPath()
+	if err != nil {
+		return errwrap.Wrapf(err, "storage.GetPath failed")
+	}
+	disk.Source.File.File = path
+	return nil
+}
+
 type virtDevice interface {
 	GetXML(idx int) string
 }
@@ -1243,6 +1343,10 @@ func (obj *VirtRes) Cmp(r engine.Res) error {
 		}
 	}
 
+	if obj.Clone != res.Clone {
+		return fmt.Errorf("the Clone differs")
+	}
+
 	if err := obj.Auth.Cmp(res.Auth); err != nil {
 		return errwrap.Wrapf(err, "the Auth differs")
 	}
@@ -1303,12 +1407,89 @@ func randMAC() string {
 
 // isNotFound tells us if this is a domain not found error.
 func isNotFound(err error) bool {
+	return isVirtError(err, libvirt.ERR_NO_DOMAIN)
+}
+
+// isVirtError tells us if this is a libvirt error with this code.
+func isVirtError(err error, code libvirt.ErrorNumber) bool {
 	if err == nil {
 		return false
 	}
-	if virErr, ok := err.(libvirt.Error); ok && virErr.Code == libvirt.ERR_NO_DOMAIN {
-		// domain not found
+	if virErr, ok := err.(libvirt.Error); ok && virErr.Code == code {
 		return true
 	}
 	return false // some other error
 }
+
+// virtEventInit registers the default libvirt event loop implementation. This
+// must happen before any connection is opened if we want to receive events. It
+// is safe to call it more than once.
+func virtEventInit() error {
+	libvirtMutex.Lock()
+	defer libvirtMutex.Unlock()
+	if libvirtInitialized {
+		return nil
+	}
+	if err := libvirt.EventRegisterDefaultImpl(); err != nil {
+		return errwrap.Wrapf(err, "method EventRegisterDefaultImpl failed")
+	}
+	libvirtInitialized = true
+	return nil
+}
+
+// virtEventRun runs the libvirt event loop until the exit channel closes. If it
+// fails, then the error is sent on the error channel, and it returns.
+func virtEventRun(exitChan <-chan struct{}, errorChan chan<- error) {
+	for {
+		select {
+		case <-exitChan:
+			return
+		default:
+		}
+		if err := libvirt.EventRunDefaultImpl(); err != nil {
+			select {
+			case errorChan <- errwrap.Wrapf(err, "EventRunDefaultImpl failed"):
+			case <-exitChan:
+				// pass
+			}
+			return
+		}
+	}
+}
+
+// virtConnect opens a libvirt connection to the URI. It can handle auth. It
+// also returns the version of libvirt, which is zero if it isn't known.
+func virtConnect(uri string, auth *VirtAuth) (conn *libvirt.Connect, version uint32, err error) {
+	if auth != nil {
+		callback := func(creds []*libvirt.ConnectCredential) {
+			// Populate credential structs with the
+			// prepared username/password values
+			for _, cred := range creds {
+				if cred.Type == libvirt.CRED_AUTHNAME {
+					cred.Result = auth.Username
+					cred.ResultLen = len(cred.Result)
+				} else if cred.Type == libvirt.CRED_PASSPHRASE {
+					cred.Result = auth.Password
+					cred.ResultLen = len(cred.Result)
+				}
+			}
+		}
+		connectAuth := &libvirt.ConnectAuth{
+			CredType: []libvirt.ConnectCredentialType{
+				libvirt.CRED_AUTHNAME, libvirt.CRED_PASSPHRASE,
+			},
+			Callback: callback,
+		}
+		conn, err = libvirt.NewConnectWithAuth(uri, connectAuth, 0)
+	}
+	if auth == nil || err != nil {
+		conn, err = libvirt.NewConnect(uri)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if v, err := conn.GetLibVersion(); err == nil {
+		version = v
+	}
+	return conn, version, nil
+}
@@ -0,0 +1,318 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !novirt
+
+package resources
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/util/errwrap"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+func init() {
+	engine.RegisterResource("virt:snapshot", func() engine.Res { return &VirtSnapshotRes{} })
+}
+
+const (
+	// VirtSnapshotStateExists is the state of a snapshot which should
+	// exist.
+	VirtSnapshotStateExists = "exists"
+	// VirtSnapshotStateAbsent is the state of a snapshot which should not
+	// exist.
+	VirtSnapshotStateAbsent = "absent"
+)
+
+// VirtSnapshotRes is a libvirt snapshot resource. It takes a snapshot of a vm
+// once, and it can revert the vm to it when it receives a refresh notification.
+// The snapshot isn't taken again if it already exists, even if the vm changes.
+type VirtSnapshotRes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Refreshable
+
+	init *engine.Init
+
+	// URI is the libvirt connection URI, eg: `qemu:///system`.
+	URI string `lang:"uri" yaml:"uri"`
+	// Auth points to the libvirt credentials to use if any are necessary.
+	Auth *VirtAuth `lang:"auth" yaml:"auth"`
+
+	// Domain is the name of the vm that the snapshot is of.
+	Domain string `lang:"domain" yaml:"domain"`
+	// Snapshot is the name of the snapshot. If it is empty, the name of the
+	// resource is used.
+	Snapshot string `lang:"snapshot" yaml:"snapshot"`
+	// State is either `exists` or `absent`.
+	State string `lang:"state" yaml:"state"`
+	// Description is stored with the snapshot when it's taken.
+	Description string `lang:"description" yaml:"description"`
+	// RevertOnRefresh specifies if we revert the vm to the snapshot on a
+	// refresh signal.
+	RevertOnRefresh bool `lang:"revertonrefresh" yaml:"revertonrefresh"`
+
+	wg   *sync.WaitGroup
+	conn *libvirt.Connect
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *VirtSnapshotRes) Default() engine.Res {
+	return &VirtSnapshotRes{
+		State: VirtSnapshotStateExists,
+	}
+}
+
+// getSnapshot returns the name of the snapshot that we're managing.
+func (obj *VirtSnapshotRes) getSnapshot() string {
+	if obj.Snapshot != "" {
+		return obj.Snapshot
+	}
+	return obj.Name()
+}
+
+// Validate if the params passed in are valid data.
+func (obj *VirtSnapshotRes) Validate() error {
+	if obj.Domain == "" {
+		return fmt.Errorf("the Domain must not be empty")
+	}
+	if obj.getSnapshot() == "" {
+		return fmt.Errorf("the Snapshot must not be empty")
+	}
+	if obj.State != VirtSnapshotStateExists && obj.State != VirtSnapshotStateAbsent {
+		return fmt.Errorf("the State must be either %s or %s", VirtSnapshotStateExists, VirtSnapshotStateAbsent)
+	}
+	if obj.State == VirtSnapshotStateAbsent && obj.RevertOnRefresh {
+		return fmt.Errorf("can't revert to an absent snapshot")
+	}
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *VirtSnapshotRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	if err := virtEventInit(); err != nil {
+		return err
+	}
+	var err error
+	obj.conn, _, err = virtConnect(obj.URI, obj.Auth) // gets closed in Close
+	if err != nil {
+		return errwrap.Wrapf(err, "connection to libvirt failed in init")
+	}
+	obj.wg = &sync.WaitGroup{}
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *VirtSnapshotRes) Close() error {
+	obj.wg.Wait() // the event loop must be done before we close the conn
+
+	_, err := obj.conn.Close() // close libvirt conn that was opened in Init
+	obj.conn = nil             // set to nil to help catch any nil ptr bugs!
+	return err
+}
+
+// Watch is the primary listener for this resource and it outputs events. There
+// are no libvirt events for snapshots, so it listens to the lifecycle events of
+// the vm, which include reverts. Other changes are only noticed with polling.
+func (obj *VirtSnapshotRes) Watch() error {
+	wg := &sync.WaitGroup{}
+	defer wg.Wait() // wait until everyone has exited before we exit!
+	domChan := make(chan libvirt.DomainEventType)
+	errorChan := make(chan error)
+	exitChan := make(chan struct{})
+	defer close(exitChan)
+	obj.wg.Add(1)
+	wg.Add(1)
+	go func() {
+		defer obj.wg.Done()
+		defer wg.Done()
+		virtEventRun(exitChan, errorChan)
+	}()
+
+	// if dom is nil, we get events for *all* domains, even new ones!
+	callbackID, err := obj.conn.DomainEventLifecycleRegister(nil, func(c *libvirt.Connect, d *libvirt.Domain, ev *libvirt.DomainEventLifecycle) {
+		if domName, _ := d.GetName(); domName != obj.Domain {
+			return
+		}
+		select {
+		case domChan <- ev.Event: // send
+		case <-exitChan:
+		}
+	})
+	if err != nil {
+		return errwrap.Wrapf(err, "DomainEventLifecycleRegister failed")
+	}
+	defer obj.conn.DomainEventDeregister(callbackID)
+
+	obj.init.Running() // when started, notify engine that we're running
+
+	for {
+		select {
+		case event := <-domChan:
+			if obj.init.Debug {
+				obj.init.Logf("event: %v", event)
+			}
+
+		case err := <-errorChan:
+			return errwrap.Wrapf(err, "unknown libvirt error")
+
+		case <-obj.init.Done: // closed by the engine to signal shutdown
+			return nil
+		}
+
+		obj.init.Event() // notify engine of an event (this can block)
+	}
+}
+
+// CheckApply checks the resource state and applies the resource if the bool
+// input is true. It returns error info and if the state check passed or not.
+func (obj *VirtSnapshotRes) CheckApply(apply bool) (bool, error) {
+	if obj.conn == nil { // programming error?
+		return false, fmt.Errorf("got called with nil connection")
+	}
+	name := obj.getSnapshot()
+
+	dom, err := obj.conn.LookupDomainByName(obj.Domain)
+	if isNotFound(err) {
+		if obj.State == VirtSnapshotStateAbsent {
+			return true, nil // no domain, no snapshot
+		}
+		return false, fmt.Errorf("the domain %s does not exist", obj.Domain)
+	} else if err != nil {
+		return false, errwrap.Wrapf(err, "LookupDomainByName failed")
+	}
+	defer dom.Free()
+
+	snap, err := dom.SnapshotLookupByName(name, 0)
+	if isVirtError(err, libvirt.ERR_NO_DOMAIN_SNAPSHOT) {
+		if obj.State == VirtSnapshotStateAbsent {
+			return true, nil
+		}
+		if !apply {
+			return false, nil
+		}
+		// there's nothing to revert to yet, so this is the refresh
+		return false, obj.snapshotCreate(dom)
+
+	} else if err != nil {
+		return false, errwrap.Wrapf(err, "domain.SnapshotLookupByName failed")
+	}
+	defer snap.Free()
+
+	if obj.State == VirtSnapshotStateAbsent {
+		if !apply {
+			return false, nil
+		}
+		// the snapshots taken after this one are kept
+		if err := snap.Delete(0); err != nil {
+			return false, errwrap.Wrapf(err, "snapshot.Delete failed")
+		}
+		obj.init.Logf("snapshot deleted")
+		return false, nil
+	}
+
+	if !obj.RevertOnRefresh || !obj.init.Refresh() {
+		return true, nil
+	}
+	if !apply {
+		return false, nil
+	}
+	if err := snap.RevertToSnapshot(0); err != nil {
+		return false, errwrap.Wrapf(err, "snapshot.RevertToSnapshot failed")
+	}
+	obj.init.Logf("reverted to snapshot")
+	return false, nil
+}
+
+// snapshotCreate takes the snapshot of the domain.
+func (obj *VirtSnapshotRes) snapshotCreate(dom *libvirt.Domain) error {
+	snapXML := &libvirtxml.DomainSnapshot{
+		Name:        obj.getSnapshot(),
+		Description: obj.Description,
+	}
+	s, err := snapXML.Marshal()
+	if err != nil {
+		return errwrap.Wrapf(err, "could not marshal XML")
+	}
+	snap, err := dom.CreateSnapshotXML(s, 0)
+	if err != nil {
+		return errwrap.Wrapf(err, "domain.CreateSnapshotXML failed")
+	}
+	defer snap.Free()
+	obj.init.Logf("snapshot created")
+	return nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *VirtSnapshotRes) Cmp(r engine.Res) error {
+	// we can only compare VirtSnapshotRes to others of the same resource kind
+	res, ok := r.(*VirtSnapshotRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.URI != res.URI {
+		return fmt.Errorf("the URI differs")
+	}
+	if err := obj.Auth.Cmp(res.Auth); err != nil {
+		return errwrap.Wrapf(err, "the Auth differs")
+	}
+	if obj.Domain != res.Domain {
+		return fmt.Errorf("the Domain differs")
+	}
+	if obj.getSnapshot() != res.getSnapshot() {
+		return fmt.Errorf("the Snapshot differs")
+	}
+	if obj.State != res.State {
+		return fmt.Errorf("the State differs")
+	}
+	if obj.Description != res.Description {
+		return fmt.Errorf("the Description differs")
+	}
+	if obj.RevertOnRefresh != res.RevertOnRefresh {
+		return fmt.Errorf("the RevertOnRefresh differs")
+	}
+
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *VirtSnapshotRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes VirtSnapshotRes // indirection to avoid infinite recursion
+
+	def := obj.Default()              // get the default
+	res, ok := def.(*VirtSnapshotRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to VirtSnapshotRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = VirtSnapshotRes(raw) // restore from indirection with type conversion!
+	return nil
+}
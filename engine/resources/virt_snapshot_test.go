@@ -0,0 +1,113 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root && !novirt
+
+package resources
+
+import (
+	"testing"
+)
+
+func TestVirtSnapshotValidate1(t *testing.T) {
+	tests := []struct {
+		res  *VirtSnapshotRes
+		fail bool
+	}{
+		{&VirtSnapshotRes{Domain: "test", State: "exists"}, false},
+		{&VirtSnapshotRes{Domain: "test", State: "exists", RevertOnRefresh: true}, false},
+		{&VirtSnapshotRes{Domain: "test", Snapshot: "clean", State: "absent"}, false},
+		{&VirtSnapshotRes{Domain: "", State: "exists"}, true},                            // no domain
+		{&VirtSnapshotRes{Domain: "test", State: "reverted"}, true},                      // bad state
+		{&VirtSnapshotRes{Domain: "test", State: "absent", RevertOnRefresh: true}, true}, // nothing to revert to
+	}
+	for i, tt := range tests {
+		tt.res.SetKind("virt:snapshot")
+		tt.res.SetName("snap1")
+		if err := tt.res.Validate(); (err != nil) != tt.fail {
+			t.Errorf("test #%d: expected fail: %t, got: %v", i, tt.fail, err)
+		}
+	}
+}
+
+func TestVirtSnapshot1(t *testing.T) {
+	refresh := false
+	res := (&VirtSnapshotRes{}).Default().(*VirtSnapshotRes)
+	res.URI = virtTestURI
+	res.Domain = "test"
+	res.Description = "before the upgrade"
+	res.RevertOnRefresh = true
+	res.SetKind("virt:snapshot")
+	res.SetName("snap1")
+	if err := res.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	if err := res.Init(virtTestInit(t, &refresh)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	defer res.Close()
+
+	if checkOK, err := res.CheckApply(false); err != nil || checkOK {
+		t.Errorf("expected the snapshot to be missing: %t, %v", checkOK, err)
+	}
+	if _, err := res.CheckApply(true); err != nil {
+		t.Errorf("expected the snapshot to be taken: %v", err)
+	}
+	if checkOK, err := res.CheckApply(true); err != nil || !checkOK {
+		t.Errorf("expected the snapshot to exist: %t, %v", checkOK, err)
+	}
+
+	dom, err := res.conn.LookupDomainByName("test")
+	if err != nil {
+		t.Errorf("domain lookup failed with: %v", err)
+		return
+	}
+	defer dom.Free()
+	snap, err := dom.SnapshotLookupByName("snap1", 0)
+	if err != nil {
+		t.Errorf("snapshot lookup failed with: %v", err)
+		return
+	}
+	defer snap.Free()
+
+	// the revert makes the snapshot current again
+	snap2, err := dom.CreateSnapshotXML("<domainsnapshot><name>snap2</name></domainsnapshot>", 0)
+	if err != nil {
+		t.Errorf("snapshot failed with: %v", err)
+		return
+	}
+	defer snap2.Free()
+	refresh = true
+	if checkOK, err := res.CheckApply(true); err != nil || checkOK {
+		t.Errorf("expected the domain to be reverted: %t, %v", checkOK, err)
+	}
+	if current, err := snap.IsCurrent(0); err != nil || !current {
+		t.Errorf("expected the snapshot to be current: %t, %v", current, err)
+	}
+	refresh = false
+
+	res.State = "absent"
+	res.RevertOnRefresh = false
+	if _, err := res.CheckApply(true); err != nil {
+		t.Errorf("expected the snapshot to be deleted: %v", err)
+	}
+	if checkOK, err := res.CheckApply(false); err != nil || !checkOK {
+		t.Errorf("expected the snapshot to be absent: %t, %v", checkOK, err)
+	}
+}
@@ -0,0 +1,150 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root && !novirt
+
+package resources
+
+import (
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+const virtTestTemplate = `<domain type='test'>
+	<name>tmpl</name>
+	<memory unit='KiB'>1048576</memory>
+	<vcpu>1</vcpu>
+	<os><type>hvm</type></os>
+	<devices>
+		<disk type='file' device='disk'>
+			<source file='/default-pool/tmpl.img'/>
+			<target dev='vda' bus='virtio'/>
+		</disk>
+		<interface type='network'>
+			<mac address='52:54:00:00:00:01'/>
+			<source network='default'/>
+		</interface>
+	</devices>
+</domain>`
+
+func TestVirtValidate1(t *testing.T) {
+	tests := []struct {
+		res  *VirtRes
+		fail bool
+	}{
+		{&VirtRes{CPUs: 1, MaxCPUs: 2}, false},
+		{&VirtRes{CPUs: 1, MaxCPUs: 2, Clone: "tmpl"}, false},
+		{&VirtRes{CPUs: 4, MaxCPUs: 2}, true},                                               // too many cpus
+		{&VirtRes{CPUs: 1, MaxCPUs: 2, Clone: "vm1"}, true},                                 // itself
+		{&VirtRes{CPUs: 1, MaxCPUs: 2, Clone: "tmpl", Disk: []*DiskDevice{{}}}, true},       // disks come from the template
+		{&VirtRes{CPUs: 1, MaxCPUs: 2, Clone: "tmpl", Network: []*NetworkDevice{{}}}, true}, // and so does the network
+	}
+	for i, tt := range tests {
+		tt.res.SetKind("virt")
+		tt.res.SetName("vm1")
+		if err := tt.res.Validate(); (err != nil) != tt.fail {
+			t.Errorf("test #%d: expected fail: %t, got: %v", i, tt.fail, err)
+		}
+	}
+}
+
+func TestVirtClone1(t *testing.T) {
+	res := (&VirtRes{}).Default().(*VirtRes)
+	res.URI = virtTestURI
+	res.State = "shutoff"
+	res.CPUs = 1
+	res.HotCPUs = false
+	res.Memory = 524288
+	res.Clone = "tmpl"
+	res.SetKind("virt")
+	res.SetName("clone1")
+	if err := res.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	if err := res.Init(virtTestInit(t, nil)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	defer res.Close()
+
+	// make the template and its disk
+	pool, err := res.conn.LookupStoragePoolByName("default-pool")
+	if err != nil {
+		t.Errorf("pool lookup failed with: %v", err)
+		return
+	}
+	defer pool.Free()
+	vol, err := pool.StorageVolCreateXML("<volume><name>tmpl.img</name><capacity>1048576</capacity></volume>", 0)
+	if err != nil {
+		t.Errorf("volume create failed with: %v", err)
+		return
+	}
+	defer vol.Free()
+	tmpl, err := res.conn.DomainDefineXML(virtTestTemplate)
+	if err != nil {
+		t.Errorf("template define failed with: %v", err)
+		return
+	}
+	defer tmpl.Free()
+
+	if _, err := res.CheckApply(true); err != nil {
+		t.Errorf("expected the domain to be cloned: %v", err)
+		return
+	}
+
+	dom, err := res.conn.LookupDomainByName("clone1")
+	if err != nil {
+		t.Errorf("domain lookup failed with: %v", err)
+		return
+	}
+	defer dom.Free()
+	xmlDesc, err := dom.GetXMLDesc(0)
+	if err != nil {
+		t.Errorf("domain xml failed with: %v", err)
+		return
+	}
+	domXML := &libvirtxml.Domain{}
+	if err := domXML.Unmarshal(xmlDesc); err != nil {
+		t.Errorf("domain xml unmarshal failed with: %v", err)
+		return
+	}
+	if domXML.Devices == nil {
+		t.Errorf("expected the domain to have devices")
+		return
+	}
+	if disks := domXML.Devices.Disks; len(disks) != 1 || disks[0].Source == nil || disks[0].Source.File == nil || disks[0].Source.File.File != "/default-pool/clone1-vda.img" {
+		t.Errorf("expected the disk to be a copy: %+v", disks)
+	}
+	if nics := domXML.Devices.Interfaces; len(nics) != 1 || nics[0].MAC == nil || nics[0].MAC.Address == "52:54:00:00:00:01" {
+		t.Errorf("expected a new mac address: %+v", nics)
+	}
+	if domXML.Memory == nil || domXML.Memory.Value != 524288 {
+		t.Errorf("expected the memory to change: %+v", domXML.Memory)
+	}
+
+	// the template is untouched, and the copy is reused
+	if v, err := pool.LookupStorageVolByName("tmpl.img"); err != nil {
+		t.Errorf("expected the template disk to exist: %v", err)
+	} else {
+		v.Free()
+	}
+	if _, err := res.CheckApply(true); err != nil {
+		t.Errorf("expected the clone to be unchanged: %v", err)
+	}
+}
@@ -0,0 +1,383 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !novirt
+
+package resources
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/util/errwrap"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+func init() {
+	engine.RegisterResource("virt:volume", func() engine.Res { return &VirtVolumeRes{} })
+}
+
+const (
+	// VirtVolumeStateExists is the state of a volume which should exist.
+	VirtVolumeStateExists = "exists"
+	// VirtVolumeStateAbsent is the state of a volume which should not exist.
+	VirtVolumeStateAbsent = "absent"
+)
+
+// VirtVolumeRes is a libvirt storage volume resource. The name of the resource
+// is the name of the volume in the pool, such as `web1.qcow2`. The volume can
+// be made from a backing image, so that it only stores the changes which the
+// vm makes to it. It is grown when its Size increases, but it is never shrunk,
+// since that would lose the data at the end of it.
+type VirtVolumeRes struct {
+	traits.Base // add the base methods without re-implementation
+
+	init *engine.Init
+
+	// URI is the libvirt connection URI, eg: `qemu:///system`.
+	URI string `lang:"uri" yaml:"uri"`
+	// Auth points to the libvirt credentials to use if any are necessary.
+	Auth *VirtAuth `lang:"auth" yaml:"auth"`
+
+	// Pool is the name of the storage pool that the volume is in. The pool
+	// must already exist and be active.
+	Pool string `lang:"pool" yaml:"pool"`
+	// State is either `exists` or `absent`.
+	State string `lang:"state" yaml:"state"`
+	// Size is the capacity of the volume in bytes. It can be zero when
+	// there's a Backing image, in which case the volume is the same size.
+	Size uint64 `lang:"size" yaml:"size"`
+	// Format is the format of the volume, such as `qcow2` or `raw`.
+	Format string `lang:"format" yaml:"format"`
+	// Backing is the path to an image that the new volume is made on top
+	// of. It isn't changed by writes to the volume. The backing image of a
+	// volume that already exists can't be changed.
+	Backing string `lang:"backing" yaml:"backing"`
+	// BackingFormat is the format of the Backing image.
+	BackingFormat string `lang:"backing_format" yaml:"backing_format"`
+
+	wg   *sync.WaitGroup
+	conn *libvirt.Connect
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *VirtVolumeRes) Default() engine.Res {
+	return &VirtVolumeRes{
+		Pool:          "default",
+		State:         VirtVolumeStateExists,
+		Format:        "qcow2",
+		BackingFormat: "qcow2",
+	}
+}
+
+// Validate if the params passed in are valid data.
+func (obj *VirtVolumeRes) Validate() error {
+	if obj.Pool == "" {
+		return fmt.Errorf("the Pool must not be empty")
+	}
+	if obj.State != VirtVolumeStateExists && obj.State != VirtVolumeStateAbsent {
+		return fmt.Errorf("the State must be either %s or %s", VirtVolumeStateExists, VirtVolumeStateAbsent)
+	}
+	if obj.State == VirtVolumeStateAbsent {
+		return nil
+	}
+	if obj.Format == "" {
+		return fmt.Errorf("the Format must not be empty")
+	}
+	if obj.Size == 0 && obj.Backing == "" {
+		return fmt.Errorf("the Size must be set when there is no Backing image")
+	}
+	if obj.Backing != "" && obj.BackingFormat == "" {
+		return fmt.Errorf("the BackingFormat must not be empty")
+	}
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *VirtVolumeRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	if err := virtEventInit(); err != nil {
+		return err
+	}
+	var err error
+	obj.conn, _, err = virtConnect(obj.URI, obj.Auth) // gets closed in Close
+	if err != nil {
+		return errwrap.Wrapf(err, "connection to libvirt failed in init")
+	}
+	obj.wg = &sync.WaitGroup{}
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *VirtVolumeRes) Close() error {
+	obj.wg.Wait() // the event loop must be done before we close the conn
+
+	_, err := obj.conn.Close() // close libvirt conn that was opened in Init
+	obj.conn = nil             // set to nil to help catch any nil ptr bugs!
+	return err
+}
+
+// Watch is the primary listener for this resource and it outputs events. There
+// are no libvirt events for volumes, so it listens to the events of the pool,
+// which include refreshes. Other changes are only noticed with polling.
+func (obj *VirtVolumeRes) Watch() error {
+	wg := &sync.WaitGroup{}
+	defer wg.Wait() // wait until everyone has exited before we exit!
+	eventChan := make(chan struct{})
+	errorChan := make(chan error)
+	exitChan := make(chan struct{})
+	defer close(exitChan)
+	obj.wg.Add(1)
+	wg.Add(1)
+	go func() {
+		defer obj.wg.Done()
+		defer wg.Done()
+		virtEventRun(exitChan, errorChan)
+	}()
+
+	send := func(p *libvirt.StoragePool) {
+		if name, _ := p.GetName(); name != obj.Pool {
+			return
+		}
+		select {
+		case eventChan <- struct{}{}:
+		case <-exitChan:
+		}
+	}
+	// if pool is nil, we get events for *all* pools, even new ones!
+	lifecycleID, err := obj.conn.StoragePoolEventLifecycleRegister(nil, func(c *libvirt.Connect, p *libvirt.StoragePool, ev *libvirt.StoragePoolEventLifecycle) {
+		send(p)
+	})
+	if err != nil {
+		return errwrap.Wrapf(err, "StoragePoolEventLifecycleRegister failed")
+	}
+	defer obj.conn.StoragePoolEventDeregister(lifecycleID)
+	refreshID, err := obj.conn.StoragePoolEventRefreshRegister(nil, func(c *libvirt.Connect, p *libvirt.StoragePool) {
+		send(p)
+	})
+	if err != nil {
+		return errwrap.Wrapf(err, "StoragePoolEventRefreshRegister failed")
+	}
+	defer obj.conn.StoragePoolEventDeregister(refreshID)
+
+	obj.init.Running() // when started, notify engine that we're running
+
+	for {
+		select {
+		case <-eventChan:
+			if obj.init.Debug {
+				obj.init.Logf("event: pool %s", obj.Pool)
+			}
+
+		case err := <-errorChan:
+			return errwrap.Wrapf(err, "unknown libvirt error")
+
+		case <-obj.init.Done: // closed by the engine to signal shutdown
+			return nil
+		}
+
+		obj.init.Event() // notify engine of an event (this can block)
+	}
+}
+
+// CheckApply checks the resource state and applies the resource if the bool
+// input is true. It returns error info and if the state check passed or not.
+func (obj *VirtVolumeRes) CheckApply(apply bool) (bool, error) {
+	if obj.conn == nil { // programming error?
+		return false, fmt.Errorf("got called with nil connection")
+	}
+
+	pool, err := obj.conn.LookupStoragePoolByName(obj.Pool)
+	if isVirtError(err, libvirt.ERR_NO_STORAGE_POOL) {
+		if obj.State == VirtVolumeStateAbsent {
+			return true, nil // no pool, no volume
+		}
+		return false, fmt.Errorf("the pool %s does not exist", obj.Pool)
+	} else if err != nil {
+		return false, errwrap.Wrapf(err, "LookupStoragePoolByName failed")
+	}
+	defer pool.Free()
+	if active, err := pool.IsActive(); err != nil {
+		return false, errwrap.Wrapf(err, "pool.IsActive failed")
+	} else if !active {
+		return false, fmt.Errorf("the pool %s is not active", obj.Pool)
+	}
+
+	vol, err := pool.LookupStorageVolByName(obj.Name())
+	if isVirtError(err, libvirt.ERR_NO_STORAGE_VOL) {
+		if obj.State == VirtVolumeStateAbsent {
+			return true, nil
+		}
+		if !apply {
+			return false, nil
+		}
+		return false, obj.volumeCreate(pool)
+
+	} else if err != nil {
+		return false, errwrap.Wrapf(err, "pool.LookupStorageVolByName failed")
+	}
+	defer vol.Free()
+
+	if obj.State == VirtVolumeStateAbsent {
+		if !apply {
+			return false, nil
+		}
+		if err := vol.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL); err != nil {
+			return false, errwrap.Wrapf(err, "storage.Delete failed")
+		}
+		obj.init.Logf("volume deleted")
+		return false, nil
+	}
+
+	xmlDesc, err := vol.GetXMLDesc(0)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "storage.GetXMLDesc failed")
+	}
+	volXML := &libvirtxml.StorageVolume{}
+	if err := volXML.Unmarshal(xmlDesc); err != nil {
+		return false, errwrap.Wrapf(err, "could not unmarshal XML")
+	}
+	// we won't replace a volume which has data in it to fix these two
+	if format := volumeFormat(volXML.Target); format != "" && format != obj.Format {
+		return false, fmt.Errorf("the volume exists with the %s format", format)
+	}
+	if obj.Backing != "" && (volXML.BackingStore == nil || volXML.BackingStore.Path != obj.Backing) {
+		return false, fmt.Errorf("the volume exists without the %s backing image", obj.Backing)
+	}
+
+	info, err := vol.GetInfo()
+	if err != nil {
+		return false, errwrap.Wrapf(err, "storage.GetInfo failed")
+	}
+	if info.Capacity >= obj.Size { // we never shrink it
+		return true, nil
+	}
+	if !apply {
+		return false, nil
+	}
+	if err := vol.Resize(obj.Size, 0); err != nil {
+		return false, errwrap.Wrapf(err, "storage.Resize failed")
+	}
+	obj.init.Logf("volume resized from %d to %d bytes", info.Capacity, obj.Size)
+	return false, nil
+}
+
+// volumeCreate creates the volume in the pool.
+func (obj *VirtVolumeRes) volumeCreate(pool *libvirt.StoragePool) error {
+	volXML := &libvirtxml.StorageVolume{
+		Name: obj.Name(),
+		Target: &libvirtxml.StorageVolumeTarget{
+			Format: &libvirtxml.StorageVolumeTargetFormat{
+				Type: obj.Format,
+			},
+		},
+	}
+	if obj.Size > 0 {
+		volXML.Capacity = &libvirtxml.StorageVolumeSize{
+			Unit:  "bytes",
+			Value: obj.Size,
+		}
+	}
+	if obj.Backing != "" {
+		volXML.BackingStore = &libvirtxml.StorageVolumeBackingStore{
+			Path: obj.Backing,
+			Format: &libvirtxml.StorageVolumeTargetFormat{
+				Type: obj.BackingFormat,
+			},
+		}
+	}
+	s, err := volXML.Marshal()
+	if err != nil {
+		return errwrap.Wrapf(err, "could not marshal XML")
+	}
+	vol, err := pool.StorageVolCreateXML(s, 0)
+	if err != nil {
+		return errwrap.Wrapf(err, "pool.StorageVolCreateXML failed")
+	}
+	defer vol.Free()
+	obj.init.Logf("volume created")
+	return nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *VirtVolumeRes) Cmp(r engine.Res) error {
+	// we can only compare VirtVolumeRes to others of the same resource kind
+	res, ok := r.(*VirtVolumeRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.URI != res.URI {
+		return fmt.Errorf("the URI differs")
+	}
+	if err := obj.Auth.Cmp(res.Auth); err != nil {
+		return errwrap.Wrapf(err, "the Auth differs")
+	}
+	if obj.Pool != res.Pool {
+		return fmt.Errorf("the Pool differs")
+	}
+	if obj.State != res.State {
+		return fmt.Errorf("the State differs")
+	}
+	if obj.Size != res.Size {
+		return fmt.Errorf("the Size differs")
+	}
+	if obj.Format != res.Format {
+		return fmt.Errorf("the Format differs")
+	}
+	if obj.Backing != res.Backing {
+		return fmt.Errorf("the Backing differs")
+	}
+	if obj.BackingFormat != res.BackingFormat {
+		return fmt.Errorf("the BackingFormat differs")
+	}
+
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *VirtVolumeRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes VirtVolumeRes // indirection to avoid infinite recursion
+
+	def := obj.Default()            // get the default
+	res, ok := def.(*VirtVolumeRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to VirtVolumeRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = VirtVolumeRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// volumeFormat returns the format of a volume target, or empty if it has none.
+func volumeFormat(target *libvirtxml.StorageVolumeTarget) string {
+	if target == nil || target.Format == nil {
+		return ""
+	}
+	return target.Format.Type
+}
@@ -0,0 +1,123 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root && !novirt
+
+package resources
+
+import (
+	"testing"
+
+	"github.com/purpleidea/mgmt/engine"
+)
+
+// virtTestURI is the libvirt test driver. It starts with a running domain named
+// `test` and an active pool named `default-pool`, and it's all in memory.
+const virtTestURI = "test:///default"
+
+func virtTestInit(t *testing.T, refresh *bool) *engine.Init {
+	return &engine.Init{
+		Refresh: func() bool {
+			return refresh != nil && *refresh
+		},
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+	}
+}
+
+func TestVirtVolumeValidate1(t *testing.T) {
+	tests := []struct {
+		res  *VirtVolumeRes
+		fail bool
+	}{
+		{&VirtVolumeRes{Pool: "default", State: "exists", Format: "qcow2", Size: 1024}, false},
+		{&VirtVolumeRes{Pool: "default", State: "exists", Format: "qcow2", Backing: "/var/lib/libvirt/images/base.qcow2", BackingFormat: "qcow2"}, false},
+		{&VirtVolumeRes{Pool: "default", State: "absent"}, false},
+		{&VirtVolumeRes{Pool: "default", State: "exists", Format: "qcow2"}, true},              // no size
+		{&VirtVolumeRes{Pool: "default", State: "present", Format: "qcow2", Size: 1}, true},    // bad state
+		{&VirtVolumeRes{Pool: "", State: "exists", Format: "qcow2", Size: 1024}, true},         // no pool
+		{&VirtVolumeRes{Pool: "default", State: "exists", Backing: "/base.qcow2"}, true},       // no format
+		{&VirtVolumeRes{Pool: "default", State: "exists", Format: "raw", Backing: "/x"}, true}, // no backing format
+	}
+	for i, tt := range tests {
+		tt.res.SetKind("virt:volume")
+		tt.res.SetName("vol1.qcow2")
+		if err := tt.res.Validate(); (err != nil) != tt.fail {
+			t.Errorf("test #%d: expected fail: %t, got: %v", i, tt.fail, err)
+		}
+	}
+}
+
+func TestVirtVolume1(t *testing.T) {
+	res := (&VirtVolumeRes{}).Default().(*VirtVolumeRes)
+	res.URI = virtTestURI
+	res.Pool = "default-pool"
+	res.Size = 1024 * 1024
+	res.Backing = "/default-pool/base.qcow2"
+	res.SetKind("virt:volume")
+	res.SetName("vol1.qcow2")
+	if err := res.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return
+	}
+	if err := res.Init(virtTestInit(t, nil)); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	defer res.Close()
+
+	if checkOK, err := res.CheckApply(false); err != nil || checkOK {
+		t.Errorf("expected the volume to be missing: %t, %v", checkOK, err)
+	}
+	if _, err := res.CheckApply(true); err != nil {
+		t.Errorf("expected the volume to be created: %v", err)
+	}
+	if checkOK, err := res.CheckApply(true); err != nil || !checkOK {
+		t.Errorf("expected the volume to exist: %t, %v", checkOK, err)
+	}
+
+	pool, err := res.conn.LookupStoragePoolByName("default-pool")
+	if err != nil {
+		t.Errorf("pool lookup failed with: %v", err)
+		return
+	}
+	defer pool.Free()
+	vol, err := pool.LookupStorageVolByName("vol1.qcow2")
+	if err != nil {
+		t.Errorf("volume lookup failed with: %v", err)
+		return
+	}
+	defer vol.Free()
+	if info, err := vol.GetInfo(); err != nil || info.Capacity != res.Size {
+		t.Errorf("unexpected volume info: %+v, %v", info, err)
+	}
+
+	// we won't recreate a volume with data in it to change the backing
+	res.Backing = "/default-pool/other.qcow2"
+	if _, err := res.CheckApply(true); err == nil {
+		t.Errorf("expected a different backing image to fail")
+	}
+
+	res.State = "absent"
+	if _, err := res.CheckApply(true); err != nil {
+		t.Errorf("expected the volume to be deleted: %v", err)
+	}
+	if checkOK, err := res.CheckApply(false); err != nil || !checkOK {
+		t.Errorf("expected the volume to be absent: %t, %v", checkOK, err)
+	}
+}
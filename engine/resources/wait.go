@@ -0,0 +1,402 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	"github.com/purpleidea/mgmt/recwatch"
+	"github.com/purpleidea/mgmt/util/errwrap"
+)
+
+func init() {
+	engine.RegisterResource("wait", func() engine.Res { return &WaitRes{} })
+}
+
+const (
+	// WaitDefaultTimeout is the default number of seconds to wait for.
+	WaitDefaultTimeout = 60
+
+	// WaitDefaultInterval is the default number of milliseconds between two
+	// checks of the conditions.
+	WaitDefaultInterval = 1000
+
+	// waitProbeTimeout is the longest that a single network check can take.
+	waitProbeTimeout = 5 * time.Second
+)
+
+// WaitRes is a resource which waits until some conditions are met. Its
+// CheckApply only succeeds once all of the specified conditions are true, so
+// that any resource which depends on it only runs after that. If they aren't
+// met before the Timeout, then it errors, and the Retry and Delay metaparams can
+// be used to keep on waiting. Nothing is changed on the system.
+type WaitRes struct {
+	traits.Base // add the base methods without re-implementation
+
+	init *engine.Init
+
+	// TCP is a host:port address which must accept connections.
+	TCP string `lang:"tcp" yaml:"tcp"`
+
+	// Socket is the path of a unix socket which must accept connections.
+	Socket string `lang:"socket" yaml:"socket"`
+
+	// File is a path which must exist.
+	File string `lang:"file" yaml:"file"`
+
+	// URL is an http or https url which must return the Status.
+	URL string `lang:"url" yaml:"url"`
+
+	// Status is the http status code that the URL must return.
+	Status int64 `lang:"status" yaml:"status"`
+
+	// Cmd is a command which must succeed.
+	Cmd string `lang:"cmd" yaml:"cmd"`
+
+	// Shell is the (optional) shell to run the Cmd with. If it is empty,
+	// the Cmd is split on whitespace and run directly.
+	Shell string `lang:"shell" yaml:"shell"`
+
+	// Timeout is the number of seconds to wait for the conditions, before
+	// returning an error. If it is zero, then they're only checked once.
+	Timeout uint64 `lang:"timeout" yaml:"timeout"`
+
+	// Interval is the number of milliseconds between two checks of the
+	// conditions.
+	Interval uint64 `lang:"interval" yaml:"interval"`
+
+	interruptChan chan struct{}
+	interruptOnce *sync.Once
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *WaitRes) Default() engine.Res {
+	return &WaitRes{
+		Status:   http.StatusOK,
+		Timeout:  WaitDefaultTimeout,
+		Interval: WaitDefaultInterval,
+	}
+}
+
+// Validate if the params passed in are valid data.
+func (obj *WaitRes) Validate() error {
+	if obj.TCP == "" && obj.Socket == "" && obj.File == "" && obj.URL == "" && obj.Cmd == "" {
+		return fmt.Errorf("there is nothing to wait for")
+	}
+
+	if obj.TCP != "" {
+		if _, _, err := net.SplitHostPort(obj.TCP); err != nil {
+			return errwrap.Wrapf(err, "the TCP address is invalid")
+		}
+	}
+	if obj.Socket != "" && !strings.HasPrefix(obj.Socket, "/") {
+		return fmt.Errorf("the Socket must be an absolute path")
+	}
+	if obj.File != "" && !strings.HasPrefix(obj.File, "/") {
+		return fmt.Errorf("the File must be an absolute path")
+	}
+	if obj.URL != "" {
+		u, err := url.Parse(obj.URL)
+		if err != nil {
+			return errwrap.Wrapf(err, "the URL is invalid")
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("the URL must be http or https")
+		}
+	}
+	if obj.Status < 100 || obj.Status > 599 {
+		return fmt.Errorf("the Status is invalid")
+	}
+	if obj.Cmd == "" && obj.Shell != "" {
+		return fmt.Errorf("the Shell can only be used with a Cmd")
+	}
+	if obj.Cmd != "" && obj.Shell == "" && len(strings.Fields(obj.Cmd)) == 0 {
+		return fmt.Errorf("the Cmd can't be empty")
+	}
+
+	if obj.Interval == 0 {
+		return fmt.Errorf("the Interval must be positive")
+	}
+
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *WaitRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	obj.interruptChan = make(chan struct{})
+	obj.interruptOnce = &sync.Once{}
+
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *WaitRes) Close() error {
+	return nil
+}
+
+// Watch is the primary listener for this resource and it outputs events. Only
+// the File and the Socket can be watched, the other conditions are only ever
+// checked from within CheckApply.
+func (obj *WaitRes) Watch() error {
+	var fileEvents, socketEvents chan recwatch.Event // nil channels block forever
+	if obj.File != "" {
+		recWatcher, err := recwatch.NewRecWatcher(obj.File, false)
+		if err != nil {
+			return err
+		}
+		defer recWatcher.Close()
+		fileEvents = recWatcher.Events()
+	}
+	if obj.Socket != "" {
+		recWatcher, err := recwatch.NewRecWatcher(obj.Socket, false)
+		if err != nil {
+			return err
+		}
+		defer recWatcher.Close()
+		socketEvents = recWatcher.Events()
+	}
+
+	obj.init.Running() // when started, notify engine that we're running
+
+	for {
+		var event recwatch.Event
+		var ok bool
+		select {
+		case event, ok = <-fileEvents:
+		case event, ok = <-socketEvents:
+		case <-obj.init.Done: // closed by the engine to signal shutdown
+			return nil
+		}
+		if !ok { // channel shutdown
+			return nil
+		}
+		if err := event.Error; err != nil {
+			return errwrap.Wrapf(err, "unknown %s watcher error", obj)
+		}
+		if obj.init.Debug { // don't access event.Body if event.Error isn't nil
+			obj.init.Logf("event(%s): %v", event.Body.Name, event.Body.Op)
+		}
+
+		obj.init.Event() // notify engine of an event (this can block)
+	}
+}
+
+// CheckApply checks the conditions and, if apply is true, keeps on checking
+// them every Interval until they're all met or the Timeout is reached. It
+// returns false if it had to wait, since the state of the system has changed.
+func (obj *WaitRes) CheckApply(apply bool) (bool, error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if obj.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(obj.Timeout)*time.Second)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+	interruptChan := obj.interruptChan // this goroutine can outlive us
+	go func() {
+		select {
+		case <-interruptChan:
+			cancel()
+		case <-ctx.Done():
+			// let this exit
+		}
+	}()
+
+	err := obj.check(ctx)
+	if err == nil {
+		return true, nil
+	}
+	if !apply {
+		return false, nil
+	}
+	if obj.Timeout == 0 {
+		return false, err
+	}
+	obj.init.Logf("waiting: %v", err)
+
+	ticker := time.NewTicker(time.Duration(obj.Interval) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err = obj.check(ctx); err == nil {
+				obj.init.Logf("conditions met")
+				return false, nil
+			}
+			if obj.init.Debug {
+				obj.init.Logf("still waiting: %v", err)
+			}
+
+		case <-ctx.Done():
+			select {
+			case <-obj.interruptChan:
+				return false, fmt.Errorf("interrupted")
+			default:
+			}
+			return false, errwrap.Wrapf(err, "timed out after %d seconds", obj.Timeout)
+		}
+	}
+}
+
+// check returns an error describing the first condition which is not met.
+func (obj *WaitRes) check(ctx context.Context) error {
+	if obj.File != "" {
+		if _, err := os.Stat(obj.File); err != nil {
+			return errwrap.Wrapf(err, "the file `%s` does not exist", obj.File)
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: waitProbeTimeout}
+	if obj.Socket != "" {
+		conn, err := dialer.DialContext(ctx, "unix", obj.Socket)
+		if err != nil {
+			return errwrap.Wrapf(err, "the socket `%s` is not accepting connections", obj.Socket)
+		}
+		conn.Close()
+	}
+	if obj.TCP != "" {
+		conn, err := dialer.DialContext(ctx, "tcp", obj.TCP)
+		if err != nil {
+			return errwrap.Wrapf(err, "the address `%s` is not accepting connections", obj.TCP)
+		}
+		conn.Close()
+	}
+
+	if obj.URL != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, obj.URL, nil)
+		if err != nil {
+			return err
+		}
+		client := &http.Client{
+			Timeout: waitProbeTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse // the status of a redirect counts
+			},
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return errwrap.Wrapf(err, "the url `%s` could not be reached", obj.URL)
+		}
+		resp.Body.Close()
+		if int64(resp.StatusCode) != obj.Status {
+			return fmt.Errorf("the url `%s` returned status %d instead of %d", obj.URL, resp.StatusCode, obj.Status)
+		}
+	}
+
+	if obj.Cmd != "" {
+		cmdName, cmdArgs := obj.Shell, []string{"-c", obj.Cmd}
+		if obj.Shell == "" {
+			split := strings.Fields(obj.Cmd)
+			cmdName, cmdArgs = split[0], split[1:]
+		}
+		cmd := exec.CommandContext(ctx, cmdName, cmdArgs...)
+		// ignore signals sent to parent process (we're in our own group)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Setpgid: true,
+			Pgid:    0,
+		}
+		if out, err := cmd.CombinedOutput(); err != nil {
+			if obj.init.Debug && len(out) > 0 {
+				obj.init.Logf("cmd output: %s", strings.TrimSpace(string(out)))
+			}
+			return errwrap.Wrapf(err, "the cmd `%s` failed", obj.Cmd)
+		}
+	}
+
+	return nil
+}
+
+// Interrupt is called to ask the CheckApply to stop waiting.
+func (obj *WaitRes) Interrupt() error {
+	obj.interruptOnce.Do(func() { close(obj.interruptChan) }) // idempotent
+	return nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *WaitRes) Cmp(r engine.Res) error {
+	// we can only compare WaitRes to others of the same resource kind
+	res, ok := r.(*WaitRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.TCP != res.TCP {
+		return fmt.Errorf("the TCP differs")
+	}
+	if obj.Socket != res.Socket {
+		return fmt.Errorf("the Socket differs")
+	}
+	if obj.File != res.File {
+		return fmt.Errorf("the File differs")
+	}
+	if obj.URL != res.URL {
+		return fmt.Errorf("the URL differs")
+	}
+	if obj.Status != res.Status {
+		return fmt.Errorf("the Status differs")
+	}
+	if obj.Cmd != res.Cmd {
+		return fmt.Errorf("the Cmd differs")
+	}
+	if obj.Shell != res.Shell {
+		return fmt.Errorf("the Shell differs")
+	}
+	if obj.Timeout != res.Timeout {
+		return fmt.Errorf("the Timeout differs")
+	}
+	if obj.Interval != res.Interval {
+		return fmt.Errorf("the Interval differs")
+	}
+
+	return nil
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *WaitRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes WaitRes // indirection to avoid infinite recursion
+
+	def := obj.Default()      // get the default
+	res, ok := def.(*WaitRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to WaitRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = WaitRes(raw) // restore from indirection with type conversion!
+	return nil
+}
@@ -0,0 +1,167 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root
+
+package resources
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+)
+
+func TestWaitValidate1(t *testing.T) {
+	tests := []struct {
+		res  *WaitRes
+		fail bool
+	}{
+		{&WaitRes{TCP: "localhost:5432", Status: 200, Interval: 1000}, false},
+		{&WaitRes{URL: "https://example.com/health", Status: 204, Interval: 1000}, false},
+		{&WaitRes{Cmd: "pg_isready", Shell: "/bin/sh", Status: 200, Interval: 1000}, false},
+		{&WaitRes{Status: 200, Interval: 1000}, true},                            // nothing to wait for
+		{&WaitRes{TCP: "localhost", Status: 200, Interval: 1000}, true},          // no port
+		{&WaitRes{File: "relative", Status: 200, Interval: 1000}, true},          // relative path
+		{&WaitRes{URL: "ftp://example.com/", Status: 200, Interval: 1000}, true}, // not http
+		{&WaitRes{URL: "http://example.com/", Status: 42, Interval: 1000}, true}, // bad status
+		{&WaitRes{File: "/tmp/file", Status: 200}, true},                         // no interval
+		{&WaitRes{Cmd: " \t", Status: 200, Interval: 1000}, true},                // blank cmd
+	}
+	for i, tt := range tests {
+		tt.res.SetKind("wait")
+		tt.res.SetName("wait")
+		if err := tt.res.Validate(); (err != nil) != tt.fail {
+			t.Errorf("test #%d: expected fail: %t, got: %v", i, tt.fail, err)
+		}
+	}
+}
+
+func TestWait1(t *testing.T) {
+	tmpdir := t.TempDir()
+	init := &engine.Init{
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+	}
+	// run returns the result of a checkapply, with the defaults already set
+	run := func(res *WaitRes, apply bool) (bool, error) {
+		res.SetKind("wait")
+		res.SetName("wait")
+		if err := res.Validate(); err != nil {
+			return false, err
+		}
+		if err := res.Init(init); err != nil {
+			return false, err
+		}
+		defer res.Close()
+		return res.CheckApply(apply)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("could not listen: %v", err)
+		return
+	}
+	defer listener.Close()
+	socket := path.Join(tmpdir, "socket")
+	unixListener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Errorf("could not listen: %v", err)
+		return
+	}
+	defer unixListener.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	// everything is already there
+	res := &WaitRes{
+		TCP:      listener.Addr().String(),
+		Socket:   socket,
+		URL:      server.URL,
+		Status:   http.StatusNoContent,
+		Cmd:      "true",
+		Timeout:  1,
+		Interval: 100,
+	}
+	if checkOK, err := run(res, true); err != nil || !checkOK {
+		t.Errorf("expected the conditions to be met: %t, %v", checkOK, err)
+	}
+
+	// the wrong status
+	res = &WaitRes{URL: server.URL, Status: http.StatusOK, Timeout: 1, Interval: 100}
+	if _, err := run(res, true); err == nil {
+		t.Errorf("expected the wrong status to time out")
+	}
+
+	// a failing cmd errors right away without a timeout
+	res = &WaitRes{Cmd: "exit 1", Shell: "/bin/sh", Status: http.StatusOK, Interval: 100}
+	if _, err := run(res, true); err == nil {
+		t.Errorf("expected the cmd to fail")
+	}
+	if checkOK, err := run(res, false); err != nil || checkOK {
+		t.Errorf("expected the noop check to be false: %t, %v", checkOK, err)
+	}
+
+	// a file which shows up while waiting
+	file := path.Join(tmpdir, "file")
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		ioutil.WriteFile(file, []byte("hello\n"), 0644)
+	}()
+	res = &WaitRes{File: file, Status: http.StatusOK, Timeout: 10, Interval: 100}
+	if checkOK, err := run(res, true); err != nil || checkOK {
+		t.Errorf("expected to wait for the file: %t, %v", checkOK, err)
+	}
+
+	// a closed port times out
+	addr := listener.Addr().String()
+	listener.Close()
+	res = &WaitRes{TCP: addr, Status: http.StatusOK, Timeout: 1, Interval: 100}
+	start := time.Now()
+	if _, err := run(res, true); err == nil {
+		t.Errorf("expected the closed port to time out")
+	}
+	if d := time.Since(start); d < time.Second || d > 5*time.Second {
+		t.Errorf("the timeout took %s", d)
+	}
+
+	// an interrupt stops the wait, and a second one is harmless
+	res = &WaitRes{TCP: addr, Status: http.StatusOK, Timeout: 10, Interval: 100}
+	res.SetKind("wait")
+	res.SetName("wait")
+	if err := res.Init(init); err != nil {
+		t.Errorf("init failed with: %v", err)
+		return
+	}
+	defer res.Close()
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		res.Interrupt()
+		res.Interrupt()
+	}()
+	if _, err := res.CheckApply(true); err == nil || err.Error() != "interrupted" {
+		t.Errorf("expected the wait to be interrupted: %v", err)
+	}
+}
@@ -0,0 +1,1508 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+	"github.com/purpleidea/mgmt/engine/traits"
+	engineUtil "github.com/purpleidea/mgmt/engine/util"
+	"github.com/purpleidea/mgmt/recwatch"
+	"github.com/purpleidea/mgmt/util/errwrap"
+)
+
+func init() {
+	engine.RegisterResource("x509:key", func() engine.Res { return &X509KeyRes{} })
+	engine.RegisterResource("x509:ca", func() engine.Res { return &X509CARes{} })
+	engine.RegisterResource("x509:cert", func() engine.Res { return &X509CertRes{} })
+}
+
+const (
+	// X509KeyTypeRSA is the RSA private key type.
+	X509KeyTypeRSA = "rsa"
+
+	// X509KeyTypeECDSA is the ECDSA private key type.
+	X509KeyTypeECDSA = "ecdsa"
+
+	// X509KeyTypeEd25519 is the Ed25519 private key type.
+	X509KeyTypeEd25519 = "ed25519"
+
+	// X509DefaultBits is the default size of an RSA key.
+	X509DefaultBits = 2048
+
+	// X509DefaultCurve is the default curve of an ECDSA key.
+	X509DefaultCurve = "P-256"
+
+	// X509DefaultCAValidity is the default lifetime of a CA in days.
+	X509DefaultCAValidity = 3650
+
+	// X509DefaultValidity is the default lifetime of a certificate in days.
+	X509DefaultValidity = 365
+
+	// X509DefaultRenewBefore is the default number of days before the end
+	// of the lifetime of a certificate that it gets renewed.
+	X509DefaultRenewBefore = 30
+
+	// X509UsageServer is the usage for a TLS server certificate.
+	X509UsageServer = "server"
+
+	// X509UsageClient is the usage for a TLS client certificate.
+	X509UsageClient = "client"
+
+	// x509KeyMode is the default mode of a private key file.
+	x509KeyMode = "0600"
+
+	// x509CertMode is the default mode of a certificate file.
+	x509CertMode = "0644"
+
+	// x509Backdate is how far in the past a new certificate starts being
+	// valid, so that a small clock skew doesn't make it invalid.
+	x509Backdate = 5 * time.Minute
+)
+
+var (
+	// x509Curves are the valid ECDSA curves.
+	x509Curves = map[string]elliptic.Curve{
+		"P-256": elliptic.P256(),
+		"P-384": elliptic.P384(),
+		"P-521": elliptic.P521(),
+	}
+)
+
+// X509KeyRes is a private key resource. The key is generated if the file
+// doesn't exist, and it is written in the PKCS #8 PEM format. An existing key
+// is never replaced, unless it has the wrong type and Force is set.
+type X509KeyRes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Edgeable
+	traits.Sendable
+
+	init *engine.Init
+
+	// Path is the absolute path of the key file. If it is not specified,
+	// then the resource name is used instead.
+	Path string `lang:"path" yaml:"path"`
+
+	// Type is the type of key, either "rsa", "ecdsa" or "ed25519". The
+	// default is "ecdsa".
+	Type string `lang:"type" yaml:"type"`
+
+	// Bits is the size of an RSA key. The default is 2048.
+	Bits uint64 `lang:"bits" yaml:"bits"`
+
+	// Curve is the curve of an ECDSA key, either "P-256", "P-384" or
+	// "P-521". The default is "P-256".
+	Curve string `lang:"curve" yaml:"curve"`
+
+	// Force replaces an existing key which has the wrong type or size. Any
+	// certificates for the old key will stop working.
+	Force bool `lang:"force" yaml:"force"`
+
+	// Owner is the owner of the file, as a user name or uid.
+	Owner string `lang:"owner" yaml:"owner"`
+
+	// Group is the group of the file, as a group name or gid.
+	Group string `lang:"group" yaml:"group"`
+
+	// Mode is the octal mode of the file. The default is "0600".
+	Mode string `lang:"mode" yaml:"mode"`
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *X509KeyRes) Default() engine.Res {
+	return &X509KeyRes{
+		Type:  X509KeyTypeECDSA,
+		Bits:  X509DefaultBits,
+		Curve: X509DefaultCurve,
+		Mode:  x509KeyMode,
+	}
+}
+
+// getPath returns the actual path to use. When Path is not specified, we use
+// the Name.
+func (obj *X509KeyRes) getPath() string {
+	if obj.Path != "" {
+		return obj.Path
+	}
+	return obj.Name()
+}
+
+// Validate if the params passed in are valid data.
+func (obj *X509KeyRes) Validate() error {
+	if !filepath.IsAbs(obj.getPath()) {
+		return fmt.Errorf("the Path must be absolute")
+	}
+	switch obj.Type {
+	case X509KeyTypeRSA:
+		if obj.Bits < 2048 {
+			return fmt.Errorf("an rsa key must have at least 2048 bits")
+		}
+	case X509KeyTypeECDSA:
+		if _, exists := x509Curves[obj.Curve]; !exists {
+			return fmt.Errorf("invalid Curve: %s", obj.Curve)
+		}
+	case X509KeyTypeEd25519:
+	default:
+		return fmt.Errorf("invalid Type: %s", obj.Type)
+	}
+	return x509ValidateFile(obj.Owner, obj.Group, obj.Mode)
+}
+
+// Init runs some startup code for this resource.
+func (obj *X509KeyRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *X509KeyRes) Close() error {
+	return nil
+}
+
+// Watch is the primary listener for this resource and it outputs events.
+func (obj *X509KeyRes) Watch() error {
+	return x509Watch(obj.init, []string{obj.getPath()}, nil)
+}
+
+// matches returns nil if the key has the type and size that we expect.
+func (obj *X509KeyRes) matches(key crypto.Signer) error {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if obj.Type != X509KeyTypeRSA {
+			return fmt.Errorf("the key is rsa")
+		}
+		if uint64(k.N.BitLen()) != obj.Bits {
+			return fmt.Errorf("the key has %d bits", k.N.BitLen())
+		}
+	case *ecdsa.PrivateKey:
+		if obj.Type != X509KeyTypeECDSA {
+			return fmt.Errorf("the key is ecdsa")
+		}
+		if k.Curve.Params().Name != obj.Curve {
+			return fmt.Errorf("the key uses the %s curve", k.Curve.Params().Name)
+		}
+	case ed25519.PrivateKey:
+		if obj.Type != X509KeyTypeEd25519 {
+			return fmt.Errorf("the key is ed25519")
+		}
+	default:
+		return fmt.Errorf("the key has an unknown type")
+	}
+	return nil
+}
+
+// generate builds a new private key.
+func (obj *X509KeyRes) generate() (crypto.Signer, error) {
+	switch obj.Type {
+	case X509KeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, int(obj.Bits))
+	case X509KeyTypeECDSA:
+		return ecdsa.GenerateKey(x509Curves[obj.Curve], rand.Reader)
+	case X509KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("invalid Type: %s", obj.Type) // programming error
+}
+
+// CheckApply method for the x509:key resource.
+func (obj *X509KeyRes) CheckApply(apply bool) (bool, error) {
+	checkOK := true
+	p := obj.getPath()
+
+	key, err := x509ReadKey(p)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errwrap.Wrapf(err, "could not read the key")
+	}
+	if key != nil {
+		if err := obj.matches(key); err != nil && !obj.Force {
+			return false, errwrap.Wrapf(err, "the existing key has the wrong type")
+		} else if err != nil {
+			obj.init.Logf("replacing key: %v", err)
+			key = nil
+		}
+	}
+
+	if key == nil {
+		if !apply {
+			return false, nil
+		}
+		checkOK = false
+		obj.init.Logf("generating %s key", obj.Type)
+		if key, err = obj.generate(); err != nil {
+			return false, errwrap.Wrapf(err, "could not generate the key")
+		}
+		b, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "could not marshal the key")
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b})
+		if err := x509WriteFile(p, data); err != nil {
+			return false, err
+		}
+	}
+
+	if c, err := x509FileCheckApply(obj.init, apply, p, obj.Owner, obj.Group, obj.Mode); err != nil {
+		return false, err
+	} else if !c {
+		checkOK = false
+	}
+
+	b, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return false, errwrap.Wrapf(err, "could not marshal the public key")
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return false, err
+	}
+	priv := string(data)
+	public := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}))
+	if err := obj.init.Send(&X509KeySends{
+		Key:    &priv,
+		Public: &public,
+	}); err != nil {
+		return false, err
+	}
+
+	return checkOK, nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *X509KeyRes) Cmp(r engine.Res) error {
+	// we can only compare X509KeyRes to others of the same resource kind
+	res, ok := r.(*X509KeyRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.getPath() != res.getPath() {
+		return fmt.Errorf("the Path differs")
+	}
+	if obj.Type != res.Type {
+		return fmt.Errorf("the Type differs")
+	}
+	if obj.Bits != res.Bits {
+		return fmt.Errorf("the Bits differ")
+	}
+	if obj.Curve != res.Curve {
+		return fmt.Errorf("the Curve differs")
+	}
+	if obj.Force != res.Force {
+		return fmt.Errorf("the Force differs")
+	}
+	if obj.Owner != res.Owner {
+		return fmt.Errorf("the Owner differs")
+	}
+	if obj.Group != res.Group {
+		return fmt.Errorf("the Group differs")
+	}
+	if obj.Mode != res.Mode {
+		return fmt.Errorf("the Mode differs")
+	}
+
+	return nil
+}
+
+// X509KeySends is the struct of data which is sent after a successful Apply.
+type X509KeySends struct {
+	// Key is the private key in the PEM format.
+	Key *string `lang:"key"`
+
+	// Public is the public key in the PEM format.
+	Public *string `lang:"public"`
+}
+
+// Sends represents the default struct of values we can send using Send/Recv.
+func (obj *X509KeyRes) Sends() interface{} {
+	return &X509KeySends{
+		Key:    nil,
+		Public: nil,
+	}
+}
+
+// UIDs includes all params to make a unique identification of this object.
+// Most resources only return one, although some resources can return multiple.
+func (obj *X509KeyRes) UIDs() []engine.ResUID {
+	x := &X509UID{
+		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
+		path:    obj.getPath(),
+	}
+	return []engine.ResUID{x}
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *X509KeyRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes X509KeyRes // indirection to avoid infinite recursion
+
+	def := obj.Default()         // get the default
+	res, ok := def.(*X509KeyRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to X509KeyRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = X509KeyRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// X509CARes is a self-signed certificate authority resource. The certificate
+// is signed with the private key from the Key file, which is usually managed by
+// an x509:key resource. It gets renewed when it is close to its expiry, or if it
+// doesn't match the key or the subject any more. A renewed CA keeps the same
+// key, so the certificates that it signed are still valid.
+type X509CARes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Edgeable
+	traits.Sendable
+
+	init *engine.Init
+
+	// Path is the absolute path of the certificate file. If it is not
+	// specified, then the resource name is used instead.
+	Path string `lang:"path" yaml:"path"`
+
+	// Key is the absolute path of the private key file of the CA.
+	Key string `lang:"key" yaml:"key"`
+
+	// CommonName is the common name of the CA.
+	CommonName string `lang:"common_name" yaml:"common_name"`
+
+	// Organization is the organization of the CA.
+	Organization string `lang:"organization" yaml:"organization"`
+
+	// Validity is the lifetime of the certificate in days. The default is
+	// 3650.
+	Validity uint64 `lang:"validity" yaml:"validity"`
+
+	// RenewBefore is the number of days before the end of the lifetime of
+	// the certificate that it gets renewed. The default is 30.
+	RenewBefore uint64 `lang:"renew_before" yaml:"renew_before"`
+
+	// Owner is the owner of the file, as a user name or uid.
+	Owner string `lang:"owner" yaml:"owner"`
+
+	// Group is the group of the file, as a group name or gid.
+	Group string `lang:"group" yaml:"group"`
+
+	// Mode is the octal mode of the file. The default is "0644".
+	Mode string `lang:"mode" yaml:"mode"`
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *X509CARes) Default() engine.Res {
+	return &X509CARes{
+		Validity:    X509DefaultCAValidity,
+		RenewBefore: X509DefaultRenewBefore,
+		Mode:        x509CertMode,
+	}
+}
+
+// getPath returns the actual path to use. When Path is not specified, we use
+// the Name.
+func (obj *X509CARes) getPath() string {
+	if obj.Path != "" {
+		return obj.Path
+	}
+	return obj.Name()
+}
+
+// Validate if the params passed in are valid data.
+func (obj *X509CARes) Validate() error {
+	if !filepath.IsAbs(obj.getPath()) {
+		return fmt.Errorf("the Path must be absolute")
+	}
+	if !filepath.IsAbs(obj.Key) {
+		return fmt.Errorf("the Key must be an absolute path")
+	}
+	if obj.CommonName == "" {
+		return fmt.Errorf("the CommonName must not be empty")
+	}
+	if err := x509ValidateValidity(obj.Validity, obj.RenewBefore); err != nil {
+		return err
+	}
+	return x509ValidateFile(obj.Owner, obj.Group, obj.Mode)
+}
+
+// Init runs some startup code for this resource.
+func (obj *X509CARes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *X509CARes) Close() error {
+	return nil
+}
+
+// Watch is the primary listener for this resource and it outputs events. It
+// also sends an event when the certificate needs to be renewed.
+func (obj *X509CARes) Watch() error {
+	return x509Watch(obj.init, []string{obj.getPath(), obj.Key}, func() time.Time {
+		return x509RenewTime(obj.getPath(), obj.RenewBefore)
+	})
+}
+
+// subject returns the subject of the CA.
+func (obj *X509CARes) subject() pkix.Name {
+	return x509Subject(obj.CommonName, obj.Organization)
+}
+
+// check returns nil if the certificate is what we expect.
+func (obj *X509CARes) check(cert *x509.Certificate, key crypto.Signer) error {
+	if !cert.IsCA {
+		return fmt.Errorf("the certificate is not a CA")
+	}
+	if err := x509KeyMatches(cert.PublicKey, key); err != nil {
+		return err
+	}
+	if err := x509SubjectMatches(cert.Subject, obj.subject()); err != nil {
+		return err
+	}
+	if err := cert.CheckSignatureFrom(cert); err != nil {
+		return errwrap.Wrapf(err, "the certificate is not self-signed")
+	}
+	return x509CheckRenew(cert, obj.RenewBefore)
+}
+
+// CheckApply method for the x509:ca resource.
+func (obj *X509CARes) CheckApply(apply bool) (bool, error) {
+	checkOK := true
+	p := obj.getPath()
+
+	key, err := x509ReadKey(obj.Key)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "could not read the key")
+	}
+
+	cert, err := x509ReadCert(p)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errwrap.Wrapf(err, "could not read the certificate")
+	}
+	if cert != nil {
+		if err := obj.check(cert, key); err != nil {
+			obj.init.Logf("the certificate needs to be replaced: %v", err)
+			cert = nil
+		}
+	}
+
+	if cert == nil {
+		if !apply {
+			return false, nil
+		}
+		checkOK = false
+		serial, err := x509Serial()
+		if err != nil {
+			return false, err
+		}
+		now := time.Now()
+		template := &x509.Certificate{
+			SerialNumber:          serial,
+			Subject:               obj.subject(),
+			NotBefore:             now.Add(-x509Backdate),
+			NotAfter:              now.Add(x509Days(obj.Validity)),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		obj.init.Logf("signing CA certificate")
+		der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "could not sign the certificate")
+		}
+		if err := x509WriteFile(p, x509CertPEM(der)); err != nil {
+			return false, err
+		}
+	}
+
+	if c, err := x509FileCheckApply(obj.init, apply, p, obj.Owner, obj.Group, obj.Mode); err != nil {
+		return false, err
+	} else if !c {
+		checkOK = false
+	}
+
+	if err := x509SendCert(obj.init, p); err != nil {
+		return false, err
+	}
+
+	return checkOK, nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *X509CARes) Cmp(r engine.Res) error {
+	// we can only compare X509CARes to others of the same resource kind
+	res, ok := r.(*X509CARes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.getPath() != res.getPath() {
+		return fmt.Errorf("the Path differs")
+	}
+	if obj.Key != res.Key {
+		return fmt.Errorf("the Key differs")
+	}
+	if obj.CommonName != res.CommonName {
+		return fmt.Errorf("the CommonName differs")
+	}
+	if obj.Organization != res.Organization {
+		return fmt.Errorf("the Organization differs")
+	}
+	if obj.Validity != res.Validity {
+		return fmt.Errorf("the Validity differs")
+	}
+	if obj.RenewBefore != res.RenewBefore {
+		return fmt.Errorf("the RenewBefore differs")
+	}
+	if obj.Owner != res.Owner {
+		return fmt.Errorf("the Owner differs")
+	}
+	if obj.Group != res.Group {
+		return fmt.Errorf("the Group differs")
+	}
+	if obj.Mode != res.Mode {
+		return fmt.Errorf("the Mode differs")
+	}
+
+	return nil
+}
+
+// Sends represents the default struct of values we can send using Send/Recv.
+func (obj *X509CARes) Sends() interface{} {
+	return &X509CertSends{
+		Cert: nil,
+	}
+}
+
+// AutoEdges returns the AutoEdge interface. In this case, the key.
+func (obj *X509CARes) AutoEdges() (engine.AutoEdge, error) {
+	return x509AutoEdges(obj.Name(), obj.Kind(), obj.Key), nil
+}
+
+// UIDs includes all params to make a unique identification of this object.
+// Most resources only return one, although some resources can return multiple.
+func (obj *X509CARes) UIDs() []engine.ResUID {
+	x := &X509UID{
+		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
+		path:    obj.getPath(),
+	}
+	return []engine.ResUID{x}
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *X509CARes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes X509CARes // indirection to avoid infinite recursion
+
+	def := obj.Default()        // get the default
+	res, ok := def.(*X509CARes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to X509CARes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = X509CARes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// X509CertRes is a certificate resource which is signed by a CA. The CA can be
+// managed elsewhere in the graph by an x509:ca resource. The certificate is for
+// the public key of the Key file, or of the certificate signing request in the
+// CSR file. It gets renewed when it is close to its expiry, or if it doesn't
+// match the key, the subject or the CA any more.
+type X509CertRes struct {
+	traits.Base // add the base methods without re-implementation
+	traits.Edgeable
+	traits.Sendable
+
+	init *engine.Init
+
+	// Path is the absolute path of the certificate file. If it is not
+	// specified, then the resource name is used instead.
+	Path string `lang:"path" yaml:"path"`
+
+	// Key is the absolute path of the private key file for which this
+	// certificate is issued. It must not be combined with CSR.
+	Key string `lang:"key" yaml:"key"`
+
+	// CSR is the absolute path of a PEM certificate signing request to
+	// sign. The public key and the subject are taken from it, but the
+	// names are still only the ones specified here. It must not be
+	// combined with Key.
+	CSR string `lang:"csr" yaml:"csr"`
+
+	// CA is the absolute path of the CA certificate file.
+	CA string `lang:"ca" yaml:"ca"`
+
+	// CAKey is the absolute path of the CA private key file.
+	CAKey string `lang:"ca_key" yaml:"ca_key"`
+
+	// CommonName is the common name of the certificate.
+	CommonName string `lang:"common_name" yaml:"common_name"`
+
+	// Organization is the organization of the certificate.
+	Organization string `lang:"organization" yaml:"organization"`
+
+	// DNSNames is the list of DNS names that the certificate is valid for.
+	DNSNames []string `lang:"dns_names" yaml:"dns_names"`
+
+	// IPAddresses is the list of IP addresses that the certificate is
+	// valid for.
+	IPAddresses []string `lang:"ip_addresses" yaml:"ip_addresses"`
+
+	// Usage is the list of extended key usages, either "server" or
+	// "client". The default is "server".
+	Usage []string `lang:"usage" yaml:"usage"`
+
+	// Validity is the lifetime of the certificate in days. The default is
+	// 365. It is capped so that the certificate doesn't outlive the CA.
+	Validity uint64 `lang:"validity" yaml:"validity"`
+
+	// RenewBefore is the number of days before the end of the lifetime of
+	// the certificate that it gets renewed. The default is 30.
+	RenewBefore uint64 `lang:"renew_before" yaml:"renew_before"`
+
+	// Owner is the owner of the file, as a user name or uid.
+	Owner string `lang:"owner" yaml:"owner"`
+
+	// Group is the group of the file, as a group name or gid.
+	Group string `lang:"group" yaml:"group"`
+
+	// Mode is the octal mode of the file. The default is "0644".
+	Mode string `lang:"mode" yaml:"mode"`
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *X509CertRes) Default() engine.Res {
+	return &X509CertRes{
+		Usage:       []string{X509UsageServer},
+		Validity:    X509DefaultValidity,
+		RenewBefore: X509DefaultRenewBefore,
+		Mode:        x509CertMode,
+	}
+}
+
+// getPath returns the actual path to use. When Path is not specified, we use
+// the Name.
+func (obj *X509CertRes) getPath() string {
+	if obj.Path != "" {
+		return obj.Path
+	}
+	return obj.Name()
+}
+
+// Validate if the params passed in are valid data.
+func (obj *X509CertRes) Validate() error {
+	if !filepath.IsAbs(obj.getPath()) {
+		return fmt.Errorf("the Path must be absolute")
+	}
+	if (obj.Key == "") == (obj.CSR == "") {
+		return fmt.Errorf("exactly one of Key or CSR must be specified")
+	}
+	for name, p := range map[string]string{"Key": obj.Key, "CSR": obj.CSR} {
+		if p != "" && !filepath.IsAbs(p) {
+			return fmt.Errorf("the %s must be an absolute path", name)
+		}
+	}
+	if !filepath.IsAbs(obj.CA) {
+		return fmt.Errorf("the CA must be an absolute path")
+	}
+	if !filepath.IsAbs(obj.CAKey) {
+		return fmt.Errorf("the CAKey must be an absolute path")
+	}
+	if obj.CommonName == "" && obj.CSR == "" {
+		return fmt.Errorf("the CommonName must not be empty")
+	}
+	if _, err := x509ParseIPs(obj.IPAddresses); err != nil {
+		return err
+	}
+	if _, err := x509ExtKeyUsage(obj.Usage); err != nil {
+		return err
+	}
+	if err := x509ValidateValidity(obj.Validity, obj.RenewBefore); err != nil {
+		return err
+	}
+	return x509ValidateFile(obj.Owner, obj.Group, obj.Mode)
+}
+
+// Init runs some startup code for this resource.
+func (obj *X509CertRes) Init(init *engine.Init) error {
+	obj.init = init // save for later
+
+	return nil
+}
+
+// Close is run by the engine to clean up after the resource is done.
+func (obj *X509CertRes) Close() error {
+	return nil
+}
+
+// Watch is the primary listener for this resource and it outputs events. It
+// also sends an event when the certificate needs to be renewed.
+func (obj *X509CertRes) Watch() error {
+	paths := []string{obj.getPath(), obj.CA, obj.CAKey}
+	if obj.Key != "" {
+		paths = append(paths, obj.Key)
+	}
+	if obj.CSR != "" {
+		paths = append(paths, obj.CSR)
+	}
+	return x509Watch(obj.init, paths, func() time.Time {
+		return x509RenewTime(obj.getPath(), obj.RenewBefore)
+	})
+}
+
+// public returns the public key and the subject that the certificate is for.
+func (obj *X509CertRes) public() (crypto.PublicKey, pkix.Name, error) {
+	subject := x509Subject(obj.CommonName, obj.Organization)
+	if obj.Key != "" {
+		key, err := x509ReadKey(obj.Key)
+		if err != nil {
+			return nil, subject, errwrap.Wrapf(err, "could not read the key")
+		}
+		return key.Public(), subject, nil
+	}
+
+	data, err := ioutil.ReadFile(obj.CSR)
+	if err != nil {
+		return nil, subject, errwrap.Wrapf(err, "could not read the csr")
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, subject, fmt.Errorf("the csr is not a PEM certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, subject, errwrap.Wrapf(err, "could not parse the csr")
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, subject, errwrap.Wrapf(err, "the csr has an invalid signature")
+	}
+	if obj.CommonName == "" && obj.Organization == "" {
+		subject = csr.Subject
+	}
+	return csr.PublicKey, subject, nil
+}
+
+// check returns nil if the certificate is what we expect.
+func (obj *X509CertRes) check(cert, ca *x509.Certificate, pub crypto.PublicKey, subject pkix.Name) error {
+	if err := cert.CheckSignatureFrom(ca); err != nil {
+		return errwrap.Wrapf(err, "the certificate is not signed by the CA")
+	}
+	if err := x509PublicMatches(cert.PublicKey, pub); err != nil {
+		return err
+	}
+	if err := x509SubjectMatches(cert.Subject, subject); err != nil {
+		return err
+	}
+	if !x509StringsEqual(cert.DNSNames, obj.DNSNames) {
+		return fmt.Errorf("the dns names differ")
+	}
+	ips, err := x509ParseIPs(obj.IPAddresses)
+	if err != nil {
+		return err
+	}
+	if len(cert.IPAddresses) != len(ips) {
+		return fmt.Errorf("the ip addresses differ")
+	}
+	for i, ip := range ips {
+		if !cert.IPAddresses[i].Equal(ip) {
+			return fmt.Errorf("the ip addresses differ")
+		}
+	}
+	usage, err := x509ExtKeyUsage(obj.Usage)
+	if err != nil {
+		return err
+	}
+	if len(cert.ExtKeyUsage) != len(usage) {
+		return fmt.Errorf("the usage differs")
+	}
+	for i, x := range usage {
+		if cert.ExtKeyUsage[i] != x {
+			return fmt.Errorf("the usage differs")
+		}
+	}
+	return x509CheckRenew(cert, obj.RenewBefore)
+}
+
+// CheckApply method for the x509:cert resource.
+func (obj *X509CertRes) CheckApply(apply bool) (bool, error) {
+	checkOK := true
+	p := obj.getPath()
+
+	ca, err := x509ReadCert(obj.CA)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "could not read the CA")
+	}
+	caKey, err := x509ReadKey(obj.CAKey)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "could not read the CA key")
+	}
+	if err := x509KeyMatches(ca.PublicKey, caKey); err != nil {
+		return false, errwrap.Wrapf(err, "the CA key doesn't match the CA")
+	}
+	pub, subject, err := obj.public()
+	if err != nil {
+		return false, err
+	}
+
+	cert, err := x509ReadCert(p)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errwrap.Wrapf(err, "could not read the certificate")
+	}
+	if cert != nil {
+		if err := obj.check(cert, ca, pub, subject); err != nil {
+			obj.init.Logf("the certificate needs to be replaced: %v", err)
+			cert = nil
+		}
+	}
+
+	if cert == nil {
+		if !apply {
+			return false, nil
+		}
+		checkOK = false
+		serial, err := x509Serial()
+		if err != nil {
+			return false, err
+		}
+		ips, err := x509ParseIPs(obj.IPAddresses)
+		if err != nil {
+			return false, err
+		}
+		usage, err := x509ExtKeyUsage(obj.Usage)
+		if err != nil {
+			return false, err
+		}
+		now := time.Now()
+		notAfter := now.Add(x509Days(obj.Validity))
+		if notAfter.After(ca.NotAfter) {
+			notAfter = ca.NotAfter // don't outlive the CA
+		}
+		template := &x509.Certificate{
+			SerialNumber:          serial,
+			Subject:               subject,
+			NotBefore:             now.Add(-x509Backdate),
+			NotAfter:              notAfter,
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			ExtKeyUsage:           usage,
+			BasicConstraintsValid: true,
+			DNSNames:              obj.DNSNames,
+			IPAddresses:           ips,
+		}
+		obj.init.Logf("signing certificate")
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, pub, caKey)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "could not sign the certificate")
+		}
+		if err := x509WriteFile(p, x509CertPEM(der)); err != nil {
+			return false, err
+		}
+	}
+
+	if c, err := x509FileCheckApply(obj.init, apply, p, obj.Owner, obj.Group, obj.Mode); err != nil {
+		return false, err
+	} else if !c {
+		checkOK = false
+	}
+
+	if err := x509SendCert(obj.init, p); err != nil {
+		return false, err
+	}
+
+	return checkOK, nil
+}
+
+// Cmp compares two resources and returns an error if they are not equivalent.
+func (obj *X509CertRes) Cmp(r engine.Res) error {
+	// we can only compare X509CertRes to others of the same resource kind
+	res, ok := r.(*X509CertRes)
+	if !ok {
+		return fmt.Errorf("not a %s", obj.Kind())
+	}
+
+	if obj.getPath() != res.getPath() {
+		return fmt.Errorf("the Path differs")
+	}
+	if obj.Key != res.Key {
+		return fmt.Errorf("the Key differs")
+	}
+	if obj.CSR != res.CSR {
+		return fmt.Errorf("the CSR differs")
+	}
+	if obj.CA != res.CA {
+		return fmt.Errorf("the CA differs")
+	}
+	if obj.CAKey != res.CAKey {
+		return fmt.Errorf("the CAKey differs")
+	}
+	if obj.CommonName != res.CommonName {
+		return fmt.Errorf("the CommonName differs")
+	}
+	if obj.Organization != res.Organization {
+		return fmt.Errorf("the Organization differs")
+	}
+	if !x509StringsEqual(obj.DNSNames, res.DNSNames) {
+		return fmt.Errorf("the DNSNames differ")
+	}
+	if !x509StringsEqual(obj.IPAddresses, res.IPAddresses) {
+		return fmt.Errorf("the IPAddresses differ")
+	}
+	if !x509StringsEqual(obj.Usage, res.Usage) {
+		return fmt.Errorf("the Usage differs")
+	}
+	if obj.Validity != res.Validity {
+		return fmt.Errorf("the Validity differs")
+	}
+	if obj.RenewBefore != res.RenewBefore {
+		return fmt.Errorf("the RenewBefore differs")
+	}
+	if obj.Owner != res.Owner {
+		return fmt.Errorf("the Owner differs")
+	}
+	if obj.Group != res.Group {
+		return fmt.Errorf("the Group differs")
+	}
+	if obj.Mode != res.Mode {
+		return fmt.Errorf("the Mode differs")
+	}
+
+	return nil
+}
+
+// X509CertSends is the struct of data which is sent after a successful Apply.
+type X509CertSends struct {
+	// Cert is the certificate in the PEM format.
+	Cert *string `lang:"cert"`
+}
+
+// Sends represents the default struct of values we can send using Send/Recv.
+func (obj *X509CertRes) Sends() interface{} {
+	return &X509CertSends{
+		Cert: nil,
+	}
+}
+
+// AutoEdges returns the AutoEdge interface. In this case, the key or the csr,
+// and the CA and its key.
+func (obj *X509CertRes) AutoEdges() (engine.AutoEdge, error) {
+	paths := []string{obj.CA, obj.CAKey}
+	if obj.Key != "" {
+		paths = append(paths, obj.Key)
+	}
+	if obj.CSR != "" {
+		paths = append(paths, obj.CSR)
+	}
+	return x509AutoEdges(obj.Name(), obj.Kind(), paths...), nil
+}
+
+// UIDs includes all params to make a unique identification of this object.
+// Most resources only return one, although some resources can return multiple.
+func (obj *X509CertRes) UIDs() []engine.ResUID {
+	x := &X509UID{
+		BaseUID: engine.BaseUID{Name: obj.Name(), Kind: obj.Kind()},
+		path:    obj.getPath(),
+	}
+	return []engine.ResUID{x}
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct. It is
+// primarily useful for setting the defaults.
+func (obj *X509CertRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes X509CertRes // indirection to avoid infinite recursion
+
+	def := obj.Default()          // get the default
+	res, ok := def.(*X509CertRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to X509CertRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = X509CertRes(raw) // restore from indirection with type conversion!
+	return nil
+}
+
+// X509UID is the UID struct for the x509 resources. They are all identified by
+// the path of the file that they manage.
+type X509UID struct {
+	engine.BaseUID
+
+	path string
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *X509UID) IFF(uid engine.ResUID) bool {
+	res, ok := uid.(*X509UID)
+	if !ok {
+		return false
+	}
+	return obj.path == res.path
+}
+
+// X509ResAutoEdges holds the state of the auto edge generator.
+type X509ResAutoEdges struct {
+	UIDs    []engine.ResUID
+	pointer int
+}
+
+// Next returns the next automatic edge.
+func (obj *X509ResAutoEdges) Next() []engine.ResUID {
+	if len(obj.UIDs) == 0 {
+		return nil
+	}
+	value := obj.UIDs[obj.pointer]
+	obj.pointer++
+	return []engine.ResUID{value}
+}
+
+// Test gets results of the earlier Next() call, & returns if we should
+// continue!
+func (obj *X509ResAutoEdges) Test(input []bool) bool {
+	if len(obj.UIDs) <= obj.pointer {
+		return false
+	}
+	if len(input) != 1 { // in case we get given bad data
+		panic(fmt.Sprintf("Expecting a single value!"))
+	}
+	return true // keep going
+}
+
+// x509AutoEdges returns the edges from the resources which manage these files.
+func x509AutoEdges(name, kind string, paths ...string) *X509ResAutoEdges {
+	uids := []engine.ResUID{}
+	for _, p := range paths {
+		reversed := true
+		uids = append(uids, &X509UID{
+			BaseUID: engine.BaseUID{
+				Name:     name,
+				Kind:     kind,
+				Reversed: &reversed,
+			},
+			path: p,
+		})
+	}
+	return &X509ResAutoEdges{
+		UIDs:    uids,
+		pointer: 0,
+	}
+}
+
+// x509Watch watches the files, and sends an event when any of them change. If
+// renew is not nil, then an event is also sent at the time that it returns. It
+// is checked again after every event, since the files might have changed.
+func x509Watch(init *engine.Init, paths []string, renew func() time.Time) error {
+	events := make(chan recwatch.Event)
+	closeChan := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for _, p := range paths {
+		recWatcher, err := recwatch.NewRecWatcher(p, false)
+		if err != nil {
+			close(closeChan)
+			wg.Wait()
+			return err
+		}
+		defer recWatcher.Close()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case event, ok := <-recWatcher.Events():
+					if !ok {
+						return
+					}
+					select {
+					case events <- event:
+					case <-closeChan:
+						return
+					}
+				case <-closeChan:
+					return
+				}
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(closeChan)
+
+	var timer *time.Timer
+	reset := func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		timer = nil
+		if renew == nil {
+			return
+		}
+		if t := renew(); !t.IsZero() && t.After(time.Now()) {
+			timer = time.NewTimer(time.Until(t))
+		}
+	}
+	timerChan := func() <-chan time.Time {
+		if timer == nil {
+			return nil
+		}
+		return timer.C
+	}
+	reset()
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	init.Running() // when started, notify engine that we're running
+
+	var send = false // send event?
+	for {
+		select {
+		case event := <-events:
+			if err := event.Error; err != nil {
+				return errwrap.Wrapf(err, "unknown watcher error")
+			}
+			if init.Debug {
+				init.Logf("Event(%s): %v", event.Body.Name, event.Body.Op)
+			}
+			reset()
+			send = true
+
+		case <-timerChan():
+			init.Logf("the certificate needs to be renewed")
+			timer = nil
+			send = true
+
+		case <-init.Done: // closed by the engine to signal shutdown
+			return nil
+		}
+
+		// do all our event sending all together to avoid duplicate msgs
+		if send {
+			send = false
+			init.Event() // notify engine of an event (this can block)
+		}
+	}
+}
+
+// x509ValidateFile checks the file ownership and mode params.
+func x509ValidateFile(owner, group, mode string) error {
+	if _, err := strconv.ParseUint(mode, 8, 32); err != nil {
+		return errwrap.Wrapf(err, "the Mode is not a valid octal number")
+	}
+	if owner != "" {
+		if _, err := engineUtil.GetUID(owner); err != nil {
+			return err
+		}
+	}
+	if group != "" {
+		if _, err := engineUtil.GetGID(group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// x509ValidateValidity checks the validity and the renewal params.
+func x509ValidateValidity(validity, renewBefore uint64) error {
+	if validity == 0 {
+		return fmt.Errorf("the Validity must be positive")
+	}
+	if renewBefore >= validity {
+		return fmt.Errorf("the RenewBefore must be shorter than the Validity")
+	}
+	return nil
+}
+
+// x509FileCheckApply sets the ownership and the mode of the file.
+func x509FileCheckApply(init *engine.Init, apply bool, p, owner, group, mode string) (bool, error) {
+	fileInfo, err := os.Stat(p)
+	if err != nil {
+		return false, err
+	}
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, fmt.Errorf("can't get the file owner")
+	}
+	uid, gid := int(stat.Uid), int(stat.Gid)
+	if owner != "" {
+		if uid, err = engineUtil.GetUID(owner); err != nil {
+			return false, err
+		}
+	}
+	if group != "" {
+		if gid, err = engineUtil.GetGID(group); err != nil {
+			return false, err
+		}
+	}
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return false, err
+	}
+	perm := os.FileMode(m)
+
+	if uid == int(stat.Uid) && gid == int(stat.Gid) && fileInfo.Mode().Perm() == perm {
+		return true, nil
+	}
+	if !apply {
+		return false, nil
+	}
+	if uid != int(stat.Uid) || gid != int(stat.Gid) {
+		init.Logf("chown %d:%d", uid, gid)
+		if err := os.Chown(p, uid, gid); err != nil {
+			return false, err
+		}
+	}
+	if fileInfo.Mode().Perm() != perm {
+		init.Logf("chmod %s", mode)
+		if err := os.Chmod(p, perm); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// x509WriteFile writes the file atomically. It starts out private, since it
+// might be a key, and the permissions get fixed up afterwards.
+func x509WriteFile(p string, data []byte) error {
+	dir, base := filepath.Split(p)
+	tmp := filepath.Join(dir, "."+base+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errwrap.Wrapf(err, "could not write the file")
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp) // cleanup
+		return errwrap.Wrapf(err, "could not rename the file")
+	}
+	return nil
+}
+
+// x509ReadKey reads a PEM private key in any of the common formats.
+func x509ReadKey(p string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("the file is not in the PEM format")
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unknown PEM type: %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("the key can't sign")
+	}
+	return signer, nil
+}
+
+// x509ReadCert reads the first certificate in a PEM file.
+func x509ReadCert(p string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("the file is not a PEM certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// x509CertPEM encodes a certificate in the PEM format.
+func x509CertPEM(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// x509SendCert sends the contents of the certificate file.
+func x509SendCert(init *engine.Init, p string) error {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	cert := string(data)
+	return init.Send(&X509CertSends{
+		Cert: &cert,
+	})
+}
+
+// x509Serial returns a random serial number.
+func x509Serial() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serial, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "could not generate a serial number")
+	}
+	return serial, nil
+}
+
+// x509Days returns the duration of a number of days.
+func x509Days(days uint64) time.Duration {
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// x509RenewTime returns the time when the certificate in the file should be
+// renewed. It returns the zero time if the certificate can't be read.
+func x509RenewTime(p string, renewBefore uint64) time.Time {
+	cert, err := x509ReadCert(p)
+	if err != nil {
+		return time.Time{}
+	}
+	return cert.NotAfter.Add(-x509Days(renewBefore))
+}
+
+// x509CheckRenew returns an error if the certificate is due for renewal.
+func x509CheckRenew(cert *x509.Certificate, renewBefore uint64) error {
+	if time.Now().After(cert.NotAfter.Add(-x509Days(renewBefore))) {
+		return fmt.Errorf("the certificate expires at %s", cert.NotAfter)
+	}
+	return nil
+}
+
+// x509Subject builds a subject name.
+func x509Subject(commonName, organization string) pkix.Name {
+	subject := pkix.Name{
+		CommonName: commonName,
+	}
+	if organization != "" {
+		subject.Organization = []string{organization}
+	}
+	return subject
+}
+
+// x509SubjectMatches returns nil if the two subjects are the same.
+func x509SubjectMatches(a, b pkix.Name) error {
+	if a.CommonName != b.CommonName {
+		return fmt.Errorf("the common name differs")
+	}
+	if !x509StringsEqual(a.Organization, b.Organization) {
+		return fmt.Errorf("the organization differs")
+	}
+	return nil
+}
+
+// x509KeyMatches returns nil if the public key belongs to the private key.
+func x509KeyMatches(pub crypto.PublicKey, key crypto.Signer) error {
+	return x509PublicMatches(pub, key.Public())
+}
+
+// x509PublicMatches returns nil if the two public keys are the same.
+func x509PublicMatches(a, b crypto.PublicKey) error {
+	x, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return err
+	}
+	y, err := x509.MarshalPKIXPublicKey(b)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(x, y) {
+		return fmt.Errorf("the public key differs")
+	}
+	return nil
+}
+
+// x509ParseIPs parses the list of IP addresses.
+func x509ParseIPs(addrs []string) ([]net.IP, error) {
+	ips := []net.IP{}
+	for _, x := range addrs {
+		ip := net.ParseIP(x)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %s", x)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// x509ExtKeyUsage parses the list of usages.
+func x509ExtKeyUsage(usage []string) ([]x509.ExtKeyUsage, error) {
+	result := []x509.ExtKeyUsage{}
+	for _, x := range usage {
+		switch x {
+		case X509UsageServer:
+			result = append(result, x509.ExtKeyUsageServerAuth)
+		case X509UsageClient:
+			result = append(result, x509.ExtKeyUsageClientAuth)
+		default:
+			return nil, fmt.Errorf("invalid Usage: %s", x)
+		}
+	}
+	return result, nil
+}
+
+// x509StringsEqual returns true if the two lists are the same. A nil list is
+// the same as an empty list.
+func x509StringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, x := range a {
+		if x != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,299 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root
+
+package resources
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/purpleidea/mgmt/engine"
+)
+
+// x509Apply runs CheckApply twice, and expects the second run to be a noop.
+func x509Apply(t *testing.T, res engine.Res) bool {
+	if err := res.Validate(); err != nil {
+		t.Errorf("validate failed with: %v", err)
+		return false
+	}
+	if _, err := res.CheckApply(true); err != nil {
+		t.Errorf("checkapply failed with: %v", err)
+		return false
+	}
+	checkOK, err := res.CheckApply(true)
+	if err != nil {
+		t.Errorf("checkapply failed with: %v", err)
+		return false
+	}
+	if !checkOK {
+		t.Errorf("the second checkapply was not a noop")
+		return false
+	}
+	return true
+}
+
+func TestX509Validate1(t *testing.T) {
+	testCases := []struct {
+		name string
+		res  engine.Res
+		fail bool
+	}{
+		{"key", &X509KeyRes{Type: "ecdsa", Curve: "P-256", Mode: "0600"}, false},
+		{"key bad curve", &X509KeyRes{Type: "ecdsa", Curve: "P-1", Mode: "0600"}, true},
+		{"key small rsa", &X509KeyRes{Type: "rsa", Bits: 1024, Mode: "0600"}, true},
+		{"key bad mode", &X509KeyRes{Type: "ed25519", Mode: "abc"}, true},
+		{"ca", &X509CARes{Key: "/tmp/ca.key", CommonName: "ca", Validity: 10, RenewBefore: 1, Mode: "0644"}, false},
+		{"ca renew", &X509CARes{Key: "/tmp/ca.key", CommonName: "ca", Validity: 10, RenewBefore: 10, Mode: "0644"}, true},
+		{"cert", &X509CertRes{Key: "/tmp/a.key", CA: "/tmp/ca.crt", CAKey: "/tmp/ca.key", CommonName: "a", Validity: 10, Mode: "0644"}, false},
+		{"cert key and csr", &X509CertRes{Key: "/tmp/a.key", CSR: "/tmp/a.csr", CA: "/tmp/ca.crt", CAKey: "/tmp/ca.key", CommonName: "a", Validity: 10, Mode: "0644"}, true},
+		{"cert bad ip", &X509CertRes{Key: "/tmp/a.key", CA: "/tmp/ca.crt", CAKey: "/tmp/ca.key", CommonName: "a", IPAddresses: []string{"x"}, Validity: 10, Mode: "0644"}, true},
+		{"cert bad usage", &X509CertRes{Key: "/tmp/a.key", CA: "/tmp/ca.crt", CAKey: "/tmp/ca.key", CommonName: "a", Usage: []string{"x"}, Validity: 10, Mode: "0644"}, true},
+	}
+	for _, tc := range testCases {
+		tc.res.SetName("/tmp/" + strings.ReplaceAll(tc.name, " ", "-"))
+		err := tc.res.Validate()
+		if tc.fail && err == nil {
+			t.Errorf("%s: validate should have failed", tc.name)
+		}
+		if !tc.fail && err != nil {
+			t.Errorf("%s: validate failed with: %v", tc.name, err)
+		}
+	}
+}
+
+func TestX509Cert1(t *testing.T) {
+	tmpdir := t.TempDir()
+	sends := map[string]interface{}{}
+	init := &engine.Init{
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+		Send: func(st interface{}) error {
+			switch x := st.(type) {
+			case *X509KeySends:
+				sends["key"] = *x.Key
+			case *X509CertSends:
+				sends["cert"] = *x.Cert
+			}
+			return nil
+		},
+	}
+
+	caKeyPath := path.Join(tmpdir, "ca.key")
+	caKey := &X509KeyRes{Type: "ecdsa", Curve: "P-384", Mode: "0600"}
+	caKey.SetKind("x509:key")
+	caKey.SetName(caKeyPath)
+	caKey.Init(init)
+	if !x509Apply(t, caKey) {
+		return
+	}
+	if fi, err := os.Stat(caKeyPath); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("the key has the wrong mode: %v", err)
+	}
+	data, _ := ioutil.ReadFile(caKeyPath)
+	if sends["key"] != string(data) {
+		t.Errorf("the key was not sent")
+	}
+
+	caPath := path.Join(tmpdir, "ca.crt")
+	ca := &X509CARes{Key: caKeyPath, CommonName: "Test CA", Validity: 3650, RenewBefore: 30, Mode: "0644"}
+	ca.SetKind("x509:ca")
+	ca.SetName(caPath)
+	ca.Init(init)
+	if !x509Apply(t, ca) {
+		return
+	}
+
+	keyPath := path.Join(tmpdir, "server.key")
+	key := &X509KeyRes{Type: "ed25519", Mode: "0640"}
+	key.SetKind("x509:key")
+	key.SetName(keyPath)
+	key.Init(init)
+	if !x509Apply(t, key) {
+		return
+	}
+
+	certPath := path.Join(tmpdir, "server.crt")
+	cert := &X509CertRes{
+		Key:         keyPath,
+		CA:          caPath,
+		CAKey:       caKeyPath,
+		CommonName:  "server",
+		DNSNames:    []string{"server.example.com"},
+		IPAddresses: []string{"192.0.2.1"},
+		Usage:       []string{"server"},
+		Validity:    365,
+		RenewBefore: 30,
+		Mode:        "0644",
+	}
+	cert.SetKind("x509:cert")
+	cert.SetName(certPath)
+	cert.Init(init)
+	if !x509Apply(t, cert) {
+		return
+	}
+	data, _ = ioutil.ReadFile(certPath)
+	if sends["cert"] != string(data) {
+		t.Errorf("the cert was not sent")
+	}
+
+	caCert, _ := x509ReadCert(caPath)
+	c, err := x509ReadCert(certPath)
+	if err != nil {
+		t.Errorf("could not read the cert: %v", err)
+		return
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	if _, err := c.Verify(x509.VerifyOptions{DNSName: "server.example.com", Roots: pool}); err != nil {
+		t.Errorf("the cert doesn't verify: %v", err)
+	}
+
+	// a changed name gets the cert signed again
+	cert.DNSNames = []string{"server.example.org"}
+	if !x509Apply(t, cert) {
+		return
+	}
+	if c, _ := x509ReadCert(certPath); c.DNSNames[0] != "server.example.org" {
+		t.Errorf("the cert was not renewed")
+	}
+
+	// a cert that is close to its expiry gets renewed
+	before, _ := x509ReadCert(certPath)
+	cert.Validity = 366
+	cert.RenewBefore = 365
+	if checkOK, err := cert.CheckApply(true); err != nil || checkOK {
+		t.Errorf("the cert was not renewed: %v", err)
+	}
+	if after, _ := x509ReadCert(certPath); after.SerialNumber.Cmp(before.SerialNumber) == 0 {
+		t.Errorf("the cert was not replaced")
+	}
+	if !x509Apply(t, cert) {
+		return
+	}
+	if renew := x509RenewTime(certPath, cert.RenewBefore); !renew.After(time.Now()) {
+		t.Errorf("the renewal time should be in the future: %v", renew)
+	}
+
+	// a renewed CA keeps its key, so the cert is still valid
+	if err := os.Remove(caPath); err != nil {
+		t.Errorf("could not remove the ca: %v", err)
+		return
+	}
+	if !x509Apply(t, ca) {
+		return
+	}
+	if checkOK, err := cert.CheckApply(false); err != nil || !checkOK {
+		t.Errorf("the cert should still be valid: %v", err)
+	}
+
+	// a wrong key type is an error, unless forced
+	key.Type = "rsa"
+	key.Bits = 2048
+	if _, err := key.CheckApply(true); err == nil {
+		t.Errorf("the key should not have been replaced")
+	}
+	key.Force = true
+	if !x509Apply(t, key) {
+		return
+	}
+	if checkOK, err := cert.CheckApply(true); err != nil || checkOK {
+		t.Errorf("the cert should be signed again for the new key: %v", err)
+	}
+}
+
+func TestX509CSR1(t *testing.T) {
+	tmpdir := t.TempDir()
+	init := &engine.Init{
+		Logf: func(format string, v ...interface{}) {
+			t.Logf("test: "+format, v...)
+		},
+		Send: func(st interface{}) error {
+			return nil
+		},
+	}
+
+	caKeyPath := path.Join(tmpdir, "ca.key")
+	caKey := &X509KeyRes{Type: "ecdsa", Curve: "P-256", Mode: "0600"}
+	caKey.SetKind("x509:key")
+	caKey.SetName(caKeyPath)
+	caKey.Init(init)
+	if !x509Apply(t, caKey) {
+		return
+	}
+	caPath := path.Join(tmpdir, "ca.crt")
+	ca := &X509CARes{Key: caKeyPath, CommonName: "Test CA", Validity: 3650, RenewBefore: 30, Mode: "0644"}
+	ca.SetKind("x509:ca")
+	ca.SetName(caPath)
+	ca.Init(init)
+	if !x509Apply(t, ca) {
+		return
+	}
+
+	// the csr is made by somebody else
+	key, err := (&X509KeyRes{Type: "ecdsa", Curve: "P-256"}).generate()
+	if err != nil {
+		t.Errorf("could not generate the key: %v", err)
+		return
+	}
+	template := &x509.CertificateRequest{Subject: pkix.Name{CommonName: "client"}}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		t.Errorf("could not create the csr: %v", err)
+		return
+	}
+	csrPath := path.Join(tmpdir, "client.csr")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	if err := ioutil.WriteFile(csrPath, data, 0644); err != nil {
+		t.Errorf("could not write the csr: %v", err)
+		return
+	}
+
+	certPath := path.Join(tmpdir, "client.crt")
+	cert := &X509CertRes{
+		CSR:         csrPath,
+		CA:          caPath,
+		CAKey:       caKeyPath,
+		Usage:       []string{"client"},
+		Validity:    365,
+		RenewBefore: 30,
+		Mode:        "0644",
+	}
+	cert.SetKind("x509:cert")
+	cert.SetName(certPath)
+	cert.Init(init)
+	if !x509Apply(t, cert) {
+		return
+	}
+	c, _ := x509ReadCert(certPath)
+	if c.Subject.CommonName != "client" {
+		t.Errorf("the cert has the wrong subject: %s", c.Subject)
+	}
+	if err := x509KeyMatches(c.PublicKey, key); err != nil {
+		t.Errorf("the cert has the wrong key: %v", err)
+	}
+}
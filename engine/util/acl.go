@@ -0,0 +1,314 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// These are the tag values used to identify the kind of a POSIX ACL entry. They
+// match the values used by the kernel in the xattr representation.
+const (
+	ACLTagUserObj  uint16 = 0x01
+	ACLTagUser     uint16 = 0x02
+	ACLTagGroupObj uint16 = 0x04
+	ACLTagGroup    uint16 = 0x08
+	ACLTagMask     uint16 = 0x10
+	ACLTagOther    uint16 = 0x20
+)
+
+const (
+	// ACLXattrAccess is the name of the xattr which stores the access ACL.
+	ACLXattrAccess = "system.posix_acl_access"
+
+	// ACLXattrDefault is the name of the xattr which stores the default
+	// ACL of a directory.
+	ACLXattrDefault = "system.posix_acl_default"
+
+	// ACLUndefinedID is the id used for entries that don't have a
+	// qualifier, such as the owner, owning group, mask and other entries.
+	ACLUndefinedID uint32 = 0xffffffff
+
+	// aclVersion is the version of the xattr representation of an ACL.
+	aclVersion uint32 = 0x0002
+
+	aclHeaderSize = 4
+	aclEntrySize  = 8
+)
+
+// ACLEntry is a single entry in a POSIX access control list.
+type ACLEntry struct {
+	Tag  uint16
+	Perm uint16 // only the lower rwx bits are used
+	ID   uint32 // uid or gid for named entries, or ACLUndefinedID
+}
+
+// String returns the textual representation of the entry as used by setfacl.
+// Named entries use the numeric id, since that is what is actually stored.
+func (obj ACLEntry) String() string {
+	qualifier := ""
+	if obj.ID != ACLUndefinedID {
+		qualifier = strconv.FormatUint(uint64(obj.ID), 10)
+	}
+	tag := ""
+	switch obj.Tag {
+	case ACLTagUserObj, ACLTagUser:
+		tag = "user"
+	case ACLTagGroupObj, ACLTagGroup:
+		tag = "group"
+	case ACLTagMask:
+		tag = "mask"
+	case ACLTagOther:
+		tag = "other"
+	}
+	perm := []byte("---")
+	if obj.Perm&uint16(ModeRead) != 0 {
+		perm[0] = 'r'
+	}
+	if obj.Perm&uint16(ModeWrite) != 0 {
+		perm[1] = 'w'
+	}
+	if obj.Perm&uint16(ModeExec) != 0 {
+		perm[2] = 'x'
+	}
+	return fmt.Sprintf("%s:%s:%s", tag, qualifier, perm)
+}
+
+// ParseACL parses a list of ACL entries in the textual form used by setfacl.
+// Each entry looks like `user:alice:rwx`, `group::r-x`, `mask::rw` or `other::-`
+// and may be prefixed with `default:` to specify an entry of the default ACL
+// of a directory. The short forms `u`, `g`, `m`, `o` and `d` are also accepted.
+// User and group names are looked up, and numeric ids may be used instead. It
+// returns the access entries and the default entries separately.
+func ParseACL(entries []string) ([]ACLEntry, []ACLEntry, error) {
+	access := []ACLEntry{}
+	def := []ACLEntry{}
+	for _, s := range entries {
+		fields := strings.Split(strings.TrimSpace(s), ":")
+		isDefault := false
+		if len(fields) == 4 && (fields[0] == "default" || fields[0] == "d") {
+			isDefault = true
+			fields = fields[1:]
+		}
+		if len(fields) != 3 {
+			return nil, nil, fmt.Errorf("invalid acl entry: %s", s)
+		}
+		tag, qualifier, perms := fields[0], fields[1], fields[2]
+
+		entry := ACLEntry{ID: ACLUndefinedID}
+		switch tag {
+		case "user", "u":
+			entry.Tag = ACLTagUserObj
+			if qualifier != "" {
+				uid, err := GetUID(qualifier)
+				if err != nil {
+					return nil, nil, err
+				}
+				entry.Tag = ACLTagUser
+				entry.ID = uint32(uid)
+			}
+		case "group", "g":
+			entry.Tag = ACLTagGroupObj
+			if qualifier != "" {
+				gid, err := GetGID(qualifier)
+				if err != nil {
+					return nil, nil, err
+				}
+				entry.Tag = ACLTagGroup
+				entry.ID = uint32(gid)
+			}
+		case "mask", "m":
+			entry.Tag = ACLTagMask
+		case "other", "o":
+			entry.Tag = ACLTagOther
+		default:
+			return nil, nil, fmt.Errorf("invalid acl entry tag in: %s", s)
+		}
+		if qualifier != "" && entry.Tag != ACLTagUser && entry.Tag != ACLTagGroup {
+			return nil, nil, fmt.Errorf("unexpected acl entry qualifier in: %s", s)
+		}
+
+		for _, c := range perms {
+			switch c {
+			case 'r':
+				entry.Perm |= uint16(ModeRead)
+			case 'w':
+				entry.Perm |= uint16(ModeWrite)
+			case 'x':
+				entry.Perm |= uint16(ModeExec)
+			case '-':
+			default:
+				return nil, nil, fmt.Errorf("unexpected character in acl entry permissions: %s", s)
+			}
+		}
+
+		list := &access
+		if isDefault {
+			list = &def
+		}
+		for _, x := range *list {
+			if x.Tag == entry.Tag && x.ID == entry.ID {
+				return nil, nil, fmt.Errorf("duplicate acl entry: %s", s)
+			}
+		}
+		*list = append(*list, entry)
+	}
+	return access, def, nil
+}
+
+// ACLFromMode returns the minimal ACL which is equivalent to the file mode.
+func ACLFromMode(mode os.FileMode) []ACLEntry {
+	m := uint32(mode.Perm())
+	return []ACLEntry{
+		{Tag: ACLTagUserObj, Perm: uint16(m / ModeUser & 7), ID: ACLUndefinedID},
+		{Tag: ACLTagGroupObj, Perm: uint16(m / ModeGroup & 7), ID: ACLUndefinedID},
+		{Tag: ACLTagOther, Perm: uint16(m / ModeOther & 7), ID: ACLUndefinedID},
+	}
+}
+
+// ACLComplete returns a valid ACL built from the entries. Any of the required
+// owner, owning group and other entries which are missing are taken from the
+// base list, which is usually the current ACL of the file. If there are named
+// entries and no mask, one is computed the same way that setfacl does it. The
+// result is sorted in the order that the kernel expects.
+func ACLComplete(entries, base []ACLEntry) []ACLEntry {
+	result := []ACLEntry{}
+	result = append(result, entries...)
+
+	has := func(tag uint16) bool {
+		for _, x := range result {
+			if x.Tag == tag {
+				return true
+			}
+		}
+		return false
+	}
+	for _, tag := range []uint16{ACLTagUserObj, ACLTagGroupObj, ACLTagOther} {
+		if has(tag) {
+			continue
+		}
+		for _, x := range base {
+			if x.Tag == tag {
+				result = append(result, x)
+				break
+			}
+		}
+	}
+	if !has(ACLTagMask) && (has(ACLTagUser) || has(ACLTagGroup)) {
+		mask := ACLEntry{Tag: ACLTagMask, ID: ACLUndefinedID}
+		for _, x := range result {
+			if x.Tag == ACLTagUser || x.Tag == ACLTagGroupObj || x.Tag == ACLTagGroup {
+				mask.Perm |= x.Perm
+			}
+		}
+		result = append(result, mask)
+	}
+
+	sortACL(result)
+	return result
+}
+
+// ACLCmp compares two ACL's and returns an error if they are not equivalent.
+func ACLCmp(a, b []ACLEntry) error {
+	if len(a) != len(b) {
+		return fmt.Errorf("the number of acl entries differs")
+	}
+	x := append([]ACLEntry{}, a...)
+	y := append([]ACLEntry{}, b...)
+	sortACL(x)
+	sortACL(y)
+	for i := range x {
+		if x[i] != y[i] {
+			return fmt.Errorf("the acl entry `%s` differs from `%s`", x[i], y[i])
+		}
+	}
+	return nil
+}
+
+// EncodeACL returns the xattr representation of an ACL.
+func EncodeACL(entries []ACLEntry) []byte {
+	b := make([]byte, aclHeaderSize+aclEntrySize*len(entries))
+	binary.LittleEndian.PutUint32(b[0:], aclVersion)
+	for i, x := range entries {
+		offset := aclHeaderSize + aclEntrySize*i
+		binary.LittleEndian.PutUint16(b[offset:], x.Tag)
+		binary.LittleEndian.PutUint16(b[offset+2:], x.Perm)
+		binary.LittleEndian.PutUint32(b[offset+4:], x.ID)
+	}
+	return b
+}
+
+// DecodeACL parses the xattr representation of an ACL.
+func DecodeACL(b []byte) ([]ACLEntry, error) {
+	if len(b) < aclHeaderSize || (len(b)-aclHeaderSize)%aclEntrySize != 0 {
+		return nil, fmt.Errorf("invalid acl length of %d", len(b))
+	}
+	if v := binary.LittleEndian.Uint32(b[0:]); v != aclVersion {
+		return nil, fmt.Errorf("unsupported acl version of %d", v)
+	}
+	entries := []ACLEntry{}
+	for offset := aclHeaderSize; offset < len(b); offset += aclEntrySize {
+		entries = append(entries, ACLEntry{
+			Tag:  binary.LittleEndian.Uint16(b[offset:]),
+			Perm: binary.LittleEndian.Uint16(b[offset+2:]),
+			ID:   binary.LittleEndian.Uint32(b[offset+4:]),
+		})
+	}
+	return entries, nil
+}
+
+// ACLStrings returns the textual representation of an ACL. If isDefault is
+// true, then each entry is prefixed so that it refers to the default ACL. Named
+// entries are printed with the user or group name if it can be found.
+func ACLStrings(entries []ACLEntry, isDefault bool) []string {
+	result := []string{}
+	for _, x := range entries {
+		s := x.String()
+		if x.Tag == ACLTagUser {
+			if u, err := user.LookupId(strconv.FormatUint(uint64(x.ID), 10)); err == nil {
+				s = fmt.Sprintf("user:%s:%s", u.Username, strings.SplitN(s, ":", 3)[2])
+			}
+		}
+		if x.Tag == ACLTagGroup {
+			if g, err := user.LookupGroupId(strconv.FormatUint(uint64(x.ID), 10)); err == nil {
+				s = fmt.Sprintf("group:%s:%s", g.Name, strings.SplitN(s, ":", 3)[2])
+			}
+		}
+		if isDefault {
+			s = "default:" + s
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// sortACL sorts the entries by tag and then by id, which is the kernel order.
+func sortACL(entries []ACLEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Tag != entries[j].Tag {
+			return entries[i].Tag < entries[j].Tag
+		}
+		return entries[i].ID < entries[j].ID
+	})
+}
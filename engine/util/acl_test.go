@@ -0,0 +1,126 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root
+
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseACL(t *testing.T) {
+	access, def, err := ParseACL([]string{
+		"user::rwx",
+		"u:0:r-x",
+		"group::r",
+		"mask::rwx",
+		"other::-",
+		"default:group:0:rw-",
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %+v", err)
+		return
+	}
+	expAccess := []ACLEntry{
+		{Tag: ACLTagUserObj, Perm: 7, ID: ACLUndefinedID},
+		{Tag: ACLTagUser, Perm: 5, ID: 0},
+		{Tag: ACLTagGroupObj, Perm: 4, ID: ACLUndefinedID},
+		{Tag: ACLTagMask, Perm: 7, ID: ACLUndefinedID},
+		{Tag: ACLTagOther, Perm: 0, ID: ACLUndefinedID},
+	}
+	if !reflect.DeepEqual(access, expAccess) {
+		t.Errorf("unexpected access acl: %+v", access)
+	}
+	expDef := []ACLEntry{
+		{Tag: ACLTagGroup, Perm: 6, ID: 0},
+	}
+	if !reflect.DeepEqual(def, expDef) {
+		t.Errorf("unexpected default acl: %+v", def)
+	}
+
+	for _, x := range []string{
+		"user:rwx",      // missing a field
+		"bogus::rwx",    // bad tag
+		"other:0:rwx",   // no qualifier allowed
+		"user::rwz",     // bad perms
+		"user::r,u::rw", // not split
+	} {
+		if _, _, err := ParseACL([]string{x}); err == nil {
+			t.Errorf("expected an error for: %s", x)
+		}
+	}
+	if _, _, err := ParseACL([]string{"user::rwx", "u::r"}); err == nil {
+		t.Errorf("expected an error for a duplicate entry")
+	}
+}
+
+func TestACLComplete(t *testing.T) {
+	entries, _, err := ParseACL([]string{"user:0:rw-", "group::r-x"})
+	if err != nil {
+		t.Errorf("unexpected error: %+v", err)
+		return
+	}
+	base := ACLFromMode(0640)
+	result := ACLComplete(entries, base)
+	expected := []ACLEntry{
+		{Tag: ACLTagUserObj, Perm: 6, ID: ACLUndefinedID},
+		{Tag: ACLTagUser, Perm: 6, ID: 0},
+		{Tag: ACLTagGroupObj, Perm: 5, ID: ACLUndefinedID},
+		{Tag: ACLTagMask, Perm: 7, ID: ACLUndefinedID}, // union
+		{Tag: ACLTagOther, Perm: 0, ID: ACLUndefinedID},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("unexpected acl: %+v", result)
+	}
+	if err := ACLCmp(result, expected); err != nil {
+		t.Errorf("acl should compare equal: %+v", err)
+	}
+	if err := ACLCmp(result, base); err == nil {
+		t.Errorf("acl should not compare equal")
+	}
+}
+
+func TestACLEncodeDecode(t *testing.T) {
+	entries := ACLComplete([]ACLEntry{{Tag: ACLTagGroup, Perm: 4, ID: 42}}, ACLFromMode(0755))
+	b := EncodeACL(entries)
+	if len(b) != 4+8*len(entries) {
+		t.Errorf("unexpected encoded length: %d", len(b))
+	}
+	out, err := DecodeACL(b)
+	if err != nil {
+		t.Errorf("unexpected error: %+v", err)
+		return
+	}
+	if !reflect.DeepEqual(entries, out) {
+		t.Errorf("decoded acl differs: %+v", out)
+	}
+	if _, err := DecodeACL(b[:len(b)-1]); err == nil {
+		t.Errorf("expected an error for a truncated acl")
+	}
+
+	exp := []string{"user::rwx", "group::r-x", "group:42:r--", "mask::r-x", "other::r-x"}
+	for i, x := range entries {
+		if s := x.String(); s != exp[i] {
+			t.Errorf("unexpected acl string: %s", s)
+		}
+	}
+	if s := ACLStrings(entries[:1], true); len(s) != 1 || s[0] != "default:user::rwx" {
+		t.Errorf("unexpected default acl strings: %+v", s)
+	}
+}
@@ -0,0 +1,217 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"fmt"
+	"hash"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const (
+	// cryptSHA512Prefix is the prefix of a SHA-512 crypt hash.
+	cryptSHA512Prefix = "$6$"
+
+	// cryptRoundsPrefix is the prefix of the optional rounds parameter.
+	cryptRoundsPrefix = "rounds="
+
+	cryptRoundsDefault = 5000
+	cryptRoundsMin     = 1000
+	cryptRoundsMax     = 999999999
+	cryptSaltMax       = 16
+
+	// cryptAlphabet is the alphabet used by the crypt encoding of bytes.
+	cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// SHA512CryptSalt returns a new random salt for use with SHA512Crypt. It is
+// prefixed with the SHA-512 identifier, and it uses the default rounds.
+func SHA512CryptSalt() (string, error) {
+	salt := make([]byte, cryptSaltMax)
+	max := big.NewInt(int64(len(cryptAlphabet)))
+	for i := range salt {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		salt[i] = cryptAlphabet[n.Int64()]
+	}
+	return cryptSHA512Prefix + string(salt), nil
+}
+
+// SHA512Crypt hashes the password with the SHA-512 crypt algorithm which is
+// used by glibc and the /etc/shadow file. The salt looks like `$6$salt` or
+// `$6$rounds=N$salt`, and it can also be an entire existing hash, in which case
+// only the salt and rounds are used from it. The result is the full hash.
+func SHA512Crypt(password, salt string) (string, error) {
+	if !strings.HasPrefix(salt, cryptSHA512Prefix) {
+		return "", fmt.Errorf("salt is not for SHA-512 crypt")
+	}
+	s := strings.TrimPrefix(salt, cryptSHA512Prefix)
+
+	rounds := cryptRoundsDefault
+	customRounds := false
+	if strings.HasPrefix(s, cryptRoundsPrefix) {
+		fields := strings.SplitN(strings.TrimPrefix(s, cryptRoundsPrefix), "$", 2)
+		if len(fields) != 2 {
+			return "", fmt.Errorf("invalid rounds in salt")
+		}
+		n, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return "", fmt.Errorf("invalid rounds in salt")
+		}
+		if n < cryptRoundsMin {
+			n = cryptRoundsMin
+		}
+		if n > cryptRoundsMax {
+			n = cryptRoundsMax
+		}
+		rounds = n
+		customRounds = true
+		s = fields[1]
+	}
+	if i := strings.Index(s, "$"); i >= 0 { // remove any existing hash
+		s = s[:i]
+	}
+	if len(s) > cryptSaltMax {
+		s = s[:cryptSaltMax]
+	}
+
+	p := []byte(password)
+	sb := []byte(s)
+
+	// the alternate sum
+	h := sha512.New()
+	h.Write(p)
+	h.Write(sb)
+	h.Write(p)
+	b := h.Sum(nil)
+
+	h.Reset()
+	h.Write(p)
+	h.Write(sb)
+	cryptRepeat(h, b, len(p))
+	for n := len(p); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(p)
+		}
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for i := 0; i < len(p); i++ {
+		h.Write(p)
+	}
+	pSeq := cryptSequence(h.Sum(nil), len(p))
+
+	h.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(sb)
+	}
+	sSeq := cryptSequence(h.Sum(nil), len(sb))
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(pSeq)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(sSeq)
+		}
+		if i%7 != 0 {
+			h.Write(pSeq)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(pSeq)
+		}
+		c = h.Sum(nil)
+	}
+
+	result := cryptSHA512Prefix
+	if customRounds {
+		result += fmt.Sprintf("%s%d$", cryptRoundsPrefix, rounds)
+	}
+	return result + s + "$" + cryptEncode(c), nil
+}
+
+// CryptCheck returns true if the password matches the crypt hash. Only SHA-512
+// hashes are supported, and it errors if the hash is of any other kind.
+func CryptCheck(hash, password string) (bool, error) {
+	result, err := SHA512Crypt(password, hash)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(result), []byte(hash)) == 1, nil
+}
+
+// cryptRepeat writes the sum repeatedly until length bytes have been written.
+func cryptRepeat(h hash.Hash, sum []byte, length int) {
+	for ; length > len(sum); length -= len(sum) {
+		h.Write(sum)
+	}
+	h.Write(sum[:length])
+}
+
+// cryptSequence returns the sum repeated to fill length bytes.
+func cryptSequence(sum []byte, length int) []byte {
+	result := make([]byte, 0, length)
+	for len(result) < length {
+		n := length - len(result)
+		if n > len(sum) {
+			n = len(sum)
+		}
+		result = append(result, sum[:n]...)
+	}
+	return result
+}
+
+// cryptEncode encodes the final SHA-512 sum with the byte order and alphabet
+// that the crypt format requires.
+func cryptEncode(sum []byte) string {
+	order := [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+	result := []byte{}
+	encode := func(w uint, n int) {
+		for i := 0; i < n; i++ {
+			result = append(result, cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	for _, x := range order {
+		encode(uint(sum[x[0]])<<16|uint(sum[x[1]])<<8|uint(sum[x[2]]), 4)
+	}
+	encode(uint(sum[63]), 2)
+	return string(result)
+}
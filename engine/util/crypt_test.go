@@ -0,0 +1,74 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !root
+
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSHA512Crypt(t *testing.T) {
+	testCases := []struct {
+		salt     string
+		password string
+		expected string
+	}{
+		// these are from the specification of the algorithm
+		{"$6$saltstring", "Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"$6$rounds=10000$saltstringsaltstring", "Hello world!", "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+		{"$6$rounds=5000$toolongsaltstring", "This is just a test", "$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+		{"$6$rounds=1400$anotherlongsaltstring", "a very much longer text to encrypt.  This one even stretches over morethan one line.", "$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1"},
+		{"$6$rounds=10$roundstoolow", "the minimum number is still observed", "$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX."},
+	}
+	for i, tc := range testCases {
+		result, err := SHA512Crypt(tc.password, tc.salt)
+		if err != nil {
+			t.Errorf("test #%d: failed with: %v", i, err)
+			continue
+		}
+		if result != tc.expected {
+			t.Errorf("test #%d: expected %s, got: %s", i, tc.expected, result)
+		}
+		if ok, err := CryptCheck(tc.expected, tc.password); err != nil || !ok {
+			t.Errorf("test #%d: check failed: %t, %v", i, ok, err)
+		}
+		if ok, err := CryptCheck(tc.expected, tc.password+"x"); err != nil || ok {
+			t.Errorf("test #%d: check of wrong password passed: %t, %v", i, ok, err)
+		}
+	}
+
+	if _, err := CryptCheck("$1$md5$hash", "password"); err == nil {
+		t.Errorf("expected an error for an unsupported hash")
+	}
+}
+
+func TestSHA512CryptSalt(t *testing.T) {
+	salt, err := SHA512CryptSalt()
+	if err != nil {
+		t.Errorf("failed with: %v", err)
+		return
+	}
+	if !strings.HasPrefix(salt, "$6$") || len(salt) != 3+16 {
+		t.Errorf("got invalid salt: %s", salt)
+	}
+	if other, _ := SHA512CryptSalt(); other == salt {
+		t.Errorf("salt is not random: %s", salt)
+	}
+}
@@ -0,0 +1,42 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package util
+
+const (
+	// DHCPLeasesNamespace is the prefix of the world namespace that the
+	// lease table of each dhcp:server resource is published in. The name of
+	// the server resource is appended to it.
+	DHCPLeasesNamespace = "dhcp:leases:"
+)
+
+// DHCPLease is an entry in the lease table of the dhcp:server resource. This is
+// also the format that the table is stored and published in, and that the
+// world.dhcp_leases function reads it in.
+type DHCPLease struct {
+	// Mac is the mac address of the host.
+	Mac string `json:"mac"`
+
+	// IP is the IPv4 address of the host, without the CIDR suffix.
+	IP string `json:"ip"`
+
+	// Hostname is the name of the host if it is known.
+	Hostname string `json:"hostname"`
+
+	// Expiry is the unix time in seconds when the lease expires.
+	Expiry int64 `json:"expiry"`
+}
@@ -671,6 +671,11 @@ func (obj *StmtRes) resource(resName string) (engine.Res, error) {
 		return nil, errwrap.Wrapf(err, "cannot create resource kind `%s` with named `%s`", obj.Kind, resName)
 	}
 
+	// some resources read from the deploy that they're defined in
+	if r, ok := res.(engine.DeployFsRes); ok {
+		r.SetDeployFs(obj.data.FsURI, obj.data.Base)
+	}
+
 	sv := reflect.ValueOf(res).Elem() // pointer to struct, then struct
 	if k := sv.Kind(); k != reflect.Struct {
 		panic(fmt.Sprintf("expected struct, got: %s", k))
@@ -725,7 +730,8 @@ func (obj *StmtRes) resource(resName string) (engine.Res, error) {
 		if err != nil {
 			return nil, errwrap.Wrapf(err, "resource field `%s` has no compatible type", x.Field)
 		}
-		if err := t.Cmp(typ); err != nil {
+		// a variant field can take a value of any type
+		if err := t.Cmp(typ); t.Kind != types.KindVariant && err != nil {
 			return nil, errwrap.Wrapf(err, "resource field `%s` of type `%+v`, cannot take type `%+v", x.Field, t, typ)
 		}
 
@@ -1270,6 +1276,10 @@ func (obj *StmtResField) Unify(kind string) ([]interfaces.Invariant, error) {
 	if !exists {
 		return nil, fmt.Errorf("field `%s` does not exist in `%s`", obj.Field, kind)
 	}
+	if typ.Kind == types.KindVariant {
+		// the field takes any type, so the value decides what it is
+		return invariants, nil
+	}
 	invar := &interfaces.EqualsInvariant{
 		Expr: obj.Value,
 		Type: typ,
@@ -0,0 +1,218 @@
+// Mgmt
+// Copyright (C) 2013-2022+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package coreworld
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	engineUtil "github.com/purpleidea/mgmt/engine/util"
+	"github.com/purpleidea/mgmt/lang/funcs"
+	"github.com/purpleidea/mgmt/lang/interfaces"
+	"github.com/purpleidea/mgmt/lang/types"
+	"github.com/purpleidea/mgmt/util/errwrap"
+)
+
+func init() {
+	funcs.ModuleRegister(ModuleName, "dhcp_leases", func() interfaces.Func { return &DHCPLeasesFunc{} })
+}
+
+// DHCPLeasesFunc is a function which returns the lease table of the dhcp:server
+// resource with the given name. It combines the tables of all the hosts in the
+// world which run a server with that name. The host field is the name of the
+// host which handed out the lease, and expiry is the unix time in seconds when
+// it expires, as of the last time that the table changed.
+type DHCPLeasesFunc struct {
+	init *interfaces.Init
+
+	server string
+
+	last   types.Value
+	result types.Value // last calculated output
+
+	watchChan chan error
+	closeChan chan struct{}
+}
+
+// ArgGen returns the Nth arg name for this function.
+func (obj *DHCPLeasesFunc) ArgGen(index int) (string, error) {
+	seq := []string{"server"}
+	if l := len(seq); index >= l {
+		return "", fmt.Errorf("index %d exceeds arg length of %d", index, l)
+	}
+	return seq[index], nil
+}
+
+// Validate makes sure we've built our struct properly. It is usually unused for
+// normal functions that users can use directly.
+func (obj *DHCPLeasesFunc) Validate() error {
+	return nil
+}
+
+// Info returns some static info about itself.
+func (obj *DHCPLeasesFunc) Info() *interfaces.Info {
+	return &interfaces.Info{
+		Pure: false, // definitely false
+		Memo: false,
+		Sig:  types.NewType("func(server str) []struct{host str; mac str; ip str; hostname str; expiry int}"),
+		Err:  obj.Validate(),
+	}
+}
+
+// Init runs some startup code for this function.
+func (obj *DHCPLeasesFunc) Init(init *interfaces.Init) error {
+	obj.init = init
+	// This blocks until Stream replaces it with the chan from StrMapWatch.
+	// That one is closed by the etcd watcher when the ctx is cancelled.
+	obj.watchChan = make(chan error)
+	obj.closeChan = make(chan struct{})
+	return nil
+}
+
+// Stream returns the changing values that this func has over time.
+func (obj *DHCPLeasesFunc) Stream() error {
+	defer close(obj.init.Output) // the sender closes
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for {
+		select {
+		case input, ok := <-obj.init.Input:
+			if !ok {
+				obj.init.Input = nil // don't infinite loop back
+				continue             // no more inputs, but don't return!
+			}
+
+			if obj.last != nil && input.Cmp(obj.last) == nil {
+				continue // value didn't change, skip it
+			}
+			obj.last = input // store for next
+
+			server := input.Struct()["server"].Str()
+			if server == "" {
+				return fmt.Errorf("can't use an empty server name")
+			}
+
+			// TODO: support changing the server over time...
+			if obj.server == "" {
+				obj.server = server // store it
+				var err error
+				obj.watchChan, err = obj.init.World.StrMapWatch(ctx, engineUtil.DHCPLeasesNamespace+obj.server)
+				if err != nil {
+					return err
+				}
+
+				result, err := obj.buildList(ctx)
+				if err != nil {
+					return err
+				}
+				obj.result = result // store new result
+				select {
+				case obj.init.Output <- result: // send one!
+					// pass
+				case <-obj.closeChan:
+					return nil
+				}
+
+			} else if obj.server != server {
+				return fmt.Errorf("can't change server, previously: `%s`", obj.server)
+			}
+
+			continue // we get values on the watch chan, not here!
+
+		case err, ok := <-obj.watchChan:
+			if !ok { // closed
+				return nil
+			}
+			if err != nil {
+				return errwrap.Wrapf(err, "channel watch failed on `%s`", obj.server)
+			}
+
+			result, err := obj.buildList(ctx)
+			if err != nil {
+				return err
+			}
+
+			// if the result is still the same, skip sending an update...
+			if obj.result != nil && result.Cmp(obj.result) == nil {
+				continue // result didn't change
+			}
+			obj.result = result // store new result
+
+		case <-obj.closeChan:
+			return nil
+		}
+
+		select {
+		case obj.init.Output <- obj.result: // send
+			// pass
+		case <-obj.closeChan:
+			return nil
+		}
+	}
+}
+
+// Close runs some shutdown code for this function and turns off the stream.
+func (obj *DHCPLeasesFunc) Close() error {
+	close(obj.closeChan)
+	return nil
+}
+
+// buildList builds the list of leases from the tables of all the hosts. It is
+// sorted by host, and then in the order of the table.
+func (obj *DHCPLeasesFunc) buildList(ctx context.Context) (types.Value, error) {
+	keyMap, err := obj.init.World.StrMapGet(ctx, engineUtil.DHCPLeasesNamespace+obj.server)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "channel read failed on `%s`", obj.server)
+	}
+
+	hosts := []string{}
+	for host := range keyMap {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	typ := obj.Info().Sig.Out
+	list := types.NewList(typ)
+	for _, host := range hosts {
+		leases := []*engineUtil.DHCPLease{}
+		if err := json.Unmarshal([]byte(keyMap[host]), &leases); err != nil {
+			return nil, errwrap.Wrapf(err, "invalid lease table from `%s`", host)
+		}
+		for _, lease := range leases {
+			st := types.NewStruct(typ.Val)
+			fields := map[string]types.Value{
+				"host":     &types.StrValue{V: host},
+				"mac":      &types.StrValue{V: lease.Mac},
+				"ip":       &types.StrValue{V: lease.IP},
+				"hostname": &types.StrValue{V: lease.Hostname},
+				"expiry":   &types.IntValue{V: lease.Expiry},
+			}
+			for k, v := range fields {
+				if err := st.Set(k, v); err != nil {
+					return nil, errwrap.Wrapf(err, "struct could not set field `%s`", k)
+				}
+			}
+			if err := list.Add(st); err != nil {
+				return nil, errwrap.Wrapf(err, "list could not add lease")
+			}
+		}
+	}
+	return list, nil
+}
@@ -76,10 +76,11 @@ type Type struct {
 // pointers since our language does not support pointers. It returns nil if it
 // cannot represent the type in our type system. Common examples of things it
 // cannot express include reflect.Invalid, reflect.Interface, Reflect.Complex128
-// and more. It is not reversible because some information may be either added
-// or lost. For example, reflect.Array and reflect.Slice are both converted to a
-// Type of KindList, and KindFunc names the arguments of a func sequentially.
-// The lossy inverse of this is Reflect.
+// and more. The one interface it can represent is Value, which is a variant.
+// It is not reversible because some information may be either added or lost.
+// For example, reflect.Array and reflect.Slice are both converted to a Type of
+// KindList, and KindFunc names the arguments of a func sequentially. The lossy
+// inverse of this is Reflect.
 func TypeOf(t reflect.Type) (*Type, error) {
 	typ := t
 	kind := typ.Kind()
@@ -206,8 +207,15 @@ func TypeOf(t reflect.Type) (*Type, error) {
 			Out:  out,
 		}, nil
 
-	// TODO: should this return a variant type?
-	//case reflect.Interface:
+	case reflect.Interface:
+		// a Value field can hold any of our values, so it's a variant
+		// TODO: should this return a variant type for other interfaces?
+		if typ == reflect.TypeOf((*Value)(nil)).Elem() {
+			return &Type{
+				Kind: KindVariant,
+			}, nil
+		}
+		return nil, fmt.Errorf("unable to represent type of %s", typ.String())
 
 	default:
 		return nil, fmt.Errorf("unable to represent type of %s", typ.String())
@@ -264,6 +264,12 @@ func Into(v Value, rv reflect.Value) error {
 		rv = rv.Elem() // un-nest rv from pointer
 	}
 
+	// a Value destination holds a variant, so it takes the value as-is
+	if typ == reflect.TypeOf((*Value)(nil)).Elem() {
+		rv.Set(reflect.ValueOf(v))
+		return nil
+	}
+
 	// capture rv and v in a closure that is static for the scope of this Into() call
 	// mustInto ensures rv is in a list of compatible types before attempting to reflect it
 	mustInto := func(kinds ...reflect.Kind) error {
@@ -1094,3 +1094,33 @@ func TestValueIntoStructNameMapping(t *testing.T) {
 		t.Errorf("struct field value is missing or incorrect")
 	}
 }
+
+func TestValueIntoVariant(t *testing.T) {
+	st := NewStruct(NewType("struct{name str; ports []int}"))
+	if err := st.Set("name", &StrValue{V: "zing"}); err != nil {
+		t.Errorf("struct could not set key, error: %v", err)
+	}
+
+	var compare struct {
+		Word Value `lang:"word"`
+	}
+	typ, err := TypeOf(reflect.TypeOf(compare))
+	if err != nil {
+		t.Errorf("function TypeOf() returned an error: %s", err)
+		return
+	}
+	if typ.Map["word"].Kind != KindVariant {
+		t.Errorf("a Value field should be a variant, got: %s", typ.Map["word"])
+	}
+	if _, err := TypeOf(reflect.TypeOf((*fmt.Stringer)(nil)).Elem()); err == nil {
+		t.Errorf("other interfaces should not have a type")
+	}
+
+	if err := Into(st, reflect.ValueOf(&compare.Word)); err != nil {
+		t.Errorf("function Into() returned an error: %s", err)
+		return
+	}
+	if err := st.Cmp(compare.Word); err != nil {
+		t.Errorf("the variant holds a different value: %v", err)
+	}
+}
@@ -815,6 +815,90 @@ func TestUnification1(t *testing.T) {
 		})
 	}
 
+	{
+		//file "/tmp/t1" {
+		//	template => "/tmp/t1.tmpl",
+		//	template_vars => [13, 42,],	# a variant takes any type
+		//}
+		expr := &ast.ExprList{
+			Elements: []interfaces.Expr{
+				&ast.ExprInt{V: 13},
+				&ast.ExprInt{V: 42},
+			},
+		}
+		stmt := &ast.StmtProg{
+			Body: []interfaces.Stmt{
+				&ast.StmtRes{
+					Kind: "file",
+					Name: &ast.ExprStr{V: "/tmp/t1"},
+					Contents: []ast.StmtResContents{
+						&ast.StmtResField{
+							Field: "template",
+							Value: &ast.ExprStr{V: "/tmp/t1.tmpl"},
+						},
+						&ast.StmtResField{
+							Field: "template_vars",
+							Value: expr,
+						},
+					},
+				},
+			},
+		}
+		testCases = append(testCases, test{
+			name: "variant res field",
+			ast:  stmt,
+			fail: false,
+			expect: map[interfaces.Expr]*types.Type{
+				expr: types.NewType("[]int"),
+			},
+		})
+	}
+	{
+		//$w = true
+		//$x str = $w	# should fail unification
+		//file "/tmp/t1" {
+		//	template => "/tmp/t1.tmpl",
+		//	template_vars => $x,
+		//}
+		wvar := &ast.ExprBool{V: true}
+		xvar := &ast.ExprVar{Name: "w"}
+		xvar.SetType(types.TypeStr) // should fail unification
+		stmt := &ast.StmtProg{
+			Body: []interfaces.Stmt{
+				&ast.StmtBind{
+					Ident: "w",
+					Value: wvar,
+				},
+				&ast.StmtBind{
+					Ident: "x", // the var
+					Value: xvar,
+				},
+				&ast.StmtRes{
+					Kind: "file",
+					Name: &ast.ExprStr{V: "/tmp/t1"},
+					Contents: []ast.StmtResContents{
+						&ast.StmtResField{
+							Field: "template",
+							Value: &ast.ExprStr{V: "/tmp/t1.tmpl"},
+						},
+						&ast.StmtResField{
+							Field: "template_vars",
+							Value: &ast.ExprVar{
+								Name: "x", // the var
+							},
+						},
+					},
+				},
+			},
+		}
+		testCases = append(testCases, test{
+			name:      "typed var in variant res field",
+			ast:       stmt,
+			fail:      true,
+			experrstr: "can't unify, invariant illogicality with equality: base kind does not match (Str != Bool)",
+		})
+	}
+
 	names := []string{}
 	for index, tc := range testCases { // run all the tests
 		if tc.name == "" {
@@ -54,7 +54,9 @@ func NewSocketSet(groups uint32, name string, proto int) (*SocketSet, error) {
 	if err := unix.Bind(fdEvents, &unix.SockaddrNetlink{
 		Family: unix.AF_NETLINK,
 		Groups: groups,
-		Pid:    uint32(os.Getpid()), // set PID to our process
+		// Let the kernel pick a unique port id, since using our PID
+		// only works for the first socket of each netlink protocol.
+		Pid: 0,
 	}); err != nil {
 		return nil, errwrap.Wrapf(err, "error binding netlink socket")
 	}